@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"remotegateway/internal/audit"
+	"remotegateway/internal/config"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/rdpgw/protocol"
+	"remotegateway/internal/session"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+)
+
+type lockoutListResponse struct {
+	Lockouts []lockout.Entry `json:"lockouts"`
+}
+
+// isAdmin reports whether user is listed in ADMIN_USERS or is a member of
+// one of the ADMIN_GROUPS.
+func isAdmin(settings *config.SettingsType, user *types.User) bool {
+	if settings == nil || user == nil {
+		return false
+	}
+	for _, name := range strings.Split(settings.Get(config.ADMIN_USERS), ",") {
+		if name = strings.TrimSpace(name); name != "" && strings.EqualFold(name, user.GetName()) {
+			return true
+		}
+	}
+	for _, group := range strings.Split(settings.Get(config.ADMIN_GROUPS), ",") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		for _, member := range user.GetGroups() {
+			if strings.EqualFold(group, member) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireAdmin writes a 403 unless the session belongs to an admin that
+// passed the second factor.
+func requireAdmin(w http.ResponseWriter, req *http.Request, sessionManager *session.Manager, settings *config.SettingsType) (*types.User, bool) {
+	admin, ok := sessionManager.UserFromContext(req.Context())
+	if !ok || !isAdmin(settings, admin) {
+		writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+			OK:    false,
+			Error: "Admin access required.",
+		})
+		return nil, false
+	}
+	if !sessionManager.MFAVerified(req.Context()) {
+		writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+			OK:    false,
+			Error: "Two-factor verification required.",
+		})
+		return nil, false
+	}
+	return admin, true
+}
+
+// recordAdminAction writes an admin action to the audit log.
+func recordAdminAction(auditLog *audit.Logger, req *http.Request, admin *types.User, action, target string, detail map[string]string) {
+	auditLog.Record(audit.Event{
+		Actor:  strings.ToLower(admin.GetName()),
+		Action: action,
+		Target: target,
+		Remote: common.RemoteHost(req),
+		Detail: detail,
+	})
+}
+
+type adminOwnerVMs struct {
+	// Owner is empty for VMs without ownership metadata.
+	Owner string        `json:"owner"`
+	VMs   []dashboardVM `json:"vms"`
+}
+
+type adminTunnel struct {
+	ConnID       string    `json:"connId"`
+	User         string    `json:"user"`
+	ClientIP     string    `json:"clientIp"`
+	ClientName   string    `json:"clientName"`
+	Target       string    `json:"target"`
+	Host         string    `json:"host"`
+	Redirect     string    `json:"redirect"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+type adminOverviewResponse struct {
+	Owners   []adminOwnerVMs   `json:"owners"`
+	Sessions []session.Summary `json:"sessions"`
+	Tunnels  []adminTunnel     `json:"tunnels"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// adminOverview lists every VM grouped by owner, unowned VMs last, with the
+// logged in sessions and open gateway tunnels.
+func adminOverview(sessionManager *session.Manager, tunnels *protocol.TunnelRegistry) (adminOverviewResponse, error) {
+	vmList, err := listVMs("")
+	if err != nil {
+		return adminOverviewResponse{}, err
+	}
+	byOwner := make(map[string][]dashboardVM)
+	for _, vm := range vmList {
+		byOwner[vm.Owner] = append(byOwner[vm.Owner], newDashboardVM(vm, "admin", vm.Grants))
+	}
+	owners := make([]adminOwnerVMs, 0, len(byOwner))
+	for owner, vms := range byOwner {
+		sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+		owners = append(owners, adminOwnerVMs{Owner: owner, VMs: vms})
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if (owners[i].Owner == "") != (owners[j].Owner == "") {
+			return owners[j].Owner == ""
+		}
+		return owners[i].Owner < owners[j].Owner
+	})
+
+	sessions, err := sessionManager.List()
+	if err != nil {
+		return adminOverviewResponse{}, err
+	}
+	open := tunnels.List()
+	rows := make([]adminTunnel, 0, len(open))
+	for _, t := range open {
+		rows = append(rows, adminTunnel{
+			ConnID:       t.ConnID,
+			User:         t.User,
+			ClientIP:     t.ClientIP,
+			ClientName:   t.ClientName,
+			Target:       t.Target,
+			Host:         t.Host,
+			Redirect:     t.Redirect.String(),
+			ConnectedAt:  t.ConnectedAt,
+			LastActivity: t.LastActivity,
+		})
+	}
+	return adminOverviewResponse{Owners: owners, Sessions: sessions, Tunnels: rows}, nil
+}
+
+// adminVMActions are the actions an admin can take on any VM. Tests replace
+// the entries.
+var adminVMActions = map[string]func(string) error{
+	"start":    virt.StartExistingVM,
+	"restart":  virt.RestartVM,
+	"shutdown": virt.ShutdownVM,
+	"remove":   virt.RemoveVM,
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/totp"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+)
+
+func TestIsAdmin(t *testing.T) {
+	t.Setenv(config.ADMIN_USERS, "root")
+	t.Setenv(config.ADMIN_GROUPS, "vdi-admins, ops")
+	settings := config.NewSettingType(false)
+
+	tests := []struct {
+		user types.User
+		want bool
+	}{
+		{types.User{Name: "Root"}, true},
+		{types.User{Name: "alice", Groups: []string{"staff", "VDI-Admins"}}, true},
+		{types.User{Name: "bob", Groups: []string{"staff"}}, false},
+	}
+	for _, tt := range tests {
+		if got := isAdmin(settings, &tt.user); got != tt.want {
+			t.Fatalf("isAdmin(%s %v) = %t, want %t", tt.user.Name, tt.user.Groups, got, tt.want)
+		}
+	}
+}
+
+func TestAdminOverviewAndVMActions(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv(config.AUDIT_LOG_PATH, auditPath)
+	t.Setenv(config.ADMIN_GROUPS, "vdi-admins")
+	t.Setenv(config.OIDC_ROLE_MAPPING, "idp-admins=vdi-admins")
+	secret, _ := preEnroll(t, "root-admin")
+	stubVMOwners(t, map[string]string{"bob-vm": "bob", "old-vm": ""})
+	prevList := listVMs
+	listVMs = func(string) ([]virt.VMInfo, error) {
+		return []virt.VMInfo{
+			{Name: "old-vm", State: "shutoff"},
+			{Name: "bob-vm", State: "running", Owner: "bob"},
+			{Name: "alice-vm", State: "running", Owner: "alice"},
+		}, nil
+	}
+	var stopped []string
+	prevShutdown := adminVMActions["shutdown"]
+	adminVMActions["shutdown"] = func(name string) error {
+		stopped = append(stopped, name)
+		return nil
+	}
+	t.Cleanup(func() {
+		listVMs = prevList
+		adminVMActions["shutdown"] = prevShutdown
+	})
+
+	env := newOIDCTestEnv(t, "root-admin")
+	env.mock.Groups = []string{"idp-admins"}
+	env.login(t)
+	code, _ := totp.Code(secret, time.Now())
+	env.postForm(t, "/login/mfa", url.Values{"code": {code}})
+
+	resp, err := env.client.Get(env.server.URL + "/api/admin/overview")
+	if err != nil {
+		t.Fatalf("overview: %v", err)
+	}
+	var overview adminOverviewResponse
+	if err := json.NewDecoder(resp.Body).Decode(&overview); err != nil {
+		t.Fatalf("decode overview: %v", err)
+	}
+	resp.Body.Close()
+	var owners []string
+	for _, group := range overview.Owners {
+		owners = append(owners, group.Owner+":"+group.VMs[0].Name)
+	}
+	if strings.Join(owners, ",") != "alice:alice-vm,bob:bob-vm,:old-vm" {
+		t.Fatalf("unexpected grouping %v", owners)
+	}
+	if len(overview.Sessions) != 1 || overview.Sessions[0].User != "root-admin" || !overview.Sessions[0].MFAVerified {
+		t.Fatalf("expected the admin's own session, got %+v", overview.Sessions)
+	}
+
+	if resp, body := env.postForm(t, "/api/admin/vm", url.Values{"vm_name": {"bob-vm"}, "action": {"shutdown"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected admin shutdown to succeed, got %d %q", resp.StatusCode, body)
+	}
+	if len(stopped) != 1 || stopped[0] != "bob-vm" {
+		t.Fatalf("expected bob-vm to be shut down, got %v", stopped)
+	}
+	if resp, _ := env.postForm(t, "/api/admin/vm", url.Values{"vm_name": {"bob-vm"}, "action": {"explode"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected unknown action to be refused, got %d", resp.StatusCode)
+	}
+	if resp, _ := env.postForm(t, "/api/admin/vm", url.Values{"vm_name": {"ghost-vm"}, "action": {"shutdown"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected missing vm to be 404, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := env.postForm(t, "/api/admin/sessions/revoke", url.Values{"username": {"nobody"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected revoke without sessions to be 404, got %d", resp.StatusCode)
+	}
+	if resp, body := env.postForm(t, "/api/admin/sessions/revoke", url.Values{"username": {"root-admin"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected revoke to succeed, got %d %q", resp.StatusCode, body)
+	}
+	if _, ok := env.sessionManager.GetSessionFromUserName("root-admin"); ok {
+		t.Fatal("expected the revoked session to be gone")
+	}
+
+	raw, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	for _, want := range []string{`"action":"admin.vm.shutdown","target":"bob-vm"`, `"owner":"bob"`, `"action":"admin.session.revoke","target":"root-admin"`} {
+		if !strings.Contains(string(raw), want) {
+			t.Fatalf("expected %s in audit log:\n%s", want, raw)
+		}
+	}
+}
+
+func TestAdminOverviewRequiresAdmin(t *testing.T) {
+	env := newOIDCTestEnv(t, "mallory")
+	env.mock.Groups = []string{"staff"}
+	env.login(t)
+
+	resp, err := env.client.Get(env.server.URL + "/api/admin/overview")
+	if err != nil {
+		t.Fatalf("overview: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin, got %d", resp.StatusCode)
+	}
+	if resp, _ := env.postForm(t, "/api/admin/vm", url.Values{"vm_name": {"bob-vm"}, "action": {"remove"}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin vm action, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"remotegateway/internal/apitoken"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/adapters/humachi"
+)
+
+// apiScopeMetadata is the operation metadata key naming the scope an API
+// token needs for the route. Routes without it are session only.
+const apiScopeMetadata = "apiTokenScope"
+
+const defaultAPITokenDays = 30
+
+type apiTokenContextKey struct{}
+
+type apiTokenView struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Expired    bool       `json:"expired"`
+}
+
+type apiTokenListResponse struct {
+	Tokens []apiTokenView `json:"tokens"`
+	Error  string         `json:"error,omitempty"`
+}
+
+type apiTokenCreateResponse struct {
+	OK      bool          `json:"ok"`
+	Message string        `json:"message,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Token   string        `json:"token,omitempty"`
+	Info    *apiTokenView `json:"info,omitempty"`
+}
+
+func newAPITokenView(token apitoken.Token, now time.Time) apiTokenView {
+	view := apiTokenView{
+		ID:        token.ID,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+		Expired:   !now.Before(token.ExpiresAt),
+	}
+	if !token.LastUsedAt.IsZero() {
+		lastUsed := token.LastUsedAt
+		view.LastUsedAt = &lastUsed
+	}
+	return view
+}
+
+// allowAPIToken lets API tokens holding scope call the operation.
+func allowAPIToken(op *huma.Operation, scope string) {
+	if op.Metadata == nil {
+		op.Metadata = map[string]any{}
+	}
+	op.Metadata[apiScopeMetadata] = scope
+}
+
+// apiTokenFromContext returns the token that authenticated the request, if
+// the request was not made with a browser session.
+func apiTokenFromContext(ctx context.Context) (apitoken.Token, bool) {
+	token, ok := ctx.Value(apiTokenContextKey{}).(apitoken.Token)
+	return token, ok
+}
+
+// bearerToken returns the credentials of an "Authorization: Bearer" header.
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(strings.TrimSpace(req.Header.Get("Authorization")), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// apiAuthMiddleware accepts a bearer API token or, without one, the browser
+// session. Token failures get a 401 JSON response instead of the login
+// redirect, and tokens only reach routes marked with allowAPIToken.
+func apiAuthMiddleware(sessionManager *session.Manager, tokens *apitoken.Store) func(huma.Context, func(huma.Context)) {
+	sessionAuth := sessionManager.SessionMiddleware()
+	return func(ctx huma.Context, next func(huma.Context)) {
+		req, w := humachi.Unwrap(ctx)
+		raw, ok := bearerToken(req)
+		if !ok {
+			sessionAuth(ctx, next)
+			return
+		}
+
+		token, err := tokens.Authenticate(raw, time.Now())
+		if err != nil {
+			if !errors.Is(err, apitoken.ErrInvalidToken) && !errors.Is(err, apitoken.ErrExpired) {
+				log.Printf("api token lookup failed: %v", err)
+			}
+			log.Printf("api token rejected for %s %s from %s: %v", req.Method, req.URL.Path, common.RemoteHost(req), err)
+			message := "Invalid API token."
+			if errors.Is(err, apitoken.ErrExpired) {
+				message = "API token expired."
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+				OK:    false,
+				Error: message,
+			})
+			return
+		}
+
+		scope, _ := ctx.Operation().Metadata[apiScopeMetadata].(string)
+		if scope == "" || !token.Allows(scope) {
+			log.Printf("api token %s of %s lacks scope %q for %s %s", token.ID, token.Username, scope, req.Method, req.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			message := "This API token cannot be used for this request."
+			if scope != "" {
+				message = "This API token lacks the " + scope + " scope."
+			}
+			writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+				OK:    false,
+				Error: message,
+			})
+			return
+		}
+
+		ctx = session.WithUser(ctx, token.User())
+		next(huma.WithValue(ctx, apiTokenContextKey{}, token))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remotegateway/internal/config"
+)
+
+// bearerRequest calls path with token and no session cookie.
+func (e *oidcTestEnv) bearerRequest(t *testing.T, method, path, token string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, e.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("new request %s: %v", path, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	client := e.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return resp, string(body)
+}
+
+func TestAPITokenLifecycle(t *testing.T) {
+	t.Setenv(config.API_TOKEN_STORE_PATH, filepath.Join(t.TempDir(), "tokens.json"))
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	form := url.Values{"name": {"ci"}, "scope": {"power"}, "expires_days": {"7"}}
+	if resp, _ := env.postForm(t, "/api/tokens", form); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected token creation to require mfa, got %d", resp.StatusCode)
+	}
+	enrollTOTP(t, env)
+	if resp, _ := env.postForm(t, "/api/tokens", url.Values{"name": {"ci"}, "expires_days": {"365"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected lifetime above API_TOKEN_MAX_DAYS to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, body := env.postForm(t, "/api/tokens", form)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 creating token, got %d %s", resp.StatusCode, body)
+	}
+	var created apiTokenCreateResponse
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("decode token: %v", err)
+	}
+	if !created.OK || created.Token == "" || created.Info == nil || strings.Join(created.Info.Scopes, ",") != "power,read" {
+		t.Fatalf("unexpected token response %+v", created)
+	}
+
+	// read: the RDP file is issued for the token owner without a cookie.
+	resp, body = env.bearerRequest(t, http.MethodGet, "/api/rdpgw.rdp", created.Token, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `\alice`) {
+		t.Fatalf("expected rdp file for alice, got %d %q", resp.StatusCode, body)
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) != 0 {
+		t.Fatalf("expected no session cookie for token requests, got %v", cookies)
+	}
+
+	// power: the handler is reached and validates the form without CSRF.
+	if resp, body := env.bearerRequest(t, http.MethodPost, "/api/dashboard/start", created.Token, url.Values{"vm_name": {""}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected power scope to reach the handler, got %d %q", resp.StatusCode, body)
+	}
+	// manage is not granted and session only routes refuse tokens.
+	for _, path := range []string{"/api/dashboard", "/api/dashboard/remove", "/api/dashboard/app-password", "/api/tokens"} {
+		if resp, body := env.bearerRequest(t, http.MethodPost, path, created.Token, url.Values{"vm_name": {"x"}}); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected %s to be forbidden for the token, got %d %q", path, resp.StatusCode, body)
+		}
+	}
+
+	resp, body = env.bearerRequest(t, http.MethodGet, "/api/dashboard/data", "rgw_0000_bogus", nil)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body, "Invalid API token.") || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected 401 json for a bad token, got %d %q", resp.StatusCode, body)
+	}
+
+	listResp, err := env.client.Get(env.server.URL + "/api/tokens")
+	if err != nil {
+		t.Fatalf("list tokens: %v", err)
+	}
+	var list apiTokenListResponse
+	err = json.NewDecoder(listResp.Body).Decode(&list)
+	listResp.Body.Close()
+	if err != nil || len(list.Tokens) != 1 || list.Tokens[0].ID != created.Info.ID || list.Tokens[0].LastUsedAt == nil {
+		t.Fatalf("unexpected token list %+v %v", list, err)
+	}
+
+	if resp, body := env.postForm(t, "/api/tokens/revoke", url.Values{"id": {created.Info.ID}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected revoke to succeed, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := env.bearerRequest(t, http.MethodGet, "/api/rdpgw.rdp", created.Token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected revoked token to be refused, got %d", resp.StatusCode)
+	}
+}
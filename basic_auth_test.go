@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remotegateway/internal/auth"
+	"remotegateway/internal/config"
+	"remotegateway/internal/contextKey"
+	"remotegateway/internal/ldap"
+	"remotegateway/internal/localusers"
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/ntlm"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+	"remotegateway/internal/types"
+)
+
+type countingAuthenticator struct {
+	password string
+	calls    int
+}
+
+func (a *countingAuthenticator) Authenticate(username, password string) (*types.User, error) {
+	a.calls++
+	if password != a.password {
+		return nil, localusers.ErrInvalidCredentials
+	}
+	return types.NewUser(username, password, "vdi")
+}
+
+// serveGatewayBasic sends a Basic authenticated gateway request and returns
+// the status and the user that reached the gateway handler.
+func serveGatewayBasic(t *testing.T, auth *ntlm.StaticAuth, url, user, password string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.RemoteAddr = "10.1.2.3:50000"
+	req.SetBasicAuth(user, password)
+
+	reachedUser := ""
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reachedUser, _ = contextKey.AuthUserFromContext(r.Context())
+	})
+	rec := httptest.NewRecorder()
+	common.EnrichContext(ntlm.BasicAuthMiddleware(auth, next)).ServeHTTP(rec, req)
+	return rec.Code, reachedUser
+}
+
+func TestGatewayBasicAuthSessionPassword(t *testing.T) {
+	t.Setenv(config.GATEWAY_BASIC_AUTH, "true")
+	settings := config.NewSettingType(false)
+	sessionManager := session.NewManager()
+	seedSession(t, sessionManager, ntlm.StaticUser, ntlm.StaticPassword, ldap.GatewayDomain(settings))
+	auth := &ntlm.StaticAuth{
+		SessionManager: sessionManager,
+		Basic:          gatewayBasicAuth(mfa.NewStore(t.TempDir()+"/mfa.json"), nil, settings),
+	}
+
+	if code, user := serveGatewayBasic(t, auth, "https://gw.example.com/remoteDesktopGateway/", `VDI\`+ntlm.StaticUser, ntlm.StaticPassword); code != http.StatusOK || user != ntlm.StaticUser {
+		t.Fatalf("expected session password to authenticate, got status %d user %q", code, user)
+	}
+	if code, user := serveGatewayBasic(t, auth, "https://gw.example.com/remoteDesktopGateway/", ntlm.StaticUser, "wrong"); code != http.StatusUnauthorized || user != "" {
+		t.Fatalf("expected wrong password to be refused, got status %d user %q", code, user)
+	}
+	if code, user := serveGatewayBasic(t, auth, "http://gw.example.com/remoteDesktopGateway/", ntlm.StaticUser, ntlm.StaticPassword); code != http.StatusUnauthorized || user != "" {
+		t.Fatalf("expected Basic without TLS to be refused, got status %d user %q", code, user)
+	}
+}
+
+func TestGatewayBasicAuthDirectoryCached(t *testing.T) {
+	t.Setenv(config.GATEWAY_BASIC_AUTH, "true")
+	settings := config.NewSettingType(false)
+	directory := &countingAuthenticator{password: "secret"}
+	auth := &ntlm.StaticAuth{
+		SessionManager: session.NewManager(),
+		Basic:          gatewayBasicAuth(mfa.NewStore(t.TempDir()+"/mfa.json"), directory, settings),
+	}
+
+	for i := 0; i < 3; i++ {
+		if code, user := serveGatewayBasic(t, auth, "https://gw.example.com/", "alice", "secret"); code != http.StatusOK || user != "alice" {
+			t.Fatalf("request %d: expected directory login, got status %d user %q", i, code, user)
+		}
+	}
+	if directory.calls != 1 {
+		t.Fatalf("expected one directory lookup, got %d", directory.calls)
+	}
+	if code, _ := serveGatewayBasic(t, auth, "https://gw.example.com/", "alice", "other"); code != http.StatusUnauthorized {
+		t.Fatalf("expected a different password to miss the cache, got status %d", code)
+	}
+	if directory.calls != 2 {
+		t.Fatalf("expected the wrong password to reach the directory, got %d lookups", directory.calls)
+	}
+}
+
+func TestGatewayBasicAuthRevokeDropsCachedLogin(t *testing.T) {
+	t.Setenv(config.GATEWAY_BASIC_AUTH, "true")
+	settings := config.NewSettingType(false)
+	sessionManager := session.NewManager()
+	seedSession(t, sessionManager, ntlm.StaticUser, ntlm.StaticPassword, ldap.GatewayDomain(settings))
+	auth := &ntlm.StaticAuth{
+		SessionManager: sessionManager,
+		Basic:          gatewayBasicAuth(mfa.NewStore(t.TempDir()+"/mfa.json"), nil, settings),
+	}
+
+	if code, _ := serveGatewayBasic(t, auth, "https://gw.example.com/", ntlm.StaticUser, ntlm.StaticPassword); code != http.StatusOK {
+		t.Fatalf("expected the session password to authenticate, got status %d", code)
+	}
+	if revoked, err := sessionManager.RevokeUser(ntlm.StaticUser); err != nil || revoked != 1 {
+		t.Fatalf("revoke: %d %v", revoked, err)
+	}
+	if code, user := serveGatewayBasic(t, auth, "https://gw.example.com/", ntlm.StaticUser, ntlm.StaticPassword); code != http.StatusUnauthorized || user != "" {
+		t.Fatalf("expected the cached login to end with the sessions, got status %d user %q", code, user)
+	}
+}
+
+func TestGatewayBasicAuthDisableDropsCachedLogin(t *testing.T) {
+	t.Setenv(config.GATEWAY_BASIC_AUTH, "true")
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := localusers.NewStore(path).Add("carol", "secret", nil, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	settings := config.NewSettingType(false)
+	chain := auth.Chain{auth.Local{Store: localusers.NewStore(path)}}
+	gateway := &ntlm.StaticAuth{
+		SessionManager: session.NewManager(),
+		Basic:          gatewayBasicAuth(mfa.NewStore(t.TempDir()+"/mfa.json"), chain, settings),
+	}
+
+	if code, _ := serveGatewayBasic(t, gateway, "https://gw.example.com/", "carol", "secret"); code != http.StatusOK {
+		t.Fatalf("expected a local login, got status %d", code)
+	}
+	// The CLI disables the account from another process.
+	if err := localusers.NewStore(path).SetDisabled("carol", true, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if code, user := serveGatewayBasic(t, gateway, "https://gw.example.com/", "carol", "secret"); code != http.StatusUnauthorized || user != "" {
+		t.Fatalf("expected the cached login to end with the account, got status %d user %q", code, user)
+	}
+}
+
+func TestGatewayBasicAuthDirectoryNeedsNoSecondFactor(t *testing.T) {
+	preEnroll(t, "alice")
+	t.Setenv(config.GATEWAY_BASIC_AUTH, "true")
+	settings := config.NewSettingType(false)
+	directory := &countingAuthenticator{password: "secret"}
+	auth := &ntlm.StaticAuth{
+		SessionManager: session.NewManager(),
+		Basic:          gatewayBasicAuth(mfa.NewStore(settings.Get(config.MFA_STORE_PATH)), directory, settings),
+	}
+
+	if code, _ := serveGatewayBasic(t, auth, "https://gw.example.com/", "alice", "secret"); code != http.StatusUnauthorized {
+		t.Fatalf("expected enrolled user to be refused a directory login, got status %d", code)
+	}
+	if code, user := serveGatewayBasic(t, auth, "https://gw.example.com/", "bob", "secret"); code != http.StatusOK || user != "bob" {
+		t.Fatalf("expected user without MFA to log in, got status %d user %q", code, user)
+	}
+
+	t.Setenv(config.MFA_REQUIRED, "true")
+	settings = config.NewSettingType(false)
+	auth.Basic = gatewayBasicAuth(mfa.NewStore(settings.Get(config.MFA_STORE_PATH)), directory, settings)
+	if code, _ := serveGatewayBasic(t, auth, "https://gw.example.com/", "bob", "secret"); code != http.StatusUnauthorized {
+		t.Fatalf("expected MFA_REQUIRED to refuse directory logins, got status %d", code)
+	}
+}
+
+func TestGatewayBasicAuthDisabled(t *testing.T) {
+	settings := config.NewSettingType(false)
+	if basic := gatewayBasicAuth(nil, &countingAuthenticator{}, settings); basic != nil {
+		t.Fatalf("expected Basic auth to be disabled")
+	}
+
+	auth := &ntlm.StaticAuth{SessionManager: session.NewManager()}
+	code, _ := serveGatewayBasic(t, auth, "https://gw.example.com/", "alice", "secret")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://gw.example.com/", nil)
+	rec := httptest.NewRecorder()
+	ntlm.BasicAuthMiddleware(auth, http.NotFoundHandler()).ServeHTTP(rec, req)
+	for _, v := range rec.Header().Values("WWW-Authenticate") {
+		if v == `Basic realm="rdpgw"` {
+			t.Fatalf("expected no Basic challenge when disabled, got %v", rec.Header().Values("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/identity"
+	"remotegateway/internal/localusers"
+	"remotegateway/internal/policy"
+	"remotegateway/internal/virt"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+const cliUsage = `usage:
+  remotegateway user add <name> [-groups a,b] [-password-stdin]
+  remotegateway user reset <name> [-password-stdin]
+  remotegateway user disable <name>
+  remotegateway user enable <name>
+  remotegateway user list
+  remotegateway identity release <name>
+  remotegateway vm list
+  remotegateway vm migrate [-dry-run]
+  remotegateway vm set-owner <vm> <user>
+  remotegateway image list
+  remotegateway image remove <volume>
+  remotegateway policy test [-file path] -user <name> [-groups a,b] [-ip addr]
+                            [-client name] [-target vm] [-port 3389] [-time RFC3339]
+`
+
+// runCLI handles admin subcommands and returns the process exit code.
+func runCLI(args []string, settings *config.SettingsType, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "user":
+		store := localusers.NewStore(settings.Get(config.LOCAL_USERS_PATH))
+		err = runUserCommand(store, args[1], args[2:], stdin, stdout, stderr)
+	case "identity":
+		err = runIdentityCommand(identity.NewStore(settings.Get(config.IDENTITY_STORE_PATH)), args[1], args[2:], stdout)
+	case "vm":
+		err = runVMCommand(args[1], args[2:], stdout, stderr)
+	case "image":
+		err = runImageCommand(args[1], args[2:], stdout)
+	case "policy":
+		err = runPolicyCommand(settings, args[1], args[2:], stdout, stderr)
+	default:
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+var errUsage = errors.New("invalid arguments")
+
+func runUserCommand(store *localusers.Store, command string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if command == "list" {
+		return listUsers(store, stdout)
+	}
+
+	// Accept the user name before or after the flags.
+	name := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("user "+command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	groups := fs.String("groups", "", "comma separated groups (add only)")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if name == "" && fs.NArg() == 1 {
+		name = fs.Arg(0)
+	} else if fs.NArg() != 0 {
+		return errUsage
+	}
+	if name == "" {
+		return errUsage
+	}
+
+	now := time.Now()
+	switch command {
+	case "add", "reset":
+		password, generated, err := readOrGeneratePassword(stdin, *passwordStdin)
+		if err != nil {
+			return err
+		}
+		if command == "add" {
+			err = store.Add(name, password, splitGroups(*groups), now)
+		} else {
+			err = store.SetPassword(name, password, now)
+		}
+		if err != nil {
+			return err
+		}
+		if generated {
+			fmt.Fprintf(stdout, "password for %s: %s\n", strings.ToLower(name), password)
+		} else {
+			fmt.Fprintf(stdout, "password for %s updated\n", strings.ToLower(name))
+		}
+		return nil
+	case "disable", "enable":
+		if err := store.SetDisabled(name, command == "disable", now); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s %sd\n", strings.ToLower(name), command)
+		return nil
+	default:
+		return errUsage
+	}
+}
+
+// runIdentityCommand releases a username bound to a login backend, e.g. so
+// a directory user can sign in after a single sign-on account claimed the
+// name.
+func runIdentityCommand(store *identity.Store, command string, args []string, stdout io.Writer) error {
+	if command != "release" || len(args) != 1 {
+		return errUsage
+	}
+	released, err := store.Release(args[0])
+	if err != nil {
+		return err
+	}
+	if !released {
+		return fmt.Errorf("%s is not bound", strings.ToLower(args[0]))
+	}
+	fmt.Fprintf(stdout, "%s released\n", strings.ToLower(args[0]))
+	return nil
+}
+
+func readOrGeneratePassword(stdin io.Reader, fromStdin bool) (string, bool, error) {
+	if !fromStdin {
+		password, err := localusers.GeneratePassword()
+		return password, true, err
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", false, err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", false, localusers.ErrEmptyPassword
+	}
+	return password, false, nil
+}
+
+func splitGroups(value string) []string {
+	var groups []string
+	for _, group := range strings.Split(value, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func listUsers(store *localusers.Store, stdout io.Writer) error {
+	users, err := store.List()
+	if err != nil {
+		return err
+	}
+	table := tablewriter.NewWriter(stdout)
+	table.Header("USER", "Groups", "Disabled", "Updated")
+	for _, u := range users {
+		if err := table.Append([]string{
+			u.Username,
+			strings.Join(u.Groups, ","),
+			strconv.FormatBool(u.Disabled),
+			u.UpdatedAt.Format(time.RFC3339),
+		}); err != nil {
+			return err
+		}
+	}
+	return table.Render()
+}
+
+// vmOwnerRow is the ownership view of a domain used by the vm subcommands.
+type vmOwnerRow struct {
+	Name      string
+	Owner     string
+	Creator   string
+	CreatedAt time.Time
+}
+
+// vmMigration assigns Owner to a domain that has no ownership metadata.
+type vmMigration struct {
+	Name  string
+	Owner string
+}
+
+func runVMCommand(command string, args []string, stdout, stderr io.Writer) error {
+	switch command {
+	case "list":
+		rows, err := listVMOwners()
+		if err != nil {
+			return err
+		}
+		return writeVMOwners(rows, stdout)
+	case "migrate":
+		fs := flag.NewFlagSet("vm migrate", flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		dryRun := fs.Bool("dry-run", false, "show the owners that would be recorded")
+		if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+			return errUsage
+		}
+		rows, err := listVMOwners()
+		if err != nil {
+			return err
+		}
+		migrations, skipped := planOwnerMigration(rows)
+		for _, name := range skipped {
+			fmt.Fprintf(stdout, "skipped %s: owner cannot be derived from the name, use vm set-owner\n", name)
+		}
+		for _, m := range migrations {
+			if *dryRun {
+				fmt.Fprintf(stdout, "would set owner of %s to %s\n", m.Name, m.Owner)
+				continue
+			}
+			if err := virt.SetOwnership(m.Name, virt.Ownership{Owner: m.Owner}); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "set owner of %s to %s\n", m.Name, m.Owner)
+		}
+		return nil
+	case "set-owner":
+		if len(args) != 2 || strings.TrimSpace(args[1]) == "" {
+			return errUsage
+		}
+		name, owner := args[0], strings.ToLower(strings.TrimSpace(args[1]))
+		previous, err := virt.LookupOwnership(name)
+		if err != nil && !errors.Is(err, virt.ErrUnowned) {
+			return err
+		}
+		// Keep the recorded creator and creation time when only the owner changes.
+		previous.Owner = owner
+		if err := virt.SetOwnership(name, previous); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "set owner of %s to %s\n", name, owner)
+		return nil
+	default:
+		return errUsage
+	}
+}
+
+func listVMOwners() ([]vmOwnerRow, error) {
+	vms, err := virt.ListVMs("")
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]vmOwnerRow, 0, len(vms))
+	for _, vm := range vms {
+		rows = append(rows, vmOwnerRow{Name: vm.Name, Owner: vm.Owner, Creator: vm.Creator, CreatedAt: vm.CreatedAt})
+	}
+	return rows, nil
+}
+
+// planOwnerMigration derives an owner from the legacy "<user>-<name>" form
+// for every domain without ownership metadata. Domains whose name does not
+// follow that form are skipped.
+func planOwnerMigration(rows []vmOwnerRow) ([]vmMigration, []string) {
+	var migrations []vmMigration
+	var skipped []string
+	for _, row := range rows {
+		if row.Owner != "" {
+			continue
+		}
+		owner, ok := virt.LegacyOwner(row.Name)
+		if !ok {
+			skipped = append(skipped, row.Name)
+			continue
+		}
+		migrations = append(migrations, vmMigration{Name: row.Name, Owner: strings.ToLower(owner)})
+	}
+	return migrations, skipped
+}
+
+func writeVMOwners(rows []vmOwnerRow, stdout io.Writer) error {
+	table := tablewriter.NewWriter(stdout)
+	table.Header("VM", "Owner", "Creator", "Created")
+	for _, row := range rows {
+		created := "-"
+		if !row.CreatedAt.IsZero() {
+			created = row.CreatedAt.Format(time.RFC3339)
+		}
+		if err := table.Append([]string{row.Name, orDash(row.Owner), orDash(row.Creator), created}); err != nil {
+			return err
+		}
+	}
+	return table.Render()
+}
+
+// listBaseVolumes and removeBaseVolume allow tests to stub the pool.
+var (
+	listBaseVolumes  = virt.ListBaseVolumes
+	removeBaseVolume = virt.RemoveBaseVolume
+)
+
+// runImageCommand lists and removes the template images imported for
+// linked clones.
+func runImageCommand(command string, args []string, stdout io.Writer) error {
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		bases, err := listBaseVolumes()
+		if err != nil {
+			return err
+		}
+		table := tablewriter.NewWriter(stdout)
+		table.Header("Volume", "Size", "Linked clones")
+		for _, base := range bases {
+			clones := strconv.Itoa(len(base.Clones))
+			if len(base.Clones) > 0 {
+				clones += " (" + strings.Join(base.Clones, ", ") + ")"
+			}
+			if err := table.Append([]string{base.Name, fmt.Sprintf("%d GB", base.CapacityGB), clones}); err != nil {
+				return err
+			}
+		}
+		return table.Render()
+	case "remove":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := removeBaseVolume(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "removed %s\n", args[0])
+		return nil
+	default:
+		return errUsage
+	}
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// runPolicyCommand explains how the policy file decides a hypothetical
+// connection.
+func runPolicyCommand(settings *config.SettingsType, command string, args []string, stdout, stderr io.Writer) error {
+	if command != "test" {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", settings.Get(config.GATEWAY_POLICY_PATH), "policy file")
+	user := fs.String("user", "", "authenticated user")
+	groups := fs.String("groups", "", "comma separated groups of the user")
+	clientIP := fs.String("ip", "", "client ip address")
+	clientName := fs.String("client", "", "client machine name")
+	target := fs.String("target", "", "requested vm or host")
+	port := fs.Int("port", 3389, "requested port")
+	at := fs.String("time", "", "connection time, RFC3339; default now")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *user == "" || *file == "" {
+		return errUsage
+	}
+	when := time.Now()
+	if *at != "" {
+		parsed, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -time: %w", err)
+		}
+		when = parsed
+	}
+	p, err := policy.Load(*file)
+	if err != nil {
+		return err
+	}
+
+	req := policy.Request{
+		Stage:      policy.StageChannelCreate,
+		User:       strings.ToLower(*user),
+		Groups:     splitGroups(*groups),
+		ClientIP:   *clientIP,
+		ClientName: *clientName,
+		Target:     *target,
+		Port:       *port,
+		Time:       when,
+	}
+	d := p.Evaluate(req)
+	for _, line := range d.Trace {
+		fmt.Fprintln(stdout, line)
+	}
+	verdict := "deny"
+	if d.Allow {
+		verdict = "allow"
+	}
+	if d.Rule != "" {
+		fmt.Fprintf(stdout, "decision: %s by %s\n", verdict, d.Rule)
+	} else {
+		fmt.Fprintf(stdout, "decision: %s by default\n", verdict)
+	}
+	if !d.Allow {
+		return nil
+	}
+	if d.Limits.MaxSessions > 0 {
+		fmt.Fprintf(stdout, "max sessions: %d\n", d.Limits.MaxSessions)
+	}
+	rule, redirect, limits, ok := p.TunnelSettings(req)
+	if !ok {
+		fmt.Fprintln(stdout, "tunnel settings: gateway defaults")
+		return nil
+	}
+	fmt.Fprintf(stdout, "tunnel settings from %s:\n", rule)
+	if redirect != nil {
+		fmt.Fprintf(stdout, "  redirect: clipboard=%t drive=%t printer=%t port=%t pnp=%t\n",
+			redirect.Clipboard, redirect.Drive, redirect.Printer, redirect.Port, redirect.Pnp)
+	}
+	fmt.Fprintf(stdout, "  idle timeout: %d min, max session: %d min\n", limits.IdleTimeoutMinutes, limits.MaxSessionMinutes)
+	return nil
+}
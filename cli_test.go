@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/identity"
+	"remotegateway/internal/session"
+	"remotegateway/internal/virt"
+)
+
+func runTestCLI(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, config.NewSettingType(false), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLIManagesLocalUsers(t *testing.T) {
+	t.Setenv(config.AUTH_BACKENDS, "local")
+	t.Setenv(config.LOCAL_USERS_PATH, filepath.Join(t.TempDir(), "users.json"))
+
+	code, out, errOut := runTestCLI(t, "", "user", "add", "Dave", "-groups", "ops, vdi")
+	if code != 0 {
+		t.Fatalf("add failed: %d %s", code, errOut)
+	}
+	m := regexp.MustCompile(`password for dave: (\S+)`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("expected generated password, got %q", out)
+	}
+	if code, _, _ := runTestCLI(t, "", "user", "add", "dave"); code != 1 {
+		t.Fatalf("expected duplicate add to fail, got %d", code)
+	}
+
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), config.NewSettingType(false))
+	if rec := postLogin(handler, "192.0.2.1:1000", "dave", m[1]); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected generated password to log in, got %d", rec.Code)
+	}
+
+	if code, _, errOut := runTestCLI(t, "hunter22\n", "user", "reset", "-password-stdin", "dave"); code != 0 {
+		t.Fatalf("reset failed: %s", errOut)
+	}
+	if rec := postLogin(handler, "192.0.2.1:1000", "dave", "hunter22"); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected reset password to log in, got %d", rec.Code)
+	}
+
+	if code, _, _ := runTestCLI(t, "", "user", "disable", "dave"); code != 0 {
+		t.Fatalf("disable failed")
+	}
+	rec := postLogin(handler, "192.0.2.1:1000", "dave", "hunter22")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Your account is disabled.") {
+		t.Fatalf("expected disabled account message, got %d", rec.Code)
+	}
+
+	code, out, _ = runTestCLI(t, "", "user", "list")
+	if code != 0 || !strings.Contains(out, "dave") || !strings.Contains(out, "ops,vdi") || !strings.Contains(out, "true") {
+		t.Fatalf("unexpected list output %q", out)
+	}
+}
+
+func TestCLIReleasesIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	t.Setenv(config.IDENTITY_STORE_PATH, path)
+	if err := identity.NewStore(path).Bind("erin", identity.BackendOIDC, "https://idp#erin", time.Now()); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if code, out, errOut := runTestCLI(t, "", "identity", "release", "Erin"); code != 0 || out != "erin released\n" {
+		t.Fatalf("unexpected release result %d %q %q", code, out, errOut)
+	}
+	if code, _, errOut := runTestCLI(t, "", "identity", "release", "erin"); code != 1 || !strings.Contains(errOut, "not bound") {
+		t.Fatalf("expected a second release to fail, got %d %q", code, errOut)
+	}
+}
+
+func TestCLIUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"vm"}, {"user", "rename", "a"}, {"user", "add"}} {
+		if code, _, errOut := runTestCLI(t, "", args...); code != 2 || !strings.Contains(errOut, "usage:") {
+			t.Fatalf("%v: expected usage error, got %d %q", args, code, errOut)
+		}
+	}
+}
+
+func TestPlanOwnerMigration(t *testing.T) {
+	migrations, skipped := planOwnerMigration([]vmOwnerRow{
+		{Name: "Alice-vm"},
+		{Name: "bob-dev-01"},
+		{Name: "carol-vm", Owner: "dave"},
+		{Name: "standalone"},
+	})
+	want := []vmMigration{{Name: "Alice-vm", Owner: "alice"}, {Name: "bob-dev-01", Owner: "bob"}}
+	if !reflect.DeepEqual(migrations, want) {
+		t.Fatalf("unexpected migrations %+v", migrations)
+	}
+	if !reflect.DeepEqual(skipped, []string{"standalone"}) {
+		t.Fatalf("unexpected skipped domains %v", skipped)
+	}
+}
+
+func TestCLIImageCommands(t *testing.T) {
+	prevList, prevRemove := listBaseVolumes, removeBaseVolume
+	t.Cleanup(func() { listBaseVolumes, removeBaseVolume = prevList, prevRemove })
+	listBaseVolumes = func() ([]virt.BaseVolume, error) {
+		return []virt.BaseVolume{
+			{Name: "base@noble.img", CapacityGB: 12, Clones: []string{"alice-dev", "bob-ws"}},
+			{Name: "base@fedora.img", CapacityGB: 10},
+		}, nil
+	}
+	var removed []string
+	removeBaseVolume = func(name string) error {
+		if name == "base@noble.img" {
+			return fmt.Errorf("delete volume %s: %w: alice-dev, bob-ws", name, virt.ErrBaseInUse)
+		}
+		removed = append(removed, name)
+		return nil
+	}
+
+	code, out, errOut := runTestCLI(t, "", "image", "list")
+	if code != 0 || !strings.Contains(out, "2 (alice-dev, bob-ws)") || !strings.Contains(out, "base@fedora.img") {
+		t.Fatalf("unexpected list output %d %q %q", code, out, errOut)
+	}
+	if code, _, errOut := runTestCLI(t, "", "image", "remove", "base@noble.img"); code != 1 || !strings.Contains(errOut, "linked clones") {
+		t.Fatalf("expected a base with clones to be kept, got %d %q", code, errOut)
+	}
+	if code, out, _ := runTestCLI(t, "", "image", "remove", "base@fedora.img"); code != 0 || !strings.Contains(out, "removed base@fedora.img") {
+		t.Fatalf("expected removal, got %d %q", code, out)
+	}
+	if len(removed) != 1 {
+		t.Fatalf("unexpected removals %v", removed)
+	}
+}
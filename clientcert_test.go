@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"remotegateway/internal/clientcert"
+	"remotegateway/internal/clientcert/clientcerttest"
+	"remotegateway/internal/config"
+	"remotegateway/internal/contextKey"
+	"remotegateway/internal/ldap"
+	"remotegateway/internal/ntlm"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+
+	"github.com/caddyserver/certmagic"
+)
+
+type gatewayCertResult struct {
+	code    int
+	reached bool
+	user    string
+	cert    contextKey.ClientCert
+}
+
+// presentClientCert makes req carry a verified client certificate for user.
+func presentClientCert(t *testing.T, req *http.Request, user string) {
+	t.Helper()
+	ca, err := clientcerttest.NewCA("Device CA")
+	if err != nil {
+		t.Fatalf("ca: %v", err)
+	}
+	cert, err := ca.Issue(clientcerttest.Identity{CommonName: "LAPTOP-1", UPN: user + "@corp.example.com"})
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	chains, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: ca.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	req.TLS.PeerCertificates = []*x509.Certificate{cert.Leaf}
+	req.TLS.VerifiedChains = chains
+}
+
+// serveGatewayWithCert sends a gateway request through the auth middleware
+// with the given client certificate mode. certUser, when set, presents a
+// verified certificate for that user; withNTLM adds a valid NTLM message for
+// the static user.
+func serveGatewayWithCert(t *testing.T, mode, certUser string, withNTLM bool) gatewayCertResult {
+	t.Helper()
+	sessionManager := session.NewManager()
+	domain := defaultNTLMDomain()
+	seedSession(t, sessionManager, ntlm.StaticUser, ntlm.StaticPassword, domain)
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	req := httptest.NewRequest(http.MethodGet, "https://gw.example.com/remoteDesktopGateway/", nil)
+	req.RemoteAddr = "10.1.2.3:50000"
+	auth := &ntlm.StaticAuth{
+		Challenges: map[string]ntlm.NtlmChallengeState{
+			ntlm.NtlmChallengeKey(req): {Challenge: challenge, IssuedAt: time.Now()},
+		},
+		SessionManager:   sessionManager,
+		ClientCertMode:   mode,
+		ClientCertMapper: clientcert.Mapper{Sources: []string{clientcert.SourceUPN, clientcert.SourceCN}, Domains: []string{"corp.example.com"}},
+	}
+	if withNTLM {
+		ntResponse := ntlm.BuildTestNTLMv2Response(challenge, ntlm.StaticUser, domain, ntlm.StaticPassword)
+		msg := ntlm.BuildTestNTLMAuthenticateMessage(ntlm.StaticUser, domain, ntResponse, true)
+		req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(msg))
+	}
+	if certUser != "" {
+		presentClientCert(t, req, certUser)
+	}
+
+	var result gatewayCertResult
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result.reached = true
+		result.user, _ = contextKey.AuthUserFromContext(r.Context())
+		result.cert, _ = contextKey.ClientCertFromContext(r.Context())
+	})
+	rec := httptest.NewRecorder()
+	common.EnrichContext(ntlm.BasicAuthMiddleware(auth, next)).ServeHTTP(rec, req)
+	result.code = rec.Code
+	return result
+}
+
+func TestGatewayClientCertModes(t *testing.T) {
+	if r := serveGatewayWithCert(t, clientcert.ModeRequired, "alice", false); !r.reached || r.user != "alice" || r.cert.Subject != "CN=LAPTOP-1" {
+		t.Fatalf("required: expected certificate to authenticate alice, got %+v", r)
+	}
+	if r := serveGatewayWithCert(t, clientcert.ModeRequired, "", true); r.reached || r.code != http.StatusForbidden {
+		t.Fatalf("required: expected NTLM alone to be refused, got %+v", r)
+	}
+
+	if r := serveGatewayWithCert(t, clientcert.ModeOptional, "alice", false); !r.reached || r.user != "alice" {
+		t.Fatalf("optional: expected certificate login, got %+v", r)
+	}
+	if r := serveGatewayWithCert(t, clientcert.ModeOptional, "", true); !r.reached || r.user != ntlm.StaticUser {
+		t.Fatalf("optional: expected NTLM fallback, got %+v", r)
+	}
+
+	if r := serveGatewayWithCert(t, clientcert.ModeFactor, ntlm.StaticUser, true); !r.reached || r.user != ntlm.StaticUser || r.cert.User != ntlm.StaticUser {
+		t.Fatalf("factor: expected NTLM plus matching certificate, got %+v", r)
+	}
+	if r := serveGatewayWithCert(t, clientcert.ModeFactor, "alice", true); r.reached || r.code != http.StatusForbidden {
+		t.Fatalf("factor: expected mismatched certificate to be refused, got %+v", r)
+	}
+	if r := serveGatewayWithCert(t, clientcert.ModeFactor, "", true); r.reached || r.code != http.StatusForbidden {
+		t.Fatalf("factor: expected missing certificate to be refused, got %+v", r)
+	}
+	if r := serveGatewayWithCert(t, clientcert.ModeFactor, ntlm.StaticUser, false); r.reached || r.code != http.StatusUnauthorized {
+		t.Fatalf("factor: expected certificate alone to get an NTLM challenge, got %+v", r)
+	}
+
+	if r := serveGatewayWithCert(t, clientcert.ModeOff, "alice", false); r.reached {
+		t.Fatalf("off: expected certificate to be ignored, got %+v", r)
+	}
+}
+
+func TestServerTLSConfigClientCerts(t *testing.T) {
+	cfg, err := serverTLSConfig(config.NewSettingType(false), nil)
+	if err != nil || cfg.ClientAuth != tls.NoClientCert || cfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected no client auth by default, got %+v err=%v", cfg, err)
+	}
+
+	t.Setenv(config.CLIENT_CERT_MODE, "factor")
+	if _, err := serverTLSConfig(config.NewSettingType(false), nil); err == nil {
+		t.Fatalf("expected missing CA bundle to be rejected")
+	}
+
+	ca, err := clientcerttest.NewCA("Device CA")
+	if err != nil {
+		t.Fatalf("ca: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, ca.PEM(), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	t.Setenv(config.CLIENT_CERT_CA_FILE, path)
+	cfg, err = serverTLSConfig(config.NewSettingType(false), nil)
+	if err != nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven || cfg.ClientCAs == nil {
+		t.Fatalf("expected client certificates to be requested, got %+v err=%v", cfg, err)
+	}
+}
+
+func TestClientCertSettingsDomains(t *testing.T) {
+	t.Setenv(config.CLIENT_CERT_MODE, "factor")
+	t.Setenv(config.NTLM_DOMAIN, "CORP")
+	t.Setenv(config.CLIENT_CERT_DOMAINS, "corp.example.com")
+	_, mapper, err := clientCertSettings(config.NewSettingType(false))
+	if err != nil {
+		t.Fatalf("settings: %v", err)
+	}
+	want := []string{"corp.example.com", ldap.GatewayDomain(config.NewSettingType(false))}
+	if !reflect.DeepEqual(mapper.Domains, want) {
+		t.Fatalf("expected configured and NTLM domains, got %v want %v", mapper.Domains, want)
+	}
+}
+
+func TestACMEHTTPHandlerRedirectsToHTTPS(t *testing.T) {
+	handler := acmeHTTPHandler(certmagic.NewDefault())
+	req := httptest.NewRequest(http.MethodGet, "http://gw.example.com:80/login?next=1", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://gw.example.com/login?next=1" {
+		t.Fatalf("expected a redirect to https, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
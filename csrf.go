@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/adapters/humachi"
+)
+
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// csrfMiddleware rejects state-changing API requests that come from another
+// origin or lack the session's CSRF token. The token is handed to the
+// dashboard with /api/dashboard/data.
+func csrfMiddleware(sessionManager *session.Manager) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		req, w := humachi.Unwrap(ctx)
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next(ctx)
+			return
+		}
+		// Bearer tokens are never sent by the browser on its own.
+		if _, ok := apiTokenFromContext(ctx.Context()); ok {
+			next(ctx)
+			return
+		}
+
+		if !sameOrigin(req) {
+			log.Printf("csrf: rejected cross-origin %s %s from %s origin=%q referer=%q",
+				req.Method, req.URL.Path, common.RemoteHost(req), req.Header.Get("Origin"), req.Header.Get("Referer"))
+			writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+				OK:    false,
+				Error: "Cross-origin request rejected.",
+			})
+			return
+		}
+
+		token := req.Header.Get(csrfHeader)
+		if token == "" {
+			token = req.PostFormValue(csrfFormField)
+		}
+		if !sessionManager.ValidCSRFToken(req.Context(), token) {
+			log.Printf("csrf: missing or invalid token for %s %s from %s", req.Method, req.URL.Path, common.RemoteHost(req))
+			writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+				OK:    false,
+				Error: "Invalid or missing CSRF token. Reload the page and try again.",
+			})
+			return
+		}
+		next(ctx)
+	}
+}
+
+// sameOrigin checks Origin, or Referer when Origin is absent, against the
+// host the request was sent to. Requests carrying neither header come from
+// non-browser clients and are left to the token check.
+func sameOrigin(req *http.Request) bool {
+	source := req.Header.Get("Origin")
+	if source == "" {
+		source = req.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	origin := normalizeOriginHost(u.Host, u.Scheme)
+	for _, host := range []string{req.Host, req.Header.Get("X-Forwarded-Host")} {
+		if idx := strings.Index(host, ","); idx >= 0 {
+			host = host[:idx]
+		}
+		if host = strings.TrimSpace(host); host != "" && normalizeOriginHost(host, u.Scheme) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeOriginHost lower-cases host and drops the scheme's default port.
+func normalizeOriginHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	switch {
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		return strings.TrimSuffix(host, ":443")
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		return strings.TrimSuffix(host, ":80")
+	}
+	return host
+}
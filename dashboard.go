@@ -1,12 +1,18 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"io/fs"
 	"log"
+	"math/big"
 	"net/http"
+	"strings"
+	"time"
 
+	"remotegateway/internal/types"
 	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
 )
 
 const dashboardHTMLPath = "static/dashboard.html"
@@ -19,18 +25,72 @@ type dashboardVM struct {
 	MemoryMiB int    `json:"memoryMiB"`
 	VCPU      int    `json:"vcpu"`
 	VolumeGB  int    `json:"volumeGB"`
+	Owner     string `json:"owner"`
+	Template  string `json:"template,omitempty"`
+	// Readiness is provisioning, ready or failed for VMs that report
+	// through phone-home.
+	Readiness string `json:"readiness,omitempty"`
+	// KeepRunning opts the VM out of the idle shutdown.
+	KeepRunning bool `json:"keepRunning,omitempty"`
+	// IdleShutdownAt is when the VM is shut down if it stays idle.
+	IdleShutdownAt *time.Time `json:"idleShutdownAt,omitempty"`
+	// Access is the caller's right on the VM: owner, manage or connect, or
+	// admin in the admin overview.
+	Access string `json:"access"`
+	// Grants is only filled in for the owner.
+	Grants []virt.Grant `json:"grants,omitempty"`
 }
 
 type dashboardDataResponse struct {
-	Filename string        `json:"filename"`
-	VMs      []dashboardVM `json:"vms"`
-	Error    string        `json:"error,omitempty"`
+	Filename    string          `json:"filename"`
+	VMs         []dashboardVM   `json:"vms"`
+	Error       string          `json:"error,omitempty"`
+	MFAVerified bool            `json:"mfaVerified"`
+	CSRFToken   string          `json:"csrfToken,omitempty"`
+	IsAdmin     bool            `json:"isAdmin,omitempty"`
+	Quota       *quotaReport    `json:"quota,omitempty"`
+	Sizes       *vmsize.Catalog `json:"sizes,omitempty"`
+	Templates   *virt.Catalog   `json:"templates,omitempty"`
+	// IdleShutdown is set when idle VMs are shut down.
+	IdleShutdown bool `json:"idleShutdown,omitempty"`
 }
 
 type dashboardActionResponse struct {
 	OK      bool   `json:"ok"`
 	Message string `json:"message,omitempty"`
 	Error   string `json:"error,omitempty"`
+	// JobID is the provisioning job started by the action.
+	JobID string `json:"jobId,omitempty"`
+}
+
+type appPasswordResponse struct {
+	OK       bool   `json:"ok"`
+	Message  string `json:"message,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// appPasswordAlphabet avoids characters that are easily confused when typed
+// into an RDP client credential prompt.
+const appPasswordAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func generateAppPassword() (string, error) {
+	const groups, groupLen = 4, 5
+	buf := make([]byte, groups*groupLen)
+	max := big.NewInt(int64(len(appPasswordAlphabet)))
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		buf[i] = appPasswordAlphabet[n.Int64()]
+	}
+	parts := make([]string, 0, groups)
+	for i := 0; i < groups; i++ {
+		parts = append(parts, string(buf[i*groupLen:(i+1)*groupLen]))
+	}
+	return strings.Join(parts, "-"), nil
 }
 
 func renderDashboardPage(w http.ResponseWriter) {
@@ -46,25 +106,53 @@ func renderDashboardPage(w http.ResponseWriter) {
 	}
 }
 
-func listDashboardVMs() ([]dashboardVM, error) {
-	vmList, err := virt.ListVMs("")
-	if err != nil {
-		return nil, err
-	}
+// dashboardVMs returns the VMs of vmList user owns or was granted access
+// to.
+func dashboardVMs(user *types.User, vmList []virt.VMInfo) []dashboardVM {
 	rows := make([]dashboardVM, 0, len(vmList))
 	for _, vm := range vmList {
-		rdpHost := rdpTargetHost(vm.Name)
-		rows = append(rows, dashboardVM{
-			Name:      vm.Name,
-			IP:        vm.IP,
-			RDPHost:   rdpHost,
-			State:     vm.State,
-			MemoryMiB: vm.MemoryMiB,
-			VCPU:      vm.VCPU,
-			VolumeGB:  vm.VolumeGB,
-		})
+		ownership := virt.Ownership{Owner: vm.Owner, Grants: vm.Grants}
+		access := virt.RightOwner
+		var grants []virt.Grant
+		if ownership.OwnedBy(user.GetName()) {
+			grants = vm.Grants
+		} else if _, ok := ownership.Access(user.GetName(), user.GetGroups(), virt.RightManage); ok {
+			access = virt.RightManage
+		} else if _, ok := ownership.Access(user.GetName(), user.GetGroups(), virt.RightConnect); ok {
+			access = virt.RightConnect
+		} else {
+			continue
+		}
+		rows = append(rows, newDashboardVM(vm, access, grants))
+	}
+	return rows
+}
+
+func newDashboardVM(vm virt.VMInfo, access string, grants []virt.Grant) dashboardVM {
+	return dashboardVM{
+		Name:        vm.Name,
+		IP:          vm.IP,
+		RDPHost:     rdpTargetHost(vm.Name),
+		State:       vm.State,
+		MemoryMiB:   vm.MemoryMiB,
+		VCPU:        vm.VCPU,
+		VolumeGB:    vm.VolumeGB,
+		Owner:       vm.Owner,
+		Template:    vm.Template,
+		Readiness:   vm.Readiness,
+		KeepRunning: vm.KeepRunning,
+		Access:      access,
+		Grants:      grants,
+	}
+}
+
+// markIdleVMs fills in when the idle VMs of rows will be shut down.
+func markIdleVMs(rows []dashboardVM, idle *idleReconciler) {
+	for i := range rows {
+		if at, ok := idle.shutdownAt(rows[i].Name); ok {
+			rows[i].IdleShutdownAt = &at
+		}
 	}
-	return rows, nil
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
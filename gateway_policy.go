@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/contextKey"
+	"remotegateway/internal/policy"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/rdpgw/protocol"
+)
+
+// gatewayPolicy applies the connection policy file to gateway tunnels, on
+// top of the VM ownership check.
+type gatewayPolicy struct {
+	policy   *policy.Policy
+	registry *protocol.TunnelRegistry
+	now      func() time.Time
+	// next provides the tunnel settings a rule does not set.
+	next protocol.TunnelSettingsFunc
+}
+
+// loadGatewayPolicy returns nil when GATEWAY_POLICY_PATH is not set. A
+// policy that fails to load denies every tunnel until it is fixed.
+func loadGatewayPolicy(settings *config.SettingsType, registry *protocol.TunnelRegistry) *gatewayPolicy {
+	if !settings.Has(config.GATEWAY_POLICY_PATH) {
+		return nil
+	}
+	p, err := policy.Load(settings.Get(config.GATEWAY_POLICY_PATH))
+	if err != nil {
+		log.Printf("gateway policy: %v; denying all tunnels", err)
+		p = &policy.Policy{Default: policy.ActionDeny}
+	}
+	return &gatewayPolicy{policy: p, registry: registry, now: time.Now}
+}
+
+// apply sets the policy hooks on conf. Settings from rules take precedence
+// over those of the TunnelSettingsFunc already set.
+func (g *gatewayPolicy) apply(conf *protocol.ServerConf) {
+	if g == nil {
+		return
+	}
+	g.next = conf.TunnelSettingsFunc
+	conf.VerifyTunnelCreate = g.verifyTunnelCreate
+	conf.VerifyTunnelAuthFunc = g.verifyTunnelAuth
+	conf.TunnelSettingsFunc = g.tunnelSettings
+	conf.VerifyServerFunc = g.verifyServer
+}
+
+func (g *gatewayPolicy) request(ctx context.Context, stage policy.Stage) policy.Request {
+	user, _ := contextKey.AuthUserFromContext(ctx)
+	groups, _ := contextKey.AuthGroupsFromContext(ctx)
+	info, _ := protocol.TunnelInfoFromContext(ctx)
+	return policy.Request{
+		Stage:      stage,
+		User:       user,
+		Groups:     groups,
+		ClientIP:   common.GetClientIp(ctx),
+		ClientName: info.ClientName,
+		Target:     info.Target,
+		Port:       int(info.Port),
+		Time:       g.now(),
+	}
+}
+
+func (g *gatewayPolicy) decide(ctx context.Context, stage policy.Stage) bool {
+	req := g.request(ctx, stage)
+	if _, known := contextKey.AuthGroupsFromContext(ctx); !known && g.policy.UsesGroups() {
+		// A group deny rule cannot be skipped by the groups being unknown.
+		log.Printf("gateway policy denied %s: user=%s client_ip=%s: groups unknown and the policy has group rules", stage, req.User, req.ClientIP)
+		return false
+	}
+	d := g.policy.Evaluate(req)
+	if !d.Allow {
+		log.Printf(
+			"gateway policy denied %s: user=%s client_ip=%s client=%q target=%q port=%d rule=%q",
+			stage, req.User, req.ClientIP, req.ClientName, req.Target, req.Port, d.Rule,
+		)
+		return false
+	}
+	if stage == policy.StageChannelCreate && d.Limits.MaxSessions > 0 {
+		if open := g.registry.CountUser(req.User); open >= d.Limits.MaxSessions {
+			log.Printf(
+				"gateway policy denied %s: user=%s has %d open tunnels, %s allows %d",
+				stage, req.User, open, d.Rule, d.Limits.MaxSessions,
+			)
+			return false
+		}
+	}
+	return true
+}
+
+func (g *gatewayPolicy) verifyTunnelCreate(ctx context.Context, _ string) (bool, error) {
+	return g.decide(ctx, policy.StageTunnelCreate), nil
+}
+
+func (g *gatewayPolicy) verifyTunnelAuth(ctx context.Context, _ string) (bool, error) {
+	return g.decide(ctx, policy.StageTunnelAuth), nil
+}
+
+func (g *gatewayPolicy) verifyServer(ctx context.Context, _ string) (bool, error) {
+	return g.decide(ctx, policy.StageChannelCreate), nil
+}
+
+func (g *gatewayPolicy) tunnelSettings(ctx context.Context, client string) (*protocol.TunnelSettings, error) {
+	var settings *protocol.TunnelSettings
+	if g.next != nil {
+		var err error
+		if settings, err = g.next(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+	req := g.request(ctx, policy.StageTunnelAuth)
+	rule, redirect, limits, ok := g.policy.TunnelSettings(req)
+	if !ok {
+		return settings, nil
+	}
+	if settings == nil {
+		settings = &protocol.TunnelSettings{}
+	}
+	settings.IdleTimeout = limits.IdleTimeoutMinutes
+	settings.MaxDuration = time.Duration(limits.MaxSessionMinutes) * time.Minute
+	if redirect != nil {
+		settings.RedirectFlags = &protocol.RedirectFlags{
+			Clipboard: redirect.Clipboard,
+			Drive:     redirect.Drive,
+			Printer:   redirect.Printer,
+			Port:      redirect.Port,
+			Pnp:       redirect.Pnp,
+		}
+	}
+	log.Printf("gateway policy %s applies to user=%s client=%q: redirect=%+v limits=%+v", rule, req.User, req.ClientName, redirect, limits)
+	return settings, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/contextKey"
+	"remotegateway/internal/rdpgw/protocol"
+)
+
+const gatewayPolicyYAML = `
+default: deny
+rules:
+  - name: ops
+    action: allow
+    groups: [ops]
+    redirect: {clipboard: true}
+    limits: {max_sessions: 1, idle_timeout_minutes: 10, max_session_minutes: 60}
+  - name: alice-lab
+    action: allow
+    users: [alice]
+    targets: ["lab-*"]
+`
+
+func writeGatewayPolicy(t *testing.T, raw string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte(raw), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	return file
+}
+
+func TestGatewayPolicyHooks(t *testing.T) {
+	t.Setenv(config.GATEWAY_POLICY_PATH, writeGatewayPolicy(t, gatewayPolicyYAML))
+	registry := protocol.NewTunnelRegistry()
+	gp := loadGatewayPolicy(config.NewSettingType(false), registry)
+	if gp == nil {
+		t.Fatal("expected the policy to load")
+	}
+	conf := &protocol.ServerConf{}
+	gp.apply(conf)
+	if conf.VerifyTunnelCreate == nil || conf.VerifyTunnelAuthFunc == nil || conf.VerifyServerFunc == nil || conf.TunnelSettingsFunc == nil {
+		t.Fatal("expected apply to set every policy hook")
+	}
+
+	opsCtx := contextKey.WithAuthGroups(contextKey.WithAuthUser(context.Background(), "bob"), []string{"ops"})
+	if ok, _ := gp.verifyServer(opsCtx, "vm1:3389"); !ok {
+		t.Fatal("expected ops member to be allowed")
+	}
+	settings, err := gp.tunnelSettings(opsCtx, "laptop")
+	if err != nil || settings == nil {
+		t.Fatalf("expected tunnel settings, got %+v %v", settings, err)
+	}
+	if settings.RedirectFlags == nil || !settings.RedirectFlags.Clipboard || settings.RedirectFlags.Drive {
+		t.Fatalf("unexpected redirect flags %+v", settings.RedirectFlags)
+	}
+	if settings.IdleTimeout != 10 || settings.MaxDuration != time.Hour {
+		t.Fatalf("unexpected limits %+v", settings)
+	}
+
+	aliceCtx := contextKey.WithAuthGroups(contextKey.WithAuthUser(context.Background(), "alice"), nil)
+	if ok, _ := gp.verifyTunnelAuth(aliceCtx, "laptop"); !ok {
+		t.Fatal("expected a target rule to leave tunnel auth pending")
+	}
+	if ok, _ := gp.verifyServer(aliceCtx, "prod:3389"); ok {
+		t.Fatal("expected a target outside the rule to be denied")
+	}
+	if settings, _ := gp.tunnelSettings(aliceCtx, "laptop"); settings != nil {
+		t.Fatalf("expected gateway defaults for alice, got %+v", settings)
+	}
+}
+
+func TestGatewayPolicyUnknownGroups(t *testing.T) {
+	t.Setenv(config.GATEWAY_POLICY_PATH, writeGatewayPolicy(t, `
+default: allow
+rules:
+  - name: no-contractors
+    action: deny
+    groups: [contractors]
+`))
+	gp := loadGatewayPolicy(config.NewSettingType(false), protocol.NewTunnelRegistry())
+
+	// A tunnel without a web session or directory login has no known
+	// groups and must not slip past the group deny rule.
+	ctx := contextKey.WithAuthUser(context.Background(), "carol")
+	if ok, _ := gp.verifyTunnelCreate(ctx, ""); ok {
+		t.Fatal("expected unknown groups to be denied by a policy with group rules")
+	}
+	if ok, _ := gp.verifyTunnelCreate(contextKey.WithAuthGroups(ctx, []string{"contractors"}), ""); ok {
+		t.Fatal("expected contractors to be denied")
+	}
+	if ok, _ := gp.verifyTunnelCreate(contextKey.WithAuthGroups(ctx, nil), ""); !ok {
+		t.Fatal("expected a user in no group to be allowed")
+	}
+
+	t.Setenv(config.GATEWAY_POLICY_PATH, writeGatewayPolicy(t, "default: allow"))
+	gp = loadGatewayPolicy(config.NewSettingType(false), protocol.NewTunnelRegistry())
+	if ok, _ := gp.verifyTunnelCreate(ctx, ""); !ok {
+		t.Fatal("expected unknown groups to be allowed by a policy without group rules")
+	}
+}
+
+func TestGatewayPolicyDisabledOrBroken(t *testing.T) {
+	if gp := loadGatewayPolicy(config.NewSettingType(false), nil); gp != nil {
+		t.Fatal("expected no policy without GATEWAY_POLICY_PATH")
+	}
+	conf := &protocol.ServerConf{}
+	(*gatewayPolicy)(nil).apply(conf)
+	if conf.VerifyServerFunc != nil {
+		t.Fatal("expected a nil policy to leave the hooks alone")
+	}
+
+	t.Setenv(config.GATEWAY_POLICY_PATH, writeGatewayPolicy(t, "rules: [{action: sometimes}]"))
+	gp := loadGatewayPolicy(config.NewSettingType(false), nil)
+	ctx := contextKey.WithAuthUser(context.Background(), "alice")
+	if ok, _ := gp.verifyTunnelCreate(ctx, ""); ok {
+		t.Fatal("expected a broken policy to deny")
+	}
+}
+
+func TestCLIPolicyTest(t *testing.T) {
+	file := writeGatewayPolicy(t, gatewayPolicyYAML)
+
+	code, out, errOut := runTestCLI(t, "", "policy", "test", "-file", file, "-user", "Alice", "-target", "lab-3")
+	if code != 0 {
+		t.Fatalf("policy test failed: %d %s", code, errOut)
+	}
+	for _, want := range []string{
+		"rule 1 (ops) [allow]: no listed group",
+		"rule 2 (alice-lab) [allow]: matched",
+		"decision: allow by rule 2 (alice-lab)",
+		"tunnel settings: gateway defaults",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	_, out, _ = runTestCLI(t, "", "policy", "test", "-file", file, "-user", "bob", "-groups", "ops")
+	for _, want := range []string{
+		"decision: allow by rule 1 (ops)",
+		"max sessions: 1",
+		"redirect: clipboard=true drive=false",
+		"idle timeout: 10 min, max session: 60 min",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	_, out, _ = runTestCLI(t, "", "policy", "test", "-file", file, "-user", "eve")
+	if !strings.Contains(out, "no rule matched: default deny\ndecision: deny by default") {
+		t.Fatalf("expected default deny, got:\n%s", out)
+	}
+
+	if code, _, _ := runTestCLI(t, "", "policy", "test", "-file", file); code != 2 {
+		t.Fatalf("expected usage error without -user, got %d", code)
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"remotegateway/internal/auth"
 	"remotegateway/internal/config"
+	"remotegateway/internal/identity"
 	"remotegateway/internal/ldap"
+	"remotegateway/internal/localusers"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/ntlm"
+	"remotegateway/internal/rdpgw/common"
 	"remotegateway/internal/session"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -34,42 +45,94 @@ func extractCredentials(r *http.Request) (string, string, bool, error) {
 	return username, password, true, nil
 }
 
-func handleLoginPost(sessionManager *session.Manager, settings *config.SettingsType) http.HandlerFunc {
+func handleLoginPost(sessionManager *session.Manager, mfaStore *mfa.Store, identities *identity.Store, limiter *lockout.Limiter, authenticator auth.Authenticator, settings *config.SettingsType) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		username, password, ok, err := extractCredentials(r)
 		if err != nil {
-			serveLogin(w, "Invalid form submission.")
+			serveLogin(w, settings, "Invalid form submission.")
 			return
 		}
 		if !ok {
-			serveLogin(w, "Missing credentials.")
+			serveLogin(w, settings, "Missing credentials.")
 			return
 		}
 
-		user, err := ldap.LdapAuthenticateAccess(username, password, settings)
-		if err != nil {
-			log.Printf("ldap auth failed for %s: %v", username, err)
-			serveLogin(w, "Invalid credentials.")
+		clientIP := common.RemoteHost(r)
+		limitUser := loginLimitUser(username)
+		if wait, locked := limiter.Check(limitUser, clientIP, time.Now()); locked {
+			log.Printf("login locked out: user=%s ip=%s retry_after=%s", limitUser, clientIP, wait.Truncate(time.Second))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			serveLoginStatus(w, settings, http.StatusTooManyRequests, "Too many failed attempts. Try again later.")
 			return
 		}
 
-		if err := sessionManager.CreateSession(r.Context(), user); err != nil {
-			log.Printf("session create failed for %s: %v", username, err)
-			serveLogin(w, "Login failed.")
+		user, err := authenticator.Authenticate(username, password)
+		if err != nil {
+			log.Printf("login failed for %s: %v", username, err)
+			if !ldap.IsUnavailable(err) {
+				if wait := limiter.Failure(limitUser, clientIP, time.Now()); wait > 0 {
+					log.Printf("login lockout: user=%s ip=%s duration=%s", limitUser, clientIP, wait)
+				}
+			}
+			serveLogin(w, settings, loginErrorMessage(err))
 			return
 		}
-		http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+		if err := identities.Bind(user.GetName(), identity.BackendPassword, "", time.Now()); err != nil {
+			if errors.Is(err, identity.ErrConflict) {
+				log.Printf("login refused: %s is bound to a single sign-on account", user.GetName())
+				serveLogin(w, settings, "This account signs in with single sign-on.")
+				return
+			}
+			// The binding only guards against single sign-on takeovers;
+			// the password was verified.
+			log.Printf("login: bind identity %s: %v", user.GetName(), err)
+		}
+
+		completeLogin(w, r, sessionManager, mfaStore, limiter, settings, user)
+	}
+}
+
+// loginLimitUser is the lockout key of a login name. "alice", "VDI\alice"
+// and "alice@vdi" share one budget, as they do for NTLM and Basic.
+func loginLimitUser(username string) string {
+	return strings.ToLower(ntlm.NormalizeUser(username))
+}
+
+// loginErrorMessage only distinguishes account states that the directory
+// reports after the password was verified.
+func loginErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ldap.ErrAccountDisabled), errors.Is(err, localusers.ErrDisabled):
+		return "Your account is disabled. Contact your administrator."
+	case errors.Is(err, ldap.ErrAccountLocked):
+		return "Your account is locked out. Try again later or contact your administrator."
+	case errors.Is(err, ldap.ErrAccountExpired):
+		return "Your account has expired. Contact your administrator."
+	case errors.Is(err, ldap.ErrPasswordExpired):
+		return "Your password has expired. Change it before signing in."
+	default:
+		return "Invalid credentials."
 	}
 }
 
-func serveLogin(w http.ResponseWriter, message string) {
+func serveLogin(w http.ResponseWriter, settings *config.SettingsType, message string) {
+	serveLoginStatus(w, settings, http.StatusOK, message)
+}
+
+func serveLoginStatus(w http.ResponseWriter, settings *config.SettingsType, status int, message string) {
 	setNoCacheHeaders(w)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	errorHTML := ""
 	if message != "" {
 		errorHTML = `<div class="error">` + html.EscapeString(message) + `</div>`
 	}
-	fmt.Fprint(w, strings.Replace(loginHTML, "{{ERROR}}", errorHTML, 1))
+	ssoHTML := ""
+	if settings != nil && settings.Has(config.OIDC_ISSUER_URL) {
+		ssoHTML = `<a class="sso" href="/login/oidc">Sign in with single sign-on</a>`
+	}
+	page := strings.Replace(loginHTML, "{{ERROR}}", errorHTML, 1)
+	w.WriteHeader(status)
+	fmt.Fprint(w, strings.Replace(page, "{{SSO}}", ssoHTML, 1))
 }
 
 func setNoCacheHeaders(w http.ResponseWriter) {
@@ -78,8 +141,10 @@ func setNoCacheHeaders(w http.ResponseWriter) {
 	w.Header().Set("Expires", expiresValue)
 }
 
-func handleLoginGet(w http.ResponseWriter, r *http.Request) {
-	serveLogin(w, "")
+func handleLoginGet(settings *config.SettingsType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveLogin(w, settings, "")
+	}
 }
 
 func handleLogout(sessionManager *session.Manager) http.HandlerFunc {
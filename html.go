@@ -6,7 +6,30 @@ const loginHTML = `<!doctype html>
   <meta charset="utf-8">
   <meta name="viewport" content="width=device-width, initial-scale=1">
   <title>RemoteGateway</title>
-  <style>
+` + authPageStyle + `</head>
+<body>
+  <div class="card">
+    <h1>RemoteGateway</h1>
+    <p>Sign in to see your allowed namespaces and browse repository contents.</p>
+    {{ERROR}}
+    <form method="post" action="/login">
+      <div class="field">
+        <label for="username">Username</label>
+        <input id="username" name="username" autocomplete="username" required>
+      </div>
+      <div class="field">
+        <label for="password">Password</label>
+        <input id="password" name="password" type="password" autocomplete="current-password" required>
+      </div>
+      <button type="submit">Continue</button>
+    </form>
+    {{SSO}}
+  </div>
+</body>
+</html>
+`
+
+const authPageStyle = `  <style>
     :root { --bg:#0b1224; --panel:#0f172a; --accent:#38bdf8; --muted:#94a3b8; --line:rgba(255,255,255,0.1); }
     body { margin:0; font-family: "Space Grotesk", "Segoe UI", sans-serif; background:
       radial-gradient(circle at 15% 15%, rgba(56,189,248,0.18), transparent 40%),
@@ -21,25 +44,29 @@ const loginHTML = `<!doctype html>
     label { display:block; margin-bottom:6px; font-size:13px; color:var(--muted); letter-spacing:0.3px; text-transform:uppercase; }
     input { display:block; width:100%; box-sizing:border-box; background:#0b1224; border:1px solid var(--line); color:#e2e8f0; border-radius:10px; padding:10px 12px; font-size:15px; }
     button { width:100%; box-sizing:border-box; border:0; border-radius:10px; padding:12px 14px; font-weight:600; background:var(--accent); color:#062238; cursor:pointer; }
+    .sso { display:block; margin-top:14px; text-align:center; border:1px solid var(--line); border-radius:10px; padding:11px 14px; color:#e2e8f0; text-decoration:none; font-weight:600; }
+    .sso:hover { border-color:var(--accent); color:var(--accent); }
     .error { margin-top:12px; padding:10px 12px; border-radius:10px; border:1px solid rgba(248,113,113,0.4); background:rgba(248,113,113,0.12); color:#fecaca; font-size:13px; }
+    .mfa-qr { display:block; margin:16px auto 8px; width:220px; height:220px; border-radius:12px; background:#fff; padding:8px; box-sizing:border-box; }
+    code { font-family: ui-monospace, SFMono-Regular, Menlo, monospace; color:#e2e8f0; word-break:break-all; }
+    .recovery { display:grid; grid-template-columns:repeat(2, 1fr); gap:6px 18px; margin:16px 0; padding:12px 16px; border:1px solid var(--line); border-radius:10px; list-style:none; }
+    .continue { display:block; margin-top:18px; text-align:center; border-radius:10px; padding:12px 14px; background:var(--accent); color:#062238; text-decoration:none; font-weight:600; }
   </style>
-</head>
+`
+
+const mfaHTML = `<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>RemoteGateway</title>
+` + authPageStyle + `</head>
 <body>
   <div class="card">
-    <h1>RemoteGateway</h1>
-    <p>Sign in to see your allowed namespaces and browse repository contents.</p>
+    <h1>Two-factor authentication</h1>
+    {{CONTENT}}
     {{ERROR}}
-    <form method="post" action="/login">
-      <div class="field">
-        <label for="username">Username</label>
-        <input id="username" name="username" autocomplete="username" required>
-      </div>
-      <div class="field">
-        <label for="password">Password</label>
-        <input id="password" name="password" type="password" autocomplete="current-password" required>
-      </div>
-      <button type="submit">Continue</button>
-    </form>
+    {{FORM}}
   </div>
 </body>
 </html>
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"remotegateway/internal/audit"
+	"remotegateway/internal/config"
+	"remotegateway/internal/rdpgw/protocol"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+)
+
+// vmCPUTimes allows tests to stub the libvirt CPU statistics.
+var vmCPUTimes = virt.CPUTimes
+
+// shutdownIdleVM allows tests to stub the shutdown of idle VMs.
+var shutdownIdleVM = virt.ShutdownVM
+
+// startConnectVM allows tests to stub starting VMs on connect.
+var startConnectVM = virt.StartExistingVM
+
+// connectBootTimeout and connectBootPoll bound the wait for the address of
+// a VM started on connect.
+var (
+	connectBootTimeout = 3 * time.Minute
+	connectBootPoll    = 2 * time.Second
+)
+
+type idleSample struct {
+	cpu time.Duration
+	at  time.Time
+	// idleSince is zero while the VM is in use.
+	idleSince time.Time
+}
+
+// idleReconciler shuts down running VMs that had no gateway tunnel and used
+// little CPU for a while. VMs marked KeepRunning are left alone.
+type idleReconciler struct {
+	tunnels    func() []protocol.Tunnel
+	auditLog   *audit.Logger
+	idleFor    time.Duration
+	cpuPercent float64
+
+	mu      sync.Mutex
+	samples map[string]idleSample
+}
+
+// startIdleReconciler starts checking for idle VMs every
+// IDLE_CHECK_INTERVAL_SECONDS until ctx ends. It returns nil when
+// IDLE_SHUTDOWN_SECONDS is 0.
+func startIdleReconciler(ctx context.Context, settings *config.SettingsType, tunnels *protocol.TunnelRegistry, auditLog *audit.Logger) *idleReconciler {
+	r := newIdleReconciler(settings, tunnels.List, auditLog)
+	if r == nil {
+		return nil
+	}
+	interval := time.Duration(intSetting(settings, config.IDLE_CHECK_INTERVAL_SECONDS, 60)) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go r.run(ctx, interval)
+	return r
+}
+
+func newIdleReconciler(settings *config.SettingsType, tunnels func() []protocol.Tunnel, auditLog *audit.Logger) *idleReconciler {
+	idleFor := time.Duration(intSetting(settings, config.IDLE_SHUTDOWN_SECONDS, 0)) * time.Second
+	if idleFor <= 0 {
+		return nil
+	}
+	cpuPercent := 5.0
+	if raw := strings.TrimSpace(settings.Get(config.IDLE_CPU_PERCENT)); raw != "" {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value < 0 || value > 100 {
+			log.Printf("invalid %s=%q; using %g", config.IDLE_CPU_PERCENT, raw, cpuPercent)
+		} else {
+			cpuPercent = value
+		}
+	}
+	return &idleReconciler{
+		tunnels:    tunnels,
+		auditLog:   auditLog,
+		idleFor:    idleFor,
+		cpuPercent: cpuPercent,
+		samples:    make(map[string]idleSample),
+	}
+}
+
+func (r *idleReconciler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.reconcile(now)
+		}
+	}
+}
+
+// reconcile samples the running VMs and shuts down those idle for idleFor.
+// A VM needs two samples before it can count as idle.
+func (r *idleReconciler) reconcile(now time.Time) {
+	vms, err := listVMs("")
+	if err != nil {
+		log.Printf("idle check: list vms: %v", err)
+		return
+	}
+	cpu, err := vmCPUTimes()
+	if err != nil {
+		log.Printf("idle check: cpu stats: %v", err)
+		return
+	}
+	connected := make(map[string]bool)
+	for _, t := range r.tunnels() {
+		connected[tunnelVMName(t.Target)] = true
+	}
+
+	r.mu.Lock()
+	prev := r.samples
+	r.mu.Unlock()
+
+	next := make(map[string]idleSample, len(prev))
+	for _, vm := range vms {
+		used, ok := cpu[vm.Name]
+		if !ok {
+			continue
+		}
+		last, seen := prev[vm.Name]
+		sample := idleSample{cpu: used, at: now, idleSince: last.idleSince}
+		busy := !seen ||
+			vm.KeepRunning ||
+			vm.Readiness == virt.ReadinessProvisioning ||
+			connected[strings.ToLower(vm.Name)] ||
+			cpuUsePercent(last, sample, vm.VCPU) >= r.cpuPercent
+		switch {
+		case busy:
+			sample.idleSince = time.Time{}
+		case sample.idleSince.IsZero():
+			sample.idleSince = last.at
+		}
+
+		if !sample.idleSince.IsZero() && now.Sub(sample.idleSince) >= r.idleFor {
+			if err := shutdownIdleVM(vm.Name); err != nil {
+				log.Printf("idle shutdown of vm %q failed: %v", vm.Name, err)
+				next[vm.Name] = sample
+				continue
+			}
+			log.Printf("idle shutdown of vm %q after %s", vm.Name, now.Sub(sample.idleSince).Round(time.Second))
+			r.auditLog.Record(audit.Event{
+				Actor:  "system",
+				Action: "vm.idle_shutdown",
+				Target: vm.Name,
+				Detail: map[string]string{
+					"owner":     vm.Owner,
+					"idleSince": sample.idleSince.UTC().Format(time.RFC3339),
+				},
+			})
+			continue
+		}
+		next[vm.Name] = sample
+	}
+
+	r.mu.Lock()
+	r.samples = next
+	r.mu.Unlock()
+}
+
+// shutdownAt returns when the VM name will be shut down if it stays idle.
+func (r *idleReconciler) shutdownAt(name string) (time.Time, bool) {
+	if r == nil {
+		return time.Time{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sample, ok := r.samples[name]
+	if !ok || sample.idleSince.IsZero() {
+		return time.Time{}, false
+	}
+	return sample.idleSince.Add(r.idleFor), true
+}
+
+// startOnConnect starts the shut-off VM name for a gateway tunnel, e.g. one
+// stopped for idleness, and waits for its address. Like the dashboard start,
+// it needs the manage right and room in the owner's quota; it reports false
+// when the VM was not started.
+func startOnConnect(ctx context.Context, auditLog *audit.Logger, quotas *vmQuotas, actor vmActor, name string) (string, bool, error) {
+	vms, err := listVMs("")
+	if err != nil {
+		return "", false, err
+	}
+	var state string
+	for _, vm := range vms {
+		if vm.Name == name {
+			state = vm.State
+			break
+		}
+	}
+	if state != "shut off" {
+		return "", false, nil
+	}
+	if err := authorizeVM(auditLog, actor, name, virt.RightManage, "vm.start"); err != nil {
+		log.Printf("not starting vm %q on connect for user=%s: %v", name, actor.Name, err)
+		return "", false, nil
+	}
+	if err := quotas.checkStart(&types.User{Name: actor.Name, Groups: actor.Groups}, name); err != nil {
+		log.Printf("not starting vm %q on connect for user=%s: %v", name, actor.Name, err)
+		return "", false, nil
+	}
+	if err := startConnectVM(name); err != nil {
+		return "", false, err
+	}
+	log.Printf("started vm %q on connect for user=%s", name, actor.Name)
+	auditLog.Record(audit.Event{
+		Actor:  strings.ToLower(actor.Name),
+		Action: "vm.connect_start",
+		Target: name,
+		Remote: actor.Remote,
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, connectBootTimeout)
+	defer cancel()
+	ticker := time.NewTicker(connectBootPoll)
+	defer ticker.Stop()
+	for {
+		ip, err := getIPOfVm(name)
+		if err == nil {
+			return ip, true, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", true, fmt.Errorf("wait for address of vm %s: %w", name, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// cpuUsePercent is the CPU use between two samples in percent of vcpu
+// CPUs. It reports full use when the samples cannot be compared, e.g. after
+// a reboot reset the counter.
+func cpuUsePercent(from, to idleSample, vcpu int) float64 {
+	wall := to.at.Sub(from.at)
+	used := to.cpu - from.cpu
+	if wall <= 0 || used < 0 || vcpu <= 0 {
+		return 100
+	}
+	return float64(used) / float64(wall) / float64(vcpu) * 100
+}
+
+// tunnelVMName returns the VM a tunnel target names; clients may add the
+// RDP port.
+func tunnelVMName(target string) string {
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		target = host
+	}
+	return strings.ToLower(strings.TrimSpace(target))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"remotegateway/internal/audit"
+	"remotegateway/internal/config"
+	"remotegateway/internal/rdpgw/protocol"
+	"remotegateway/internal/virt"
+)
+
+func TestIdleReconcilerShutsDownIdleVMs(t *testing.T) {
+	t.Setenv(config.IDLE_SHUTDOWN_SECONDS, "600")
+	t.Setenv(config.IDLE_CPU_PERCENT, "5")
+	stubListVMs(t, []virt.VMInfo{
+		{Name: "alice-idle", Owner: "alice", State: "running", VCPU: 2},
+		{Name: "alice-busy", Owner: "alice", State: "running", VCPU: 2},
+		{Name: "alice-rdp", Owner: "alice", State: "running", VCPU: 2},
+		{Name: "alice-keep", Owner: "alice", State: "running", VCPU: 2, KeepRunning: true},
+		{Name: "alice-off", Owner: "alice", State: "shut off", VCPU: 2},
+	})
+	cpu := map[string]time.Duration{"alice-idle": 0, "alice-busy": 0, "alice-rdp": 0, "alice-keep": 0}
+	prevCPU, prevShutdown := vmCPUTimes, shutdownIdleVM
+	vmCPUTimes = func() (map[string]time.Duration, error) {
+		copied := make(map[string]time.Duration, len(cpu))
+		for name, used := range cpu {
+			copied[name] = used
+		}
+		return copied, nil
+	}
+	var stopped []string
+	shutdownIdleVM = func(name string) error {
+		stopped = append(stopped, name)
+		return nil
+	}
+	t.Cleanup(func() { vmCPUTimes, shutdownIdleVM = prevCPU, prevShutdown })
+	tunnels := func() []protocol.Tunnel {
+		return []protocol.Tunnel{{User: "alice", Target: "Alice-RDP:3389"}}
+	}
+
+	r := newIdleReconciler(config.NewSettingType(false), tunnels, audit.NewLogger(""))
+	if r == nil {
+		t.Fatal("expected the reconciler to be enabled")
+	}
+	start := time.Unix(1700000000, 0)
+	for i := 0; i <= 10; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		// 2% of two vCPUs on the idle VMs, 50% on the busy one.
+		for _, name := range []string{"alice-idle", "alice-rdp", "alice-keep"} {
+			cpu[name] += 2 * 1200 * time.Millisecond
+		}
+		cpu["alice-busy"] += time.Minute
+		r.reconcile(now)
+		if i == 5 {
+			if at, ok := r.shutdownAt("alice-idle"); !ok || !at.Equal(start.Add(10*time.Minute)) {
+				t.Fatalf("expected the idle vm to be shut down at %s, got %s %v", start.Add(10*time.Minute), at, ok)
+			}
+			if _, ok := r.shutdownAt("alice-busy"); ok {
+				t.Fatal("expected the busy vm not to be idle")
+			}
+		}
+		if i < 10 && len(stopped) > 0 {
+			t.Fatalf("shut down %q after %d minutes", stopped, i)
+		}
+	}
+	if len(stopped) != 1 || stopped[0] != "alice-idle" {
+		t.Fatalf("expected only the idle vm to be shut down, got %q", stopped)
+	}
+	if _, ok := r.shutdownAt("alice-idle"); ok {
+		t.Fatal("expected the stopped vm to be forgotten")
+	}
+
+	t.Setenv(config.IDLE_SHUTDOWN_SECONDS, "0")
+	if r := newIdleReconciler(config.NewSettingType(false), tunnels, audit.NewLogger("")); r != nil {
+		t.Fatal("expected the reconciler to be disabled")
+	}
+}
+
+func TestIdleReconcilerStopsWithContext(t *testing.T) {
+	t.Setenv(config.IDLE_SHUTDOWN_SECONDS, "600")
+	r := newIdleReconciler(config.NewSettingType(false), func() []protocol.Tunnel { return nil }, audit.NewLogger(""))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the reconciler to stop with its context")
+	}
+}
+
+func TestCPUUsePercent(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	from := idleSample{cpu: time.Second, at: at}
+	if got := cpuUsePercent(from, idleSample{cpu: 4 * time.Second, at: at.Add(10 * time.Second)}, 3); got != 10 {
+		t.Fatalf("expected 10%%, got %g", got)
+	}
+	if got := cpuUsePercent(from, idleSample{cpu: 0, at: at.Add(10 * time.Second)}, 3); got != 100 {
+		t.Fatalf("expected a reset counter to count as busy, got %g", got)
+	}
+}
+
+func TestKeepRunning(t *testing.T) {
+	records := map[string]virt.Ownership{
+		"alice-dev": {Owner: "alice"},
+		"bob-dev":   {Owner: "bob", Grants: []virt.Grant{{Type: virt.GrantUser, Name: "alice", Right: virt.RightConnect}}},
+	}
+	stubVMOwnership(t, records)
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	if resp, body := env.postForm(t, "/api/dashboard/keep-running", url.Values{"vm_name": {"alice-dev"}, "keep": {"maybe"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid flag to be refused, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := env.postForm(t, "/api/dashboard/keep-running", url.Values{"vm_name": {"alice-dev"}, "keep": {"true"}}); resp.StatusCode != http.StatusOK || !records["alice-dev"].KeepRunning {
+		t.Fatalf("expected the vm to keep running, got %d %q %+v", resp.StatusCode, body, records["alice-dev"])
+	}
+	if resp, _ := env.postForm(t, "/api/dashboard/keep-running", url.Values{"vm_name": {"alice-dev"}, "keep": {"false"}}); resp.StatusCode != http.StatusOK || records["alice-dev"].KeepRunning {
+		t.Fatalf("expected the opt-out to be cleared, got %d %+v", resp.StatusCode, records["alice-dev"])
+	}
+	if resp, _ := env.postForm(t, "/api/dashboard/keep-running", url.Values{"vm_name": {"bob-dev"}, "keep": {"true"}}); resp.StatusCode == http.StatusOK || records["bob-dev"].KeepRunning {
+		t.Fatalf("expected a connect grant not to be enough, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,270 @@
+// Package apitoken persists personal bearer tokens for the VM API.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remotegateway/internal/jsonfile"
+	"remotegateway/internal/types"
+)
+
+// Scopes a token can be granted. Every token may read; power and manage add
+// to that.
+const (
+	// ScopeRead lists VMs and downloads RDP files.
+	ScopeRead = "read"
+	// ScopePower starts, restarts and shuts down VMs.
+	ScopePower = "power"
+	// ScopeManage creates and removes VMs.
+	ScopeManage = "manage"
+)
+
+// Prefix starts every token so they are easy to spot in logs and secret
+// scanners.
+const Prefix = "rgw_"
+
+const (
+	idBytes     = 8
+	secretBytes = 32
+	// lastUsedResolution limits how often use of a token rewrites the file.
+	lastUsedResolution = time.Minute
+)
+
+var (
+	ErrInvalidToken = errors.New("apitoken: invalid token")
+	ErrExpired      = errors.New("apitoken: token expired")
+	ErrInvalidScope = errors.New("apitoken: unknown scope")
+	ErrInvalidName  = errors.New("apitoken: name is required")
+	ErrInvalidTTL   = errors.New("apitoken: invalid lifetime")
+)
+
+// Token is a stored API token. Only a hash of the secret is kept.
+type Token struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Username   string    `json:"username"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+	Hash       string    `json:"hash"`
+	// Groups, CloudInitPasswordHash and SSHKeys are copied from the session
+	// that created the token so VMs created with it match VMs created in
+	// the browser.
+	Groups                []string `json:"groups,omitempty"`
+	CloudInitPasswordHash string   `json:"cloudInitPasswordHash,omitempty"`
+	SSHKeys               []string `json:"sshKeys,omitempty"`
+}
+
+// Allows reports whether the token grants scope.
+func (t Token) Allows(scope string) bool {
+	if scope == ScopeRead {
+		return true
+	}
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// User returns the user the token acts as.
+func (t Token) User() *types.User {
+	return &types.User{
+		Name:                  t.Username,
+		Groups:                append([]string(nil), t.Groups...),
+		CloudInitPasswordHash: t.CloudInitPasswordHash,
+		SSHKeys:               append([]string(nil), t.SSHKeys...),
+	}
+}
+
+// ParseScopes validates scopes and returns them sorted and de-duplicated
+// with ScopeRead always included.
+func ParseScopes(values []string) ([]string, error) {
+	seen := map[string]bool{ScopeRead: true}
+	for _, value := range values {
+		for _, scope := range strings.Split(value, ",") {
+			switch scope = strings.ToLower(strings.TrimSpace(scope)); scope {
+			case "":
+			case ScopeRead, ScopePower, ScopeManage:
+				seen[scope] = true
+			default:
+				return nil, fmt.Errorf("%w %q", ErrInvalidScope, scope)
+			}
+		}
+	}
+	scopes := make([]string, 0, len(seen))
+	for scope := range seen {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes, nil
+}
+
+// Store keeps tokens in a JSON file that is rewritten on every change.
+type Store struct {
+	mu     sync.Mutex
+	file   *jsonfile.Map[Token]
+	tokens map[string]Token
+}
+
+func NewStore(path string) *Store {
+	return &Store{file: jsonfile.NewMap[Token]("api token store", path)}
+}
+
+func (s *Store) load() error {
+	tokens, err := s.file.Load()
+	if err != nil {
+		return err
+	}
+	s.tokens = tokens
+	return nil
+}
+
+func (s *Store) save() error {
+	return s.file.Save(s.tokens)
+}
+
+// Create mints a token for user and returns it in clear text together with
+// the stored record. The clear text token cannot be recovered later.
+func (s *Store) Create(user *types.User, name string, scopes []string, ttl time.Duration, now time.Time) (string, Token, error) {
+	name = strings.TrimSpace(name)
+	if user == nil || jsonfile.UserKey(user.GetName()) == "" || name == "" || len(name) > 64 {
+		return "", Token{}, ErrInvalidName
+	}
+	if ttl <= 0 {
+		return "", Token{}, ErrInvalidTTL
+	}
+	scopes, err := ParseScopes(scopes)
+	if err != nil {
+		return "", Token{}, err
+	}
+	id, err := randomString(idBytes, hex.EncodeToString)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret, err := randomString(secretBytes, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", Token{}, err
+	}
+	token := Token{
+		ID:                    id,
+		Name:                  name,
+		Username:              jsonfile.UserKey(user.GetName()),
+		Scopes:                scopes,
+		CreatedAt:             now.UTC(),
+		ExpiresAt:             now.Add(ttl).UTC(),
+		Hash:                  hashSecret(secret),
+		Groups:                append([]string(nil), user.Groups...),
+		CloudInitPasswordHash: user.CloudInitPasswordHash,
+		SSHKeys:               append([]string(nil), user.SSHKeys...),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", Token{}, err
+	}
+	s.tokens[id] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return "", Token{}, err
+	}
+	return Prefix + id + "_" + secret, token, nil
+}
+
+// Authenticate looks up a clear text token and records its use.
+func (s *Store) Authenticate(raw string, now time.Time) (Token, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(raw), Prefix)
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+	// The id is hex, so the first underscore ends it.
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return Token{}, ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Token{}, err
+	}
+	token, ok := s.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashSecret(secret))) != 1 {
+		return Token{}, ErrInvalidToken
+	}
+	if !now.Before(token.ExpiresAt) {
+		return Token{}, ErrExpired
+	}
+	if now.Sub(token.LastUsedAt) >= lastUsedResolution {
+		token.LastUsedAt = now.UTC()
+		s.tokens[id] = token
+		// Failing to record the last use must not lock the user out.
+		_ = s.save()
+	}
+	return token, nil
+}
+
+// List returns the tokens of username, newest first, including expired ones.
+func (s *Store) List(username string) ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	key := jsonfile.UserKey(username)
+	tokens := []Token{}
+	for _, token := range s.tokens {
+		if token.Username == key {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// Revoke deletes the token id of username. It reports whether one existed.
+func (s *Store) Revoke(username, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	token, ok := s.tokens[id]
+	if !ok || token.Username != jsonfile.UserKey(username) {
+		return false, nil
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = token
+		return false, err
+	}
+	return true, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return encode(buf), nil
+}
@@ -0,0 +1,129 @@
+package apitoken_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/apitoken"
+	"remotegateway/internal/types"
+)
+
+func TestCreateAuthenticateAndRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store := apitoken.NewStore(path)
+	now := time.Unix(1700000000, 0)
+	user := &types.User{Name: "Alice", Groups: []string{"dev"}, CloudInitPasswordHash: "$6$hash", SSHKeys: []string{"ssh-ed25519 AAAA"}}
+
+	raw, created, err := store.Create(user, "ci", []string{"power"}, time.Hour, now)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(raw, apitoken.Prefix) || strings.Contains(created.Hash, raw) {
+		t.Fatalf("unexpected token %q record %+v", raw, created)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected private store file, got %v %v", info, err)
+	}
+	if stored, _ := os.ReadFile(path); strings.Contains(string(stored), strings.TrimPrefix(raw, apitoken.Prefix+created.ID+"_")) {
+		t.Fatalf("expected the secret not to be stored in clear text")
+	}
+
+	token, err := apitoken.NewStore(path).Authenticate(raw, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if token.Username != "alice" || !token.Allows(apitoken.ScopeRead) || !token.Allows(apitoken.ScopePower) || token.Allows(apitoken.ScopeManage) {
+		t.Fatalf("unexpected token %+v", token)
+	}
+	if u := token.User(); u.GetName() != "alice" || u.CloudInitPasswordHash != "$6$hash" || !reflect.DeepEqual(u.Groups, []string{"dev"}) || !reflect.DeepEqual(u.SSHKeys, user.SSHKeys) {
+		t.Fatalf("unexpected token user %+v", u)
+	}
+
+	if _, err := store.Authenticate(raw+"x", now); !errors.Is(err, apitoken.ErrInvalidToken) {
+		t.Fatalf("expected tampered token to fail, got %v", err)
+	}
+	if _, err := store.Authenticate(strings.TrimPrefix(raw, apitoken.Prefix), now); !errors.Is(err, apitoken.ErrInvalidToken) {
+		t.Fatalf("expected token without prefix to fail, got %v", err)
+	}
+	if _, err := store.Authenticate(raw, now.Add(time.Hour)); !errors.Is(err, apitoken.ErrExpired) {
+		t.Fatalf("expected expired token to fail, got %v", err)
+	}
+
+	if ok, err := store.Revoke("bob", created.ID); err != nil || ok {
+		t.Fatalf("expected other users not to revoke the token, got %v %v", ok, err)
+	}
+	if ok, err := store.Revoke("ALICE", created.ID); err != nil || !ok {
+		t.Fatalf("expected revoke to succeed, got %v %v", ok, err)
+	}
+	if _, err := store.Authenticate(raw, now); !errors.Is(err, apitoken.ErrInvalidToken) {
+		t.Fatalf("expected revoked token to fail, got %v", err)
+	}
+}
+
+func TestListIsPerUserAndNewestFirst(t *testing.T) {
+	store := apitoken.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	now := time.Now()
+	for i, name := range []string{"first", "second"} {
+		if _, _, err := store.Create(&types.User{Name: "alice"}, name, nil, time.Hour, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if _, _, err := store.Create(&types.User{Name: "bob"}, "other", nil, time.Hour, now); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	tokens, err := store.List("alice")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(tokens) != 2 || tokens[0].Name != "second" || tokens[1].Name != "first" {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+	if !reflect.DeepEqual(tokens[0].Scopes, []string{apitoken.ScopeRead}) {
+		t.Fatalf("expected read scope by default, got %v", tokens[0].Scopes)
+	}
+}
+
+func TestCreateValidatesInput(t *testing.T) {
+	store := apitoken.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	user := &types.User{Name: "alice"}
+	now := time.Now()
+	if _, _, err := store.Create(user, " ", nil, time.Hour, now); !errors.Is(err, apitoken.ErrInvalidName) {
+		t.Fatalf("expected empty name to fail, got %v", err)
+	}
+	if _, _, err := store.Create(user, "ci", []string{"admin"}, time.Hour, now); !errors.Is(err, apitoken.ErrInvalidScope) {
+		t.Fatalf("expected unknown scope to fail, got %v", err)
+	}
+	if _, _, err := store.Create(user, "ci", nil, 0, now); !errors.Is(err, apitoken.ErrInvalidTTL) {
+		t.Fatalf("expected zero lifetime to fail, got %v", err)
+	}
+	scopes, err := apitoken.ParseScopes([]string{"manage, power", "power"})
+	if err != nil || !reflect.DeepEqual(scopes, []string{"manage", "power", "read"}) {
+		t.Fatalf("unexpected scopes %v %v", scopes, err)
+	}
+}
+
+func TestRevokeFromAnotherStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	server := apitoken.NewStore(path)
+	now := time.Unix(1700000000, 0)
+	raw, created, err := server.Create(&types.User{Name: "alice"}, "ci", nil, time.Hour, now)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := server.Authenticate(raw, now); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if ok, err := apitoken.NewStore(path).Revoke("alice", created.ID); err != nil || !ok {
+		t.Fatalf("expected revoke to succeed, got %v %v", ok, err)
+	}
+	if _, err := server.Authenticate(raw, now); !errors.Is(err, apitoken.ErrInvalidToken) {
+		t.Fatalf("expected the running store to see the revoke, got %v", err)
+	}
+}
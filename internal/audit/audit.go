@@ -0,0 +1,75 @@
+// Package audit appends security relevant events to a JSON lines file.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Event is one audit record. Detail carries action specific fields.
+type Event struct {
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor"`
+	Action string            `json:"action"`
+	Target string            `json:"target,omitempty"`
+	Remote string            `json:"remote,omitempty"`
+	Detail map[string]string `json:"detail,omitempty"`
+}
+
+// Logger appends events to a file opened on first use. With an empty path
+// events only go to the process log.
+type Logger struct {
+	path string
+
+	mu sync.Mutex
+}
+
+func NewLogger(path string) *Logger {
+	return &Logger{path: path}
+}
+
+// Record appends e, filling in the time when unset. Failures are logged and
+// never stop the audited action. A nil Logger discards events.
+func (l *Logger) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	raw, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit: encode %s: %v", e.Action, err)
+		return
+	}
+	if l.path == "" {
+		log.Printf("audit: %s", raw)
+		return
+	}
+	if err := l.append(append(raw, '\n')); err != nil {
+		log.Printf("audit: %v; event %s", err, raw)
+	}
+}
+
+func (l *Logger) append(line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write %s: %w", l.path, err)
+	}
+	return f.Close()
+}
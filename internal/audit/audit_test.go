@@ -0,0 +1,54 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remotegateway/internal/audit"
+)
+
+func TestRecordAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	logger := audit.NewLogger(path)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	logger.Record(audit.Event{Time: at, Actor: "bob", Action: "vm.connect", Target: "alice-vm", Detail: map[string]string{"right": "connect"}})
+	logger.Record(audit.Event{Actor: "bob", Action: "vm.start", Target: "alice-vm"})
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected private audit file, got %v %v", info, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	var events []audit.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("decode %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if !events[0].Time.Equal(at) || events[0].Time.Location() != time.UTC || events[0].Detail["right"] != "connect" {
+		t.Fatalf("unexpected first event %+v", events[0])
+	}
+	if events[1].Time.IsZero() || events[1].Action != "vm.start" {
+		t.Fatalf("unexpected second event %+v", events[1])
+	}
+}
+
+func TestNilLoggerDiscards(t *testing.T) {
+	var logger *audit.Logger
+	logger.Record(audit.Event{Actor: "bob", Action: "vm.connect"})
+}
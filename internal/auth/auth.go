@@ -0,0 +1,163 @@
+// Package auth selects and chains the password backends used for web logins.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/ldap"
+	"remotegateway/internal/localusers"
+	"remotegateway/internal/types"
+)
+
+const (
+	BackendLDAP  = "ldap"
+	BackendLocal = "local"
+)
+
+// Authenticator verifies a username and password and returns the session
+// user with its NTLM hashes.
+type Authenticator interface {
+	Authenticate(username, password string) (*types.User, error)
+}
+
+// LDAP authenticates against the configured directory.
+type LDAP struct {
+	Settings *config.SettingsType
+}
+
+func (a LDAP) Authenticate(username, password string) (*types.User, error) {
+	return ldap.LdapAuthenticateAccess(username, password, a.Settings)
+}
+
+// Local authenticates against the local user database.
+type Local struct {
+	Store  *localusers.Store
+	Domain string
+}
+
+func (a Local) Authenticate(username, password string) (*types.User, error) {
+	return a.Store.Authenticate(username, password, a.Domain)
+}
+
+// HasUser reports whether the local user database has username.
+func (a Local) HasUser(username string) (bool, error) {
+	if _, err := a.Store.Get(username); err != nil {
+		if errors.Is(err, localusers.ErrUserNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Chain tries each backend in order and returns the first success. A user
+// unknown to one backend falls through to the next. If every backend fails,
+// the error of the first backend that knows the user is returned so account
+// state messages are not masked by later backends.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(username, password string) (*types.User, error) {
+	if len(c) == 0 {
+		return nil, errors.New("no authentication backend configured")
+	}
+	var firstErr, knownErr error
+	for _, a := range c {
+		user, err := a.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if knownErr == nil && !errors.Is(err, localusers.ErrUserNotFound) {
+			knownErr = err
+		}
+	}
+	if knownErr != nil {
+		return nil, knownErr
+	}
+	return nil, firstErr
+}
+
+// HasUser reports whether a backend that can be asked without a password,
+// the local user database, has username. The directory is not asked.
+func (c Chain) HasUser(username string) (bool, error) {
+	for _, a := range c {
+		local, ok := a.(Local)
+		if !ok {
+			continue
+		}
+		if found, err := local.HasUser(username); err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// Groups returns the groups of username when it signs in through the local
+// user database. It reports false when a directory backend comes first or
+// no local user has the name, since the directory is not asked without a
+// password.
+func (c Chain) Groups(username string) ([]string, bool, error) {
+	for _, a := range c {
+		local, ok := a.(Local)
+		if !ok {
+			return nil, false, nil
+		}
+		u, err := local.Store.Get(username)
+		if errors.Is(err, localusers.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return u.Groups, true, nil
+	}
+	return nil, false, nil
+}
+
+// Disabled reports whether username is a disabled local user. Directory
+// accounts are not asked without a password and count as enabled.
+func (c Chain) Disabled(username string) (bool, error) {
+	for _, a := range c {
+		local, ok := a.(Local)
+		if !ok {
+			continue
+		}
+		u, err := local.Store.Get(username)
+		if errors.Is(err, localusers.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return u.Disabled, nil
+	}
+	return false, nil
+}
+
+// FromSettings builds the chain listed in AUTH_BACKENDS.
+func FromSettings(settings *config.SettingsType) (Chain, error) {
+	var chain Chain
+	for _, name := range strings.Split(settings.Get(config.AUTH_BACKENDS), ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case BackendLDAP:
+			chain = append(chain, LDAP{Settings: settings})
+		case BackendLocal:
+			chain = append(chain, Local{
+				Store:  localusers.NewStore(settings.Get(config.LOCAL_USERS_PATH)),
+				Domain: settings.Get(config.NTLM_DOMAIN),
+			})
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %q", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("AUTH_BACKENDS lists no authentication backend")
+	}
+	return chain, nil
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/localusers"
+	"remotegateway/internal/types"
+)
+
+type fakeAuth struct {
+	user  string
+	err   error
+	calls *int
+}
+
+func (f fakeAuth) Authenticate(username, password string) (*types.User, error) {
+	if f.calls != nil {
+		*f.calls++
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &types.User{Name: f.user}, nil
+}
+
+func TestChainFallsThroughUnknownUsers(t *testing.T) {
+	calls := 0
+	chain := Chain{
+		fakeAuth{err: localusers.ErrUserNotFound},
+		fakeAuth{user: "alice", calls: &calls},
+		fakeAuth{user: "unused", calls: &calls},
+	}
+	user, err := chain.Authenticate("alice", "pw")
+	if err != nil || user.GetName() != "alice" || calls != 1 {
+		t.Fatalf("expected second backend to answer, got %v %v calls=%d", user, err, calls)
+	}
+}
+
+func TestChainKeepsAccountStateError(t *testing.T) {
+	chain := Chain{
+		fakeAuth{err: localusers.ErrUserNotFound},
+		fakeAuth{err: localusers.ErrDisabled},
+		fakeAuth{err: errors.New("ldap bind failed")},
+	}
+	if _, err := chain.Authenticate("alice", "pw"); !errors.Is(err, localusers.ErrDisabled) {
+		t.Fatalf("expected disabled error, got %v", err)
+	}
+	if _, err := (Chain{fakeAuth{err: localusers.ErrUserNotFound}}).Authenticate("a", "b"); !errors.Is(err, localusers.ErrUserNotFound) {
+		t.Fatalf("expected unknown user, got %v", err)
+	}
+}
+
+func TestChainHasUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := localusers.NewStore(path).Add("alice", "pw", nil, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	chain := Chain{fakeAuth{user: "bob"}, Local{Store: localusers.NewStore(path)}}
+	if found, err := chain.HasUser("Alice"); err != nil || !found {
+		t.Fatalf("expected the local user to be found, got %v %v", found, err)
+	}
+	if found, err := chain.HasUser("bob"); err != nil || found {
+		t.Fatalf("expected other backends not to be asked, got %v %v", found, err)
+	}
+}
+
+func TestChainGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := localusers.NewStore(path).Add("alice", "pw", []string{"ops"}, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	local := Local{Store: localusers.NewStore(path)}
+	if groups, known, err := (Chain{local, fakeAuth{user: "bob"}}).Groups("alice"); err != nil || !known || len(groups) != 1 || groups[0] != "ops" {
+		t.Fatalf("expected the local groups, got %v %v %v", groups, known, err)
+	}
+	if _, known, err := (Chain{local, fakeAuth{user: "bob"}}).Groups("bob"); err != nil || known {
+		t.Fatalf("expected directory users to have unknown groups, got %v %v", known, err)
+	}
+	if _, known, err := (Chain{fakeAuth{user: "alice"}, local}).Groups("alice"); err != nil || known {
+		t.Fatalf("expected a directory ahead of the local users to win, got %v %v", known, err)
+	}
+}
+
+func TestChainDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store := localusers.NewStore(path)
+	if err := store.Add("alice", "pw", nil, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	chain := Chain{fakeAuth{user: "bob"}, Local{Store: localusers.NewStore(path)}}
+	if disabled, err := chain.Disabled("alice"); err != nil || disabled {
+		t.Fatalf("expected alice to be enabled, got %v %v", disabled, err)
+	}
+	if err := store.SetDisabled("alice", true, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if disabled, err := chain.Disabled("alice"); err != nil || !disabled {
+		t.Fatalf("expected alice to be disabled, got %v %v", disabled, err)
+	}
+	if disabled, err := chain.Disabled("bob"); err != nil || disabled {
+		t.Fatalf("expected directory users to count as enabled, got %v %v", disabled, err)
+	}
+}
+
+func TestFromSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := localusers.NewStore(path).Add("alice", "pw", nil, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	t.Setenv(config.AUTH_BACKENDS, " local , ldap")
+	t.Setenv(config.LOCAL_USERS_PATH, path)
+	chain, err := FromSettings(config.NewSettingType(false))
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("expected two backends, got %d err=%v", len(chain), err)
+	}
+	if _, ok := chain[0].(Local); !ok {
+		t.Fatalf("expected local backend first, got %T", chain[0])
+	}
+	if user, err := chain[0].Authenticate("alice", "pw"); err != nil || user.GetName() != "alice" {
+		t.Fatalf("expected local login, got %v %v", user, err)
+	}
+
+	t.Setenv(config.AUTH_BACKENDS, "ldap,kerberos")
+	if _, err := FromSettings(config.NewSettingType(false)); err == nil {
+		t.Fatalf("expected unknown backend to be rejected")
+	}
+	t.Setenv(config.AUTH_BACKENDS, " , ")
+	if _, err := FromSettings(config.NewSettingType(false)); err == nil {
+		t.Fatalf("expected empty backend list to be rejected")
+	}
+}
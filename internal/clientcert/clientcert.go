@@ -0,0 +1,224 @@
+// Package clientcert maps verified TLS client certificates to gateway users.
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"remotegateway/internal/contextKey"
+)
+
+// Modes for the gateway endpoint.
+const (
+	// ModeOff ignores client certificates.
+	ModeOff = "off"
+	// ModeOptional lets a mapped certificate authenticate on its own and
+	// falls back to NTLM without one.
+	ModeOptional = "optional"
+	// ModeFactor requires NTLM and a certificate mapping to the same user.
+	ModeFactor = "factor"
+	// ModeRequired authenticates with the certificate alone and rejects
+	// clients without one.
+	ModeRequired = "required"
+)
+
+// Sources a username can be taken from.
+const (
+	SourceUPN   = "upn"
+	SourceEmail = "email"
+	SourceCN    = "cn"
+	SourceDNS   = "dns"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// oidUPN is the Microsoft user principal name otherName.
+	oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+func ParseMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", ModeOff:
+		return ModeOff, nil
+	case ModeOptional, ModeFactor, ModeRequired:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown client certificate mode %q", value)
+	}
+}
+
+func ParseSources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		switch source = strings.ToLower(strings.TrimSpace(source)); source {
+		case "":
+		case SourceUPN, SourceEmail, SourceCN, SourceDNS:
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("unknown client certificate user source %q", source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no client certificate user source configured")
+	}
+	return sources, nil
+}
+
+// LoadCAPool reads a PEM bundle of CAs allowed to issue client certificates.
+func LoadCAPool(path string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Configure asks clients for a certificate signed by pool. Clients without
+// one can still connect so the web login keeps working; the gateway
+// middleware enforces the mode.
+func Configure(cfg *tls.Config, pool *x509.CertPool) {
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.ClientCAs = pool
+}
+
+// Mapper turns a verified certificate into a username.
+type Mapper struct {
+	Sources []string
+	// Domains are accepted as a UPN or mail suffix and as a down-level
+	// prefix. Names with another domain are skipped, so users of different
+	// domains under the same CA cannot map to the same username.
+	Domains []string
+}
+
+// Identity returns the identity of the verified client certificate on the
+// connection, if any.
+func (m Mapper) Identity(state *tls.ConnectionState) (contextKey.ClientCert, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return contextKey.ClientCert{}, false
+	}
+	cert := state.VerifiedChains[0][0]
+	user := m.username(cert)
+	if user == "" {
+		return contextKey.ClientCert{}, false
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return contextKey.ClientCert{
+		User:        user,
+		Subject:     cert.Subject.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}, true
+}
+
+func (m Mapper) username(cert *x509.Certificate) string {
+	for _, source := range m.Sources {
+		var candidates []string
+		switch source {
+		case SourceUPN:
+			candidates = upns(cert)
+		case SourceEmail:
+			candidates = cert.EmailAddresses
+		case SourceCN:
+			candidates = []string{cert.Subject.CommonName}
+		case SourceDNS:
+			candidates = cert.DNSNames
+		}
+		for _, candidate := range candidates {
+			if user := m.localPart(candidate); user != "" {
+				return user
+			}
+		}
+	}
+	return ""
+}
+
+// localPart strips a mail or UPN domain and a down-level domain prefix. It
+// returns "" when a domain is not one of m.Domains.
+func (m Mapper) localPart(name string) string {
+	name = strings.TrimSpace(name)
+	if idx := strings.LastIndex(name, `\`); idx >= 0 {
+		if !m.knownDomain(name[:idx]) {
+			return ""
+		}
+		name = name[idx+1:]
+	}
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		if !m.knownDomain(name[idx+1:]) {
+			return ""
+		}
+		name = name[:idx]
+	}
+	return name
+}
+
+func (m Mapper) knownDomain(domain string) bool {
+	for _, known := range m.Domains {
+		if known != "" && strings.EqualFold(known, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDomains splits a comma separated list of domains.
+func ParseDomains(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// upns extracts user principal names from the subjectAltName otherName
+// entries, which crypto/x509 does not expose.
+func upns(cert *x509.Certificate) []string {
+	var names []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &seq); err != nil || len(rest) != 0 {
+			continue
+		}
+		rest := seq.Bytes
+		for len(rest) > 0 {
+			var gn asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &gn); err != nil {
+				break
+			}
+			// otherName is [0] IMPLICIT SEQUENCE { type-id, [0] EXPLICIT value }.
+			if gn.Class != asn1.ClassContextSpecific || gn.Tag != 0 {
+				continue
+			}
+			var other struct {
+				ID    asn1.ObjectIdentifier
+				Value asn1.RawValue
+			}
+			if _, err := asn1.UnmarshalWithParams(gn.FullBytes, &other, "tag:0"); err != nil || !other.ID.Equal(oidUPN) {
+				continue
+			}
+			if other.Value.Class != asn1.ClassContextSpecific || other.Value.Tag != 0 {
+				continue
+			}
+			var upn string
+			if _, err := asn1.UnmarshalWithParams(other.Value.Bytes, &upn, "utf8"); err == nil && upn != "" {
+				names = append(names, upn)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,148 @@
+package clientcert_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"remotegateway/internal/clientcert"
+	"remotegateway/internal/clientcert/clientcerttest"
+)
+
+func verifiedState(t *testing.T, ca *clientcerttest.CA, id clientcerttest.Identity) *tls.ConnectionState {
+	t.Helper()
+	cert, err := ca.Issue(id)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	chains, err := cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:     ca.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}, VerifiedChains: chains}
+}
+
+func TestMapperSources(t *testing.T) {
+	ca, err := clientcerttest.NewCA("Device CA")
+	if err != nil {
+		t.Fatalf("ca: %v", err)
+	}
+	id := clientcerttest.Identity{
+		CommonName: "LAPTOP-042",
+		Emails:     []string{"mail.alias@example.com"},
+		UPN:        "alice@corp.example.com",
+	}
+	state := verifiedState(t, ca, id)
+	domains := []string{"CORP.example.com", "example.com"}
+
+	cases := []struct {
+		sources []string
+		want    string
+	}{
+		{[]string{clientcert.SourceUPN, clientcert.SourceCN}, "alice"},
+		{[]string{clientcert.SourceEmail}, "mail.alias"},
+		{[]string{clientcert.SourceCN}, "LAPTOP-042"},
+		{[]string{clientcert.SourceDNS, clientcert.SourceCN}, "LAPTOP-042"},
+	}
+	for _, tc := range cases {
+		got, ok := clientcert.Mapper{Sources: tc.sources, Domains: domains}.Identity(state)
+		if !ok || got.User != tc.want {
+			t.Fatalf("sources %v: got %+v %v, want %q", tc.sources, got, ok, tc.want)
+		}
+		if got.Subject != "CN=LAPTOP-042" || len(got.Fingerprint) != 64 {
+			t.Fatalf("unexpected identity details %+v", got)
+		}
+	}
+
+	if _, ok := (clientcert.Mapper{Sources: []string{clientcert.SourceDNS}}).Identity(state); ok {
+		t.Fatalf("expected no identity without a matching field")
+	}
+	if _, ok := (clientcert.Mapper{Sources: []string{clientcert.SourceUPN}, Domains: []string{"partner.example"}}).Identity(state); ok {
+		t.Fatalf("expected a name from another domain to be rejected")
+	}
+	unverified := &tls.ConnectionState{PeerCertificates: state.PeerCertificates}
+	if _, ok := (clientcert.Mapper{Sources: []string{clientcert.SourceCN}}).Identity(unverified); ok {
+		t.Fatalf("expected unverified certificates to be ignored")
+	}
+}
+
+func TestMapperDomains(t *testing.T) {
+	ca, err := clientcerttest.NewCA("Device CA")
+	if err != nil {
+		t.Fatalf("ca: %v", err)
+	}
+	mapper := clientcert.Mapper{
+		Sources: []string{clientcert.SourceUPN, clientcert.SourceCN},
+		Domains: []string{"corp.example", "CORP"},
+	}
+	cases := []struct {
+		upn  string
+		want string
+		ok   bool
+	}{
+		{"alice@corp.example", "alice", true},
+		{"alice@Corp.Example", "alice", true},
+		{`corp\alice`, "alice", true},
+		{"alice@partner.example", "", false},
+		{`PARTNER\alice`, "", false},
+		{`corp\alice@partner.example`, "", false},
+	}
+	for _, tc := range cases {
+		// Without a CN the UPN is the only candidate.
+		state := verifiedState(t, ca, clientcerttest.Identity{UPN: tc.upn})
+		got, ok := mapper.Identity(state)
+		if ok != tc.ok || got.User != tc.want {
+			t.Fatalf("upn %q: got %+v %v, want %q %v", tc.upn, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// A rejected name falls through to the next source.
+	state := verifiedState(t, ca, clientcerttest.Identity{CommonName: "LAPTOP-7", UPN: "alice@partner.example"})
+	if got, ok := mapper.Identity(state); !ok || got.User != "LAPTOP-7" {
+		t.Fatalf("expected the CN after a rejected UPN, got %+v %v", got, ok)
+	}
+}
+
+func TestParseModeSourcesAndCAPool(t *testing.T) {
+	if mode, err := clientcert.ParseMode(""); err != nil || mode != clientcert.ModeOff {
+		t.Fatalf("expected empty mode to be off, got %q %v", mode, err)
+	}
+	if mode, err := clientcert.ParseMode(" Factor "); err != nil || mode != clientcert.ModeFactor {
+		t.Fatalf("expected factor, got %q %v", mode, err)
+	}
+	if _, err := clientcert.ParseMode("always"); err == nil {
+		t.Fatalf("expected unknown mode to fail")
+	}
+	if domains := clientcert.ParseDomains(" corp.example, ,CORP "); len(domains) != 2 || domains[1] != "CORP" {
+		t.Fatalf("unexpected domains %v", domains)
+	}
+	if sources, err := clientcert.ParseSources("UPN, cn"); err != nil || len(sources) != 2 || sources[0] != "upn" {
+		t.Fatalf("unexpected sources %v %v", sources, err)
+	}
+	if _, err := clientcert.ParseSources("serial"); err == nil {
+		t.Fatalf("expected unknown source to fail")
+	}
+
+	ca, err := clientcerttest.NewCA("Device CA")
+	if err != nil {
+		t.Fatalf("ca: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, ca.PEM(), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := clientcert.LoadCAPool(path); err != nil {
+		t.Fatalf("load pool: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("not pem"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := clientcert.LoadCAPool(path); err == nil {
+		t.Fatalf("expected bundle without certificates to fail")
+	}
+}
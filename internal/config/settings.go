@@ -30,7 +30,74 @@ func NewSettingType(print bool) *SettingsType {
 	s.Set(LDAP_USER_DOMAIN, "LDAP user mail domain", "@example.com")
 	s.Set(LDAP_STARTTLS, "Use StartTLS when connecting to LDAP", "false")
 	s.Set(LDAP_SKIP_TLS_VERIFY, "Skip TLS verification when connecting to LDAP", "true")
+	s.Set(LDAP_MODE, "LDAP directory flavour: glauth or ad (Active Directory)", "glauth")
+	s.Set(LDAP_AD_NETBIOS_DOMAIN, "Active Directory NetBIOS domain used for NTLM (defaults to NTLM_DOMAIN)", "")
+	s.Set(LDAP_AD_NESTED_GROUPS, "Resolve nested Active Directory groups with LDAP_MATCHING_RULE_IN_CHAIN", "true")
+	s.Set(LDAP_SSH_KEY_ATTRIBUTE, "LDAP attribute holding the SSH public keys authorized in new VMs, disabled when empty", "sshPublicKey")
+	s.Set(AUTH_BACKENDS, "Comma separated login backends tried in order: ldap, local", "ldap")
+	s.Set(LOCAL_USERS_PATH, "File holding local users and bcrypt password hashes", "/data/users/users.json")
 	s.Set(NTLM_DOMAIN, "NTLM domain name", "vdi")
+	s.Set(OIDC_ISSUER_URL, "OpenID Connect issuer url, enables single sign-on when set", "")
+	s.Set(OIDC_CLIENT_ID, "OpenID Connect client id", "")
+	s.Set(OIDC_CLIENT_SECRET, "OpenID Connect client secret (optional with PKCE)", "")
+	s.Set(OIDC_REDIRECT_URL, "OpenID Connect redirect url, e.g. https://gw.example.com/login/oidc/callback", "")
+	s.Set(OIDC_SCOPES, "Space separated OpenID Connect scopes", "openid profile email groups")
+	s.Set(OIDC_USERNAME_CLAIM, "ID token claim used as username", "preferred_username")
+	s.Set(OIDC_GROUPS_CLAIM, "ID token claim holding group names", "groups")
+	s.Set(OIDC_ROLE_MAPPING, "Comma separated group=role mapping applied to OpenID Connect groups; unmapped groups are dropped", "")
+	s.Set(OIDC_GROUP_PASSTHROUGH, "Keep OpenID Connect groups without a role mapping under their IdP name (opt-in)", "false")
+	s.Set(MFA_REQUIRED, "Require TOTP enrollment for every web login", "false")
+	s.Set(MFA_ISSUER, "Issuer name shown in authenticator apps", "RemoteGateway")
+	s.Set(MFA_STORE_PATH, "File holding TOTP enrollments and recovery code hashes", "/data/mfa/enrollments.json")
+	s.Set(IDENTITY_STORE_PATH, "File binding each username to the login backend, password or single sign-on, that first used it", "/data/identities/identities.json")
+	s.Set(API_TOKEN_STORE_PATH, "File holding API token hashes", "/data/tokens/tokens.json")
+	s.Set(SSH_KEY_STORE_PATH, "File holding the SSH public keys users add on the dashboard", "/data/sshkeys/keys.json")
+	s.Set(API_TOKEN_MAX_DAYS, "Longest lifetime in days a user may give an API token", "90")
+	s.Set(AUDIT_LOG_PATH, "JSON lines audit log file; empty writes audit events to the process log", "/data/audit/audit.log")
+	s.Set(ADMIN_USERS, "Comma separated usernames allowed to use admin endpoints", "")
+	s.Set(ADMIN_GROUPS, "Comma separated LDAP or local groups whose members are admins", "")
+	s.Set(QUOTA_DEFAULT, "VM quota of every user, e.g. vms=3,vcpu=8,memory=8192,disk=120 (memory in MiB, disk in GB); empty is unlimited", "")
+	s.Set(QUOTA_GROUPS, "Per group quotas, the most generous applies, e.g. staff:vms=5,vcpu=16;contractors:vms=1", "")
+	s.Set(QUOTA_USERS, "Per user quotas replacing the group and default quota, e.g. alice:vms=10", "")
+	s.Set(VM_SIZES, "VM size profiles offered on creation as name:vcpu=N,memory=MiB,disk=GB entries separated by ;", "small:vcpu=2,memory=2048,disk=30;medium:vcpu=4,memory=4096,disk=40;large:vcpu=8,memory=8192,disk=80")
+	s.Set(VM_SIZE_DEFAULT, "VM size profile used when none is chosen; empty picks the first", "medium")
+	s.Set(VM_SIZE_CUSTOM_MAX, "Largest custom VM size, e.g. vcpu=16,memory=32768,disk=200; empty allows only the profiles", "")
+	s.Set(VM_DISK_MODE, "Disk of new VMs: linked for a qcow2 overlay on the template image, copy for a full copy", "linked")
+	s.Set(JOB_STORE_PATH, "File holding VM provisioning jobs so they resume after a restart", "/data/jobs/jobs.json")
+	s.Set(JOB_WORKERS, "Number of VMs provisioned at the same time", "2")
+	s.Set(VM_READY_TIMEOUT_SECONDS, "Seconds a new VM may take to get an address and accept RDP connections", "1800")
+	s.Set(PHONE_HOME_URL, "Gateway URL new VMs report readiness to, e.g. https://192.168.122.1:8443; empty waits for the RDP port instead", "")
+	s.Set(PHONE_HOME_SKIP_TLS_VERIFY, "Let VMs skip verifying the gateway certificate when reporting readiness", "false")
+	s.Set(IDLE_SHUTDOWN_SECONDS, "Seconds a running VM may go without a gateway tunnel and with low CPU before it is shut down, 0 disables", "0")
+	s.Set(IDLE_CPU_PERCENT, "CPU use, in percent of the VM's vCPUs, below which a VM without a tunnel counts as idle", "5")
+	s.Set(IDLE_CHECK_INTERVAL_SECONDS, "Seconds between idle VM checks", "60")
+	s.Set(CLOUD_INIT_DIR, "Directory whose user-data and meta-data templates replace the built-in ones for templates without their own", "")
+	s.Set(CLOUD_INIT_LOCALE, "Locale of new VMs, e.g. en_US.UTF-8; empty keeps the image default", "")
+	s.Set(CLOUD_INIT_KEYBOARD, "Keyboard layout of new VMs, e.g. us; empty keeps the image default", "")
+	s.Set(CLOUD_INIT_TIMEZONE, "Time zone of new VMs, e.g. Europe/Copenhagen; empty keeps the image default", "")
+	s.Set(RADIUS_SERVER, "RADIUS server host:port that must approve gateway connections, disabled when empty", "")
+	s.Set(RADIUS_SECRET, "RADIUS shared secret", "")
+	s.Set(RADIUS_NAS_IDENTIFIER, "NAS-Identifier sent in RADIUS Access-Requests", "remotegateway")
+	s.Set(RADIUS_PASSWORD, "User-Password sent with PAP; MFA appliances often use it to pick the factor", "push")
+	s.Set(RADIUS_CHALLENGE_RESPONSE, "Reply sent to an Access-Challenge, challenges are rejected when empty", "")
+	s.Set(RADIUS_TIMEOUT_SECONDS, "Seconds to wait for a RADIUS decision, keep below the HTTP write timeout", "25")
+	s.Set(RADIUS_APPROVAL_TTL_SECONDS, "Seconds a RADIUS approval is reused for the same user and client IP", "120")
+	s.Set(LOCKOUT_USER_THRESHOLD, "Failed logins per username before a lockout, 0 disables", "5")
+	s.Set(LOCKOUT_IP_THRESHOLD, "Failed logins per client IP before a lockout, 0 disables", "20")
+	s.Set(LOCKOUT_BASE_SECONDS, "First lockout duration in seconds, doubled on each further failure", "30")
+	s.Set(LOCKOUT_MAX_SECONDS, "Maximum lockout duration in seconds", "900")
+	s.Set(LOCKOUT_WINDOW_SECONDS, "Seconds without failures after which counters reset", "900")
+	s.Set(SESSION_STORE_PATH, "File holding web sessions, used when SESSION_ENCRYPTION_KEY is set", "/data/sessions/sessions.db")
+	s.Set(SESSION_ENCRYPTION_KEY, "32 byte key (base64 or hex) encrypting stored sessions, sessions stay in memory when empty", "")
+	s.Set(CLIENT_CERT_MODE, "TLS client certificates for the gateway: off, optional, factor (with NTLM) or required", "off")
+	s.Set(CLIENT_CERT_CA_FILE, "PEM bundle of CAs that issue client certificates", "")
+	s.Set(CLIENT_CERT_USER_SOURCES, "Comma separated certificate fields mapped to the username, tried in order: upn, email, cn, dns", "upn,email,cn")
+	s.Set(CLIENT_CERT_DOMAINS, "Comma separated domains accepted in certificate names, e.g. corp.example.com; the NTLM domain is always accepted and names with other domains are rejected", "")
+	s.Set(GATEWAY_BASIC_AUTH, "Accept HTTP Basic credentials on the gateway over TLS (opt-in)", "false")
+	s.Set(GATEWAY_BASIC_CACHE_SECONDS, "Seconds a verified Basic login is cached", "300")
+	s.Set(REDIRECT_DEFAULT, "Device redirection allowed on gateway tunnels: all, none or a list of clipboard,drive,printer,port,pnp", "none")
+	s.Set(REDIRECT_GROUPS, "Per group redirection, first listed group of the user wins, e.g. contractors=printer;staff=all", "")
+	s.Set(GATEWAY_POLICY_PATH, "YAML or JSON connection policy evaluated for every gateway tunnel; empty disables it", "")
 	s.Set(RDPGW_SEND_BUF, "RD Gateway socket send buffer size (bytes)", "1048576")
 	s.Set(RDPGW_RECV_BUF, "RD Gateway socket receive buffer size (bytes)", "1048576")
 	s.Set(RDPGW_WS_READ_BUF, "RD Gateway websocket read buffer size (bytes)", "65536")
@@ -41,7 +108,11 @@ func NewSettingType(print bool) *SettingsType {
 
 		table.Header("KEY", "Description", "value")
 		for key, setting := range s.m {
-			if err := table.Append([]string{key, setting.Description, setting.Value}); err != nil {
+			value := setting.Value
+			if secretSettings[key] && value != "" {
+				value = "********"
+			}
+			if err := table.Append([]string{key, setting.Description, value}); err != nil {
 				panic(err)
 			}
 		}
@@ -56,6 +127,13 @@ func (s *SettingsType) Get(id string) string {
 	return s.m[id].Value
 }
 
+// secretSettings are masked when the settings table is printed.
+var secretSettings = map[string]bool{
+	OIDC_CLIENT_SECRET:     true,
+	RADIUS_SECRET:          true,
+	SESSION_ENCRYPTION_KEY: true,
+}
+
 func (s *SettingsType) Has(id string) bool {
 	return len(s.m[id].Value) > 0
 }
@@ -78,16 +156,83 @@ const (
 	//LISTEN_ADDR          = "LISTEN_ADDR"
 	ACME_DATA_DIR = "ACME_DATA_DIR"
 	//ACME_CA_DIR          = "ACME_CA_DIR"
-	LDAP_URL             = "LDAP_URL"
-	LDAP_BASE_DN         = "LDAP_BASE_DN"
-	LDAP_USER_FILTER     = "LDAP_USER_FILTER"
-	LDAP_USER_DOMAIN     = "LDAP_USER_DOMAIN"
-	LDAP_STARTTLS        = "LDAP_STARTTLS"
-	LDAP_SKIP_TLS_VERIFY = "LDAP_SKIP_TLS_VERIFY"
-	VDI_IMAGE_DIR        = "VDI_IMAGE_DIR"
-	NTLM_DOMAIN          = "NTLM_DOMAIN"
-	RDPGW_SEND_BUF       = "RDPGW_SEND_BUF"
-	RDPGW_RECV_BUF       = "RDPGW_RECV_BUF"
-	RDPGW_WS_READ_BUF    = "RDPGW_WS_READ_BUF"
-	RDPGW_WS_WRITE_BUF   = "RDPGW_WS_WRITE_BUF"
+	LDAP_URL                    = "LDAP_URL"
+	LDAP_BASE_DN                = "LDAP_BASE_DN"
+	LDAP_USER_FILTER            = "LDAP_USER_FILTER"
+	LDAP_USER_DOMAIN            = "LDAP_USER_DOMAIN"
+	LDAP_STARTTLS               = "LDAP_STARTTLS"
+	LDAP_SKIP_TLS_VERIFY        = "LDAP_SKIP_TLS_VERIFY"
+	LDAP_MODE                   = "LDAP_MODE"
+	LDAP_AD_NETBIOS_DOMAIN      = "LDAP_AD_NETBIOS_DOMAIN"
+	LDAP_AD_NESTED_GROUPS       = "LDAP_AD_NESTED_GROUPS"
+	LDAP_SSH_KEY_ATTRIBUTE      = "LDAP_SSH_KEY_ATTRIBUTE"
+	VDI_IMAGE_DIR               = "VDI_IMAGE_DIR"
+	AUTH_BACKENDS               = "AUTH_BACKENDS"
+	LOCAL_USERS_PATH            = "LOCAL_USERS_PATH"
+	NTLM_DOMAIN                 = "NTLM_DOMAIN"
+	OIDC_ISSUER_URL             = "OIDC_ISSUER_URL"
+	OIDC_CLIENT_ID              = "OIDC_CLIENT_ID"
+	OIDC_CLIENT_SECRET          = "OIDC_CLIENT_SECRET"
+	OIDC_REDIRECT_URL           = "OIDC_REDIRECT_URL"
+	OIDC_SCOPES                 = "OIDC_SCOPES"
+	OIDC_USERNAME_CLAIM         = "OIDC_USERNAME_CLAIM"
+	OIDC_GROUPS_CLAIM           = "OIDC_GROUPS_CLAIM"
+	OIDC_ROLE_MAPPING           = "OIDC_ROLE_MAPPING"
+	OIDC_GROUP_PASSTHROUGH      = "OIDC_GROUP_PASSTHROUGH"
+	MFA_REQUIRED                = "MFA_REQUIRED"
+	MFA_ISSUER                  = "MFA_ISSUER"
+	MFA_STORE_PATH              = "MFA_STORE_PATH"
+	IDENTITY_STORE_PATH         = "IDENTITY_STORE_PATH"
+	API_TOKEN_STORE_PATH        = "API_TOKEN_STORE_PATH"
+	SSH_KEY_STORE_PATH          = "SSH_KEY_STORE_PATH"
+	API_TOKEN_MAX_DAYS          = "API_TOKEN_MAX_DAYS"
+	AUDIT_LOG_PATH              = "AUDIT_LOG_PATH"
+	ADMIN_USERS                 = "ADMIN_USERS"
+	ADMIN_GROUPS                = "ADMIN_GROUPS"
+	QUOTA_DEFAULT               = "QUOTA_DEFAULT"
+	QUOTA_GROUPS                = "QUOTA_GROUPS"
+	QUOTA_USERS                 = "QUOTA_USERS"
+	VM_SIZES                    = "VM_SIZES"
+	VM_SIZE_DEFAULT             = "VM_SIZE_DEFAULT"
+	VM_SIZE_CUSTOM_MAX          = "VM_SIZE_CUSTOM_MAX"
+	VM_DISK_MODE                = "VM_DISK_MODE"
+	JOB_STORE_PATH              = "JOB_STORE_PATH"
+	JOB_WORKERS                 = "JOB_WORKERS"
+	VM_READY_TIMEOUT_SECONDS    = "VM_READY_TIMEOUT_SECONDS"
+	PHONE_HOME_URL              = "PHONE_HOME_URL"
+	PHONE_HOME_SKIP_TLS_VERIFY  = "PHONE_HOME_SKIP_TLS_VERIFY"
+	IDLE_SHUTDOWN_SECONDS       = "IDLE_SHUTDOWN_SECONDS"
+	IDLE_CPU_PERCENT            = "IDLE_CPU_PERCENT"
+	IDLE_CHECK_INTERVAL_SECONDS = "IDLE_CHECK_INTERVAL_SECONDS"
+	CLOUD_INIT_DIR              = "CLOUD_INIT_DIR"
+	CLOUD_INIT_LOCALE           = "CLOUD_INIT_LOCALE"
+	CLOUD_INIT_KEYBOARD         = "CLOUD_INIT_KEYBOARD"
+	CLOUD_INIT_TIMEZONE         = "CLOUD_INIT_TIMEZONE"
+	RADIUS_SERVER               = "RADIUS_SERVER"
+	RADIUS_SECRET               = "RADIUS_SECRET"
+	RADIUS_NAS_IDENTIFIER       = "RADIUS_NAS_IDENTIFIER"
+	RADIUS_PASSWORD             = "RADIUS_PASSWORD"
+	RADIUS_CHALLENGE_RESPONSE   = "RADIUS_CHALLENGE_RESPONSE"
+	RADIUS_TIMEOUT_SECONDS      = "RADIUS_TIMEOUT_SECONDS"
+	RADIUS_APPROVAL_TTL_SECONDS = "RADIUS_APPROVAL_TTL_SECONDS"
+	LOCKOUT_USER_THRESHOLD      = "LOCKOUT_USER_THRESHOLD"
+	LOCKOUT_IP_THRESHOLD        = "LOCKOUT_IP_THRESHOLD"
+	LOCKOUT_BASE_SECONDS        = "LOCKOUT_BASE_SECONDS"
+	LOCKOUT_MAX_SECONDS         = "LOCKOUT_MAX_SECONDS"
+	LOCKOUT_WINDOW_SECONDS      = "LOCKOUT_WINDOW_SECONDS"
+	SESSION_STORE_PATH          = "SESSION_STORE_PATH"
+	SESSION_ENCRYPTION_KEY      = "SESSION_ENCRYPTION_KEY"
+	CLIENT_CERT_MODE            = "CLIENT_CERT_MODE"
+	CLIENT_CERT_CA_FILE         = "CLIENT_CERT_CA_FILE"
+	CLIENT_CERT_USER_SOURCES    = "CLIENT_CERT_USER_SOURCES"
+	CLIENT_CERT_DOMAINS         = "CLIENT_CERT_DOMAINS"
+	GATEWAY_BASIC_AUTH          = "GATEWAY_BASIC_AUTH"
+	GATEWAY_BASIC_CACHE_SECONDS = "GATEWAY_BASIC_CACHE_SECONDS"
+	REDIRECT_DEFAULT            = "REDIRECT_DEFAULT"
+	REDIRECT_GROUPS             = "REDIRECT_GROUPS"
+	GATEWAY_POLICY_PATH         = "GATEWAY_POLICY_PATH"
+	RDPGW_SEND_BUF              = "RDPGW_SEND_BUF"
+	RDPGW_RECV_BUF              = "RDPGW_RECV_BUF"
+	RDPGW_WS_READ_BUF           = "RDPGW_WS_READ_BUF"
+	RDPGW_WS_WRITE_BUF          = "RDPGW_WS_WRITE_BUF"
 )
@@ -17,3 +17,21 @@ func AuthUserFromContext(ctx context.Context) (string, bool) {
 	}
 	return user, true
 }
+
+const authGroupsKey contextKey = "authGroups"
+
+// WithAuthGroups records the groups of the authenticated user. Only call it
+// when the groups are known; a user in no group has an empty list.
+func WithAuthGroups(ctx context.Context, groups []string) context.Context {
+	if groups == nil {
+		groups = []string{}
+	}
+	return context.WithValue(ctx, authGroupsKey, groups)
+}
+
+// AuthGroupsFromContext returns the groups of the authenticated user and
+// whether they are known. Group rules must fail closed when they are not.
+func AuthGroupsFromContext(ctx context.Context) ([]string, bool) {
+	groups, ok := ctx.Value(authGroupsKey).([]string)
+	return groups, ok
+}
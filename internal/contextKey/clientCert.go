@@ -0,0 +1,24 @@
+package contextKey
+
+import "context"
+
+const clientCertKey contextKey = "clientCert"
+
+// ClientCert is the identity taken from a verified TLS client certificate.
+type ClientCert struct {
+	User        string
+	Subject     string
+	Fingerprint string
+}
+
+func WithClientCert(ctx context.Context, cert ClientCert) context.Context {
+	return context.WithValue(ctx, clientCertKey, cert)
+}
+
+func ClientCertFromContext(ctx context.Context) (ClientCert, bool) {
+	cert, ok := ctx.Value(clientCertKey).(ClientCert)
+	if !ok || cert.User == "" {
+		return ClientCert{}, false
+	}
+	return cert, true
+}
@@ -0,0 +1,128 @@
+// Package identity binds each username to the login backend that first
+// used it, so a single sign-on account cannot take over the VMs, grants and
+// tokens of a directory or local user of the same name, or of another
+// single sign-on account.
+package identity
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"remotegateway/internal/jsonfile"
+)
+
+// Backends a username can be bound to. Directory and local users share the
+// password backend; auth.Chain already gives them one namespace.
+const (
+	BackendPassword = "password"
+	BackendOIDC     = "oidc"
+)
+
+var (
+	ErrInvalidUsername = errors.New("identity: invalid username")
+	ErrConflict        = errors.New("identity: username belongs to another account")
+)
+
+type Binding struct {
+	Backend string `json:"backend"`
+	// Subject identifies the account within the backend: issuer and sub
+	// for single sign-on, empty for password logins.
+	Subject string    `json:"subject,omitempty"`
+	BoundAt time.Time `json:"boundAt"`
+}
+
+// Store keeps bindings in a JSON file that is rewritten when a username is
+// bound or released. Releases made with the CLI apply to a running server.
+type Store struct {
+	mu       sync.Mutex
+	file     *jsonfile.Map[Binding]
+	bindings map[string]Binding
+}
+
+func NewStore(path string) *Store {
+	return &Store{file: jsonfile.NewMap[Binding]("identity store", path)}
+}
+
+// ValidUsername reports whether username may name a gateway user: lower
+// case letters, digits, '.', '_' and '-', at most 64 characters.
+func ValidUsername(username string) bool {
+	if username == "" || len(username) > 64 {
+		return false
+	}
+	for _, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// OIDCSubject is the subject single sign-on accounts are bound with.
+func OIDCSubject(issuer, sub string) string {
+	return strings.TrimRight(strings.TrimSpace(issuer), "/") + "#" + sub
+}
+
+func (s *Store) load() error {
+	bindings, err := s.file.Load()
+	if err != nil {
+		return err
+	}
+	s.bindings = bindings
+	return nil
+}
+
+func (s *Store) save() error {
+	return s.file.Save(s.bindings)
+}
+
+// Bind records that username signs in with backend as subject. It fails
+// with ErrConflict when the username is already bound to another backend or
+// subject.
+func (s *Store) Bind(username, backend, subject string, now time.Time) error {
+	key := jsonfile.UserKey(username)
+	if key == "" {
+		return ErrInvalidUsername
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if existing, ok := s.bindings[key]; ok {
+		if existing.Backend != backend || existing.Subject != subject {
+			return ErrConflict
+		}
+		return nil
+	}
+	s.bindings[key] = Binding{Backend: backend, Subject: subject, BoundAt: now.UTC()}
+	if err := s.save(); err != nil {
+		delete(s.bindings, key)
+		return err
+	}
+	return nil
+}
+
+// Release removes the binding of username so another account can use the
+// name. It reports whether there was one.
+func (s *Store) Release(username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	key := jsonfile.UserKey(username)
+	binding, ok := s.bindings[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.bindings, key)
+	if err := s.save(); err != nil {
+		s.bindings[key] = binding
+		return false, err
+	}
+	return true, nil
+}
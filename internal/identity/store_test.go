@@ -0,0 +1,76 @@
+package identity
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	store := NewStore(path)
+	now := time.Now()
+	subject := OIDCSubject("https://idp.example.com/", "123")
+	if subject != "https://idp.example.com#123" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+
+	if err := store.Bind("Alice", BackendOIDC, subject, now); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if err := store.Bind("alice", BackendOIDC, subject, now); err != nil {
+		t.Fatalf("expected the same account to bind again, got %v", err)
+	}
+	if err := store.Bind("alice", BackendOIDC, OIDCSubject("https://idp.example.com", "456"), now); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected another subject to conflict, got %v", err)
+	}
+	if err := NewStore(path).Bind("alice", BackendPassword, "", now); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a password login to conflict after reload, got %v", err)
+	}
+
+	if released, err := store.Release("alice"); err != nil || !released {
+		t.Fatalf("release: %v %v", released, err)
+	}
+	if err := store.Bind("alice", BackendPassword, "", now); err != nil {
+		t.Fatalf("expected a released name to bind, got %v", err)
+	}
+}
+
+func TestReleaseFromAnotherStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	server := NewStore(path)
+	now := time.Now()
+	subject := OIDCSubject("https://idp.example.com", "123")
+	if err := server.Bind("alice", BackendOIDC, subject, now); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+
+	// The CLI releases the name from another process.
+	if released, err := NewStore(path).Release("alice"); err != nil || !released {
+		t.Fatalf("release: %v %v", released, err)
+	}
+	// A later binding must not write the released one back.
+	if err := server.Bind("bob", BackendPassword, "", now); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if err := NewStore(path).Bind("alice", BackendPassword, "", now); err != nil {
+		t.Fatalf("expected the release to last, got %v", err)
+	}
+	if err := server.Bind("alice", BackendOIDC, subject, now); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected the running store to see the new binding, got %v", err)
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	for _, name := range []string{"alice", "a.b-c_d", "user42"} {
+		if !ValidUsername(name) {
+			t.Errorf("expected %q to be valid", name)
+		}
+	}
+	for _, name := range []string{"", "Alice", "eve admin", "bob@example.com", `vdi\bob`, "x\n"} {
+		if ValidUsername(name) {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+}
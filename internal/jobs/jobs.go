@@ -0,0 +1,427 @@
+// Package jobs provisions VMs in the background with a bounded worker pool.
+// Jobs are kept in a JSON file so queued and interrupted jobs resume after a
+// restart.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remotegateway/internal/jsonfile"
+	"remotegateway/internal/vmsize"
+)
+
+// Job and step states.
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCanceled  = "canceled"
+)
+
+// retention is how long finished jobs are kept.
+const retention = 7 * 24 * time.Hour
+
+// cleanupTimeout bounds each Cleanup of a canceled or failed job.
+const cleanupTimeout = 5 * time.Minute
+
+var (
+	ErrNotFound  = errors.New("jobs: job not found")
+	ErrFinished  = errors.New("jobs: job already finished")
+	ErrBusy      = errors.New("jobs: vm already has an active job")
+	ErrQueueFull = errors.New("jobs: too many queued jobs")
+)
+
+// Spec is what a job creates. CloudInitPasswordHash is copied from the
+// session that submitted the job so a resumed job builds the same VM.
+type Spec struct {
+	Owner                 string      `json:"owner"`
+	Groups                []string    `json:"groups,omitempty"`
+	CloudInitPasswordHash string      `json:"cloudInitPasswordHash,omitempty"`
+	SSHKeys               []string    `json:"sshKeys,omitempty"`
+	Name                  string      `json:"name"`
+	VMName                string      `json:"vmName"`
+	Template              string      `json:"template"`
+	Size                  vmsize.Size `json:"size"`
+}
+
+// Step is the progress of one step of a job.
+type Step struct {
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Job is a stored job.
+type Job struct {
+	ID         string    `json:"id"`
+	Spec       Spec      `json:"spec"`
+	State      string    `json:"state"`
+	Steps      []Step    `json:"steps"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	// Attempts counts the runs of the job, more than one after a restart.
+	Attempts int `json:"attempts"`
+}
+
+// Active reports whether the job is queued or running.
+func (j Job) Active() bool {
+	return j.State == StateQueued || j.State == StateRunning
+}
+
+// StepFunc is one step of a job.
+type StepFunc struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Cleanup, when set, removes what the job built. It runs when the job
+	// is canceled or fails at this step or a later one, before the job is
+	// finished, latest step first.
+	Cleanup func(ctx context.Context) error
+}
+
+// Runner returns the steps of a job. A job resumed after a restart runs
+// every step again, so steps must cope with what an earlier run left.
+type Runner func(Job) []StepFunc
+
+// Manager queues jobs and runs them on a fixed number of workers.
+type Manager struct {
+	path    string
+	runner  Runner
+	workers int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+	queue   chan string
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// Open loads the jobs at path. Jobs that were queued or running when the
+// process stopped are queued again when Start is called.
+func Open(path string, workers, queueSize int, runner Runner) (*Manager, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	m := &Manager{
+		path:    path,
+		runner:  runner,
+		workers: workers,
+		now:     time.Now,
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+	}
+	if err := jsonfile.Read(path, &m.jobs); err != nil {
+		return nil, fmt.Errorf("job store %s: %w", path, err)
+	}
+	var resumed []*Job
+	for _, job := range m.jobs {
+		if job.Active() {
+			resumed = append(resumed, job)
+		}
+	}
+	if len(resumed) > queueSize {
+		queueSize = len(resumed)
+	}
+	m.queue = make(chan string, queueSize)
+	sort.Slice(resumed, func(i, j int) bool { return resumed[i].CreatedAt.Before(resumed[j].CreatedAt) })
+	for _, job := range resumed {
+		job.State = StateQueued
+		resetSteps(job)
+		m.queue <- job.ID
+		log.Printf("job %s for %s queued again after restart", job.ID, job.Spec.VMName)
+	}
+	return m, nil
+}
+
+func resetSteps(job *Job) {
+	for i := range job.Steps {
+		job.Steps[i] = Step{Name: job.Steps[i].Name, State: StateQueued}
+	}
+	job.Error = ""
+}
+
+// Start runs the workers until ctx ends or Close is called.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx, m.stop = context.WithCancel(ctx)
+	m.mu.Unlock()
+	for i := 0; i < m.workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+}
+
+// Close stops the workers. Running jobs are interrupted and resume on the
+// next Open.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	stop := m.stop
+	m.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	m.wg.Wait()
+}
+
+func (m *Manager) save() error {
+	cutoff := m.now().Add(-retention)
+	for id, job := range m.jobs {
+		if !job.Active() && job.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+	return jsonfile.Write(m.path, m.jobs)
+}
+
+// saveLocked persists the jobs after a state change made while running. A
+// failed write only costs the resume after a restart.
+func (m *Manager) saveLocked() {
+	if err := m.save(); err != nil {
+		log.Printf("save jobs: %v", err)
+	}
+}
+
+// Submit queues a job creating spec. It fails with ErrBusy while another
+// job for the same VM is active.
+func (m *Manager) Submit(spec Spec) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	now := m.now().UTC()
+	job := &Job{ID: id, Spec: spec, State: StateQueued, CreatedAt: now, UpdatedAt: now}
+	for _, step := range m.runner(*job) {
+		job.Steps = append(job.Steps, Step{Name: step.Name, State: StateQueued})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.jobs {
+		if other.Active() && strings.EqualFold(other.Spec.VMName, spec.VMName) {
+			return Job{}, ErrBusy
+		}
+	}
+	if len(m.queue) == cap(m.queue) {
+		return Job{}, ErrQueueFull
+	}
+	m.jobs[id] = job
+	if err := m.save(); err != nil {
+		delete(m.jobs, id)
+		return Job{}, err
+	}
+	m.queue <- id
+	return copyJob(job), nil
+}
+
+// Get returns the job id.
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return copyJob(job), true
+}
+
+// List returns the jobs of owner, or every job when owner is empty, newest
+// first.
+func (m *Manager) List(owner string) []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := []Job{}
+	for _, job := range m.jobs {
+		if owner == "" || strings.EqualFold(job.Spec.Owner, owner) {
+			jobs = append(jobs, copyJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// Cancel stops the job id. A queued job is dropped; a running job is
+// interrupted at its current step.
+func (m *Manager) Cancel(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	if !job.Active() {
+		return copyJob(job), ErrFinished
+	}
+	if cancel, running := m.cancels[id]; running {
+		// The worker records the cancellation when the step returns.
+		cancel()
+		return copyJob(job), nil
+	}
+	m.finish(job, StateCanceled, "canceled")
+	m.saveLocked()
+	return copyJob(job), nil
+}
+
+// finish ends job in state. Steps that never ran are marked canceled.
+func (m *Manager) finish(job *Job, state, message string) {
+	now := m.now().UTC()
+	job.State = state
+	job.Error = message
+	job.UpdatedAt = now
+	job.FinishedAt = now
+	for i := range job.Steps {
+		if job.Steps[i].State == StateQueued {
+			job.Steps[i].State = StateCanceled
+		}
+	}
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case id := <-m.queue:
+			m.run(id)
+		}
+	}
+}
+
+func (m *Manager) run(id string) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok || job.State != StateQueued {
+		// Canceled while queued.
+		m.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	m.cancels[id] = cancel
+	job.State = StateRunning
+	job.Attempts++
+	job.UpdatedAt = m.now().UTC()
+	steps := m.runner(copyJob(job))
+	m.saveLocked()
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.cancels, id)
+		m.mu.Unlock()
+	}()
+
+	for i, step := range steps {
+		m.mu.Lock()
+		if i < len(job.Steps) {
+			job.Steps[i].State = StateRunning
+			job.Steps[i].StartedAt = m.now().UTC()
+		}
+		job.UpdatedAt = m.now().UTC()
+		m.saveLocked()
+		m.mu.Unlock()
+
+		err := step.Run(ctx)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		m.mu.Lock()
+		if err != nil && m.ctx.Err() != nil {
+			// Shutting down: the stored job is still running, so the next
+			// Open queues it again.
+			log.Printf("job %s for %s interrupted at %s", id, job.Spec.VMName, step.Name)
+			m.mu.Unlock()
+			return
+		}
+		state := StateSucceeded
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			state = StateCanceled
+		default:
+			state = StateFailed
+		}
+		if i < len(job.Steps) {
+			job.Steps[i].FinishedAt = m.now().UTC()
+			job.Steps[i].State = state
+			if state == StateFailed {
+				job.Steps[i].Error = err.Error()
+			}
+		}
+		if err != nil {
+			vmName := job.Spec.VMName
+			m.mu.Unlock()
+			m.cleanup(id, vmName, steps[:i+1])
+			m.mu.Lock()
+			if state == StateCanceled {
+				m.finish(job, StateCanceled, "canceled")
+			} else {
+				m.finish(job, StateFailed, fmt.Sprintf("%s: %v", step.Name, err))
+			}
+			log.Printf("job %s for %s %s at %s: %v", id, job.Spec.VMName, job.State, step.Name, err)
+			m.saveLocked()
+			m.mu.Unlock()
+			return
+		}
+		m.saveLocked()
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	m.finish(job, StateSucceeded, "")
+	log.Printf("job %s for %s succeeded", id, job.Spec.VMName)
+	m.saveLocked()
+	m.mu.Unlock()
+}
+
+// cleanup runs the Cleanup of steps, latest first. The job context is done
+// by now, so each gets its own.
+func (m *Manager) cleanup(id, vmName string, steps []StepFunc) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].Cleanup == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		err := steps[i].Cleanup(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("job %s for %s: clean up after %s: %v", id, vmName, steps[i].Name, err)
+		}
+	}
+}
+
+func copyJob(job *Job) Job {
+	c := *job
+	c.Steps = append([]Step(nil), job.Steps...)
+	c.Spec.Groups = append([]string(nil), job.Spec.Groups...)
+	return c
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
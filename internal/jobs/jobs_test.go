@@ -0,0 +1,226 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"remotegateway/internal/jobs"
+)
+
+// fakeRunner runs two steps; the second blocks on block when it is set.
+// The first counts its cleanups in cleaned.
+type fakeRunner struct {
+	fail    error
+	block   chan struct{}
+	started chan string
+	cleaned atomic.Int32
+}
+
+func (f *fakeRunner) steps(job jobs.Job) []jobs.StepFunc {
+	return []jobs.StepFunc{
+		{Name: "first", Run: func(context.Context) error { return nil }, Cleanup: func(ctx context.Context) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			f.cleaned.Add(1)
+			return nil
+		}},
+		{Name: "second", Run: func(ctx context.Context) error {
+			if f.started != nil {
+				f.started <- job.ID
+			}
+			if f.block != nil {
+				select {
+				case <-f.block:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return f.fail
+		}},
+	}
+}
+
+func waitFor(t *testing.T, m *jobs.Manager, id string, state string) jobs.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, ok := m.Get(id)
+		if ok && job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s: want state %s, got %+v", id, state, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobRunsSteps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs", "jobs.json")
+	runner := &fakeRunner{}
+	m, err := jobs.Open(path, 1, 4, runner.steps)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	m.Start(context.Background())
+	defer m.Close()
+
+	job, err := m.Submit(jobs.Spec{Owner: "alice", Name: "dev", VMName: "alice-dev", CloudInitPasswordHash: "$6$hash"})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if len(job.Steps) != 2 || job.Steps[0].Name != "first" || job.State != jobs.StateQueued {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	done := waitFor(t, m, job.ID, jobs.StateSucceeded)
+	for _, step := range done.Steps {
+		if step.State != jobs.StateSucceeded || step.FinishedAt.IsZero() {
+			t.Fatalf("unexpected step %+v", step)
+		}
+	}
+	if done.Attempts != 1 || done.FinishedAt.IsZero() {
+		t.Fatalf("unexpected finished job %+v", done)
+	}
+	if n := runner.cleaned.Load(); n != 0 {
+		t.Fatalf("expected a succeeded job to keep its VM, got %d cleanups", n)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected private store file, got %v %v", info, err)
+	}
+	if got := m.List("ALICE"); len(got) != 1 || got[0].ID != job.ID {
+		t.Fatalf("unexpected jobs of alice %+v", got)
+	}
+	if got := m.List("bob"); len(got) != 0 {
+		t.Fatalf("expected no jobs of bob, got %+v", got)
+	}
+}
+
+func TestJobFailureStopsSteps(t *testing.T) {
+	runner := &fakeRunner{fail: errors.New("no address")}
+	m, err := jobs.Open(filepath.Join(t.TempDir(), "jobs.json"), 1, 4, runner.steps)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	m.Start(context.Background())
+	defer m.Close()
+
+	job, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-dev"})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	failed := waitFor(t, m, job.ID, jobs.StateFailed)
+	if failed.Error != "second: no address" || failed.Steps[1].State != jobs.StateFailed || failed.Steps[1].Error != "no address" {
+		t.Fatalf("unexpected failed job %+v", failed)
+	}
+	if n := runner.cleaned.Load(); n != 1 {
+		t.Fatalf("expected the failed job to be cleaned up once, got %d", n)
+	}
+}
+
+func TestSubmitRejectsBusyVM(t *testing.T) {
+	runner := &fakeRunner{block: make(chan struct{}), started: make(chan string, 1)}
+	m, err := jobs.Open(filepath.Join(t.TempDir(), "jobs.json"), 1, 1, runner.steps)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	m.Start(context.Background())
+	defer m.Close()
+	defer close(runner.block)
+
+	if _, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-dev"}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	<-runner.started
+	if _, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "Alice-Dev"}); !errors.Is(err, jobs.ErrBusy) {
+		t.Fatalf("expected busy error, got %v", err)
+	}
+	if _, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-web"}); err != nil {
+		t.Fatalf("submit queued job: %v", err)
+	}
+	if _, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-db"}); !errors.Is(err, jobs.ErrQueueFull) {
+		t.Fatalf("expected full queue, got %v", err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	runner := &fakeRunner{block: make(chan struct{}), started: make(chan string, 1)}
+	m, err := jobs.Open(filepath.Join(t.TempDir(), "jobs.json"), 1, 4, runner.steps)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	m.Start(context.Background())
+	defer m.Close()
+
+	running, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-dev"})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	<-runner.started
+	queued, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-web"})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+
+	if job, err := m.Cancel(queued.ID); err != nil || job.State != jobs.StateCanceled {
+		t.Fatalf("cancel queued job: %+v %v", job, err)
+	}
+	if _, err := m.Cancel(running.ID); err != nil {
+		t.Fatalf("cancel running job: %v", err)
+	}
+	canceled := waitFor(t, m, running.ID, jobs.StateCanceled)
+	if canceled.Steps[0].State != jobs.StateSucceeded || canceled.Steps[1].State != jobs.StateCanceled {
+		t.Fatalf("unexpected steps %+v", canceled.Steps)
+	}
+	// Only the running job built anything; it is cleaned up before it is
+	// reported canceled.
+	if n := runner.cleaned.Load(); n != 1 {
+		t.Fatalf("expected one cleanup, got %d", n)
+	}
+	if _, err := m.Cancel(running.ID); !errors.Is(err, jobs.ErrFinished) {
+		t.Fatalf("expected finished error, got %v", err)
+	}
+	if _, err := m.Cancel("missing"); !errors.Is(err, jobs.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestInterruptedJobResumesAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	runner := &fakeRunner{block: make(chan struct{}), started: make(chan string, 1)}
+	m, err := jobs.Open(path, 1, 4, runner.steps)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	m.Start(context.Background())
+	job, err := m.Submit(jobs.Spec{Owner: "alice", VMName: "alice-dev"})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	<-runner.started
+	m.Close()
+	if n := runner.cleaned.Load(); n != 0 {
+		t.Fatalf("expected an interrupted job to keep what it built for the resume, got %d cleanups", n)
+	}
+
+	runner = &fakeRunner{}
+	m, err = jobs.Open(path, 1, 4, runner.steps)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if resumed, ok := m.Get(job.ID); !ok || resumed.State != jobs.StateQueued {
+		t.Fatalf("expected job queued again, got %+v", resumed)
+	}
+	m.Start(context.Background())
+	defer m.Close()
+	if done := waitFor(t, m, job.ID, jobs.StateSucceeded); done.Attempts != 2 {
+		t.Fatalf("expected a second attempt, got %+v", done)
+	}
+}
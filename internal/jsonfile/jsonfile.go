@@ -0,0 +1,105 @@
+// Package jsonfile keeps small JSON stores on disk. Files are replaced
+// atomically and reloaded when they change, so edits made with the CLI apply
+// to a running server.
+package jsonfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UserKey is the key users are stored under.
+func UserKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Read decodes the file at path into v. A missing file leaves v alone.
+func Read(path string, v any) error {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Write replaces the file at path with v. The file is only readable by its
+// owner.
+func Write(path string, v any) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Map is a JSON object of V values stored at a path. It does no locking;
+// callers serialize Load and Save.
+type Map[V any] struct {
+	name string
+	path string
+
+	modTime time.Time
+	size    int64
+	values  map[string]V
+}
+
+// NewMap returns the store at path. name is used in errors, e.g. "mfa store".
+func NewMap[V any](name, path string) *Map[V] {
+	return &Map[V]{name: name, path: path}
+}
+
+// Load returns the values, read again when the file changed on disk since
+// the last Load or Save. Changes to the returned map are kept until the next
+// reload; Save them to make them last.
+func (m *Map[V]) Load() (map[string]V, error) {
+	info, err := os.Stat(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if m.values == nil || !m.modTime.IsZero() {
+			m.values = make(map[string]V)
+		}
+		m.modTime, m.size = time.Time{}, 0
+		return m.values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.values != nil && info.ModTime().Equal(m.modTime) && info.Size() == m.size {
+		return m.values, nil
+	}
+	values := make(map[string]V)
+	if err := Read(m.path, &values); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", m.name, m.path, err)
+	}
+	m.values = values
+	m.modTime, m.size = info.ModTime(), info.Size()
+	return m.values, nil
+}
+
+// Save writes values to the file and keeps them as the loaded values.
+func (m *Map[V]) Save(values map[string]V) error {
+	if err := Write(m.path, values); err != nil {
+		return err
+	}
+	m.values = values
+	if info, err := os.Stat(m.path); err == nil {
+		m.modTime, m.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package jsonfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remotegateway/internal/jsonfile"
+)
+
+func TestMapReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "values.json")
+	server := jsonfile.NewMap[int]("test store", path)
+	values, err := server.Load()
+	if err != nil || len(values) != 0 {
+		t.Fatalf("expected an empty store, got %v %v", values, err)
+	}
+	values["alice"] = 1
+	values["bob"] = 2
+	if err := server.Save(values); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a file only its owner can read, got %v %v", info, err)
+	}
+
+	// Another process, e.g. the CLI, removes a value.
+	cli := jsonfile.NewMap[int]("test store", path)
+	other, err := cli.Load()
+	if err != nil || other["bob"] != 2 {
+		t.Fatalf("expected the saved values, got %v %v", other, err)
+	}
+	delete(other, "bob")
+	if err := cli.Save(other); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	values, err = server.Load()
+	if err != nil || len(values) != 1 || values["alice"] != 1 {
+		t.Fatalf("expected the change on disk to be loaded, got %v %v", values, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if values, err = server.Load(); err != nil || len(values) != 0 {
+		t.Fatalf("expected a removed file to empty the store, got %v %v", values, err)
+	}
+}
+
+func TestMapReportsBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.json")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := jsonfile.NewMap[int]("test store", path).Load(); err == nil {
+		t.Fatalf("expected an error for a broken file")
+	}
+}
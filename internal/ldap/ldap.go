@@ -2,16 +2,47 @@ package ldap
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"remotegateway/internal/config"
+	"remotegateway/internal/sshkeys"
 	"remotegateway/internal/types"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 )
 
+const (
+	ModeGlauth = "glauth"
+	ModeAD     = "ad"
+)
+
+var (
+	ErrAccountDisabled = errors.New("account is disabled")
+	ErrAccountLocked   = errors.New("account is locked out")
+	ErrAccountExpired  = errors.New("account has expired")
+	ErrPasswordExpired = errors.New("password has expired")
+)
+
+// Active Directory userAccountControl flags, see MS-ADTS 2.2.16.
+const (
+	uacAccountDisable  = 0x2
+	uacLockout         = 0x10
+	uacPasswordExpired = 0x800000
+)
+
+// matchingRuleInChain is LDAP_MATCHING_RULE_IN_CHAIN, used to resolve
+// nested group membership on the directory server.
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
 func LdapAuthenticateAccess(username, password string, settings *config.SettingsType) (*types.User, error) {
+	if strings.EqualFold(strings.TrimSpace(settings.Get(config.LDAP_MODE)), ModeAD) {
+		return adAuthenticateAccess(username, password, settings)
+	}
+
 	conn, err := dialLDAP(settings)
 	if err != nil {
 		return nil, err
@@ -67,7 +98,7 @@ func LdapAuthenticateAccess(username, password string, settings *config.Settings
 		ldap.ScopeWholeSubtree,
 		ldap.NeverDerefAliases, 1, 0, false,
 		filter,
-		nil,
+		withSSHKeyAttribute([]string{"memberOf"}, settings),
 		nil,
 	)
 
@@ -79,7 +110,272 @@ func LdapAuthenticateAccess(username, password string, settings *config.Settings
 		return nil, fmt.Errorf("user %s not found", mail)
 	}
 
-	return types.NewUser(normalizedUser, password, ntlmDomain)
+	user, err := types.NewUser(normalizedUser, password, ntlmDomain)
+	if err != nil {
+		return nil, err
+	}
+	user.Groups = groupNamesFromDNs(sr.Entries[0].GetAttributeValues("memberOf"))
+	user.SSHKeys = sshKeysFromEntry(sr.Entries[0], settings)
+	return user, nil
+}
+
+// IsUnavailable reports whether err means the directory could not be
+// reached, as opposed to a rejected login.
+func IsUnavailable(err error) bool {
+	return ldap.IsErrorAnyOf(err, ldap.ErrorNetwork, ldap.LDAPResultUnavailable, ldap.LDAPResultBusy)
+}
+
+// GatewayDomain returns the NTLM domain clients should present to the
+// gateway: the NetBIOS domain in Active Directory mode, NTLM_DOMAIN otherwise.
+func GatewayDomain(settings *config.SettingsType) string {
+	if strings.EqualFold(strings.TrimSpace(settings.Get(config.LDAP_MODE)), ModeAD) {
+		if netbios := strings.TrimSpace(settings.Get(config.LDAP_AD_NETBIOS_DOMAIN)); netbios != "" {
+			return netbios
+		}
+	}
+	return settings.Get(config.NTLM_DOMAIN)
+}
+
+// adAuthenticateAccess binds against Active Directory with the UPN or
+// down-level logon name, rejects disabled or expired accounts and resolves
+// nested group membership.
+func adAuthenticateAccess(username, password string, settings *config.SettingsType) (*types.User, error) {
+	conn, err := dialLDAP(settings)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	upnSuffix := strings.TrimPrefix(strings.TrimSpace(settings.Get(config.LDAP_USER_DOMAIN)), "@")
+	netbios := strings.TrimSpace(settings.Get(config.LDAP_AD_NETBIOS_DOMAIN))
+	if netbios == "" {
+		netbios = strings.TrimSpace(settings.Get(config.NTLM_DOMAIN))
+	}
+
+	samAccountName, inputDomain := splitNTLMUserDomain(username, "")
+	if samAccountName == "" {
+		return nil, fmt.Errorf("empty username")
+	}
+	ntlmDomain := adNTLMDomain(inputDomain, upnSuffix, netbios)
+	log.Printf("NTLM login mapping: input=%q user=%q domain=%q", username, samAccountName, ntlmDomain)
+
+	if err := conn.Bind(adBindID(username, samAccountName, upnSuffix), password); err != nil {
+		if adErr := parseADBindError(err); adErr != nil {
+			return nil, adErr
+		}
+		return nil, fmt.Errorf("ldap bind failed: %w", err)
+	}
+
+	upn := samAccountName
+	if upnSuffix != "" {
+		upn = samAccountName + "@" + upnSuffix
+	}
+	filter := fmt.Sprintf(
+		"(&(objectCategory=person)(objectClass=user)(|(sAMAccountName=%s)(userPrincipalName=%s)))",
+		ldap.EscapeFilter(samAccountName),
+		ldap.EscapeFilter(upn),
+	)
+	searchReq := ldap.NewSearchRequest(
+		settings.Get(config.LDAP_BASE_DN),
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 1, 0, false,
+		filter,
+		withSSHKeyAttribute([]string{
+			"sAMAccountName",
+			"userAccountControl",
+			"msDS-User-Account-Control-Computed",
+			"msDS-UserPasswordExpiryTimeComputed",
+			"pwdLastSet",
+			"memberOf",
+		}, settings),
+		nil,
+	)
+	sr, err := conn.Search(searchReq)
+	if err != nil {
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(sr.Entries) == 0 {
+		return nil, fmt.Errorf("user %s not found", samAccountName)
+	}
+	entry := sr.Entries[0]
+
+	if err := checkADAccount(entry, time.Now()); err != nil {
+		return nil, err
+	}
+	if name := strings.TrimSpace(entry.GetAttributeValue("sAMAccountName")); name != "" {
+		samAccountName = name
+	}
+
+	groups := groupNamesFromDNs(entry.GetAttributeValues("memberOf"))
+	if settings.IsTrue(config.LDAP_AD_NESTED_GROUPS) {
+		nested, err := adNestedGroups(conn, settings.Get(config.LDAP_BASE_DN), entry.DN)
+		if err != nil {
+			log.Printf("ldap nested group lookup for %s failed: %v", samAccountName, err)
+		} else {
+			groups = nested
+		}
+	}
+
+	user, err := types.NewUser(samAccountName, password, ntlmDomain)
+	if err != nil {
+		return nil, err
+	}
+	user.Groups = groups
+	user.SSHKeys = sshKeysFromEntry(entry, settings)
+	return user, nil
+}
+
+// withSSHKeyAttribute adds LDAP_SSH_KEY_ATTRIBUTE to the attributes of a
+// user search.
+func withSSHKeyAttribute(attributes []string, settings *config.SettingsType) []string {
+	if attr := strings.TrimSpace(settings.Get(config.LDAP_SSH_KEY_ATTRIBUTE)); attr != "" {
+		return append(attributes, attr)
+	}
+	return attributes
+}
+
+// sshKeysFromEntry returns the valid public keys in the
+// LDAP_SSH_KEY_ATTRIBUTE values of entry.
+func sshKeysFromEntry(entry *ldap.Entry, settings *config.SettingsType) []string {
+	attr := strings.TrimSpace(settings.Get(config.LDAP_SSH_KEY_ATTRIBUTE))
+	if attr == "" {
+		return nil
+	}
+	keys, skipped := sshkeys.ParseAll(entry.GetAttributeValues(attr))
+	if skipped > 0 {
+		log.Printf("ldap: skipped %d invalid ssh keys in %s of %s", skipped, attr, entry.DN)
+	}
+	return sshkeys.Lines(keys)
+}
+
+func adNestedGroups(conn *ldap.Conn, baseDN, userDN string) ([]string, error) {
+	filter := fmt.Sprintf("(&(objectClass=group)(member:%s:=%s))", matchingRuleInChain, ldap.EscapeFilter(userDN))
+	searchReq := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{"cn"},
+		nil,
+	)
+	sr, err := conn.SearchWithPaging(searchReq, 500)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(sr.Entries))
+	for _, entry := range sr.Entries {
+		if cn := entry.GetAttributeValue("cn"); cn != "" {
+			groups = append(groups, cn)
+		}
+	}
+	return groups, nil
+}
+
+// adBindID returns the identity used for the simple bind: down-level
+// (DOMAIN\user) and UPN input is passed through, a bare sAMAccountName gets
+// the configured UPN suffix.
+func adBindID(input, samAccountName, upnSuffix string) string {
+	input = strings.TrimSpace(input)
+	if strings.Contains(input, "\\") || strings.Contains(input, "@") || upnSuffix == "" {
+		return input
+	}
+	return samAccountName + "@" + upnSuffix
+}
+
+// adNTLMDomain maps the domain typed by the user to the NetBIOS domain that
+// RDP clients send in the NTLM AUTHENTICATE message.
+func adNTLMDomain(inputDomain, upnSuffix, netbios string) string {
+	inputDomain = strings.TrimSpace(inputDomain)
+	if netbios == "" {
+		return inputDomain
+	}
+	if inputDomain == "" ||
+		strings.EqualFold(inputDomain, netbios) ||
+		strings.EqualFold(inputDomain, upnSuffix) {
+		return netbios
+	}
+	if idx := strings.Index(inputDomain, "."); idx > 0 && strings.EqualFold(inputDomain[:idx], netbios) {
+		return netbios
+	}
+	return inputDomain
+}
+
+// parseADBindError maps the AD sub-status carried in the diagnostic message
+// of an invalidCredentials bind result ("... data 533, ...").
+func parseADBindError(err error) error {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode != ldap.LDAPResultInvalidCredentials || ldapErr.Err == nil {
+		return nil
+	}
+	msg := strings.ToLower(ldapErr.Err.Error())
+	switch {
+	case strings.Contains(msg, "data 533"):
+		return ErrAccountDisabled
+	case strings.Contains(msg, "data 775"):
+		return ErrAccountLocked
+	case strings.Contains(msg, "data 701"):
+		return ErrAccountExpired
+	case strings.Contains(msg, "data 532"), strings.Contains(msg, "data 773"):
+		return ErrPasswordExpired
+	}
+	return nil
+}
+
+func checkADAccount(entry *ldap.Entry, now time.Time) error {
+	uac := attributeInt(entry, "userAccountControl")
+	computed := attributeInt(entry, "msDS-User-Account-Control-Computed")
+	if uac&uacAccountDisable != 0 {
+		return ErrAccountDisabled
+	}
+	if (uac|computed)&uacLockout != 0 {
+		return ErrAccountLocked
+	}
+	if (uac|computed)&uacPasswordExpired != 0 {
+		return ErrPasswordExpired
+	}
+	if raw := entry.GetAttributeValue("pwdLastSet"); raw == "0" {
+		return ErrPasswordExpired
+	}
+	if expiry := attributeInt(entry, "msDS-UserPasswordExpiryTimeComputed"); expiry > 0 && expiry != 0x7FFFFFFFFFFFFFFF {
+		if fileTimeToTime(expiry).Before(now) {
+			return ErrPasswordExpired
+		}
+	}
+	return nil
+}
+
+func attributeInt(entry *ldap.Entry, name string) int64 {
+	raw := strings.TrimSpace(entry.GetAttributeValue(name))
+	if raw == "" {
+		return 0
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// fileTimeToTime converts a Windows FILETIME (100ns intervals since 1601).
+func fileTimeToTime(ft int64) time.Time {
+	const epochDelta = 116444736000000000
+	return time.Unix(0, (ft-epochDelta)*100)
+}
+
+// groupNamesFromDNs returns the value of the first RDN of each group DN,
+// e.g. "cn=staff,ou=groups,dc=example,dc=com" yields "staff".
+func groupNamesFromDNs(dns []string) []string {
+	groups := make([]string, 0, len(dns))
+	for _, raw := range dns {
+		dn, err := ldap.ParseDN(raw)
+		if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+			continue
+		}
+		if name := dn.RDNs[0].Attributes[0].Value; name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups
 }
 
 func dialLDAP(settings *config.SettingsType) (*ldap.Conn, error) {
@@ -1 +1,174 @@
 package ldap
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+
+	"remotegateway/internal/config"
+)
+
+func TestSplitNTLMUserDomain(t *testing.T) {
+	cases := []struct {
+		input, fallback, user, domain string
+	}{
+		{`CORP\alice`, "vdi", "alice", "CORP"},
+		{"alice@corp.example.com", "vdi", "alice", "corp.example.com"},
+		{"alice", "@example.com", "alice", "example.com"},
+		{"", "vdi", "", ""},
+	}
+	for _, tc := range cases {
+		user, domain := splitNTLMUserDomain(tc.input, tc.fallback)
+		if user != tc.user || domain != tc.domain {
+			t.Fatalf("split %q: expected %q/%q, got %q/%q", tc.input, tc.user, tc.domain, user, domain)
+		}
+	}
+}
+
+func TestADBindID(t *testing.T) {
+	if got := adBindID("alice", "alice", "corp.example.com"); got != "alice@corp.example.com" {
+		t.Fatalf("expected UPN bind, got %q", got)
+	}
+	if got := adBindID(`CORP\alice`, "alice", "corp.example.com"); got != `CORP\alice` {
+		t.Fatalf("expected down-level bind, got %q", got)
+	}
+	if got := adBindID("alice@other.example.com", "alice", "corp.example.com"); got != "alice@other.example.com" {
+		t.Fatalf("expected UPN passthrough, got %q", got)
+	}
+}
+
+func TestADNTLMDomain(t *testing.T) {
+	cases := []struct {
+		input, want string
+	}{
+		{"", "CORP"},
+		{"corp", "CORP"},
+		{"corp.example.com", "CORP"},
+		{"CORP.EXAMPLE.COM", "CORP"},
+		{"OTHER", "OTHER"},
+	}
+	for _, tc := range cases {
+		if got := adNTLMDomain(tc.input, "corp.example.com", "CORP"); got != tc.want {
+			t.Fatalf("map %q: expected %q, got %q", tc.input, tc.want, got)
+		}
+	}
+	if got := adNTLMDomain("corp.example.com", "corp.example.com", ""); got != "corp.example.com" {
+		t.Fatalf("expected passthrough without NetBIOS domain, got %q", got)
+	}
+}
+
+func TestParseADBindError(t *testing.T) {
+	adErr := func(data string) error {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials,
+			fmt.Errorf("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data %s, v4563", data))
+	}
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{adErr("533"), ErrAccountDisabled},
+		{adErr("775"), ErrAccountLocked},
+		{adErr("701"), ErrAccountExpired},
+		{adErr("532"), ErrPasswordExpired},
+		{adErr("773"), ErrPasswordExpired},
+		{adErr("52e"), nil},
+		{errors.New("boom"), nil},
+	}
+	for _, tc := range cases {
+		if got := parseADBindError(tc.err); got != tc.want {
+			t.Fatalf("parse %v: expected %v, got %v", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestCheckADAccount(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(attrs map[string]string) *ldap.Entry {
+		m := make(map[string][]string, len(attrs))
+		for k, v := range attrs {
+			m[k] = []string{v}
+		}
+		return ldap.NewEntry("cn=alice,dc=corp,dc=example,dc=com", m)
+	}
+	toFileTime := func(ts time.Time) string {
+		return strconv.FormatInt(ts.UnixNano()/100+116444736000000000, 10)
+	}
+
+	cases := []struct {
+		name  string
+		attrs map[string]string
+		want  error
+	}{
+		{"enabled", map[string]string{"userAccountControl": "512", "pwdLastSet": "1"}, nil},
+		{"disabled", map[string]string{"userAccountControl": "514"}, ErrAccountDisabled},
+		{"locked", map[string]string{"userAccountControl": "512", "msDS-User-Account-Control-Computed": "16"}, ErrAccountLocked},
+		{"expired-flag", map[string]string{"userAccountControl": "512", "msDS-User-Account-Control-Computed": "8388608"}, ErrPasswordExpired},
+		{"must-change", map[string]string{"userAccountControl": "512", "pwdLastSet": "0"}, ErrPasswordExpired},
+		{"expiry-past", map[string]string{"userAccountControl": "512", "msDS-UserPasswordExpiryTimeComputed": toFileTime(now.Add(-time.Hour))}, ErrPasswordExpired},
+		{"expiry-future", map[string]string{"userAccountControl": "512", "msDS-UserPasswordExpiryTimeComputed": toFileTime(now.Add(time.Hour))}, nil},
+		{"never-expires", map[string]string{"userAccountControl": "66048", "msDS-UserPasswordExpiryTimeComputed": "9223372036854775807"}, nil},
+	}
+	for _, tc := range cases {
+		if got := checkADAccount(entry(tc.attrs), now); got != tc.want {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestGroupNamesFromDNs(t *testing.T) {
+	groups := groupNamesFromDNs([]string{
+		"cn=Staff,ou=Groups,dc=corp,dc=example,dc=com",
+		"ou=team1,ou=groups,dc=glauth,dc=com",
+		"not a dn",
+	})
+	if len(groups) != 2 || groups[0] != "Staff" || groups[1] != "team1" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+}
+
+func TestSSHKeysFromEntry(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh key: %v", err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " alice@laptop"
+	entry := ldap.NewEntry("cn=alice,dc=glauth,dc=com", map[string][]string{
+		"sshPublicKey": {key, "not a key"},
+		"altKeys":      {key + "\n" + key},
+	})
+
+	t.Setenv(config.LDAP_SSH_KEY_ATTRIBUTE, "sshPublicKey")
+	settings := config.NewSettingType(false)
+	if keys := sshKeysFromEntry(entry, settings); len(keys) != 1 || keys[0] != key {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+	if attrs := withSSHKeyAttribute([]string{"memberOf"}, settings); len(attrs) != 2 || attrs[1] != "sshPublicKey" {
+		t.Fatalf("unexpected attributes %q", attrs)
+	}
+
+	t.Setenv(config.LDAP_SSH_KEY_ATTRIBUTE, "altKeys")
+	if keys := sshKeysFromEntry(entry, config.NewSettingType(false)); len(keys) != 1 || keys[0] != key {
+		t.Fatalf("expected keys of the configured attribute, got %q", keys)
+	}
+
+	t.Setenv(config.LDAP_SSH_KEY_ATTRIBUTE, "")
+	settings = config.NewSettingType(false)
+	if keys := sshKeysFromEntry(entry, settings); keys != nil {
+		t.Fatalf("expected no keys when disabled, got %q", keys)
+	}
+	if attrs := withSSHKeyAttribute([]string{"memberOf"}, settings); len(attrs) != 1 {
+		t.Fatalf("unexpected attributes %q", attrs)
+	}
+}
@@ -0,0 +1,267 @@
+// Package localusers is a file-backed user database with bcrypt password
+// hashes for installations without a directory server.
+package localusers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"remotegateway/internal/types"
+)
+
+var (
+	ErrUserNotFound       = errors.New("localusers: user not found")
+	ErrUserExists         = errors.New("localusers: user already exists")
+	ErrInvalidCredentials = errors.New("localusers: invalid credentials")
+	ErrDisabled           = errors.New("localusers: account is disabled")
+	ErrInvalidUsername    = errors.New("localusers: invalid username")
+	ErrEmptyPassword      = errors.New("localusers: empty password")
+)
+
+// dummyHash is compared against for unknown users.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("remotegateway"), bcrypt.DefaultCost)
+
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Groups       []string  `json:"groups,omitempty"`
+	Disabled     bool      `json:"disabled,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// Store keeps users in a JSON file. The file is reloaded when it changes on
+// disk so edits made with the CLI apply to a running server.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string]User
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+func userKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func validUsername(username string) bool {
+	if username == "" || len(username) > 64 {
+		return false
+	}
+	for _, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.users = make(map[string]User)
+		s.modTime, s.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.users != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]User)
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return fmt.Errorf("user store %s: %w", s.path, err)
+	}
+	s.users = users
+	s.modTime, s.size = info.ModTime(), info.Size()
+	return nil
+}
+
+func (s *Store) save() error {
+	raw, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime, s.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// Add creates a user. Usernames are stored in lower case.
+func (s *Store) Add(username, password string, groups []string, now time.Time) error {
+	key := userKey(username)
+	if !validUsername(key) {
+		return ErrInvalidUsername
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.users[key]; ok {
+		return ErrUserExists
+	}
+	s.users[key] = User{
+		Username:     key,
+		PasswordHash: hash,
+		Groups:       groups,
+		CreatedAt:    now.UTC(),
+		UpdatedAt:    now.UTC(),
+	}
+	return s.save()
+}
+
+// SetPassword replaces the password of username.
+func (s *Store) SetPassword(username, password string, now time.Time) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.update(username, now, func(u *User) {
+		u.PasswordHash = hash
+	})
+}
+
+// SetDisabled disables or re-enables username.
+func (s *Store) SetDisabled(username string, disabled bool, now time.Time) error {
+	return s.update(username, now, func(u *User) {
+		u.Disabled = disabled
+	})
+}
+
+func (s *Store) update(username string, now time.Time, fn func(*User)) error {
+	key := userKey(username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	u, ok := s.users[key]
+	if !ok {
+		return ErrUserNotFound
+	}
+	fn(&u)
+	u.UpdatedAt = now.UTC()
+	s.users[key] = u
+	return s.save()
+}
+
+// List returns all users sorted by name.
+func (s *Store) List() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// Get returns the user named username without checking a password.
+func (s *Store) Get(username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return User{}, err
+	}
+	u, ok := s.users[userKey(username)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// Authenticate checks the password of username and returns a session user
+// with NTLM hashes for domain. Disabled accounts are reported only after the
+// password matched.
+func (s *Store) Authenticate(username, password, domain string) (*types.User, error) {
+	s.mu.Lock()
+	err := s.load()
+	u, ok := s.users[userKey(username)]
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Spend the same time as a wrong password so probing does not
+		// reveal which accounts exist.
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrUserNotFound
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if u.Disabled {
+		return nil, ErrDisabled
+	}
+	user, err := types.NewUser(u.Username, password, domain)
+	if err != nil {
+		return nil, err
+	}
+	user.Groups = append([]string(nil), u.Groups...)
+	return user, nil
+}
+
+// GeneratePassword returns a random password for new or reset accounts.
+func GeneratePassword() (string, error) {
+	buf := make([]byte, 15)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", ErrEmptyPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,76 @@
+package localusers
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddAuthenticateAndReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users", "users.json")
+	s := NewStore(path)
+	now := time.Unix(1700000000, 0)
+
+	if err := s.Add("Alice", "s3cret", []string{"vdi-users"}, now); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := s.Add("alice", "other", nil, now); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected duplicate to fail, got %v", err)
+	}
+	if err := s.Add("bad name", "x", nil, now); !errors.Is(err, ErrInvalidUsername) {
+		t.Fatalf("expected invalid username, got %v", err)
+	}
+
+	user, err := s.Authenticate("ALICE", "s3cret", "vdi")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if user.GetName() != "alice" || !user.InGroup("vdi-users") || len(user.NtlmHashes()) != 1 {
+		t.Fatalf("unexpected user %+v", user)
+	}
+	if _, err := s.Authenticate("alice", "wrong", "vdi"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if _, err := s.Authenticate("nobody", "s3cret", "vdi"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected unknown user, got %v", err)
+	}
+
+	if err := s.SetPassword("alice", "n3w", now); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if _, err := s.Authenticate("alice", "s3cret", "vdi"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected old password to stop working, got %v", err)
+	}
+	if err := s.SetPassword("nobody", "x", now); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected reset of unknown user to fail, got %v", err)
+	}
+}
+
+func TestDisableAppliesToOtherStoreInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	server := NewStore(path)
+	cli := NewStore(path)
+	now := time.Unix(1700000000, 0)
+
+	if err := cli.Add("bob", "pw", nil, now); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := server.Authenticate("bob", "pw", "vdi"); err != nil {
+		t.Fatalf("expected server to see new user: %v", err)
+	}
+	if err := cli.SetDisabled("bob", true, now); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if _, err := server.Authenticate("bob", "pw", "vdi"); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("expected disabled account, got %v", err)
+	}
+	if _, err := server.Authenticate("bob", "wrong", "vdi"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected disabled state to stay hidden without the password, got %v", err)
+	}
+
+	users, err := server.List()
+	if err != nil || len(users) != 1 || !users[0].Disabled {
+		t.Fatalf("unexpected list %+v err=%v", users, err)
+	}
+}
@@ -0,0 +1,189 @@
+// Package lockout tracks failed logins per username and per client IP and
+// locks them out with exponential backoff.
+package lockout
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KindUser = "user"
+	KindIP   = "ip"
+)
+
+type Config struct {
+	// UserThreshold and IPThreshold are the failures tolerated before a
+	// lockout starts. Client IPs get more room since many users can share
+	// one address behind NAT.
+	UserThreshold int
+	IPThreshold   int
+	// BaseDelay is the first lockout; each further failure doubles it up to
+	// MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Window resets the counter after this long without failures.
+	Window time.Duration
+}
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Entry is a snapshot of a tracked key for admin views.
+type Entry struct {
+	Key         string    `json:"key"`
+	Kind        string    `json:"kind"`
+	Value       string    `json:"value"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+	Locked      bool      `json:"locked"`
+}
+
+type Limiter struct {
+	cfg Config
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func New(cfg Config) *Limiter {
+	return &Limiter{cfg: cfg, entries: make(map[string]*entry)}
+}
+
+func Key(kind, value string) string {
+	return kind + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+func (l *Limiter) keys(username, ip string) []string {
+	keys := make([]string, 0, 2)
+	if strings.TrimSpace(username) != "" {
+		keys = append(keys, Key(KindUser, username))
+	}
+	if strings.TrimSpace(ip) != "" {
+		keys = append(keys, Key(KindIP, ip))
+	}
+	return keys
+}
+
+func (l *Limiter) threshold(key string) int {
+	if strings.HasPrefix(key, KindIP+":") {
+		return l.cfg.IPThreshold
+	}
+	return l.cfg.UserThreshold
+}
+
+// expiredLocked drops an entry whose window passed and which is not locked.
+func (l *Limiter) expiredLocked(key string, e *entry, now time.Time) bool {
+	if now.Before(e.lockedUntil) || now.Sub(e.lastFailure) < l.cfg.Window {
+		return false
+	}
+	delete(l.entries, key)
+	return true
+}
+
+// Check reports whether username or ip is locked out and for how long.
+func (l *Limiter) Check(username, ip string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range l.keys(username, ip) {
+		e, ok := l.entries[key]
+		if !ok || l.expiredLocked(key, e, now) {
+			continue
+		}
+		if remaining := e.lockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, wait > 0
+}
+
+// Failure records a failed attempt and returns the resulting lockout, if any.
+func (l *Limiter) Failure(username, ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range l.keys(username, ip) {
+		e, ok := l.entries[key]
+		if !ok || l.expiredLocked(key, e, now) {
+			e = &entry{}
+			l.entries[key] = e
+		}
+		e.failures++
+		e.lastFailure = now
+		threshold := l.threshold(key)
+		if threshold <= 0 || e.failures < threshold {
+			continue
+		}
+		delay := l.cfg.BaseDelay
+		for i := threshold; i < e.failures && delay < l.cfg.MaxDelay; i++ {
+			delay *= 2
+		}
+		if l.cfg.MaxDelay > 0 && delay > l.cfg.MaxDelay {
+			delay = l.cfg.MaxDelay
+		}
+		e.lockedUntil = now.Add(delay)
+		if delay > wait {
+			wait = delay
+		}
+	}
+	return wait
+}
+
+// Success clears the username counter. The IP counter is kept so a single
+// valid account cannot be used to reset guessing from the same address.
+func (l *Limiter) Success(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, Key(KindUser, username))
+}
+
+// List returns all tracked keys, locked ones first.
+func (l *Limiter) List(now time.Time) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]Entry, 0, len(l.entries))
+	for key, e := range l.entries {
+		if l.expiredLocked(key, e, now) {
+			continue
+		}
+		kind, value, _ := strings.Cut(key, ":")
+		item := Entry{
+			Key:         key,
+			Kind:        kind,
+			Value:       value,
+			Failures:    e.failures,
+			LastFailure: e.lastFailure,
+			Locked:      now.Before(e.lockedUntil),
+		}
+		if item.Locked {
+			item.LockedUntil = e.lockedUntil
+		}
+		out = append(out, item)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Locked != out[j].Locked {
+			return out[i].Locked
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Clear removes a tracked key. It reports whether the key existed.
+func (l *Limiter) Clear(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key = strings.ToLower(strings.TrimSpace(key))
+	if _, ok := l.entries[key]; !ok {
+		return false
+	}
+	delete(l.entries, key)
+	return true
+}
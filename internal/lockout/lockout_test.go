@@ -0,0 +1,100 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func testLimiter() *Limiter {
+	return New(Config{
+		UserThreshold: 3,
+		IPThreshold:   5,
+		BaseDelay:     10 * time.Second,
+		MaxDelay:      time.Minute,
+		Window:        15 * time.Minute,
+	})
+}
+
+func TestUserLockoutBacksOffExponentially(t *testing.T) {
+	l := testLimiter()
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 2; i++ {
+		if wait := l.Failure("Alice", "10.0.0.1", now); wait != 0 {
+			t.Fatalf("failure %d: expected no lockout, got %s", i+1, wait)
+		}
+	}
+	if wait := l.Failure("alice", "10.0.0.2", now); wait != 10*time.Second {
+		t.Fatalf("expected 10s lockout at threshold, got %s", wait)
+	}
+	if wait, locked := l.Check("ALICE", "10.9.9.9", now.Add(5*time.Second)); !locked || wait != 5*time.Second {
+		t.Fatalf("expected username lockout from any address, got %s %v", wait, locked)
+	}
+	if _, locked := l.Check("alice", "", now.Add(11*time.Second)); locked {
+		t.Fatalf("expected lockout to expire")
+	}
+
+	if wait := l.Failure("alice", "10.0.0.3", now.Add(12*time.Second)); wait != 20*time.Second {
+		t.Fatalf("expected doubled lockout, got %s", wait)
+	}
+	for i := 0; i < 5; i++ {
+		l.Failure("alice", "10.0.0.4", now.Add(13*time.Second))
+	}
+	if wait := l.Failure("alice", "10.0.0.5", now.Add(14*time.Second)); wait != time.Minute {
+		t.Fatalf("expected lockout capped at max, got %s", wait)
+	}
+}
+
+func TestIPLockoutAndSuccess(t *testing.T) {
+	l := testLimiter()
+	now := time.Unix(1700000000, 0)
+
+	users := []string{"a", "b", "c", "d", "e"}
+	for _, user := range users {
+		l.Failure(user, "192.0.2.7", now)
+	}
+	if _, locked := l.Check("newuser", "192.0.2.7", now); !locked {
+		t.Fatalf("expected address lockout after spraying users")
+	}
+
+	l.Failure("bob", "198.51.100.1", now)
+	l.Failure("bob", "198.51.100.1", now)
+	l.Success("bob")
+	if wait := l.Failure("bob", "198.51.100.1", now); wait != 0 {
+		t.Fatalf("expected success to reset the username counter, got %s", wait)
+	}
+}
+
+func TestWindowExpiresCounters(t *testing.T) {
+	l := testLimiter()
+	now := time.Unix(1700000000, 0)
+	l.Failure("alice", "", now)
+	l.Failure("alice", "", now)
+	if wait := l.Failure("alice", "", now.Add(16*time.Minute)); wait != 0 {
+		t.Fatalf("expected counter to restart after window, got %s", wait)
+	}
+	if got := len(l.List(now.Add(40 * time.Minute))); got != 0 {
+		t.Fatalf("expected stale entries to be dropped, got %d", got)
+	}
+}
+
+func TestListAndClear(t *testing.T) {
+	l := testLimiter()
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 3; i++ {
+		l.Failure("alice", "10.0.0.1", now)
+	}
+	entries := l.List(now)
+	if len(entries) != 2 || !entries[0].Locked || entries[0].Key != "user:alice" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if !l.Clear("user:Alice") {
+		t.Fatalf("expected clear to remove entry")
+	}
+	if _, locked := l.Check("alice", "", now); locked {
+		t.Fatalf("expected user to be unlocked after clear")
+	}
+	if l.Clear("user:alice") {
+		t.Fatalf("expected second clear to report missing entry")
+	}
+}
@@ -0,0 +1,189 @@
+// Package mfa persists per-user TOTP enrollments and recovery codes.
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"remotegateway/internal/jsonfile"
+	"remotegateway/internal/totp"
+)
+
+const (
+	RecoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+var (
+	ErrNotEnrolled = errors.New("mfa: user is not enrolled")
+	ErrInvalidCode = errors.New("mfa: invalid code")
+)
+
+type Enrollment struct {
+	Secret string `json:"secret"`
+	// RecoveryCodes holds SHA-256 hashes of the unused recovery codes.
+	RecoveryCodes []string  `json:"recoveryCodes"`
+	EnrolledAt    time.Time `json:"enrolledAt"`
+	// LastStep is the last accepted TOTP step; older or equal steps are
+	// rejected so a code cannot be replayed.
+	LastStep int64 `json:"lastStep"`
+}
+
+// Store keeps enrollments in a JSON file that is rewritten on every change.
+type Store struct {
+	mu    sync.Mutex
+	file  *jsonfile.Map[Enrollment]
+	users map[string]Enrollment
+}
+
+func NewStore(path string) *Store {
+	return &Store{file: jsonfile.NewMap[Enrollment]("mfa store", path)}
+}
+
+func (s *Store) load() error {
+	users, err := s.file.Load()
+	if err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+func (s *Store) save() error {
+	return s.file.Save(s.users)
+}
+
+func (s *Store) Enrolled(username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	_, ok := s.users[jsonfile.UserKey(username)]
+	return ok, nil
+}
+
+// Enroll stores secret for username, replacing any previous enrollment, and
+// returns freshly generated recovery codes in clear text.
+func (s *Store) Enroll(username, secret string, now time.Time) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.users[jsonfile.UserKey(username)] = Enrollment{
+		Secret:        secret,
+		RecoveryCodes: hashes,
+		EnrolledAt:    now.UTC(),
+		LastStep:      totp.Step(now),
+	}
+	if err := s.save(); err != nil {
+		delete(s.users, jsonfile.UserKey(username))
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify accepts either a current TOTP code or an unused recovery code. It
+// reports whether a recovery code was consumed.
+func (s *Store) Verify(username, code string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	key := jsonfile.UserKey(username)
+	enrollment, ok := s.users[key]
+	if !ok {
+		return false, ErrNotEnrolled
+	}
+
+	if step, ok := totp.Validate(enrollment.Secret, code, now); ok {
+		if step <= enrollment.LastStep {
+			return false, ErrInvalidCode
+		}
+		enrollment.LastStep = step
+		s.users[key] = enrollment
+		return false, s.save()
+	}
+
+	hashed := hashRecoveryCode(code)
+	for i, candidate := range enrollment.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(hashed)) == 1 {
+			enrollment.RecoveryCodes = append(enrollment.RecoveryCodes[:i:i], enrollment.RecoveryCodes[i+1:]...)
+			s.users[key] = enrollment
+			return true, s.save()
+		}
+	}
+	return false, ErrInvalidCode
+}
+
+// RemainingRecoveryCodes returns how many recovery codes are still unused.
+func (s *Store) RemainingRecoveryCodes(username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	enrollment, ok := s.users[jsonfile.UserKey(username)]
+	if !ok {
+		return 0, ErrNotEnrolled
+	}
+	return len(enrollment.RecoveryCodes), nil
+}
+
+// Reset removes the enrollment for username. It reports whether one existed.
+func (s *Store) Reset(username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	key := jsonfile.UserKey(username)
+	enrollment, ok := s.users[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.users, key)
+	if err := s.save(); err != nil {
+		s.users[key] = enrollment
+		return false, err
+	}
+	return true, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	buf := make([]byte, recoveryCodeBytes)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := hex.EncodeToString(buf)
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
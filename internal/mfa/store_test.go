@@ -0,0 +1,106 @@
+package mfa_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/totp"
+)
+
+func TestEnrollVerifyAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mfa.json")
+	store := mfa.NewStore(path)
+	secret, _ := totp.GenerateSecret()
+	enrolledAt := time.Unix(1700000000, 0)
+
+	codes, err := store.Enroll("Alice", secret, enrolledAt)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if len(codes) != mfa.RecoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", mfa.RecoveryCodeCount, len(codes))
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected private store file, got %v %v", info, err)
+	}
+
+	// The code used to confirm enrollment must not be accepted again.
+	enrollCode, _ := totp.Code(secret, enrolledAt)
+	if _, err := store.Verify("alice", enrollCode, enrolledAt); !errors.Is(err, mfa.ErrInvalidCode) {
+		t.Fatalf("expected enrollment code replay to fail, got %v", err)
+	}
+
+	later := enrolledAt.Add(totp.Period)
+	code, _ := totp.Code(secret, later)
+	if used, err := store.Verify("alice", code, later); err != nil || used {
+		t.Fatalf("expected totp to verify, got used=%v err=%v", used, err)
+	}
+	if _, err := store.Verify("alice", code, later); !errors.Is(err, mfa.ErrInvalidCode) {
+		t.Fatalf("expected replay to fail, got %v", err)
+	}
+
+	reopened := mfa.NewStore(path)
+	if ok, err := reopened.Enrolled("ALICE"); err != nil || !ok {
+		t.Fatalf("expected enrollment to persist, got %v %v", ok, err)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	store := mfa.NewStore(filepath.Join(t.TempDir(), "mfa.json"))
+	secret, _ := totp.GenerateSecret()
+	now := time.Now()
+	codes, err := store.Enroll("bob", secret, now)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+
+	if used, err := store.Verify("bob", codes[3], now); err != nil || !used {
+		t.Fatalf("expected recovery code to verify, got used=%v err=%v", used, err)
+	}
+	if _, err := store.Verify("bob", codes[3], now); !errors.Is(err, mfa.ErrInvalidCode) {
+		t.Fatalf("expected recovery code reuse to fail, got %v", err)
+	}
+	if remaining, _ := store.RemainingRecoveryCodes("bob"); remaining != mfa.RecoveryCodeCount-1 {
+		t.Fatalf("expected %d remaining codes, got %d", mfa.RecoveryCodeCount-1, remaining)
+	}
+}
+
+func TestResetRemovesEnrollment(t *testing.T) {
+	store := mfa.NewStore(filepath.Join(t.TempDir(), "mfa.json"))
+	secret, _ := totp.GenerateSecret()
+	if _, err := store.Enroll("carol", secret, time.Now()); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if removed, err := store.Reset("carol"); err != nil || !removed {
+		t.Fatalf("expected reset, got %v %v", removed, err)
+	}
+	if removed, _ := store.Reset("carol"); removed {
+		t.Fatalf("expected second reset to be a no-op")
+	}
+	if _, err := store.Verify("carol", "123456", time.Now()); !errors.Is(err, mfa.ErrNotEnrolled) {
+		t.Fatalf("expected not enrolled, got %v", err)
+	}
+}
+
+func TestResetFromAnotherStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mfa.json")
+	server := mfa.NewStore(path)
+	secret, _ := totp.GenerateSecret()
+	if _, err := server.Enroll("carol", secret, time.Now()); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if enrolled, err := server.Enrolled("carol"); err != nil || !enrolled {
+		t.Fatalf("expected carol to be enrolled, got %v %v", enrolled, err)
+	}
+	if removed, err := mfa.NewStore(path).Reset("carol"); err != nil || !removed {
+		t.Fatalf("expected reset, got %v %v", removed, err)
+	}
+	if enrolled, err := server.Enrolled("carol"); err != nil || enrolled {
+		t.Fatalf("expected the running store to see the reset, got %v %v", enrolled, err)
+	}
+}
@@ -0,0 +1,215 @@
+package ntlm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"remotegateway/internal/hash"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+	"remotegateway/internal/types"
+)
+
+const basicCacheMaxEntries = 1024
+
+var (
+	errBasicRequiresTLS = errors.New("basic auth requires TLS")
+	errBasicInvalid     = errors.New("invalid basic credentials")
+)
+
+// PasswordAuthenticator verifies a username and password, e.g. against LDAP.
+type PasswordAuthenticator interface {
+	Authenticate(username, password string) (*types.User, error)
+}
+
+// BasicAuth verifies HTTP Basic credentials for gateway clients that do not
+// speak NTLM. Passwords are checked against the NTLM hashes of the user's web
+// session first, which covers app passwords, and then against Authenticator.
+type BasicAuth struct {
+	// Authenticator, when set, checks directory passwords.
+	Authenticator PasswordAuthenticator
+	// DirectoryAllowed, when set, decides per user whether Authenticator may
+	// be used. Users that must pass a second factor are limited to app
+	// passwords from a verified web session.
+	DirectoryAllowed func(username string) bool
+	// Domain is the NTLM domain app password hashes were created with.
+	Domain string
+	// CacheTTL keeps successful logins so repeated gateway requests do not
+	// query the directory. Zero disables caching. Cached logins are dropped
+	// when the sessions of the user are revoked.
+	CacheTTL time.Duration
+	// Disabled, when set, is asked on cache hits so a disabled account does
+	// not keep its cached logins.
+	Disabled func(username string) bool
+
+	mu       sync.Mutex
+	cacheKey []byte
+	cache    map[string]basicCacheEntry
+}
+
+type basicCacheEntry struct {
+	mac []byte
+	id  identity
+	// revocations is the revocation count of the user when the login was
+	// verified.
+	revocations uint64
+	expires     time.Time
+}
+
+// authenticateBasic handles an "Authorization: Basic" header.
+func (a *StaticAuth) authenticateBasic(r *http.Request) (identity, error) {
+	if a.Basic == nil {
+		return identity{}, errors.New("basic auth disabled")
+	}
+	if r.TLS == nil {
+		log.Printf("Basic auth rejected without TLS from %s", r.RemoteAddr)
+		return identity{}, errBasicRequiresTLS
+	}
+	rawUser, password, ok := r.BasicAuth()
+	user := NormalizeUser(rawUser)
+	if !ok || user == "" || password == "" {
+		return identity{}, errBasicInvalid
+	}
+
+	clientIP := common.RemoteHost(r)
+	if a.Limiter != nil {
+		if wait, locked := a.Limiter.Check(user, clientIP, time.Now()); locked {
+			log.Printf("Basic auth locked out: user=%q ip=%s retry_after=%s", user, clientIP, wait.Truncate(time.Second))
+			return identity{}, errBasicInvalid
+		}
+	}
+
+	id, err := a.Basic.verify(a.SessionManager, rawUser, user, password, time.Now())
+	if err != nil {
+		log.Printf("Basic auth failed for user=%q from %s: %v", user, clientIP, err)
+		a.recordFailure(user, clientIP)
+		return identity{}, errBasicInvalid
+	}
+	if a.Limiter != nil {
+		a.Limiter.Success(user)
+	}
+	return id, nil
+}
+
+// verify returns the user the password belongs to, with the groups of the
+// session or directory entry that matched.
+func (b *BasicAuth) verify(sessionManager *session.Manager, rawUser, user, password string, now time.Time) (identity, error) {
+	if id, ok := b.cached(sessionManager, user, password, now); ok {
+		return id, nil
+	}
+	// Read before verifying so a revoke during the check is not missed.
+	revocations := revocationsOf(sessionManager, user)
+
+	if sessionManager != nil {
+		if sess, ok := sessionManager.GetSessionFromUserName(user); ok {
+			for _, domain := range basicDomains(rawUser, b.Domain) {
+				candidate := hash.NtlmV2Hash(password, sess.User.GetName(), domain)
+				for _, known := range sess.User.NtlmHashes() {
+					if hmac.Equal(candidate, known) {
+						id := identity{user: sess.User.GetName(), groups: sess.User.GetGroups(), groupsKnown: true}
+						b.remember(user, password, id, revocations, now)
+						return id, nil
+					}
+				}
+			}
+		}
+	}
+
+	if b.Authenticator == nil || (b.DirectoryAllowed != nil && !b.DirectoryAllowed(user)) {
+		return identity{}, errBasicInvalid
+	}
+	verified, err := b.Authenticator.Authenticate(user, password)
+	if err != nil {
+		return identity{}, err
+	}
+	id := identity{user: NormalizeUser(verified.GetName()), groups: verified.GetGroups(), groupsKnown: true}
+	b.remember(user, password, id, revocations, now)
+	return id, nil
+}
+
+func revocationsOf(sessionManager *session.Manager, user string) uint64 {
+	if sessionManager == nil {
+		return 0
+	}
+	return sessionManager.Revocations(user)
+}
+
+// basicDomains lists the NTLM domains a session hash may have been built
+// with: the gateway domain and the one the client typed, if any.
+func basicDomains(rawUser, fallback string) []string {
+	domains := []string{fallback}
+	if idx := strings.LastIndex(rawUser, `\`); idx > 0 && rawUser[:idx] != fallback {
+		domains = append(domains, rawUser[:idx])
+	}
+	return domains
+}
+
+func (b *BasicAuth) mac(user, password string) []byte {
+	m := hmac.New(sha256.New, b.cacheKey)
+	m.Write([]byte(strings.ToLower(user)))
+	m.Write([]byte{0})
+	m.Write([]byte(password))
+	return m.Sum(nil)
+}
+
+func (b *BasicAuth) cached(sessionManager *session.Manager, user, password string, now time.Time) (identity, bool) {
+	if b.CacheTTL <= 0 {
+		return identity{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.cache[strings.ToLower(user)]
+	if !ok || b.cacheKey == nil {
+		return identity{}, false
+	}
+	if now.After(entry.expires) || entry.revocations != revocationsOf(sessionManager, user) ||
+		(b.Disabled != nil && b.Disabled(entry.id.user)) {
+		delete(b.cache, strings.ToLower(user))
+		return identity{}, false
+	}
+	if !hmac.Equal(entry.mac, b.mac(user, password)) {
+		return identity{}, false
+	}
+	return entry.id, true
+}
+
+func (b *BasicAuth) remember(user, password string, id identity, revocations uint64, now time.Time) {
+	if b.CacheTTL <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cacheKey == nil {
+		b.cacheKey = make([]byte, 32)
+		if _, err := rand.Read(b.cacheKey); err != nil {
+			b.cacheKey = nil
+			return
+		}
+	}
+	if b.cache == nil {
+		b.cache = make(map[string]basicCacheEntry)
+	}
+	if len(b.cache) >= basicCacheMaxEntries {
+		for key, entry := range b.cache {
+			if now.After(entry.expires) {
+				delete(b.cache, key)
+			}
+		}
+	}
+	if len(b.cache) >= basicCacheMaxEntries {
+		return
+	}
+	b.cache[strings.ToLower(user)] = basicCacheEntry{
+		mac:         b.mac(user, password),
+		id:          id,
+		revocations: revocations,
+		expires:     now.Add(b.CacheTTL),
+	}
+}
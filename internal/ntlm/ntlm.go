@@ -7,6 +7,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"remotegateway/internal/clientcert"
 	"remotegateway/internal/contextKey"
 	"remotegateway/internal/hash"
 	"remotegateway/internal/rdpgw/common"
@@ -342,64 +343,125 @@ func buildTestNTLMToken(messageType uint32) []byte {
 	return token
 }
 
-func BasicAuthMiddleware(authenticator *StaticAuth, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, err := authenticator.Authenticate(r.Context(), r)
-		if err != nil {
-			isRDG := r.URL.Path == "/remoteDesktopGateway" || strings.HasPrefix(r.URL.Path, "/remoteDesktopGateway/")
-			var challenge AuthChallenge
-			if errors.As(err, &challenge) {
-				scheme, token := splitAuthHeader(challenge.Header)
-				var authHeaders []string
-				if isRDG {
-					authHeaders = append(authHeaders, challenge.Header)
-					if strings.EqualFold(scheme, "Negotiate") && token != "" {
-						authHeaders = append(authHeaders, "NTLM "+token)
-					}
-				} else {
-					authHeaders = append(authHeaders, challenge.Header)
-					if strings.EqualFold(scheme, "Negotiate") && token != "" {
-						authHeaders = append(authHeaders, "NTLM "+token)
-					}
-					authHeaders = append(authHeaders, `Basic realm="rdpgw"`)
+// ntlmAuthenticate runs the NTLM handshake and writes the challenge or error
+// response when the request is not authenticated yet.
+func ntlmAuthenticate(authenticator *StaticAuth, w http.ResponseWriter, r *http.Request) (identity, bool) {
+	id, err := authenticator.authenticate(r.Context(), r)
+	if err != nil {
+		isRDG := r.URL.Path == "/remoteDesktopGateway" || strings.HasPrefix(r.URL.Path, "/remoteDesktopGateway/")
+		var challenge AuthChallenge
+		if errors.As(err, &challenge) {
+			scheme, token := splitAuthHeader(challenge.Header)
+			var authHeaders []string
+			if isRDG {
+				authHeaders = append(authHeaders, challenge.Header)
+				if strings.EqualFold(scheme, "Negotiate") && token != "" {
+					authHeaders = append(authHeaders, "NTLM "+token)
 				}
-				for _, header := range authHeaders {
-					w.Header().Add("WWW-Authenticate", header)
+			} else {
+				authHeaders = append(authHeaders, challenge.Header)
+				if strings.EqualFold(scheme, "Negotiate") && token != "" {
+					authHeaders = append(authHeaders, "NTLM "+token)
+				}
+				if authenticator.Basic != nil {
+					authHeaders = append(authHeaders, `Basic realm="rdpgw"`)
 				}
-				log.Printf(
-					"Gateway auth challenge: scheme=%s remote=%s client_ip=%s method=%s path=%s conn_id=%s www_authenticate=%q",
-					scheme,
-					r.RemoteAddr,
-					common.GetClientIp(r.Context()),
-					r.Method,
-					r.URL.Path,
-					r.Header.Get("Rdg-Connection-Id"),
-					strings.Join(authHeaders, " | "),
-				)
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
-				return
 			}
-
+			for _, header := range authHeaders {
+				w.Header().Add("WWW-Authenticate", header)
+			}
 			log.Printf(
-				"Gateway auth failed: remote=%s client_ip=%s method=%s path=%s conn_id=%s err=%v",
+				"Gateway auth challenge: scheme=%s remote=%s client_ip=%s method=%s path=%s conn_id=%s www_authenticate=%q",
+				scheme,
 				r.RemoteAddr,
 				common.GetClientIp(r.Context()),
 				r.Method,
 				r.URL.Path,
 				r.Header.Get("Rdg-Connection-Id"),
-				err,
+				strings.Join(authHeaders, " | "),
 			)
-			if isRDG {
-				w.Header().Add("WWW-Authenticate", "NTLM")
-				w.Header().Add("WWW-Authenticate", "Negotiate")
-			} else {
-				w.Header().Set("WWW-Authenticate", `Basic realm="rdpgw"`)
-			}
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return identity{}, false
+		}
+
+		log.Printf(
+			"Gateway auth failed: remote=%s client_ip=%s method=%s path=%s conn_id=%s err=%v",
+			r.RemoteAddr,
+			common.GetClientIp(r.Context()),
+			r.Method,
+			r.URL.Path,
+			r.Header.Get("Rdg-Connection-Id"),
+			err,
+		)
+		if isRDG || authenticator.Basic == nil {
+			w.Header().Add("WWW-Authenticate", "NTLM")
+			w.Header().Add("WWW-Authenticate", "Negotiate")
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rdpgw"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return identity{}, false
+	}
+	return id, true
+}
+
+func BasicAuthMiddleware(authenticator *StaticAuth, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert, hasCert := authenticator.ClientCertMapper.Identity(r.TLS)
+		mode := authenticator.ClientCertMode
+		var id identity
+		switch {
+		case hasCert && (mode == clientcert.ModeOptional || mode == clientcert.ModeRequired):
+			id.user = cert.User
+			log.Printf(
+				"Gateway client certificate auth: user=%s subject=%q fingerprint=%s remote=%s path=%s",
+				id.user, cert.Subject, cert.Fingerprint, r.RemoteAddr, r.URL.Path,
+			)
+		case mode == clientcert.ModeRequired:
+			log.Printf("Gateway client certificate missing: remote=%s client_ip=%s path=%s", r.RemoteAddr, common.GetClientIp(r.Context()), r.URL.Path)
+			http.Error(w, "client certificate required", http.StatusForbidden)
 			return
+		default:
+			var ok bool
+			if id, ok = ntlmAuthenticate(authenticator, w, r); !ok {
+				return
+			}
+			if mode == clientcert.ModeFactor && (!hasCert || !strings.EqualFold(cert.User, id.user)) {
+				log.Printf(
+					"Gateway client certificate mismatch: user=%s cert_user=%q remote=%s path=%s",
+					id.user, cert.User, r.RemoteAddr, r.URL.Path,
+				)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		user := id.user
+
+		if authenticator.SecondFactor != nil {
+			if err := authenticator.SecondFactor.Approve(r.Context(), user, common.GetClientIp(r.Context())); err != nil {
+				log.Printf(
+					"Gateway second factor denied: user=%s remote=%s client_ip=%s path=%s conn_id=%s err=%v",
+					user,
+					r.RemoteAddr,
+					common.GetClientIp(r.Context()),
+					r.URL.Path,
+					r.Header.Get("Rdg-Connection-Id"),
+					err,
+				)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
 		}
 
 		ctx := contextKey.WithAuthUser(r.Context(), user)
+		if groups, ok := authenticator.groupsOf(id); ok {
+			ctx = contextKey.WithAuthGroups(ctx, groups)
+		} else {
+			log.Printf("Gateway groups unknown: user=%s; group rules fail closed", user)
+		}
+		if hasCert {
+			ctx = contextKey.WithClientCert(ctx, cert)
+		}
 		log.Printf(
 			"Gateway connect: user=%s remote=%s client_ip=%s method=%s path=%s conn_id=%s ua=%q",
 			user,
@@ -414,6 +476,23 @@ func BasicAuthMiddleware(authenticator *StaticAuth, next http.Handler) http.Hand
 	})
 }
 
+// groupsOf returns the groups of the authenticated id: those its login
+// revealed, else those of its web session, else those of the Groups lookup.
+func (a *StaticAuth) groupsOf(id identity) ([]string, bool) {
+	if id.groupsKnown {
+		return id.groups, true
+	}
+	if a.SessionManager != nil {
+		if sess, ok := a.SessionManager.GetSessionFromUserName(id.user); ok && sess.User != nil {
+			return sess.User.GetGroups(), true
+		}
+	}
+	if a.Groups != nil {
+		return a.Groups(id.user)
+	}
+	return nil, false
+}
+
 func BuildTestNTLMv2Response(challenge []byte, user, domain, password string) []byte {
 	ntlmHash := hash.NtlmV2Hash(password, user, domain)
 	temp := []byte{0x10, 0x20, 0x30, 0x40}
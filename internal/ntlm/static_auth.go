@@ -9,6 +9,9 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"remotegateway/internal/clientcert"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/rdpgw/common"
 	"remotegateway/internal/rdpgw/protocol"
 	"remotegateway/internal/session"
 	"strings"
@@ -26,6 +29,27 @@ type StaticAuth struct {
 	mu             sync.Mutex
 	Challenges     map[string]NtlmChallengeState
 	SessionManager *session.Manager
+	// SecondFactor, when set, must approve every NTLM authenticated user
+	// before the request reaches the gateway.
+	SecondFactor SecondFactor
+	// Limiter, when set, counts failed NTLM logins. Locked out users get the
+	// same challenge as a wrong password.
+	Limiter *lockout.Limiter
+	// ClientCertMode is one of the clientcert modes; empty means off.
+	ClientCertMode   string
+	ClientCertMapper clientcert.Mapper
+	// Basic, when set, accepts HTTP Basic credentials over TLS for clients
+	// that do not speak NTLM.
+	Basic *BasicAuth
+	// Groups, when set, looks up the groups of a user whose login did not
+	// reveal them and who has no web session. It reports false when they
+	// cannot be determined.
+	Groups func(user string) ([]string, bool)
+}
+
+// SecondFactor approves an authenticated gateway user, e.g. via RADIUS.
+type SecondFactor interface {
+	Approve(ctx context.Context, user, clientIP string) error
 }
 
 const StaticUser = "testuser"
@@ -39,10 +63,26 @@ func (a AuthChallenge) Error() string {
 	return "authentication challenge"
 }
 
+// identity is an authenticated gateway user. Groups are set when the login
+// itself revealed them, as a directory password check does.
+type identity struct {
+	user        string
+	groups      []string
+	groupsKnown bool
+}
+
 func (a *StaticAuth) Authenticate(
 	ctx context.Context,
 	r *http.Request,
 ) (string, error) {
+	id, err := a.authenticate(ctx, r)
+	return id.user, err
+}
+
+func (a *StaticAuth) authenticate(
+	ctx context.Context,
+	r *http.Request,
+) (identity, error) {
 
 	fmt.Println(r)
 	authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
@@ -72,29 +112,32 @@ func (a *StaticAuth) Authenticate(
 	)
 	if authHeader != "" {
 		scheme, token := splitAuthHeader(authHeader)
+		if strings.EqualFold(scheme, "Basic") {
+			return a.authenticateBasic(r)
+		}
 		if scheme != "" && (strings.EqualFold(scheme, "NTLM") || strings.EqualFold(scheme, "Negotiate")) {
 			canonicalScheme := canonicalAuthScheme(scheme)
 			log.Printf("NTLM auth header: scheme=%s token_len=%d", canonicalScheme, len(token))
 			if token == "" {
-				return "", AuthChallenge{Header: canonicalScheme}
+				return identity{}, AuthChallenge{Header: canonicalScheme}
 			}
 			decoded, err := base64.StdEncoding.DecodeString(token)
 			if err != nil {
 				log.Printf("%s token decode failed from %s: %v", canonicalScheme, r.RemoteAddr, err)
-				return "", AuthChallenge{Header: canonicalScheme}
+				return identity{}, AuthChallenge{Header: canonicalScheme}
 			}
 			ntlmToken := decoded
 			if canonicalScheme == "Negotiate" {
 				ntlmToken, err = extractNTLMToken(decoded)
 				if err != nil {
 					log.Printf("Negotiate token missing NTLM for %s: %v", r.RemoteAddr, err)
-					return "", AuthChallenge{Header: canonicalScheme}
+					return identity{}, AuthChallenge{Header: canonicalScheme}
 				}
 			}
 			msgType, err := ntlmMessageType(ntlmToken)
 			if err != nil {
 				log.Printf("Invalid NTLM message from %s: %v", r.RemoteAddr, err)
-				return "", AuthChallenge{Header: canonicalScheme}
+				return identity{}, AuthChallenge{Header: canonicalScheme}
 			}
 			log.Printf(
 				"NTLM auth token: scheme=%s msg_type=%d decoded_len=%d",
@@ -107,22 +150,22 @@ func (a *StaticAuth) Authenticate(
 				flags, err := parseNTLMNegotiateFlags(ntlmToken)
 				if err != nil {
 					log.Printf("NTLM negotiate parse failed from %s: %v", r.RemoteAddr, err)
-					return "", a.ntlmChallengeError(r, canonicalScheme, nil)
+					return identity{}, a.ntlmChallengeError(r, canonicalScheme, nil)
 				}
 				log.Printf("NTLM negotiate flags: 0x%x", flags)
-				return "", a.ntlmChallengeError(r, canonicalScheme, &flags)
+				return identity{}, a.ntlmChallengeError(r, canonicalScheme, &flags)
 			case ntlmMessageTypeAuthenticate:
 				user, err := a.VerifyNTLMAuthenticate(r, ntlmToken, canonicalScheme)
 				if err != nil {
-					return "", err
+					return identity{}, err
 				}
-				return normalizeUser(user), nil
+				return identity{user: NormalizeUser(user)}, nil
 			default:
-				return "", AuthChallenge{Header: canonicalScheme}
+				return identity{}, AuthChallenge{Header: canonicalScheme}
 			}
 		}
 	}
-	return "", errors.New("authHeader missing or invalid")
+	return identity{}, errors.New("authHeader missing or invalid")
 }
 
 func splitAuthHeader(header string) (string, string) {
@@ -254,6 +297,15 @@ func (a *StaticAuth) VerifyNTLMAuthenticate(r *http.Request, data []byte, scheme
 		return "", a.ntlmChallengeError(r, scheme, nil)
 	}
 
+	limitUser := NormalizeUser(msg.UserName)
+	clientIP := common.RemoteHost(r)
+	if a.Limiter != nil {
+		if wait, locked := a.Limiter.Check(limitUser, clientIP, time.Now()); locked {
+			log.Printf("NTLM auth locked out: user=%q ip=%s retry_after=%s", msg.UserName, clientIP, wait.Truncate(time.Second))
+			return "", a.ntlmChallengeError(r, scheme, nil)
+		}
+	}
+
 	if a.SessionManager == nil {
 		log.Printf("NTLM auth failed, session manager not configured")
 		return "", a.ntlmChallengeError(r, scheme, nil)
@@ -262,10 +314,18 @@ func (a *StaticAuth) VerifyNTLMAuthenticate(r *http.Request, data []byte, scheme
 	userLdap, ok := a.SessionManager.GetSessionFromUserName(msg.UserName)
 	if !ok {
 		log.Printf("NTLM auth failed, user %q not found", msg.UserName)
+		a.recordFailure(limitUser, clientIP)
 		return "", a.ntlmChallengeError(r, scheme, nil)
 	}
 
-	if !verifyNTLMv2Response(challenge, userLdap.User.GetNtlmPassword(), msg.NtChallengeResponse) {
+	verified := false
+	for _, ntlmHash := range userLdap.User.NtlmHashes() {
+		if verifyNTLMv2Response(challenge, ntlmHash, msg.NtChallengeResponse) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
 		log.Printf(
 			"NTLM auth failed for user=%q domain=%q key=%s response_len=%d",
 			msg.UserName,
@@ -273,12 +333,27 @@ func (a *StaticAuth) VerifyNTLMAuthenticate(r *http.Request, data []byte, scheme
 			NtlmChallengeKey(r),
 			len(msg.NtChallengeResponse),
 		)
+		a.recordFailure(limitUser, clientIP)
 		return "", a.ntlmChallengeError(r, scheme, nil)
 	}
+	if a.Limiter != nil {
+		a.Limiter.Success(limitUser)
+	}
 	return msg.UserName, nil
 }
 
-func normalizeUser(user string) string {
+func (a *StaticAuth) recordFailure(user, clientIP string) {
+	if a.Limiter == nil {
+		return
+	}
+	if wait := a.Limiter.Failure(user, clientIP, time.Now()); wait > 0 {
+		log.Printf("NTLM lockout: user=%q ip=%s duration=%s", user, clientIP, wait)
+	}
+}
+
+// NormalizeUser strips a "DOMAIN\" prefix and an "@domain" suffix from a
+// login name.
+func NormalizeUser(user string) string {
 	user = strings.TrimSpace(user)
 	if user == "" {
 		return ""
@@ -0,0 +1,143 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"remotegateway/internal/oidc"
+	"remotegateway/internal/oidc/oidctest"
+)
+
+const testRedirectURL = "https://gw.example.com/login/oidc/callback"
+
+// authorize drives the mock provider's authorize endpoint and returns the
+// code it redirects back with.
+func authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected authorize redirect, got %d", resp.StatusCode)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlowWithPKCE(t *testing.T) {
+	mock := oidctest.NewProvider("gateway")
+	defer mock.Close()
+	mock.Username = "alice"
+	mock.Groups = []string{"vdi-admins", "staff"}
+
+	provider := oidc.NewProvider(oidc.Config{
+		IssuerURL:   mock.Issuer(),
+		ClientID:    "gateway",
+		RedirectURL: testRedirectURL,
+	})
+	ctx := context.Background()
+
+	verifier, err := oidc.NewPKCEVerifier()
+	if err != nil {
+		t.Fatalf("verifier: %v", err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("auth url: %v", err)
+	}
+	code, state := authorize(t, authURL)
+	if state != "state-1" || code == "" {
+		t.Fatalf("unexpected callback state=%q code=%q", state, code)
+	}
+
+	claims, err := provider.Exchange(ctx, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if claims.Username != "alice" || claims.Subject != "sub-alice" {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+	if !reflect.DeepEqual(claims.Groups, []string{"vdi-admins", "staff"}) {
+		t.Fatalf("unexpected groups %v", claims.Groups)
+	}
+}
+
+func TestExchangeRejectsWrongVerifierAndNonce(t *testing.T) {
+	mock := oidctest.NewProvider("gateway")
+	defer mock.Close()
+	provider := oidc.NewProvider(oidc.Config{
+		IssuerURL:   mock.Issuer(),
+		ClientID:    "gateway",
+		RedirectURL: testRedirectURL,
+	})
+	ctx := context.Background()
+
+	verifier, _ := oidc.NewPKCEVerifier()
+	authURL, err := provider.AuthCodeURL(ctx, "s", "n", verifier)
+	if err != nil {
+		t.Fatalf("auth url: %v", err)
+	}
+	code, _ := authorize(t, authURL)
+	if _, err := provider.Exchange(ctx, code, "wrong-verifier", "n"); err == nil {
+		t.Fatalf("expected PKCE failure")
+	}
+
+	authURL, _ = provider.AuthCodeURL(ctx, "s", "n", verifier)
+	code, _ = authorize(t, authURL)
+	if _, err := provider.Exchange(ctx, code, verifier, "other"); !errors.Is(err, oidc.ErrNonceInvalid) {
+		t.Fatalf("expected nonce mismatch, got %v", err)
+	}
+}
+
+func TestExchangeRejectsForeignAudience(t *testing.T) {
+	mock := oidctest.NewProvider("someone-else")
+	defer mock.Close()
+	provider := oidc.NewProvider(oidc.Config{
+		IssuerURL:   mock.Issuer(),
+		ClientID:    "someone-else",
+		RedirectURL: testRedirectURL,
+	})
+	ctx := context.Background()
+	verifier, _ := oidc.NewPKCEVerifier()
+	authURL, _ := provider.AuthCodeURL(ctx, "s", "n", verifier)
+	code, _ := authorize(t, authURL)
+
+	// Same provider, different relying party: the ID token audience no longer matches.
+	other := oidc.NewProvider(oidc.Config{
+		IssuerURL:   mock.Issuer(),
+		ClientID:    "gateway",
+		RedirectURL: testRedirectURL,
+	})
+	if _, err := other.Exchange(ctx, code, verifier, "n"); !errors.Is(err, oidc.ErrInvalidToken) {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+}
+
+func TestMapRoles(t *testing.T) {
+	mapping := oidc.ParseRoleMapping("vdi-admins=admin, contractors = contractor,broken")
+	groups := []string{"vdi-admins", "staff", "contractors", "staff"}
+
+	// Unmapped groups are dropped unless passthrough is on.
+	got := oidc.MapRoles(groups, mapping, false)
+	want := []string{"admin", "contractor"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	got = oidc.MapRoles(groups, mapping, true)
+	want = []string{"admin", "staff", "contractor"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v with passthrough, got %v", want, got)
+	}
+}
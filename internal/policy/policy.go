@@ -0,0 +1,465 @@
+// Package policy evaluates the gateway connection policy file.
+//
+// A policy is an ordered list of rules; the first rule matching a
+// connection decides it, and Default applies when none does. Rules are
+// evaluated at tunnel create, tunnel auth and channel create. Early stages
+// do not know the client name, target or port yet, so a decision is only
+// made there once no earlier rule could still match.
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Stage is the point of the gateway protocol a request is evaluated at.
+type Stage int
+
+const (
+	StageTunnelCreate Stage = iota
+	StageTunnelAuth
+	StageChannelCreate
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageTunnelCreate:
+		return "tunnel create"
+	case StageTunnelAuth:
+		return "tunnel auth"
+	default:
+		return "channel create"
+	}
+}
+
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// Policy is the parsed policy file.
+type Policy struct {
+	// Default is the action when no rule matches; deny when empty.
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule matches when every condition it sets matches. Empty conditions
+// match everything.
+type Rule struct {
+	Name   string `yaml:"name"`
+	Action string `yaml:"action"`
+
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+	// ClientIPs are CIDRs or single addresses.
+	ClientIPs []string `yaml:"client_ips"`
+	// ClientNames and Targets are shell patterns, compared case-insensitively.
+	ClientNames []string    `yaml:"client_names"`
+	Targets     []string    `yaml:"targets"`
+	Ports       []int       `yaml:"ports"`
+	Time        *TimeWindow `yaml:"time"`
+
+	// Redirect and Limits apply to tunnels the rule allows.
+	Redirect *Redirect `yaml:"redirect"`
+	Limits   Limits    `yaml:"limits"`
+
+	nets []*net.IPNet
+}
+
+// TimeWindow matches From until To on Days, in Timezone. A window whose To
+// is before From runs past midnight.
+type TimeWindow struct {
+	Days     []string `yaml:"days"`
+	From     string   `yaml:"from"`
+	To       string   `yaml:"to"`
+	Timezone string   `yaml:"timezone"`
+
+	days     map[time.Weekday]bool
+	from, to int
+	loc      *time.Location
+}
+
+// Redirect lists the device redirections a tunnel may use. Anything not
+// set to true is disabled.
+type Redirect struct {
+	Clipboard bool `yaml:"clipboard"`
+	Drive     bool `yaml:"drive"`
+	Printer   bool `yaml:"printer"`
+	Port      bool `yaml:"port"`
+	Pnp       bool `yaml:"pnp"`
+}
+
+// Limits restrict the sessions a rule allows. Zero means no limit.
+type Limits struct {
+	// MaxSessions caps the concurrent tunnels of the user.
+	MaxSessions int `yaml:"max_sessions"`
+	// IdleTimeoutMinutes is sent to the client, which disconnects when idle.
+	IdleTimeoutMinutes int `yaml:"idle_timeout_minutes"`
+	// MaxSessionMinutes closes the tunnel after that long.
+	MaxSessionMinutes int `yaml:"max_session_minutes"`
+}
+
+// Request describes a connection attempt. Fields not known at Stage are
+// ignored.
+type Request struct {
+	Stage      Stage
+	User       string
+	Groups     []string
+	ClientIP   string
+	ClientName string
+	Target     string
+	Port       int
+	Time       time.Time
+}
+
+// Decision is the outcome of Evaluate.
+type Decision struct {
+	Allow bool
+	// Final is false when a rule depending on fields not known at this stage
+	// could still match. The connection proceeds and is decided later.
+	Final bool
+	// Rule is the deciding rule's label, empty for the default action.
+	Rule     string
+	Redirect *Redirect
+	Limits   Limits
+	// Trace explains each rule that was considered.
+	Trace []string
+}
+
+// Load reads a policy from a YAML or JSON file.
+func Load(file string) (*Policy, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return p, nil
+}
+
+// Parse decodes and validates a policy. JSON is accepted as YAML.
+func Parse(raw []byte) (*Policy, error) {
+	var p Policy
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) compile() error {
+	p.Default = strings.ToLower(strings.TrimSpace(p.Default))
+	if p.Default == "" {
+		p.Default = ActionDeny
+	}
+	if p.Default != ActionAllow && p.Default != ActionDeny {
+		return fmt.Errorf("%w: default must be allow or deny, got %q", ErrInvalidPolicy, p.Default)
+	}
+	for i := range p.Rules {
+		if err := p.Rules[i].compile(); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidPolicy, p.Rules[i].label(i), err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	r.Action = strings.ToLower(strings.TrimSpace(r.Action))
+	if r.Action != ActionAllow && r.Action != ActionDeny {
+		return fmt.Errorf("action must be allow or deny, got %q", r.Action)
+	}
+	r.nets = nil
+	for _, value := range r.ClientIPs {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("invalid client ip %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("invalid client ip %q", value)
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+	for _, pattern := range append(append([]string{}, r.ClientNames...), r.Targets...) {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	for _, port := range r.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if r.Limits.MaxSessions < 0 || r.Limits.IdleTimeoutMinutes < 0 || r.Limits.MaxSessionMinutes < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if r.Time != nil {
+		return r.Time.compile()
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (w *TimeWindow) compile() error {
+	w.days = nil
+	if len(w.Days) > 0 {
+		w.days = make(map[time.Weekday]bool, len(w.Days))
+		for _, day := range w.Days {
+			key := strings.ToLower(strings.TrimSpace(day))
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, ok := weekdays[key]
+			if !ok {
+				return fmt.Errorf("invalid day %q", day)
+			}
+			w.days[weekday] = true
+		}
+	}
+	var err error
+	if w.from, err = parseClock(w.From, 0); err != nil {
+		return err
+	}
+	if w.to, err = parseClock(w.To, 24*60); err != nil {
+		return err
+	}
+	w.loc = time.Local
+	if w.Timezone != "" {
+		if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", w.Timezone)
+		}
+	}
+	return nil
+}
+
+// parseClock returns the minute of the day of an "HH:MM" value.
+func parseClock(value string, empty int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return empty, nil
+	}
+	hh, mm, ok := strings.Cut(value, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", value)
+	}
+	return h*60 + m, nil
+}
+
+func (w *TimeWindow) matches(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from <= w.to {
+		return w.dayAllowed(day) && minute >= w.from && minute < w.to
+	}
+	// The window runs past midnight; the early part belongs to the day before.
+	if minute >= w.from {
+		return w.dayAllowed(day)
+	}
+	return minute < w.to && w.dayAllowed((day+6)%7)
+}
+
+func (w *TimeWindow) dayAllowed(day time.Weekday) bool {
+	return w.days == nil || w.days[day]
+}
+
+func (r *Rule) label(i int) string {
+	if r.Name != "" {
+		return fmt.Sprintf("rule %d (%s)", i+1, r.Name)
+	}
+	return fmt.Sprintf("rule %d", i+1)
+}
+
+// matchResult is the outcome of one rule against a request.
+type matchResult int
+
+const (
+	noMatch matchResult = iota
+	match
+	// pending means every known condition matched but the rule also
+	// depends on fields the stage does not know yet.
+	pending
+)
+
+func (r *Rule) match(req Request) (matchResult, string) {
+	if len(r.Users) > 0 && !containsFold(r.Users, req.User) && !containsFold(r.Users, "*") {
+		return noMatch, "user " + req.User + " not listed"
+	}
+	if len(r.Groups) > 0 && !anyFold(r.Groups, req.Groups) {
+		return noMatch, "no listed group"
+	}
+	if len(r.nets) > 0 && !r.ipMatches(req.ClientIP) {
+		return noMatch, "client ip " + req.ClientIP + " not in range"
+	}
+	if r.Time != nil && !r.Time.matches(req.Time) {
+		return noMatch, "outside time window"
+	}
+
+	var unknown []string
+	if len(r.ClientNames) > 0 {
+		if req.Stage < StageTunnelAuth {
+			unknown = append(unknown, "client name")
+		} else if !patternMatches(r.ClientNames, req.ClientName) {
+			return noMatch, "client name " + req.ClientName + " not matched"
+		}
+	}
+	if len(r.Targets) > 0 || len(r.Ports) > 0 {
+		if req.Stage < StageChannelCreate {
+			unknown = append(unknown, "target")
+		} else if len(r.Targets) > 0 && !patternMatches(r.Targets, req.Target) {
+			return noMatch, "target " + req.Target + " not matched"
+		} else if len(r.Ports) > 0 && !containsPort(r.Ports, req.Port) {
+			return noMatch, fmt.Sprintf("port %d not listed", req.Port)
+		}
+	}
+	if len(unknown) > 0 {
+		return pending, "depends on " + strings.Join(unknown, " and ") + ", not known at " + req.Stage.String()
+	}
+	return match, "matched"
+}
+
+// usesTarget reports whether the rule can only be decided at channel create.
+func (r *Rule) usesTarget() bool {
+	return len(r.Targets) > 0 || len(r.Ports) > 0
+}
+
+func (r *Rule) ipMatches(value string) bool {
+	host := value
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(strings.TrimSpace(host))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range r.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesGroups reports whether a rule depends on the groups of the user.
+func (p *Policy) UsesGroups() bool {
+	for i := range p.Rules {
+		if len(p.Rules[i].Groups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate decides req with the first matching rule.
+func (p *Policy) Evaluate(req Request) Decision {
+	var d Decision
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		result, why := rule.match(req)
+		d.Trace = append(d.Trace, fmt.Sprintf("%s [%s]: %s", rule.label(i), rule.Action, why))
+		switch result {
+		case pending:
+			d.Allow, d.Final = true, false
+			return d
+		case match:
+			d.Allow, d.Final = rule.Action == ActionAllow, true
+			d.Rule = rule.label(i)
+			d.Redirect, d.Limits = rule.Redirect, rule.Limits
+			return d
+		}
+	}
+	d.Allow, d.Final = p.Default == ActionAllow, true
+	d.Trace = append(d.Trace, "no rule matched: default "+p.Default)
+	return d
+}
+
+// TunnelSettings returns the redirect flags and limits for an authorized
+// tunnel. They are sent at tunnel auth, before the client names its target,
+// so they come from the first matching rule that does not depend on the
+// target or port. ok is false when no such rule matches.
+func (p *Policy) TunnelSettings(req Request) (rule string, redirect *Redirect, limits Limits, ok bool) {
+	if req.Stage > StageTunnelAuth {
+		req.Stage = StageTunnelAuth
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.usesTarget() {
+			continue
+		}
+		if result, _ := r.match(req); result == match {
+			return r.label(i), r.Redirect, r.Limits, true
+		}
+	}
+	return "", nil, Limits{}, false
+}
+
+func containsFold(values []string, want string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), want) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyFold(values, candidates []string) bool {
+	for _, c := range candidates {
+		if containsFold(values, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func patternMatches(patterns []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - name: block-kiosk
+    action: deny
+    client_names: ["kiosk-*"]
+  - name: contractors-office-hours
+    action: allow
+    groups: [contractors]
+    client_ips: [10.0.0.0/8]
+    time:
+      days: [mon, tue, wed, thu, fri]
+      from: "08:00"
+      to: "18:00"
+      timezone: UTC
+    redirect:
+      clipboard: true
+    limits:
+      max_sessions: 1
+      idle_timeout_minutes: 15
+  - name: admins-rdp
+    action: allow
+    groups: [admins]
+    targets: ["prod-*"]
+    ports: [3389]
+  - name: staff
+    action: allow
+    users: [alice, bob]
+`
+
+// monday is a Monday inside the contractor window.
+var monday = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+
+func mustParse(t *testing.T, raw string) *Policy {
+	t.Helper()
+	p, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return p
+}
+
+func TestParseRejectsInvalidPolicies(t *testing.T) {
+	cases := map[string]string{
+		"unknown field":   "rules:\n  - action: allow\n    color: red\n",
+		"bad action":      "rules:\n  - action: maybe\n",
+		"bad default":     "default: perhaps\n",
+		"bad cidr":        "rules:\n  - action: allow\n    client_ips: [10.0.0.0/99]\n",
+		"bad port":        "rules:\n  - action: allow\n    ports: [70000]\n",
+		"bad pattern":     "rules:\n  - action: allow\n    targets: [\"[\"]\n",
+		"bad day":         "rules:\n  - action: allow\n    time: {days: [someday]}\n",
+		"bad clock":       "rules:\n  - action: allow\n    time: {from: \"25:00\"}\n",
+		"bad timezone":    "rules:\n  - action: allow\n    time: {timezone: Mars/Base}\n",
+		"negative limits": "rules:\n  - action: allow\n    limits: {max_sessions: -1}\n",
+	}
+	for name, raw := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(raw)); !errors.Is(err, ErrInvalidPolicy) {
+				t.Fatalf("expected ErrInvalidPolicy, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseAcceptsJSONAndEmptyFiles(t *testing.T) {
+	p := mustParse(t, `{"default": "allow", "rules": [{"action": "deny", "users": ["eve"]}]}`)
+	if p.Default != ActionAllow || len(p.Rules) != 1 {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+	empty := mustParse(t, "")
+	if d := empty.Evaluate(Request{User: "alice"}); d.Allow {
+		t.Fatal("expected an empty policy to deny")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte("rules:\n  - action: nope\n"), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	_, err := Load(file)
+	if !errors.Is(err, ErrInvalidPolicy) || !strings.Contains(err.Error(), file) {
+		t.Fatalf("expected an invalid policy error naming the file, got %v", err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p := mustParse(t, testPolicy)
+	cases := []struct {
+		name  string
+		req   Request
+		allow bool
+		final bool
+		rule  string
+	}{
+		{
+			name:  "client name rule is pending at tunnel create",
+			req:   Request{Stage: StageTunnelCreate, User: "mallory", Time: monday},
+			allow: true,
+		},
+		{
+			name:  "kiosk denied at tunnel auth",
+			req:   Request{Stage: StageTunnelAuth, User: "alice", ClientName: "KIOSK-7", Time: monday},
+			final: true,
+			rule:  "rule 1 (block-kiosk)",
+		},
+		{
+			name:  "contractor inside window",
+			req:   Request{Stage: StageTunnelAuth, User: "carol", Groups: []string{"Contractors"}, ClientIP: "10.1.2.3:5000", ClientName: "laptop", Time: monday},
+			allow: true,
+			final: true,
+			rule:  "rule 2 (contractors-office-hours)",
+		},
+		{
+			name:  "contractor outside network falls to default",
+			req:   Request{Stage: StageChannelCreate, User: "carol", Groups: []string{"contractors"}, ClientIP: "192.0.2.1", ClientName: "laptop", Target: "dev-1", Port: 3389, Time: monday},
+			final: true,
+		},
+		{
+			name:  "target rule is pending at tunnel auth",
+			req:   Request{Stage: StageTunnelAuth, User: "dave", Groups: []string{"admins"}, ClientName: "laptop", Time: monday},
+			allow: true,
+		},
+		{
+			name:  "admin reaches prod on rdp port",
+			req:   Request{Stage: StageChannelCreate, User: "dave", Groups: []string{"admins"}, ClientName: "laptop", Target: "prod-db", Port: 3389, Time: monday},
+			allow: true,
+			final: true,
+			rule:  "rule 3 (admins-rdp)",
+		},
+		{
+			name:  "admin on other port falls to default",
+			req:   Request{Stage: StageChannelCreate, User: "dave", Groups: []string{"admins"}, ClientName: "laptop", Target: "prod-db", Port: 22, Time: monday},
+			final: true,
+		},
+		{
+			name:  "listed user",
+			req:   Request{Stage: StageChannelCreate, User: "bob", ClientName: "laptop", Target: "anything", Port: 3389, Time: monday},
+			allow: true,
+			final: true,
+			rule:  "rule 4 (staff)",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := p.Evaluate(tc.req)
+			if d.Allow != tc.allow || d.Final != tc.final || d.Rule != tc.rule {
+				t.Fatalf("got allow=%t final=%t rule=%q, want allow=%t final=%t rule=%q\n%s",
+					d.Allow, d.Final, d.Rule, tc.allow, tc.final, tc.rule, strings.Join(d.Trace, "\n"))
+			}
+		})
+	}
+}
+
+func TestUsesGroups(t *testing.T) {
+	if !mustParse(t, testPolicy).UsesGroups() {
+		t.Fatal("expected the contractor rule to use groups")
+	}
+	if mustParse(t, "rules: [{action: allow, users: [alice]}]").UsesGroups() {
+		t.Fatal("expected a user rule not to use groups")
+	}
+}
+
+func TestEvaluateTrace(t *testing.T) {
+	p := mustParse(t, testPolicy)
+	d := p.Evaluate(Request{Stage: StageChannelCreate, User: "mallory", ClientName: "laptop", Target: "x", Port: 3389, Time: monday})
+	if d.Allow {
+		t.Fatal("expected deny")
+	}
+	want := []string{
+		"rule 1 (block-kiosk) [deny]: client name laptop not matched",
+		"rule 2 (contractors-office-hours) [allow]: no listed group",
+		"rule 3 (admins-rdp) [allow]: no listed group",
+		"rule 4 (staff) [allow]: user mallory not listed",
+		"no rule matched: default deny",
+	}
+	if strings.Join(d.Trace, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected trace:\n%s", strings.Join(d.Trace, "\n"))
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	p := mustParse(t, `
+rules:
+  - action: allow
+    time: {days: [fri], from: "22:00", to: "06:00", timezone: UTC}
+`)
+	friday := time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		at    time.Time
+		allow bool
+	}{
+		"friday evening":         {friday.Add(23 * time.Hour), true},
+		"saturday early morning": {friday.Add(29 * time.Hour), true},
+		"saturday after window":  {friday.Add(31 * time.Hour), false},
+		"friday early morning":   {friday.Add(2 * time.Hour), false},
+		"saturday evening":       {friday.Add(47 * time.Hour), false},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d := p.Evaluate(Request{Stage: StageChannelCreate, User: "alice", Time: tc.at})
+			if d.Allow != tc.allow {
+				t.Fatalf("at %s: got allow=%t, want %t", tc.at, d.Allow, tc.allow)
+			}
+		})
+	}
+}
+
+func TestTunnelSettings(t *testing.T) {
+	p := mustParse(t, testPolicy)
+	rule, redirect, limits, ok := p.TunnelSettings(Request{
+		Stage:      StageChannelCreate,
+		User:       "carol",
+		Groups:     []string{"contractors"},
+		ClientIP:   "10.0.0.5",
+		ClientName: "laptop",
+		Time:       monday,
+	})
+	if !ok || rule != "rule 2 (contractors-office-hours)" {
+		t.Fatalf("unexpected rule %q ok=%t", rule, ok)
+	}
+	if redirect == nil || !redirect.Clipboard || redirect.Drive {
+		t.Fatalf("unexpected redirect %+v", redirect)
+	}
+	if limits.MaxSessions != 1 || limits.IdleTimeoutMinutes != 15 {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+
+	// Rules with target conditions never provide tunnel settings.
+	if _, _, _, ok := p.TunnelSettings(Request{User: "dave", Groups: []string{"admins"}, ClientName: "laptop", Time: monday}); ok {
+		t.Fatal("expected no tunnel settings for a target-only rule")
+	}
+}
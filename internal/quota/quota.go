@@ -0,0 +1,190 @@
+// Package quota limits the VM resources each user may hold.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrExceeded is returned by Check when a request does not fit.
+	ErrExceeded = errors.New("quota exceeded")
+	// ErrInvalid is returned for malformed quota settings.
+	ErrInvalid = errors.New("invalid quota")
+)
+
+// Limits caps the resources of one user. Zero means unlimited.
+type Limits struct {
+	VMs       int `json:"vms"`
+	VCPU      int `json:"vcpu"`
+	MemoryMiB int `json:"memoryMiB"`
+	DiskGB    int `json:"diskGB"`
+}
+
+// Usage is what a user holds. VMs and DiskGB count every owned VM, VCPU and
+// MemoryMiB only the running ones.
+type Usage struct {
+	VMs       int `json:"vms"`
+	VCPU      int `json:"vcpu"`
+	MemoryMiB int `json:"memoryMiB"`
+	DiskGB    int `json:"diskGB"`
+}
+
+// Add returns the sum of u and other.
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		VMs:       u.VMs + other.VMs,
+		VCPU:      u.VCPU + other.VCPU,
+		MemoryMiB: u.MemoryMiB + other.MemoryMiB,
+		DiskGB:    u.DiskGB + other.DiskGB,
+	}
+}
+
+// Check returns an ErrExceeded error naming the first resource where
+// usage plus request exceeds l. Resources the request does not add to are
+// not checked, so users already over a lowered limit can still act on
+// what they hold.
+func (l Limits) Check(usage, request Usage) error {
+	checks := []struct {
+		name        string
+		limit, used int
+		requested   int
+		unit        string
+	}{
+		{"VM", l.VMs, usage.VMs, request.VMs, ""},
+		{"vCPU", l.VCPU, usage.VCPU, request.VCPU, ""},
+		{"memory", l.MemoryMiB, usage.MemoryMiB, request.MemoryMiB, " MiB"},
+		{"disk", l.DiskGB, usage.DiskGB, request.DiskGB, " GB"},
+	}
+	for _, c := range checks {
+		if c.limit > 0 && c.requested > 0 && c.used+c.requested > c.limit {
+			return fmt.Errorf("%w: %s quota is %d%s, %d%s in use and %d%s requested",
+				ErrExceeded, c.name, c.limit, c.unit, c.used, c.unit, c.requested, c.unit)
+		}
+	}
+	return nil
+}
+
+// Config holds the limits of every user.
+type Config struct {
+	Default Limits
+	// Groups hold group defaults; a user in several groups gets the most
+	// generous value of each resource.
+	Groups map[string]Limits
+	// Users override Default and Groups completely.
+	Users map[string]Limits
+}
+
+// Unlimited reports whether c limits nobody.
+func (c Config) Unlimited() bool {
+	return c.Default == (Limits{}) && len(c.Groups) == 0 && len(c.Users) == 0
+}
+
+// For returns the limits of username with groups.
+func (c Config) For(username string, groups []string) Limits {
+	for name, limits := range c.Users {
+		if strings.EqualFold(name, username) {
+			return limits
+		}
+	}
+	var merged Limits
+	found := false
+	for _, group := range groups {
+		for name, limits := range c.Groups {
+			if !strings.EqualFold(name, group) {
+				continue
+			}
+			if !found {
+				merged, found = limits, true
+				continue
+			}
+			merged = Limits{
+				VMs:       generous(merged.VMs, limits.VMs),
+				VCPU:      generous(merged.VCPU, limits.VCPU),
+				MemoryMiB: generous(merged.MemoryMiB, limits.MemoryMiB),
+				DiskGB:    generous(merged.DiskGB, limits.DiskGB),
+			}
+		}
+	}
+	if found {
+		return merged
+	}
+	return c.Default
+}
+
+// generous returns the larger limit, where zero is unlimited.
+func generous(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// Parse reads the quota settings. defaults is a limit list such as
+// "vms=3,vcpu=8,memory=8192,disk=120"; groups and users are
+// "name:limits" entries separated by ";".
+func Parse(defaults, groups, users string) (Config, error) {
+	var c Config
+	var err error
+	if c.Default, err = ParseLimits(defaults); err != nil {
+		return Config{}, err
+	}
+	if c.Groups, err = parseNamed(groups); err != nil {
+		return Config{}, err
+	}
+	if c.Users, err = parseNamed(users); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+func parseNamed(value string) (map[string]Limits, error) {
+	named := make(map[string]Limits)
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: want name:limits, got %q", ErrInvalid, entry)
+		}
+		limits, err := ParseLimits(list)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		named[name] = limits
+	}
+	return named, nil
+}
+
+// ParseLimits reads a comma separated list of vms, vcpu, memory (MiB) and
+// disk (GB) limits. Missing resources are unlimited.
+func ParseLimits(value string) (Limits, error) {
+	var l Limits
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		key, raw, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if !ok || err != nil || n < 0 {
+			return Limits{}, fmt.Errorf("%w: want resource=number, got %q", ErrInvalid, item)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "vms":
+			l.VMs = n
+		case "vcpu":
+			l.VCPU = n
+		case "memory":
+			l.MemoryMiB = n
+		case "disk":
+			l.DiskGB = n
+		default:
+			return Limits{}, fmt.Errorf("%w: unknown resource %q", ErrInvalid, key)
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,73 @@
+package quota
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse("vms=2, vcpu=8", "staff:vms=5,vcpu=16,memory=16384; contractors:vms=1", "Alice:vms=10")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if c.Default != (Limits{VMs: 2, VCPU: 8}) {
+		t.Fatalf("unexpected default %+v", c.Default)
+	}
+	if c.Groups["staff"] != (Limits{VMs: 5, VCPU: 16, MemoryMiB: 16384}) || c.Groups["contractors"] != (Limits{VMs: 1}) {
+		t.Fatalf("unexpected groups %+v", c.Groups)
+	}
+
+	for _, bad := range [][3]string{
+		{"vms=two", "", ""},
+		{"cores=4", "", ""},
+		{"vms=-1", "", ""},
+		{"", "staff", ""},
+		{"", "", ":vms=1"},
+	} {
+		if _, err := Parse(bad[0], bad[1], bad[2]); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected %q to be invalid, got %v", bad, err)
+		}
+	}
+	if empty, err := Parse("", "", ""); err != nil || !empty.Unlimited() {
+		t.Fatalf("expected empty settings to be unlimited, got %+v %v", empty, err)
+	}
+}
+
+func TestFor(t *testing.T) {
+	c, err := Parse("vms=2", "staff:vms=5,vcpu=16;ops:vms=3,vcpu=32,disk=100", "alice:vms=10")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	tests := []struct {
+		user   string
+		groups []string
+		want   Limits
+	}{
+		{"ALICE", []string{"staff"}, Limits{VMs: 10}},
+		{"bob", []string{"Staff"}, Limits{VMs: 5, VCPU: 16}},
+		// Disk is unlimited for staff, so a member of both gets no disk limit.
+		{"carol", []string{"staff", "ops"}, Limits{VMs: 5, VCPU: 32}},
+		{"dave", []string{"guests"}, Limits{VMs: 2}},
+	}
+	for _, tt := range tests {
+		if got := c.For(tt.user, tt.groups); got != tt.want {
+			t.Fatalf("For(%s, %v) = %+v, want %+v", tt.user, tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	limits := Limits{VMs: 2, VCPU: 8, MemoryMiB: 8192}
+	if err := limits.Check(Usage{VMs: 1, VCPU: 4, MemoryMiB: 4096}, Usage{VMs: 1, VCPU: 4, MemoryMiB: 4096, DiskGB: 40}); err != nil {
+		t.Fatalf("expected request within quota, got %v", err)
+	}
+	err := limits.Check(Usage{VMs: 1, VCPU: 6}, Usage{VMs: 1, VCPU: 4})
+	if !errors.Is(err, ErrExceeded) || !strings.Contains(err.Error(), "vCPU quota is 8, 6 in use and 4 requested") {
+		t.Fatalf("expected vCPU quota error, got %v", err)
+	}
+	// Resources the request does not add to are not checked.
+	if err := limits.Check(Usage{VMs: 3, VCPU: 0}, Usage{VCPU: 4, MemoryMiB: 4096}); err != nil {
+		t.Fatalf("expected start of an existing vm to pass the VM count, got %v", err)
+	}
+}
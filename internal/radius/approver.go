@@ -0,0 +1,114 @@
+package radius
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxChallengeRounds = 3
+
+var (
+	ErrRejected            = errors.New("radius: access rejected")
+	ErrChallengeUnanswered = errors.New("radius: challenge cannot be answered")
+)
+
+// Approver asks the RADIUS server to approve a gateway user. The gateway only
+// sees NTLM, so the configured Password (and ChallengeResponse for
+// Access-Challenge rounds) are sent on the user's behalf; MFA appliances use
+// them to select e.g. a push approval.
+type Approver struct {
+	Client            *Client
+	Password          string
+	ChallengeResponse string
+	// TTL caches an approval per user and client IP so the several HTTP
+	// requests of one RDP connection trigger a single approval.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	approved map[string]time.Time
+	inflight map[string]*approval
+}
+
+type approval struct {
+	done chan struct{}
+	err  error
+}
+
+func approvalKey(user, clientIP string) string {
+	return strings.ToLower(user) + "|" + clientIP
+}
+
+// Approve returns nil when the RADIUS server accepted user from clientIP.
+func (a *Approver) Approve(ctx context.Context, user, clientIP string) error {
+	key := approvalKey(user, clientIP)
+	now := time.Now()
+
+	a.mu.Lock()
+	if a.approved == nil {
+		a.approved = make(map[string]time.Time)
+		a.inflight = make(map[string]*approval)
+	}
+	if until, ok := a.approved[key]; ok && now.Before(until) {
+		a.mu.Unlock()
+		return nil
+	}
+	if pending, ok := a.inflight[key]; ok {
+		a.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	pending := &approval{done: make(chan struct{})}
+	a.inflight[key] = pending
+	a.mu.Unlock()
+
+	pending.err = a.exchange(ctx, user, clientIP)
+
+	a.mu.Lock()
+	delete(a.inflight, key)
+	if pending.err == nil && a.TTL > 0 {
+		a.approved[key] = time.Now().Add(a.TTL)
+	}
+	for k, until := range a.approved {
+		if now.After(until) {
+			delete(a.approved, k)
+		}
+	}
+	a.mu.Unlock()
+	close(pending.done)
+	return pending.err
+}
+
+func (a *Approver) exchange(ctx context.Context, user, clientIP string) error {
+	req := Request{Username: user, Password: a.Password, CallingStationID: clientIP}
+	for round := 0; ; round++ {
+		resp, err := a.Client.Exchange(ctx, req)
+		if err != nil {
+			return err
+		}
+		switch resp.Code {
+		case CodeAccessAccept:
+			return nil
+		case CodeAccessReject:
+			if resp.ReplyMessage != "" {
+				return fmt.Errorf("%w: %s", ErrRejected, resp.ReplyMessage)
+			}
+			return ErrRejected
+		case CodeAccessChallenge:
+			if a.ChallengeResponse == "" || round+1 >= maxChallengeRounds {
+				return fmt.Errorf("%w: %q", ErrChallengeUnanswered, resp.ReplyMessage)
+			}
+			req.Password = a.ChallengeResponse
+			req.State = resp.State
+		default:
+			return fmt.Errorf("radius: unexpected reply %s", resp.Code)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package radius
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultTimeout       = 30 * time.Second
+	defaultRetryInterval = 3 * time.Second
+)
+
+// Client sends Access-Requests over UDP. Requests are retransmitted every
+// RetryInterval until a valid reply arrives or Timeout elapses, which leaves
+// room for push based approvals that wait on the user.
+type Client struct {
+	Addr          string
+	Secret        []byte
+	NASIdentifier string
+	Timeout       time.Duration
+	RetryInterval time.Duration
+}
+
+type Request struct {
+	Username string
+	Password string
+	// State echoes the State attribute of a previous Access-Challenge.
+	State            []byte
+	CallingStationID string
+}
+
+type Response struct {
+	Code         Code
+	State        []byte
+	ReplyMessage string
+}
+
+func (c *Client) Exchange(ctx context.Context, req Request) (*Response, error) {
+	if c.Addr == "" || len(c.Secret) == 0 {
+		return nil, errors.New("radius: server address and secret are required")
+	}
+	packet, err := c.buildRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := EncodeRequest(packet, c.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	retry := c.RetryInterval
+	if retry <= 0 {
+		retry = defaultRetryInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("radius: dial %s: %w", c.Addr, err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, maxPacketLen)
+	for {
+		if _, err := conn.Write(raw); err != nil {
+			return nil, fmt.Errorf("radius: send: %w", err)
+		}
+		resend := time.Now().Add(retry)
+		for {
+			deadline := resend
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return nil, err
+			}
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					return nil, fmt.Errorf("radius: receive: %w", err)
+				}
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("radius: no reply from %s: %w", c.Addr, ctx.Err())
+				}
+				break
+			}
+			if n < headerLen || buf[1] != packet.Identifier {
+				continue
+			}
+			if err := VerifyResponse(buf[:n], packet, c.Secret); err != nil {
+				// A forged or corrupted datagram; keep waiting for the real reply.
+				continue
+			}
+			reply, err := Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			return responseFromPacket(reply), nil
+		}
+	}
+}
+
+func (c *Client) buildRequest(req Request) (*Packet, error) {
+	packet := &Packet{Code: CodeAccessRequest}
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	packet.Identifier = id[0]
+	if _, err := rand.Read(packet.Authenticator[:]); err != nil {
+		return nil, err
+	}
+
+	packet.Add(AttrUserName, []byte(req.Username))
+	hidden, err := EncryptPassword([]byte(req.Password), c.Secret, packet.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+	packet.Add(AttrUserPassword, hidden)
+	if c.NASIdentifier != "" {
+		packet.Add(AttrNASIdentifier, []byte(c.NASIdentifier))
+	}
+	if req.CallingStationID != "" {
+		packet.Add(AttrCallingStationID, []byte(req.CallingStationID))
+	}
+	if len(req.State) > 0 {
+		packet.Add(AttrState, req.State)
+	}
+	return packet, nil
+}
+
+func responseFromPacket(p *Packet) *Response {
+	resp := &Response{Code: p.Code}
+	if state, ok := p.Get(AttrState); ok {
+		resp.State = state
+	}
+	for _, attr := range p.Attributes {
+		if attr.Type == AttrReplyMessage {
+			resp.ReplyMessage += string(attr.Value)
+		}
+	}
+	return resp
+}
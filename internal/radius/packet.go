@@ -0,0 +1,284 @@
+// Package radius implements the subset of RFC 2865 needed to ask an external
+// RADIUS server (e.g. an MFA appliance) to approve gateway connections.
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+type Code byte
+
+const (
+	CodeAccessRequest   Code = 1
+	CodeAccessAccept    Code = 2
+	CodeAccessReject    Code = 3
+	CodeAccessChallenge Code = 11
+)
+
+func (c Code) String() string {
+	switch c {
+	case CodeAccessRequest:
+		return "Access-Request"
+	case CodeAccessAccept:
+		return "Access-Accept"
+	case CodeAccessReject:
+		return "Access-Reject"
+	case CodeAccessChallenge:
+		return "Access-Challenge"
+	default:
+		return fmt.Sprintf("Code(%d)", byte(c))
+	}
+}
+
+type AttributeType byte
+
+const (
+	AttrUserName             AttributeType = 1
+	AttrUserPassword         AttributeType = 2
+	AttrReplyMessage         AttributeType = 18
+	AttrState                AttributeType = 24
+	AttrCallingStationID     AttributeType = 31
+	AttrNASIdentifier        AttributeType = 32
+	AttrMessageAuthenticator AttributeType = 80
+)
+
+const (
+	headerLen     = 20
+	maxPacketLen  = 4096
+	authLen       = 16
+	maxAttrValue  = 253
+	passwordBlock = 16
+	maxPassword   = 128
+)
+
+var ErrMalformed = errors.New("radius: malformed packet")
+
+type Attribute struct {
+	Type  AttributeType
+	Value []byte
+}
+
+type Packet struct {
+	Code          Code
+	Identifier    byte
+	Authenticator [authLen]byte
+	Attributes    []Attribute
+}
+
+// Get returns the first attribute of type t.
+func (p *Packet) Get(t AttributeType) ([]byte, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Type == t {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Packet) Add(t AttributeType, value []byte) {
+	p.Attributes = append(p.Attributes, Attribute{Type: t, Value: value})
+}
+
+func (p *Packet) encodeAttributes() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, attr := range p.Attributes {
+		if len(attr.Value) > maxAttrValue {
+			return nil, fmt.Errorf("radius: attribute %d too long", attr.Type)
+		}
+		buf.WriteByte(byte(attr.Type))
+		buf.WriteByte(byte(len(attr.Value) + 2))
+		buf.Write(attr.Value)
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode serializes the packet as is, without computing authenticators.
+func (p *Packet) Encode() ([]byte, error) {
+	attrs, err := p.encodeAttributes()
+	if err != nil {
+		return nil, err
+	}
+	length := headerLen + len(attrs)
+	if length > maxPacketLen {
+		return nil, fmt.Errorf("radius: packet too long")
+	}
+	out := make([]byte, length)
+	out[0] = byte(p.Code)
+	out[1] = p.Identifier
+	binary.BigEndian.PutUint16(out[2:4], uint16(length))
+	copy(out[4:20], p.Authenticator[:])
+	copy(out[20:], attrs)
+	return out, nil
+}
+
+func Parse(data []byte) (*Packet, error) {
+	if len(data) < headerLen {
+		return nil, ErrMalformed
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < headerLen || length > len(data) || length > maxPacketLen {
+		return nil, ErrMalformed
+	}
+	p := &Packet{Code: Code(data[0]), Identifier: data[1]}
+	copy(p.Authenticator[:], data[4:20])
+	rest := data[headerLen:length]
+	for len(rest) > 0 {
+		if len(rest) < 2 || int(rest[1]) < 2 || int(rest[1]) > len(rest) {
+			return nil, ErrMalformed
+		}
+		value := append([]byte(nil), rest[2:rest[1]]...)
+		p.Attributes = append(p.Attributes, Attribute{Type: AttributeType(rest[0]), Value: value})
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+// EncodeRequest serializes an Access-Request whose Authenticator is already
+// set, adding a Message-Authenticator attribute.
+func EncodeRequest(p *Packet, secret []byte) ([]byte, error) {
+	return encodeWithMessageAuthenticator(p, secret, p.Authenticator)
+}
+
+// EncodeResponse serializes a reply to request, computing the
+// Message-Authenticator and Response Authenticator.
+func EncodeResponse(p *Packet, request *Packet, secret []byte) ([]byte, error) {
+	p.Identifier = request.Identifier
+	out, err := encodeWithMessageAuthenticator(p, secret, request.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+	copy(out[4:20], request.Authenticator[:])
+	sum := responseAuthenticator(out, secret)
+	copy(out[4:20], sum[:])
+	return out, nil
+}
+
+// encodeWithMessageAuthenticator computes the HMAC-MD5 over the packet with
+// the authenticator field set to auth, as required by RFC 3579.
+func encodeWithMessageAuthenticator(p *Packet, secret []byte, auth [authLen]byte) ([]byte, error) {
+	withMA := *p
+	withMA.Attributes = make([]Attribute, 0, len(p.Attributes)+1)
+	for _, attr := range p.Attributes {
+		if attr.Type != AttrMessageAuthenticator {
+			withMA.Attributes = append(withMA.Attributes, attr)
+		}
+	}
+	withMA.Add(AttrMessageAuthenticator, make([]byte, md5.Size))
+	withMA.Authenticator = auth
+	out, err := withMA.Encode()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(md5.New, secret)
+	mac.Write(out)
+	copy(out[len(out)-md5.Size:], mac.Sum(nil))
+	copy(out[4:20], p.Authenticator[:])
+	return out, nil
+}
+
+func responseAuthenticator(raw []byte, secret []byte) [md5.Size]byte {
+	h := md5.New()
+	h.Write(raw)
+	h.Write(secret)
+	var sum [md5.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// VerifyResponse checks the Response Authenticator and, when present, the
+// Message-Authenticator of a raw reply to request.
+func VerifyResponse(raw []byte, request *Packet, secret []byte) error {
+	if len(raw) < headerLen {
+		return ErrMalformed
+	}
+	length := int(binary.BigEndian.Uint16(raw[2:4]))
+	if length < headerLen || length > len(raw) {
+		return ErrMalformed
+	}
+	raw = raw[:length]
+	check := append([]byte(nil), raw...)
+	copy(check[4:20], request.Authenticator[:])
+	want := responseAuthenticator(check, secret)
+	if !hmac.Equal(want[:], raw[4:20]) {
+		return errors.New("radius: response authenticator mismatch")
+	}
+
+	reply, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+	got, ok := reply.Get(AttrMessageAuthenticator)
+	if !ok {
+		return nil
+	}
+	if len(got) != md5.Size {
+		return ErrMalformed
+	}
+	zeroed := append([]byte(nil), check...)
+	offset := headerLen
+	for offset < len(zeroed) {
+		attrLen := int(zeroed[offset+1])
+		if AttributeType(zeroed[offset]) == AttrMessageAuthenticator {
+			for i := offset + 2; i < offset+attrLen; i++ {
+				zeroed[i] = 0
+			}
+		}
+		offset += attrLen
+	}
+	mac := hmac.New(md5.New, secret)
+	mac.Write(zeroed)
+	if !hmac.Equal(mac.Sum(nil), got) {
+		return errors.New("radius: message authenticator mismatch")
+	}
+	return nil
+}
+
+// EncryptPassword hides a User-Password value as described in RFC 2865 5.2.
+func EncryptPassword(password, secret []byte, authenticator [authLen]byte) ([]byte, error) {
+	if len(password) > maxPassword {
+		return nil, errors.New("radius: password too long")
+	}
+	padded := len(password)
+	if padded == 0 || padded%passwordBlock != 0 {
+		padded += passwordBlock - padded%passwordBlock
+	}
+	out := make([]byte, padded)
+	copy(out, password)
+	prev := authenticator[:]
+	for i := 0; i < padded; i += passwordBlock {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < passwordBlock; j++ {
+			out[i+j] ^= b[j]
+		}
+		prev = out[i : i+passwordBlock]
+	}
+	return out, nil
+}
+
+// DecryptPassword reverses EncryptPassword.
+func DecryptPassword(hidden, secret []byte, authenticator [authLen]byte) ([]byte, error) {
+	if len(hidden) == 0 || len(hidden)%passwordBlock != 0 || len(hidden) > maxPassword {
+		return nil, ErrMalformed
+	}
+	out := make([]byte, len(hidden))
+	prev := authenticator[:]
+	for i := 0; i < len(hidden); i += passwordBlock {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < passwordBlock; j++ {
+			out[i+j] = hidden[i+j] ^ b[j]
+		}
+		prev = hidden[i : i+passwordBlock]
+	}
+	return bytes.TrimRight(out, "\x00"), nil
+}
@@ -0,0 +1,151 @@
+package radius_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"remotegateway/internal/radius"
+	"remotegateway/internal/radius/radiustest"
+)
+
+func newClient(addr, secret string) *radius.Client {
+	return &radius.Client{
+		Addr:          addr,
+		Secret:        []byte(secret),
+		NASIdentifier: "remotegateway",
+		Timeout:       2 * time.Second,
+		RetryInterval: 100 * time.Millisecond,
+	}
+}
+
+func TestPasswordRoundTrip(t *testing.T) {
+	var auth [16]byte
+	copy(auth[:], "0123456789abcdef")
+	for _, password := range []string{"", "push", "exactly-16-bytes", "a much longer password spanning blocks"} {
+		hidden, err := radius.EncryptPassword([]byte(password), []byte("s3cret"), auth)
+		if err != nil {
+			t.Fatalf("encrypt %q: %v", password, err)
+		}
+		if len(hidden)%16 != 0 || bytes.Contains(hidden, []byte(password)) && password != "" {
+			t.Fatalf("unexpected hidden value for %q", password)
+		}
+		got, err := radius.DecryptPassword(hidden, []byte("s3cret"), auth)
+		if err != nil || string(got) != password {
+			t.Fatalf("decrypt %q: got %q err=%v", password, got, err)
+		}
+	}
+}
+
+func TestExchangeAcceptAndReject(t *testing.T) {
+	server := radiustest.NewServer("s3cret", func(req radiustest.Request) radiustest.Reply {
+		if req.Username == "alice" && req.Password == "push" {
+			return radiustest.Reply{Code: radius.CodeAccessAccept}
+		}
+		return radiustest.Reply{Code: radius.CodeAccessReject, ReplyMessage: "denied"}
+	})
+	defer server.Close()
+	client := newClient(server.Addr(), "s3cret")
+
+	resp, err := client.Exchange(context.Background(), radius.Request{Username: "alice", Password: "push", CallingStationID: "10.0.0.5"})
+	if err != nil || resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept, got %+v err=%v", resp, err)
+	}
+	resp, err = client.Exchange(context.Background(), radius.Request{Username: "bob", Password: "push"})
+	if err != nil || resp.Code != radius.CodeAccessReject || resp.ReplyMessage != "denied" {
+		t.Fatalf("expected reject, got %+v err=%v", resp, err)
+	}
+
+	reqs := server.Requests()
+	if reqs[0].CallingStationID != "10.0.0.5" || reqs[0].NASIdentifier != "remotegateway" {
+		t.Fatalf("unexpected request attributes %+v", reqs[0])
+	}
+}
+
+func TestExchangeRetransmitsAndRejectsWrongSecret(t *testing.T) {
+	var calls atomic.Int32
+	server := radiustest.NewServer("s3cret", func(radiustest.Request) radiustest.Reply {
+		if calls.Add(1) == 1 {
+			return radiustest.Reply{Drop: true}
+		}
+		return radiustest.Reply{Code: radius.CodeAccessAccept}
+	})
+	defer server.Close()
+
+	resp, err := newClient(server.Addr(), "s3cret").Exchange(context.Background(), radius.Request{Username: "alice", Password: "push"})
+	if err != nil || resp.Code != radius.CodeAccessAccept || calls.Load() < 2 {
+		t.Fatalf("expected accept after retransmit, got %+v err=%v calls=%d", resp, err, calls.Load())
+	}
+
+	client := newClient(server.Addr(), "other")
+	client.Timeout = 300 * time.Millisecond
+	if _, err := client.Exchange(context.Background(), radius.Request{Username: "alice", Password: "push"}); err == nil {
+		t.Fatalf("expected replies signed with another secret to be ignored")
+	}
+}
+
+func TestApproverAnswersChallengeAndCaches(t *testing.T) {
+	server := radiustest.NewServer("s3cret", func(req radiustest.Request) radiustest.Reply {
+		if len(req.State) == 0 {
+			return radiustest.Reply{Code: radius.CodeAccessChallenge, State: []byte("round-1"), ReplyMessage: "Enter passcode or 'push'"}
+		}
+		if string(req.State) == "round-1" && req.Password == "push" {
+			return radiustest.Reply{Code: radius.CodeAccessAccept}
+		}
+		return radiustest.Reply{Code: radius.CodeAccessReject}
+	})
+	defer server.Close()
+
+	approver := &radius.Approver{
+		Client:            newClient(server.Addr(), "s3cret"),
+		Password:          "",
+		ChallengeResponse: "push",
+		TTL:               time.Minute,
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = approver.Approve(context.Background(), "alice", "10.0.0.5")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("expected approval, got %v", err)
+		}
+	}
+	if got := len(server.Requests()); got != 2 {
+		t.Fatalf("expected one challenge round trip for concurrent requests, got %d requests", got)
+	}
+
+	if err := approver.Approve(context.Background(), "alice", "10.0.0.6"); err != nil {
+		t.Fatalf("expected approval from new address: %v", err)
+	}
+	if got := len(server.Requests()); got != 4 {
+		t.Fatalf("expected approval cache to be per client address, got %d requests", got)
+	}
+}
+
+func TestApproverRejectsUnansweredChallenge(t *testing.T) {
+	server := radiustest.NewServer("s3cret", func(radiustest.Request) radiustest.Reply {
+		return radiustest.Reply{Code: radius.CodeAccessChallenge, State: []byte("s")}
+	})
+	defer server.Close()
+
+	approver := &radius.Approver{Client: newClient(server.Addr(), "s3cret")}
+	if err := approver.Approve(context.Background(), "alice", "10.0.0.5"); !errors.Is(err, radius.ErrChallengeUnanswered) {
+		t.Fatalf("expected unanswered challenge, got %v", err)
+	}
+
+	approver.ChallengeResponse = "push"
+	if err := approver.Approve(context.Background(), "alice", "10.0.0.5"); !errors.Is(err, radius.ErrChallengeUnanswered) {
+		t.Fatalf("expected endless challenges to stop, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Package radiustest provides an in-process RADIUS responder for tests.
+package radiustest
+
+import (
+	"net"
+	"sync"
+
+	"remotegateway/internal/radius"
+)
+
+// Request is a decoded Access-Request as seen by the responder.
+type Request struct {
+	Username         string
+	Password         string
+	State            []byte
+	CallingStationID string
+	NASIdentifier    string
+}
+
+// Reply describes the answer sent for a Request.
+type Reply struct {
+	Code         radius.Code
+	State        []byte
+	ReplyMessage string
+	// Drop suppresses the reply, simulating a lost datagram.
+	Drop bool
+}
+
+type Handler func(Request) Reply
+
+type Server struct {
+	Secret []byte
+
+	conn    net.PacketConn
+	handler Handler
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+// NewServer listens on a random loopback UDP port.
+func NewServer(secret string, handler Handler) *Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{Secret: []byte(secret), conn: conn, handler: handler}
+	go s.serve()
+	return s
+}
+
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *Server) Close() {
+	_ = s.conn.Close()
+}
+
+// Requests returns every Access-Request received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet, err := radius.Parse(buf[:n])
+		if err != nil || packet.Code != radius.CodeAccessRequest {
+			continue
+		}
+		req := Request{}
+		if v, ok := packet.Get(radius.AttrUserName); ok {
+			req.Username = string(v)
+		}
+		if v, ok := packet.Get(radius.AttrUserPassword); ok {
+			if password, err := radius.DecryptPassword(v, s.Secret, packet.Authenticator); err == nil {
+				req.Password = string(password)
+			}
+		}
+		if v, ok := packet.Get(radius.AttrState); ok {
+			req.State = v
+		}
+		if v, ok := packet.Get(radius.AttrCallingStationID); ok {
+			req.CallingStationID = string(v)
+		}
+		if v, ok := packet.Get(radius.AttrNASIdentifier); ok {
+			req.NASIdentifier = string(v)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+
+		reply := s.handler(req)
+		if reply.Drop {
+			continue
+		}
+		resp := &radius.Packet{Code: reply.Code}
+		if len(reply.State) > 0 {
+			resp.Add(radius.AttrState, reply.State)
+		}
+		if reply.ReplyMessage != "" {
+			resp.Add(radius.AttrReplyMessage, []byte(reply.ReplyMessage))
+		}
+		raw, err := radius.EncodeResponse(resp, packet, s.Secret)
+		if err != nil {
+			continue
+		}
+		_, _ = s.conn.WriteTo(raw, addr)
+	}
+}
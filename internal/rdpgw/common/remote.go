@@ -44,6 +44,16 @@ func EnrichContext(next http.Handler) http.Handler {
 	})
 }
 
+// RemoteHost returns the host part of r.RemoteAddr. Unlike GetClientIp it
+// ignores X-Forwarded-For, so clients cannot choose the value.
+func RemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func GetClientIp(ctx context.Context) string {
 	s, ok := ctx.Value(ClientIPCtx).(string)
 	if !ok {
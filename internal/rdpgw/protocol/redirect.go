@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// redirectDevices are the device names used by ParseRedirectFlags and
+// RedirectFlags.String, in that order.
+var redirectDevices = []string{"clipboard", "drive", "printer", "port", "pnp"}
+
+func (f *RedirectFlags) device(name string) *bool {
+	switch name {
+	case "clipboard":
+		return &f.Clipboard
+	case "drive":
+		return &f.Drive
+	case "printer":
+		return &f.Printer
+	case "port":
+		return &f.Port
+	case "pnp":
+		return &f.Pnp
+	}
+	return nil
+}
+
+// ParseRedirectFlags parses "all", "none" or a comma separated list of the
+// devices to allow: clipboard, drive, printer, port and pnp.
+func ParseRedirectFlags(value string) (RedirectFlags, error) {
+	var flags RedirectFlags
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "all":
+		return RedirectFlags{EnableAll: true}, nil
+	case "none":
+		return RedirectFlags{DisableAll: true}, nil
+	case "":
+		return RedirectFlags{}, errors.New("empty redirect flags, want all, none or a device list")
+	}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		device := flags.device(name)
+		if device == nil {
+			return RedirectFlags{}, fmt.Errorf("unknown redirect device %q", name)
+		}
+		*device = true
+	}
+	return flags, nil
+}
+
+// String returns the flags in the form ParseRedirectFlags accepts.
+func (f RedirectFlags) String() string {
+	switch {
+	case f.DisableAll:
+		return "none"
+	case f.EnableAll:
+		return "all"
+	}
+	var allowed []string
+	for _, name := range redirectDevices {
+		if *f.device(name) {
+			allowed = append(allowed, name)
+		}
+	}
+	switch len(allowed) {
+	case 0:
+		return "none"
+	case len(redirectDevices):
+		return "all"
+	}
+	return strings.Join(allowed, ",")
+}
+
+// decodeRedirectFlags is the inverse of makeRedirectFlags.
+func decodeRedirectFlags(redir int) RedirectFlags {
+	switch {
+	case redir&HTTP_TUNNEL_REDIR_DISABLE_ALL != 0:
+		return RedirectFlags{DisableAll: true}
+	case redir&HTTP_TUNNEL_REDIR_ENABLE_ALL != 0:
+		return RedirectFlags{EnableAll: true}
+	}
+	return RedirectFlags{
+		Clipboard: redir&HTTP_TUNNEL_REDIR_DISABLE_CLIPBOARD == 0,
+		Drive:     redir&HTTP_TUNNEL_REDIR_DISABLE_DRIVE == 0,
+		Printer:   redir&HTTP_TUNNEL_REDIR_DISABLE_PRINTER == 0,
+		Port:      redir&HTTP_TUNNEL_REDIR_DISABLE_PORT == 0,
+		Pnp:       redir&HTTP_TUNNEL_REDIR_DISABLE_PNP == 0,
+	}
+}
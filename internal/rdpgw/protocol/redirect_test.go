@@ -0,0 +1,36 @@
+package protocol
+
+import "testing"
+
+func TestParseRedirectFlags(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RedirectFlags
+		str   string
+	}{
+		{value: "all", want: RedirectFlags{EnableAll: true}, str: "all"},
+		{value: " None ", want: RedirectFlags{DisableAll: true}, str: "none"},
+		{value: "printer, Clipboard", want: RedirectFlags{Printer: true, Clipboard: true}, str: "clipboard,printer"},
+		{value: "clipboard,drive,printer,port,pnp", want: RedirectFlags{Clipboard: true, Drive: true, Printer: true, Port: true, Pnp: true}, str: "all"},
+	}
+	for _, tt := range tests {
+		got, err := ParseRedirectFlags(tt.value)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.value, err)
+		}
+		if got != tt.want {
+			t.Fatalf("parse %q: got %+v, want %+v", tt.value, got, tt.want)
+		}
+		if got.String() != tt.str {
+			t.Fatalf("string of %q: got %q, want %q", tt.value, got.String(), tt.str)
+		}
+		if decoded := decodeRedirectFlags(makeRedirectFlags(got)); decoded.String() != tt.str {
+			t.Fatalf("wire round trip of %q: got %q", tt.value, decoded.String())
+		}
+	}
+	for _, value := range []string{"", "clipboard,webcam"} {
+		if _, err := ParseRedirectFlags(value); err == nil {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+}
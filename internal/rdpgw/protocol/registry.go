@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type tunnelInfoCtxKey struct{}
+
+// TunnelInfo describes the tunnel being set up. Server hooks read it with
+// TunnelInfoFromContext; fields are filled in as the client sends them.
+type TunnelInfo struct {
+	ConnID     string
+	ClientName string
+	// Target is the server name the client asked for, before
+	// ConvertToInternalServerFunc.
+	Target string
+	Port   uint16
+}
+
+func withTunnelInfo(ctx context.Context, info TunnelInfo) context.Context {
+	return context.WithValue(ctx, tunnelInfoCtxKey{}, info)
+}
+
+func TunnelInfoFromContext(ctx context.Context) (TunnelInfo, bool) {
+	info, ok := ctx.Value(tunnelInfoCtxKey{}).(TunnelInfo)
+	return info, ok
+}
+
+// TunnelSettings overrides the ServerConf defaults for one tunnel. They are
+// sent to the client in the tunnel auth response.
+type TunnelSettings struct {
+	// RedirectFlags, when set, replaces ServerConf.RedirectFlags.
+	RedirectFlags *RedirectFlags
+	// IdleTimeout in minutes, when positive, replaces ServerConf.IdleTimeout.
+	IdleTimeout int
+	// MaxDuration, when positive, closes the tunnel after that long.
+	MaxDuration time.Duration
+}
+
+// Tunnel is a snapshot of an open tunnel.
+type Tunnel struct {
+	ConnID     string
+	User       string
+	ClientIP   string
+	ClientName string
+	Target     string
+	// Host is the internal host:port the tunnel is connected to.
+	Host string
+	// Redirect are the device redirections sent at tunnel auth.
+	Redirect    RedirectFlags
+	IdleTimeout int
+	ConnectedAt time.Time
+	// LastActivity is the last time the client sent data.
+	LastActivity time.Time
+}
+
+type tunnelEntry struct {
+	tunnel       Tunnel
+	lastActivity atomic.Int64
+}
+
+func (e *tunnelEntry) touch(now time.Time) {
+	e.lastActivity.Store(now.UnixNano())
+}
+
+// TunnelRegistry tracks the tunnels with an open channel.
+type TunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[*tunnelEntry]struct{}
+}
+
+func NewTunnelRegistry() *TunnelRegistry {
+	return &TunnelRegistry{tunnels: make(map[*tunnelEntry]struct{})}
+}
+
+func (r *TunnelRegistry) add(t Tunnel) *tunnelEntry {
+	e := &tunnelEntry{tunnel: t}
+	e.touch(t.ConnectedAt)
+	r.mu.Lock()
+	r.tunnels[e] = struct{}{}
+	r.mu.Unlock()
+	return e
+}
+
+func (r *TunnelRegistry) remove(e *tunnelEntry) {
+	r.mu.Lock()
+	delete(r.tunnels, e)
+	r.mu.Unlock()
+}
+
+// List returns the open tunnels, oldest first.
+func (r *TunnelRegistry) List() []Tunnel {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	tunnels := make([]Tunnel, 0, len(r.tunnels))
+	for e := range r.tunnels {
+		t := e.tunnel
+		t.LastActivity = time.Unix(0, e.lastActivity.Load())
+		tunnels = append(tunnels, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ConnectedAt.Before(tunnels[j].ConnectedAt)
+	})
+	return tunnels
+}
+
+// CountUser returns the number of open tunnels of user.
+func (r *TunnelRegistry) CountUser(user string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for e := range r.tunnels {
+		if strings.EqualFold(e.tunnel.User, user) {
+			n++
+		}
+	}
+	return n
+}
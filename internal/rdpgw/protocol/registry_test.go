@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTunnelRegistry(t *testing.T) {
+	reg := NewTunnelRegistry()
+	start := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	first := reg.add(Tunnel{ConnID: "a", User: "alice", ConnectedAt: start})
+	reg.add(Tunnel{ConnID: "b", User: "bob", ConnectedAt: start.Add(-time.Minute)})
+	reg.add(Tunnel{ConnID: "c", User: "Alice", ConnectedAt: start.Add(time.Minute)})
+
+	if n := reg.CountUser("alice"); n != 2 {
+		t.Fatalf("expected 2 tunnels for alice, got %d", n)
+	}
+	first.touch(start.Add(5 * time.Minute))
+	tunnels := reg.List()
+	if len(tunnels) != 3 || tunnels[0].ConnID != "b" || tunnels[1].ConnID != "a" || tunnels[2].ConnID != "c" {
+		t.Fatalf("expected tunnels oldest first, got %+v", tunnels)
+	}
+	if !tunnels[1].LastActivity.Equal(start.Add(5 * time.Minute)) {
+		t.Fatalf("expected touched activity, got %s", tunnels[1].LastActivity)
+	}
+
+	reg.remove(first)
+	if n := reg.CountUser("alice"); n != 1 {
+		t.Fatalf("expected 1 tunnel for alice after remove, got %d", n)
+	}
+
+	var missing *TunnelRegistry
+	if missing.List() != nil || missing.CountUser("alice") != 0 {
+		t.Fatal("expected a nil registry to be empty")
+	}
+}
+
+func TestApplySettingsOverridesDefaults(t *testing.T) {
+	srv := &Server{RedirectFlags: makeRedirectFlags(RedirectFlags{EnableAll: true}), IdleTimeout: 30}
+	srv.applySettings(nil)
+	if srv.IdleTimeout != 30 {
+		t.Fatalf("expected nil settings to keep defaults, got idle %d", srv.IdleTimeout)
+	}
+
+	srv.applySettings(&TunnelSettings{
+		RedirectFlags: &RedirectFlags{Clipboard: true},
+		IdleTimeout:   5,
+		MaxDuration:   time.Hour,
+	})
+	if want := makeRedirectFlags(RedirectFlags{Clipboard: true}); srv.RedirectFlags != want {
+		t.Fatalf("expected redirect flags %d, got %d", want, srv.RedirectFlags)
+	}
+	if srv.IdleTimeout != 5 || srv.MaxDuration != time.Hour {
+		t.Fatalf("unexpected settings idle=%d max=%s", srv.IdleTimeout, srv.MaxDuration)
+	}
+}
+
+type closeRecorder struct {
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func (c *closeRecorder) ReadPacket() (int, []byte, error)  { return 0, nil, net.ErrClosed }
+func (c *closeRecorder) WritePacket(b []byte) (int, error) { return len(b), nil }
+
+func (c *closeRecorder) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func TestMaxDurationClosesTunnel(t *testing.T) {
+	transport := &closeRecorder{done: make(chan struct{})}
+	remote, peer := net.Pipe()
+	defer peer.Close()
+	srv := &Server{
+		Session:     &SessionInfo{TransportIn: transport, TransportOut: transport},
+		Remote:      remote,
+		MaxDuration: 10 * time.Millisecond,
+	}
+	srv.openTunnel(context.Background(), "vm:3389")
+	// The tunnel goroutine keeps using the Server while the timer runs;
+	// go test -race reports it if the timer reads the same fields.
+	srv.Remote = nil
+	srv.info.ConnID = "changed"
+
+	select {
+	case <-transport.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the tunnel to be closed after MaxDuration")
+	}
+	_ = peer.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Write([]byte{0}); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected the remote connection to be closed")
+	}
+	srv.closeTunnel()
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"net"
+	authctx "remotegateway/internal/contextKey"
 	"remotegateway/internal/rdpgw/common"
 	"strconv"
 	"time"
@@ -19,14 +20,21 @@ type VerifyTunnelAuthFunc func(context.Context, string) (bool, error)
 type VerifyServerFunc func(context.Context, string) (bool, error)
 type ConvertToInternalServerFunc func(context.Context, string) (string, error)
 
+// TunnelSettingsFunc picks the settings of an authorized tunnel from the
+// client name. A nil result keeps the ServerConf defaults.
+type TunnelSettingsFunc func(context.Context, string) (*TunnelSettings, error)
+
 type Server struct {
 	Session                     *SessionInfo
 	VerifyTunnelCreate          VerifyTunnelCreate
 	VerifyTunnelAuthFunc        VerifyTunnelAuthFunc
 	VerifyServerFunc            VerifyServerFunc
 	ConvertToInternalServerFunc ConvertToInternalServerFunc
+	TunnelSettingsFunc          TunnelSettingsFunc
+	Registry                    *TunnelRegistry
 	RedirectFlags               int
 	IdleTimeout                 int
+	MaxDuration                 time.Duration
 	SmartCardAuth               bool
 	TokenAuth                   bool
 	ClientName                  string
@@ -34,6 +42,10 @@ type Server struct {
 	ReceiveBuf                  int
 	SendBuf                     int
 	State                       int
+
+	info     TunnelInfo
+	entry    *tunnelEntry
+	maxTimer *time.Timer
 }
 
 type ServerConf struct {
@@ -49,6 +61,12 @@ type ServerConf struct {
 	SendBuf                     int
 	WebsocketReadBuffer         int
 	WebsocketWriteBuffer        int
+
+	// TunnelSettingsFunc, when set, is asked for per tunnel settings after
+	// VerifyTunnelAuthFunc accepted the tunnel.
+	TunnelSettingsFunc TunnelSettingsFunc
+	// Registry, when set, tracks the tunnels with an open channel.
+	Registry *TunnelRegistry
 }
 
 func NewServer(s *SessionInfo, conf *ServerConf) *Server {
@@ -63,6 +81,8 @@ func NewServer(s *SessionInfo, conf *ServerConf) *Server {
 		VerifyServerFunc:            conf.VerifyServerFunc,
 		VerifyTunnelAuthFunc:        conf.VerifyTunnelAuthFunc,
 		ConvertToInternalServerFunc: conf.ConvertToInternalServerFunc,
+		TunnelSettingsFunc:          conf.TunnelSettingsFunc,
+		Registry:                    conf.Registry,
 		ReceiveBuf:                  conf.ReceiveBuf,
 		SendBuf:                     conf.SendBuf,
 	}
@@ -71,7 +91,14 @@ func NewServer(s *SessionInfo, conf *ServerConf) *Server {
 
 const tunnelId = 10
 
+// hookContext returns ctx carrying what is known about the tunnel so far.
+func (s *Server) hookContext(ctx context.Context) context.Context {
+	return withTunnelInfo(ctx, s.info)
+}
+
 func (s *Server) Process(ctx context.Context) error {
+	s.info.ConnID = s.Session.ConnId
+	defer s.closeTunnel()
 	for {
 		pt, sz, pkt, err := readMessage(s.Session.TransportIn)
 		if err != nil {
@@ -112,7 +139,7 @@ func (s *Server) Process(ctx context.Context) error {
 				return fmt.Errorf("failed to parse tunnel request: %w", err)
 			}
 			if s.VerifyTunnelCreate != nil {
-				if ok, _ := s.VerifyTunnelCreate(ctx, cookie); !ok {
+				if ok, _ := s.VerifyTunnelCreate(s.hookContext(ctx), cookie); !ok {
 					log.Printf("Invalid PAA cookie received from client %s", common.GetClientIp(ctx))
 					return errors.New("invalid PAA cookie")
 				}
@@ -139,12 +166,24 @@ func (s *Server) Process(ctx context.Context) error {
 				return fmt.Errorf("failed to parse tunnel auth request: %w", err)
 			}
 
+			s.info.ClientName = client
+
 			if s.VerifyTunnelAuthFunc != nil {
-				if ok, _ := s.VerifyTunnelAuthFunc(ctx, client); !ok {
+				if ok, _ := s.VerifyTunnelAuthFunc(s.hookContext(ctx), client); !ok {
 					log.Printf("Invalid client name: %s", client)
 					return errors.New("invalid client name")
 				}
 			}
+			if s.TunnelSettingsFunc != nil {
+				settings, err := s.TunnelSettingsFunc(s.hookContext(ctx), client)
+				if err != nil {
+					log.Printf("Cannot determine tunnel settings for client %s: %s", client, err)
+					return err
+				}
+				s.applySettings(settings)
+			}
+			log.Printf("Tunnel auth for client %s: redirect %s, idle timeout %d min",
+				client, decodeRedirectFlags(s.RedirectFlags), s.IdleTimeout)
 			msg, err := s.tunnelAuthResponse()
 			if err != nil {
 				return err
@@ -166,8 +205,11 @@ func (s *Server) Process(ctx context.Context) error {
 				return fmt.Errorf("failed to parse channel request: %w", err)
 			}
 
+			s.info.Target = server
+			s.info.Port = port
+
 			if s.ConvertToInternalServerFunc != nil {
-				internalServer, err := s.ConvertToInternalServerFunc(ctx, server)
+				internalServer, err := s.ConvertToInternalServerFunc(s.hookContext(ctx), server)
 				if err != nil {
 					log.Printf("Cannot convert to internal server address for %s: %s", server, err)
 					return err
@@ -177,7 +219,7 @@ func (s *Server) Process(ctx context.Context) error {
 
 			host := net.JoinHostPort(server, strconv.Itoa(int(port)))
 			if s.VerifyServerFunc != nil {
-				if ok, _ := s.VerifyServerFunc(ctx, host); !ok {
+				if ok, _ := s.VerifyServerFunc(s.hookContext(ctx), host); !ok {
 					log.Printf("Not allowed to connect to %s by policy handler", host)
 					return errors.New("denied by security policy")
 				}
@@ -190,6 +232,7 @@ func (s *Server) Process(ctx context.Context) error {
 				return err
 			}
 			s.tuneRemoteConn()
+			s.openTunnel(ctx, host)
 			log.Printf("Connection established")
 			msg, err := s.channelResponse()
 			if err != nil {
@@ -210,6 +253,9 @@ func (s *Server) Process(ctx context.Context) error {
 				return errors.New("wrong state")
 			}
 			s.State = SERVER_STATE_OPENED
+			if s.entry != nil {
+				s.entry.touch(time.Now())
+			}
 			if err := receive(pkt, s.Remote); err != nil {
 				return err
 			}
@@ -237,6 +283,64 @@ func (s *Server) Process(ctx context.Context) error {
 	}
 }
 
+func (s *Server) applySettings(settings *TunnelSettings) {
+	if settings == nil {
+		return
+	}
+	if settings.RedirectFlags != nil {
+		s.RedirectFlags = makeRedirectFlags(*settings.RedirectFlags)
+	}
+	if settings.IdleTimeout > 0 {
+		s.IdleTimeout = settings.IdleTimeout
+	}
+	if settings.MaxDuration > 0 {
+		s.MaxDuration = settings.MaxDuration
+	}
+}
+
+// openTunnel registers the connected tunnel and starts the MaxDuration
+// timer. The timer only uses values captured here, as the tunnel goroutine
+// keeps changing the Server.
+func (s *Server) openTunnel(ctx context.Context, host string) {
+	if s.MaxDuration > 0 {
+		connID, maxDuration := s.info.ConnID, s.MaxDuration
+		in, out, remote := s.Session.TransportIn, s.Session.TransportOut, s.Remote
+		s.maxTimer = time.AfterFunc(maxDuration, func() {
+			log.Printf("Closing tunnel %s to %s after %s", connID, host, maxDuration)
+			in.Close()
+			out.Close()
+			if remote != nil {
+				remote.Close()
+			}
+		})
+	}
+	if s.Registry == nil {
+		return
+	}
+	user, _ := authctx.AuthUserFromContext(ctx)
+	s.entry = s.Registry.add(Tunnel{
+		ConnID:      s.info.ConnID,
+		User:        user,
+		ClientIP:    common.GetClientIp(ctx),
+		ClientName:  s.info.ClientName,
+		Target:      s.info.Target,
+		Host:        host,
+		Redirect:    decodeRedirectFlags(s.RedirectFlags),
+		IdleTimeout: s.IdleTimeout,
+		ConnectedAt: time.Now(),
+	})
+}
+
+func (s *Server) closeTunnel() {
+	if s.maxTimer != nil {
+		s.maxTimer.Stop()
+	}
+	if s.entry != nil {
+		s.Registry.remove(s.entry)
+		s.entry = nil
+	}
+}
+
 func (s *Server) tuneRemoteConn() {
 	tcpConn, ok := s.Remote.(*net.TCPConn)
 	if !ok {
@@ -0,0 +1,225 @@
+// Package boltstore is an scs session store backed by a bbolt file. Session
+// payloads are sealed with AES-256-GCM so the NTLM hashes kept in sessions are
+// not readable from the file on disk.
+package boltstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// KeySize is the required encryption key length in bytes.
+const KeySize = 32
+
+var bucketName = []byte("sessions")
+
+// ErrInvalidKey is returned by ParseKey for malformed keys.
+var ErrInvalidKey = errors.New("session key must be 32 bytes encoded as base64 or hex")
+
+// ParseKey decodes a 32 byte key given as base64 or hex, for example the
+// output of "openssl rand -base64 32".
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+// Store implements scs.IterableStore.
+type Store struct {
+	db          *bolt.DB
+	aead        cipher.AEAD
+	stopCleanup chan bool
+}
+
+// New opens or creates the store at path with a background cleanup goroutine
+// that removes expired sessions every minute.
+func New(path string, key []byte) (*Store, error) {
+	return NewWithCleanupInterval(path, key, time.Minute)
+}
+
+// NewWithCleanupInterval is like New with a custom cleanup interval. An
+// interval of 0 disables the cleanup goroutine.
+func NewWithCleanupInterval(path string, key []byte, cleanupInterval time.Duration) (*Store, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("session key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create session store directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open session store: %w", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{db: db, aead: aead}
+	if cleanupInterval > 0 {
+		s.stopCleanup = make(chan bool)
+		go s.startCleanup(cleanupInterval, s.stopCleanup)
+	}
+	return s, nil
+}
+
+// Find returns the data for a session token. Expired entries and entries
+// that cannot be decrypted, e.g. after a key change, are reported as missing.
+func (s *Store) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(bucketName).Get([]byte(token))
+		if raw == nil {
+			return nil
+		}
+		plain, ok := s.open(token, raw, time.Now())
+		if ok {
+			b = plain
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return b, b != nil, nil
+}
+
+// Commit stores the session data for token until expiry.
+func (s *Store) Commit(token string, b []byte, expiry time.Time) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// Layout: expiry (unix nanoseconds) | nonce | ciphertext. The expiry is
+	// kept in the clear so cleanup does not need to decrypt.
+	raw := make([]byte, 8, 8+len(nonce)+len(b)+s.aead.Overhead())
+	binary.BigEndian.PutUint64(raw, uint64(expiry.UnixNano()))
+	raw = append(raw, nonce...)
+	raw = s.aead.Seal(raw, nonce, b, []byte(token))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put([]byte(token), raw)
+	})
+}
+
+// Delete removes a session token.
+func (s *Store) Delete(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete([]byte(token))
+	})
+}
+
+// All returns every live session keyed by token.
+func (s *Store) All() (map[string][]byte, error) {
+	sessions := make(map[string][]byte)
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(k, v []byte) error {
+			if plain, ok := s.open(string(k), v, now); ok {
+				sessions[string(k)] = plain
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Close stops the cleanup goroutine and closes the database file.
+func (s *Store) Close() error {
+	if s.stopCleanup != nil {
+		close(s.stopCleanup)
+		s.stopCleanup = nil
+	}
+	return s.db.Close()
+}
+
+func (s *Store) open(token string, raw []byte, now time.Time) ([]byte, bool) {
+	nonceSize := s.aead.NonceSize()
+	if len(raw) < 8+nonceSize {
+		return nil, false
+	}
+	if expired(raw, now) {
+		return nil, false
+	}
+	nonce := raw[8 : 8+nonceSize]
+	plain, err := s.aead.Open(nil, nonce, raw[8+nonceSize:], []byte(token))
+	if err != nil {
+		return nil, false
+	}
+	return plain, true
+}
+
+func expired(raw []byte, now time.Time) bool {
+	return now.UnixNano() > int64(binary.BigEndian.Uint64(raw[:8]))
+}
+
+func (s *Store) startCleanup(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.deleteExpired(); err != nil {
+				log.Printf("session store cleanup: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Store) deleteExpired() error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		var stale [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || expired(v, now) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
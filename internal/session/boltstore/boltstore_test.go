@@ -0,0 +1,109 @@
+package boltstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func openStore(t *testing.T, path string, key []byte) *Store {
+	t.Helper()
+	s, err := NewWithCleanupInterval(path, key, 0)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	return s
+}
+
+func TestCommitFindDeleteAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions", "sessions.db")
+	s := openStore(t, path, testKey(1))
+
+	secret := []byte("ntlm-hash-material")
+	if err := s.Commit("tok1", secret, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := s.Commit("tok2", []byte("other"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := s.Delete("tok2"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if bytes.Contains(raw, secret) {
+		t.Fatalf("expected session payload to be encrypted on disk")
+	}
+
+	s = openStore(t, path, testKey(1))
+	defer s.Close()
+	b, ok, err := s.Find("tok1")
+	if err != nil || !ok || !bytes.Equal(b, secret) {
+		t.Fatalf("expected session after reopen, got %q %v %v", b, ok, err)
+	}
+	if _, ok, _ := s.Find("tok2"); ok {
+		t.Fatalf("expected deleted session to stay deleted")
+	}
+	all, err := s.All()
+	if err != nil || len(all) != 1 {
+		t.Fatalf("expected one session, got %d err=%v", len(all), err)
+	}
+}
+
+func TestExpiredAndForeignKeySessionsAreMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	s := openStore(t, path, testKey(1))
+	if err := s.Commit("old", []byte("x"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := s.Commit("live", []byte("y"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, ok, _ := s.Find("old"); ok {
+		t.Fatalf("expected expired session to be missing")
+	}
+	if err := s.deleteExpired(); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	s.Close()
+
+	s = openStore(t, path, testKey(2))
+	defer s.Close()
+	if _, ok, err := s.Find("live"); ok || err != nil {
+		t.Fatalf("expected session under another key to be missing, got ok=%v err=%v", ok, err)
+	}
+	all, err := s.All()
+	if err != nil || len(all) != 0 {
+		t.Fatalf("expected no readable sessions, got %d err=%v", len(all), err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := testKey(7)
+	for _, encoded := range []string{
+		base64.StdEncoding.EncodeToString(key),
+		" " + base64.RawURLEncoding.EncodeToString(key) + "\n",
+		"0707070707070707070707070707070707070707070707070707070707070707",
+	} {
+		got, err := ParseKey(encoded)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Fatalf("parse %q: got %x err=%v", encoded, got, err)
+		}
+	}
+	if _, err := ParseKey("too-short"); err != ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+// indexPruneInterval is how often tokens of sessions that expired without a
+// Delete are dropped from the index.
+const indexPruneInterval = 10 * time.Minute
+
+// iterableStore is a session store that can list its sessions.
+type iterableStore interface {
+	scs.Store
+	scs.IterableStore
+}
+
+// indexedStore wraps a session store and keeps a username to token index up
+// to date on every write, so NTLM lookups do not decode every session.
+type indexedStore struct {
+	iterableStore
+	codec scs.Codec
+
+	mu        sync.RWMutex
+	tokens    map[string]map[string]struct{}
+	owners    map[string]string
+	lastPrune time.Time
+}
+
+func newIndexedStore(store iterableStore, codec scs.Codec) *indexedStore {
+	s := &indexedStore{
+		iterableStore: store,
+		codec:         codec,
+		tokens:        make(map[string]map[string]struct{}),
+		owners:        make(map[string]string),
+		lastPrune:     time.Now(),
+	}
+	s.rebuild()
+	return s
+}
+
+// rebuild indexes the sessions already in the store, e.g. after a restart.
+func (s *indexedStore) rebuild() {
+	sessions, err := s.iterableStore.All()
+	if err != nil {
+		return
+	}
+	for token, b := range sessions {
+		s.index(token, b)
+	}
+}
+
+func (s *indexedStore) Commit(token string, b []byte, expiry time.Time) error {
+	if err := s.iterableStore.Commit(token, b, expiry); err != nil {
+		return err
+	}
+	s.index(token, b)
+	s.maybePrune(time.Now())
+	return nil
+}
+
+func (s *indexedStore) Delete(token string) error {
+	if err := s.iterableStore.Delete(token); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.unindexLocked(token)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *indexedStore) index(token string, b []byte) {
+	username := ""
+	if _, values, err := s.codec.Decode(b); err == nil {
+		if sess, ok := values[sessionKey].(sessionData); ok && sess.User != nil {
+			username = sess.User.GetName()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owners[token] == username {
+		return
+	}
+	s.unindexLocked(token)
+	if username == "" {
+		return
+	}
+	if s.tokens[username] == nil {
+		s.tokens[username] = make(map[string]struct{})
+	}
+	s.tokens[username][token] = struct{}{}
+	s.owners[token] = username
+}
+
+func (s *indexedStore) maybePrune(now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastPrune) < indexPruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = now
+	tokens := make([]string, 0, len(s.owners))
+	for token := range s.owners {
+		tokens = append(tokens, token)
+	}
+	s.mu.Unlock()
+
+	for _, token := range tokens {
+		if _, ok, err := s.iterableStore.Find(token); err == nil && !ok {
+			s.mu.Lock()
+			s.unindexLocked(token)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *indexedStore) unindexLocked(token string) {
+	username, ok := s.owners[token]
+	if !ok {
+		return
+	}
+	delete(s.owners, token)
+	delete(s.tokens[username], token)
+	if len(s.tokens[username]) == 0 {
+		delete(s.tokens, username)
+	}
+}
+
+// tokensOf returns the indexed tokens of username.
+func (s *indexedStore) tokensOf(username string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]string, 0, len(s.tokens[username]))
+	for token := range s.tokens[username] {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// find returns the newest live session of username. Tokens whose session
+// expired in the underlying store are dropped from the index.
+func (s *indexedStore) find(username string) (sessionData, bool) {
+	candidates := s.tokensOf(username)
+
+	var best sessionData
+	found := false
+	for _, token := range candidates {
+		b, ok, err := s.iterableStore.Find(token)
+		if err != nil {
+			continue
+		}
+		if !ok {
+			s.mu.Lock()
+			s.unindexLocked(token)
+			s.mu.Unlock()
+			continue
+		}
+		_, values, err := s.codec.Decode(b)
+		if err != nil {
+			continue
+		}
+		sess, ok := values[sessionKey].(sessionData)
+		if !ok || sess.User == nil || sess.User.GetName() != username {
+			continue
+		}
+		if !found || sess.CreatedAt.After(best.CreatedAt) {
+			best, found = sess, true
+		}
+	}
+	return best, found
+}
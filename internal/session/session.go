@@ -2,9 +2,22 @@ package session
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"remotegateway/internal/config"
+	"remotegateway/internal/session/boltstore"
 	"remotegateway/internal/types"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
@@ -14,29 +27,85 @@ import (
 )
 
 type sessionData struct {
-	User      *types.User
-	CreatedAt time.Time
+	User        *types.User
+	CreatedAt   time.Time
+	MFAVerified bool
 }
 
-const sessionKey = "session"
+// pendingLogin holds a user whose password was accepted but who still has to
+// pass the second factor. It grants no access on its own.
+type pendingLogin struct {
+	User     *types.User
+	Since    time.Time
+	Attempts int
+}
+
+const (
+	sessionKey = "session"
+	pendingKey = "pending_login"
+	csrfKey    = "csrf_token"
+)
 
 func init() {
 	gob.Register(sessionData{})
+	gob.Register(pendingLogin{})
 }
 
-const sessionTTL = 30 * time.Minute
+const (
+	sessionTTL      = 30 * time.Minute
+	pendingLoginTTL = 5 * time.Minute
+)
 
 type Manager struct {
 	*scs.SessionManager
+	store  *indexedStore
+	closer io.Closer
+
+	revokeMu    sync.Mutex
+	revocations map[string]uint64
 }
 
+// NewManager returns a manager with an in-memory store. Sessions are lost on
+// restart.
 func NewManager() *Manager {
-	return &Manager{SessionManager: newSessionManager()}
+	return newManager(memstore.New(), nil)
+}
+
+// NewManagerFromSettings returns a manager backed by the encrypted file store
+// when SESSION_ENCRYPTION_KEY is set, and an in-memory store otherwise.
+func NewManagerFromSettings(settings *config.SettingsType) (*Manager, error) {
+	if !settings.Has(config.SESSION_ENCRYPTION_KEY) {
+		log.Printf("SESSION_ENCRYPTION_KEY not set, sessions are kept in memory and lost on restart")
+		return NewManager(), nil
+	}
+	key, err := boltstore.ParseKey(settings.Get(config.SESSION_ENCRYPTION_KEY))
+	if err != nil {
+		return nil, err
+	}
+	store, err := boltstore.New(settings.Get(config.SESSION_STORE_PATH), key)
+	if err != nil {
+		return nil, err
+	}
+	return newManager(store, store), nil
+}
+
+func newManager(store iterableStore, closer io.Closer) *Manager {
+	manager := newSessionManager()
+	indexed := newIndexedStore(store, manager.Codec)
+	manager.Store = indexed
+	return &Manager{SessionManager: manager, store: indexed, closer: closer}
+}
+
+// Close releases the underlying store.
+func (m *Manager) Close() error {
+	if m.closer == nil {
+		return nil
+	}
+	return m.closer.Close()
 }
 
 func newSessionManager() *scs.SessionManager {
 	manager := scs.New()
-	manager.Store = memstore.New()
 	manager.Lifetime = sessionTTL
 	manager.Cookie.Name = "cv_session"
 	manager.Cookie.Path = "/"
@@ -47,16 +116,108 @@ func newSessionManager() *scs.SessionManager {
 }
 
 func (m *Manager) CreateSession(ctx context.Context, u *types.User) error {
+	return m.createSession(ctx, u, false)
+}
+
+// CreateVerifiedSession creates a session for a user that passed the second
+// factor.
+func (m *Manager) CreateVerifiedSession(ctx context.Context, u *types.User) error {
+	return m.createSession(ctx, u, true)
+}
+
+func (m *Manager) createSession(ctx context.Context, u *types.User, mfaVerified bool) error {
 	if err := m.RenewToken(ctx); err != nil {
 		return err
 	}
+	m.Remove(ctx, pendingKey)
+	m.Remove(ctx, csrfKey)
 	m.Put(ctx, sessionKey, sessionData{
-		User:      u,
-		CreatedAt: time.Now(),
+		User:        u,
+		CreatedAt:   time.Now(),
+		MFAVerified: mfaVerified,
 	})
 	return nil
 }
 
+// MFAVerified reports whether the current session passed the second factor.
+func (m *Manager) MFAVerified(ctx context.Context) bool {
+	sess, ok := m.Get(ctx, sessionKey).(sessionData)
+	return ok && sess.User != nil && sess.MFAVerified
+}
+
+// BeginPendingLogin replaces any existing session with a pending login that
+// must be completed by CreateVerifiedSession.
+func (m *Manager) BeginPendingLogin(ctx context.Context, u *types.User) error {
+	if err := m.RenewToken(ctx); err != nil {
+		return err
+	}
+	m.Remove(ctx, sessionKey)
+	m.Remove(ctx, csrfKey)
+	m.Put(ctx, pendingKey, pendingLogin{User: u, Since: time.Now()})
+	return nil
+}
+
+// PendingLogin returns the user waiting for the second factor, if any.
+func (m *Manager) PendingLogin(ctx context.Context) (*types.User, bool) {
+	pending, ok := m.Get(ctx, pendingKey).(pendingLogin)
+	if !ok || pending.User == nil {
+		return nil, false
+	}
+	if time.Since(pending.Since) > pendingLoginTTL {
+		m.Remove(ctx, pendingKey)
+		return nil, false
+	}
+	return pending.User, true
+}
+
+// RecordFailedMFA counts a failed second factor attempt and returns the total.
+func (m *Manager) RecordFailedMFA(ctx context.Context) int {
+	pending, ok := m.Get(ctx, pendingKey).(pendingLogin)
+	if !ok {
+		return 0
+	}
+	pending.Attempts++
+	m.Put(ctx, pendingKey, pending)
+	return pending.Attempts
+}
+
+// ClearPendingLogin abandons a pending login.
+func (m *Manager) ClearPendingLogin(ctx context.Context) {
+	m.Remove(ctx, pendingKey)
+}
+
+// CSRFToken returns the CSRF token of the current session, creating it on
+// first use. Logging in rotates it.
+func (m *Manager) CSRFToken(ctx context.Context) (string, error) {
+	if token := m.GetString(ctx, csrfKey); token != "" {
+		return token, nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	m.Put(ctx, csrfKey, token)
+	return token, nil
+}
+
+// ValidCSRFToken reports whether token matches the session's CSRF token.
+func (m *Manager) ValidCSRFToken(ctx context.Context, token string) bool {
+	expected := m.GetString(ctx, csrfKey)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// UpdateUser replaces the user stored in the current session.
+func (m *Manager) UpdateUser(ctx context.Context, u *types.User) error {
+	sess, ok := m.Get(ctx, sessionKey).(sessionData)
+	if !ok || sess.User == nil {
+		return errors.New("no active session")
+	}
+	sess.User = u
+	m.Put(ctx, sessionKey, sess)
+	return nil
+}
+
 func (m *Manager) getSession(r *http.Request) (sessionData, bool) {
 	sess, ok := m.Get(r.Context(), sessionKey).(sessionData)
 	if !ok || sess.User == nil {
@@ -78,26 +239,80 @@ func (m *Manager) UserFromContext(ctx context.Context) (*types.User, bool) {
 	return nil, false
 }
 
+// GetSessionFromUserName returns the newest session of username.
 func (m *Manager) GetSessionFromUserName(username string) (sessionData, bool) {
-	store, ok := m.Store.(scs.IterableStore)
-	if !ok {
-		return sessionData{}, false
-	}
-	sessions, err := store.All()
+	return m.store.find(username)
+}
+
+// Summary describes a logged in session without its token.
+type Summary struct {
+	// ID is derived from the token and identifies the session in listings.
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Groups      []string  `json:"groups,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Expiry      time.Time `json:"expiry"`
+	MFAVerified bool      `json:"mfaVerified"`
+}
+
+// List returns the logged in sessions, newest first. Pending logins are
+// left out.
+func (m *Manager) List() ([]Summary, error) {
+	sessions, err := m.store.All()
 	if err != nil {
-		return sessionData{}, false
+		return nil, err
 	}
-	for _, raw := range sessions {
-		_, values, err := m.Codec.Decode(raw)
+	summaries := make([]Summary, 0, len(sessions))
+	for token, b := range sessions {
+		expiry, values, err := m.Codec.Decode(b)
 		if err != nil {
 			continue
 		}
-		if sess, ok := values[sessionKey].(sessionData); ok &&
-			sess.User != nil && sess.User.GetName() == username {
-			return sess, true
+		sess, ok := values[sessionKey].(sessionData)
+		if !ok || sess.User == nil {
+			continue
+		}
+		id := sha256.Sum256([]byte(token))
+		summaries = append(summaries, Summary{
+			ID:          hex.EncodeToString(id[:6]),
+			User:        sess.User.GetName(),
+			Groups:      sess.User.GetGroups(),
+			CreatedAt:   sess.CreatedAt,
+			Expiry:      expiry,
+			MFAVerified: sess.MFAVerified,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].CreatedAt.After(summaries[j].CreatedAt)
+	})
+	return summaries, nil
+}
+
+// RevokeUser deletes every session of username, which also ends its
+// gateway logins, and returns how many there were.
+func (m *Manager) RevokeUser(username string) (int, error) {
+	m.revokeMu.Lock()
+	if m.revocations == nil {
+		m.revocations = make(map[string]uint64)
+	}
+	m.revocations[strings.ToLower(username)]++
+	m.revokeMu.Unlock()
+
+	tokens := m.store.tokensOf(username)
+	for _, token := range tokens {
+		if err := m.store.Delete(token); err != nil {
+			return 0, err
 		}
 	}
-	return sessionData{}, false
+	return len(tokens), nil
+}
+
+// Revocations counts the RevokeUser calls for username, so caches of its
+// logins can tell when to drop them.
+func (m *Manager) Revocations(username string) uint64 {
+	m.revokeMu.Lock()
+	defer m.revokeMu.Unlock()
+	return m.revocations[strings.ToLower(username)]
 }
 
 func (m *Manager) DestroySession(ctx context.Context) error {
@@ -106,6 +321,12 @@ func (m *Manager) DestroySession(ctx context.Context) error {
 
 type sessionContextKey struct{}
 
+// WithUser returns ctx acting as u without a browser session, e.g. for API
+// token requests. UserFromContext on ctx.Context() then returns u.
+func WithUser(ctx huma.Context, u *types.User) huma.Context {
+	return huma.WithValue(ctx, sessionContextKey{}, sessionData{User: u})
+}
+
 func (m *Manager) SessionMiddleware() func(huma.Context, func(huma.Context)) {
 	return func(ctx huma.Context, next func(huma.Context)) {
 		req, w := humachi.Unwrap(ctx)
@@ -0,0 +1,127 @@
+package session
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"remotegateway/internal/hash"
+	"remotegateway/internal/session/boltstore"
+	"remotegateway/internal/types"
+)
+
+func login(t *testing.T, m *Manager, name, password string) *http.Cookie {
+	t.Helper()
+	handler := m.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := types.NewUser(name, password, "vdi")
+		if err != nil {
+			t.Fatalf("new user: %v", err)
+		}
+		if err := m.CreateSession(r.Context(), user); err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/login", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("expected session cookie")
+	}
+	return cookies[0]
+}
+
+func logout(t *testing.T, m *Manager, cookie *http.Cookie) {
+	t.Helper()
+	handler := m.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.DestroySession(r.Context()); err != nil {
+			t.Fatalf("destroy: %v", err)
+		}
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.AddCookie(cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestGetSessionFromUserNameUsesIndex(t *testing.T) {
+	m := NewManager()
+	login(t, m, "alice", "first")
+	second := login(t, m, "alice", "second")
+	login(t, m, "bob", "secret")
+
+	sess, ok := m.GetSessionFromUserName("alice")
+	if !ok || !bytes.Equal(sess.User.GetNtlmPassword(), hash.NtlmV2Hash("second", "alice", "vdi")) {
+		t.Fatalf("expected newest session for alice, got %+v %v", sess, ok)
+	}
+	if len(m.store.tokens["alice"]) != 2 {
+		t.Fatalf("expected two indexed sessions for alice, got %d", len(m.store.tokens["alice"]))
+	}
+
+	logout(t, m, second)
+	sess, ok = m.GetSessionFromUserName("alice")
+	if !ok || !bytes.Equal(sess.User.GetNtlmPassword(), hash.NtlmV2Hash("first", "alice", "vdi")) {
+		t.Fatalf("expected remaining session after logout, got %+v %v", sess, ok)
+	}
+	if _, ok := m.GetSessionFromUserName("carol"); ok {
+		t.Fatalf("expected no session for unknown user")
+	}
+}
+
+func TestPersistentSessionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	key := bytes.Repeat([]byte{3}, boltstore.KeySize)
+
+	store, err := boltstore.NewWithCleanupInterval(path, key, 0)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	m := newManager(store, store)
+	login(t, m, "alice", "secret")
+	if err := m.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	store, err = boltstore.NewWithCleanupInterval(path, key, 0)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	m = newManager(store, store)
+	defer m.Close()
+	sess, ok := m.GetSessionFromUserName("alice")
+	if !ok || len(sess.User.NtlmHashes()) == 0 {
+		t.Fatalf("expected NTLM hashes to survive restart, got %+v %v", sess, ok)
+	}
+}
+
+func TestListAndRevokeUser(t *testing.T) {
+	m := NewManager()
+	login(t, m, "alice", "first")
+	login(t, m, "alice", "second")
+	login(t, m, "bob", "secret")
+
+	sessions, err := m.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %+v", sessions)
+	}
+	for _, sess := range sessions {
+		if len(sess.ID) != 12 || sess.Expiry.IsZero() || len(sess.Groups) != 0 {
+			t.Fatalf("unexpected summary %+v", sess)
+		}
+	}
+
+	n, err := m.RevokeUser("alice")
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 revoked sessions, got %d %v", n, err)
+	}
+	if _, ok := m.GetSessionFromUserName("alice"); ok {
+		t.Fatalf("expected alice to have no session left")
+	}
+	sessions, _ = m.List()
+	if len(sessions) != 1 || sessions[0].User != "bob" {
+		t.Fatalf("expected only bob's session, got %+v", sessions)
+	}
+}
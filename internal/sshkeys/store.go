@@ -0,0 +1,181 @@
+// Package sshkeys parses SSH public keys and persists the extra keys users
+// add on the dashboard.
+package sshkeys
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"remotegateway/internal/jsonfile"
+)
+
+// MaxKeys is how many extra keys a user may add.
+const MaxKeys = 20
+
+var (
+	ErrInvalidKey = errors.New("sshkeys: invalid public key")
+	ErrDuplicate  = errors.New("sshkeys: key already added")
+	ErrTooMany    = errors.New("sshkeys: too many keys")
+)
+
+// Key is a public key in authorized_keys format.
+type Key struct {
+	// Fingerprint is the SHA256 fingerprint and identifies the key.
+	Fingerprint string    `json:"fingerprint"`
+	Type        string    `json:"type"`
+	Comment     string    `json:"comment,omitempty"`
+	Line        string    `json:"line"`
+	AddedAt     time.Time `json:"addedAt,omitempty"`
+}
+
+// Parse reads one authorized_keys line without options and normalizes it.
+func Parse(line string) (Key, error) {
+	pub, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(line)))
+	if err != nil || len(options) > 0 || len(strings.TrimSpace(string(rest))) > 0 {
+		return Key{}, ErrInvalidKey
+	}
+	comment = strings.TrimSpace(comment)
+	normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		normalized += " " + comment
+	}
+	return Key{
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Type:        pub.Type(),
+		Comment:     comment,
+		Line:        normalized,
+	}, nil
+}
+
+// ParseAll reads every valid key of values, which may hold several lines
+// each, and returns how many lines were skipped as invalid.
+func ParseAll(values []string) ([]Key, int) {
+	var keys []Key
+	skipped := 0
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, err := Parse(line)
+			if err != nil {
+				skipped++
+				continue
+			}
+			if !seen[key.Fingerprint] {
+				seen[key.Fingerprint] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, skipped
+}
+
+// Lines returns the authorized_keys lines of keys.
+func Lines(keys []Key) []string {
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, key.Line)
+	}
+	return lines
+}
+
+// Store keeps the extra keys of users in a JSON file that is rewritten on
+// every change.
+type Store struct {
+	mu    sync.Mutex
+	file  *jsonfile.Map[[]Key]
+	users map[string][]Key
+}
+
+func NewStore(path string) *Store {
+	return &Store{file: jsonfile.NewMap[[]Key]("ssh key store", path)}
+}
+
+func (s *Store) load() error {
+	users, err := s.file.Load()
+	if err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+func (s *Store) save() error {
+	return s.file.Save(s.users)
+}
+
+// List returns the extra keys of username in the order they were added.
+func (s *Store) List(username string) ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return append([]Key{}, s.users[jsonfile.UserKey(username)]...), nil
+}
+
+// Add parses line and stores it as an extra key of username.
+func (s *Store) Add(username, line string, now time.Time) (Key, error) {
+	key, err := Parse(line)
+	if err != nil || jsonfile.UserKey(username) == "" {
+		return Key{}, ErrInvalidKey
+	}
+	key.AddedAt = now.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Key{}, err
+	}
+	user := jsonfile.UserKey(username)
+	prev := s.users[user]
+	for _, existing := range prev {
+		if existing.Fingerprint == key.Fingerprint {
+			return Key{}, ErrDuplicate
+		}
+	}
+	if len(prev) >= MaxKeys {
+		return Key{}, ErrTooMany
+	}
+	s.users[user] = append(prev[:len(prev):len(prev)], key)
+	if err := s.save(); err != nil {
+		s.users[user] = prev
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// Remove deletes the key with fingerprint of username. It reports whether
+// one existed.
+func (s *Store) Remove(username, fingerprint string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	user := jsonfile.UserKey(username)
+	prev := s.users[user]
+	for i, key := range prev {
+		if key.Fingerprint != fingerprint {
+			continue
+		}
+		keys := append(prev[:i:i], prev[i+1:]...)
+		if len(keys) == 0 {
+			delete(s.users, user)
+		} else {
+			s.users[user] = keys
+		}
+		if err := s.save(); err != nil {
+			s.users[user] = prev
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,124 @@
+package sshkeys_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"remotegateway/internal/sshkeys"
+)
+
+func newKey(t *testing.T, comment string) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh key: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+}
+
+func TestParse(t *testing.T) {
+	line := newKey(t, "alice@laptop")
+	key, err := sshkeys.Parse("  " + strings.Replace(line, " ", "   ", 1) + "\n")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if key.Line != line || key.Type != ssh.KeyAlgoED25519 || key.Comment != "alice@laptop" || !strings.HasPrefix(key.Fingerprint, "SHA256:") {
+		t.Fatalf("unexpected key %+v", key)
+	}
+	for _, bad := range []string{"", "ssh-ed25519", "ssh-ed25519 AAAA", `command="rm -rf /" ` + line, line + "\n" + line} {
+		if _, err := sshkeys.Parse(bad); !errors.Is(err, sshkeys.ErrInvalidKey) {
+			t.Fatalf("expected %q to be refused, got %v", bad, err)
+		}
+	}
+
+	other := newKey(t, "")
+	keys, skipped := sshkeys.ParseAll([]string{line + "\n# comment\n\nnot a key\n" + line, other})
+	if skipped != 1 || len(keys) != 2 || keys[1].Line != strings.TrimSpace(other) {
+		t.Fatalf("unexpected keys %+v skipped %d", keys, skipped)
+	}
+	if lines := sshkeys.Lines(keys); len(lines) != 2 || lines[0] != line {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store := sshkeys.NewStore(path)
+	now := time.Unix(1700000000, 0)
+	line := newKey(t, "laptop")
+
+	key, err := store.Add("Alice", line, now)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected private store file, got %v %v", info, err)
+	}
+	if _, err := store.Add("alice", line, now); !errors.Is(err, sshkeys.ErrDuplicate) {
+		t.Fatalf("expected a duplicate key to be refused, got %v", err)
+	}
+	if _, err := store.Add("alice", "nope", now); !errors.Is(err, sshkeys.ErrInvalidKey) {
+		t.Fatalf("expected an invalid key to be refused, got %v", err)
+	}
+
+	keys, err := sshkeys.NewStore(path).List("alice")
+	if err != nil || len(keys) != 1 || keys[0].Line != line || !keys[0].AddedAt.Equal(now) {
+		t.Fatalf("unexpected keys %+v %v", keys, err)
+	}
+	if keys, err := store.List("bob"); err != nil || len(keys) != 0 {
+		t.Fatalf("expected bob to have no keys, got %+v %v", keys, err)
+	}
+
+	if ok, err := store.Remove("bob", key.Fingerprint); err != nil || ok {
+		t.Fatalf("expected other users not to remove the key, got %v %v", ok, err)
+	}
+	if ok, err := store.Remove("alice", key.Fingerprint); err != nil || !ok {
+		t.Fatalf("remove: %v %v", ok, err)
+	}
+	if keys, _ := store.List("alice"); len(keys) != 0 {
+		t.Fatalf("expected the key to be gone, got %+v", keys)
+	}
+
+	for i := 0; i < sshkeys.MaxKeys; i++ {
+		if _, err := store.Add("alice", newKey(t, ""), now); err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+	}
+	if _, err := store.Add("alice", newKey(t, ""), now); !errors.Is(err, sshkeys.ErrTooMany) {
+		t.Fatalf("expected ErrTooMany, got %v", err)
+	}
+}
+
+func TestStoreSeesChangesFromAnotherStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	server := sshkeys.NewStore(path)
+	now := time.Unix(1700000000, 0)
+	if _, err := server.Add("alice", newKey(t, "laptop"), now); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	key, err := sshkeys.NewStore(path).Add("alice", newKey(t, "desktop"), now)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if keys, err := server.List("alice"); err != nil || len(keys) != 2 {
+		t.Fatalf("expected both keys, got %+v %v", keys, err)
+	}
+	if removed, err := sshkeys.NewStore(path).Remove("alice", key.Fingerprint); err != nil || !removed {
+		t.Fatalf("expected remove to succeed, got %v %v", removed, err)
+	}
+	if keys, err := server.List("alice"); err != nil || len(keys) != 1 {
+		t.Fatalf("expected the running store to see the removal, got %+v %v", keys, err)
+	}
+}
@@ -0,0 +1,65 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed from RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeMatchesRFC6238Vectors(t *testing.T) {
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range cases {
+		got, err := Code(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("code at %d: %v", unix, err)
+		}
+		if got != want {
+			t.Fatalf("code at %d: expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestValidateAcceptsAdjacentSteps(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	previous, _ := Code(rfcSecret, now.Add(-Period))
+	step, ok := Validate(rfcSecret, previous, now)
+	if !ok || step != Step(now)-1 {
+		t.Fatalf("expected previous step to validate, got step=%d ok=%v", step, ok)
+	}
+
+	stale, _ := Code(rfcSecret, now.Add(-3*Period))
+	if _, ok := Validate(rfcSecret, stale, now); ok {
+		t.Fatalf("expected stale code to be rejected")
+	}
+	if _, ok := Validate(rfcSecret, "12345", now); ok {
+		t.Fatalf("expected short code to be rejected")
+	}
+	if _, ok := Validate("not base32!", "123456", now); ok {
+		t.Fatalf("expected invalid secret to be rejected")
+	}
+}
+
+func TestGenerateSecretAndKeyURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("generate secret: %v", err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("expected 32 character secret, got %q", secret)
+	}
+	uri := KeyURI("RemoteGateway", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/RemoteGateway:alice?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("unexpected key uri %q", uri)
+	}
+}
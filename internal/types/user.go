@@ -1,11 +1,21 @@
 package types
 
-import "remotegateway/internal/hash"
+import (
+	"remotegateway/internal/hash"
+	"strings"
+)
 
 type User struct {
 	Name                  string
 	NtlmPassword          []byte
 	CloudInitPasswordHash string
+	Groups                []string
+	// AppPasswords holds NTLMv2 hashes of generated gateway passwords.
+	AppPasswords [][]byte
+	// SSHKeys are authorized_keys lines authorized in new VMs of the user:
+	// those from the directory and, when creating a VM, the extra keys
+	// added on the dashboard.
+	SSHKeys []string
 }
 
 func NewUser(name, password, domain string) (*User, error) {
@@ -30,6 +40,46 @@ func (u *User) GetNtlmPassword() []byte {
 	return u.NtlmPassword
 }
 
+// NtlmHashes returns every NTLMv2 hash accepted for gateway logins.
+func (u *User) NtlmHashes() [][]byte {
+	hashes := make([][]byte, 0, len(u.AppPasswords)+1)
+	if len(u.NtlmPassword) > 0 {
+		hashes = append(hashes, u.NtlmPassword)
+	}
+	return append(hashes, u.AppPasswords...)
+}
+
+// AddAppPassword registers a generated gateway password. Users without a
+// directory password (e.g. single sign-on) also get it as VM password.
+func (u *User) AddAppPassword(password, domain string) error {
+	u.AppPasswords = append(u.AppPasswords, hash.NtlmV2Hash(password, u.Name, domain))
+	if u.CloudInitPasswordHash == "" {
+		cloudInitPassword, err := hash.CloudInitPasswordHash(password)
+		if err != nil {
+			return err
+		}
+		u.CloudInitPasswordHash = cloudInitPassword
+	}
+	return nil
+}
+
 func (u *User) GetCloudInitPasswordHash() string {
 	return u.CloudInitPasswordHash
 }
+
+func (u *User) GetSSHKeys() []string {
+	return u.SSHKeys
+}
+
+func (u *User) GetGroups() []string {
+	return u.Groups
+}
+
+func (u *User) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
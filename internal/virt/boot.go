@@ -1,12 +1,16 @@
 package virt
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"remotegateway/internal/config"
 	"remotegateway/internal/types"
+	"remotegateway/internal/vmsize"
+	"strings"
 
 	"libvirt.org/go/libvirt"
 )
@@ -19,31 +23,9 @@ const (
 	BASE_IMAGE_URL = "https://github.com/define42/ubuntu-desktop-cloud-image/releases/download/v0.0.11/noble-desktop-cloudimg-amd64.img"
 )
 
-// startVM starts a libvirt VM by name if it is not already running
-
-func StartVM(name, seedIso string) error {
-	conn, err := libvirt.NewConnect(LibvirtURI())
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	dom, err := conn.DomainDefineXML(UbuntuDomain(name, seedIso))
-	if err != nil {
-		fmt.Println("whaat", err)
-		return err
-	}
-	defer func() {
-		_ = dom.Free()
-	}()
-
-	if err := dom.Create(); err != nil {
-		return err
-	}
-
-	//fmt.Printf("VM %s started (ID %d)\n", name, dom.GetID())
-	return nil
-
+// VMName returns the domain name BootNewVM uses for name of username.
+func VMName(username, name string) string {
+	return username + "-" + name
 }
 
 func RemoveVolumes(conn *libvirt.Connect, volumeNames ...string) error {
@@ -66,6 +48,19 @@ func RemoveVolumes(conn *libvirt.Connect, volumeNames ...string) error {
 			_ = vol.Free()
 		}()
 
+		// Deleting a base volume would break the linked clones on it.
+		path, err := volumePath(vol)
+		if err != nil {
+			return err
+		}
+		users, err := volumesBackedBy(pool, path)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("delete volume %s: %w: %s", volumeName, ErrBaseInUse, strings.Join(users, ", "))
+		}
+
 		if err := vol.Delete(0); err != nil {
 			return fmt.Errorf("delete volume %s: %w", volumeName, err)
 		}
@@ -245,58 +240,46 @@ func InitVirt(settings *config.SettingsType) error {
 		log.Printf("Storage pool %s started", DEFAULT_VIRT_STORAGE)
 	}
 
-	baseImage := settings.Get(config.VDI_IMAGE_DIR) + "/" + BASE_IMAGE
-
-	// check image exists
-	if _, err := os.Stat(baseImage); os.IsNotExist(err) {
-
-		if err := os.MkdirAll(settings.Get(config.VDI_IMAGE_DIR), 0755); err != nil {
-			return fmt.Errorf("Failed to create image directory: %v", err)
-		}
+	catalog, err := LoadCatalog(settings.Get(config.VDI_IMAGE_DIR), settings.Get(config.CLOUD_INIT_DIR))
+	if err != nil {
+		return fmt.Errorf("Failed to load template catalog: %v", err)
+	}
+	if err := ensureTemplateImages(settings.Get(config.VDI_IMAGE_DIR), catalog); err != nil {
+		return err
+	}
 
-		log.Printf("Base image %s not found, downloading...", BASE_IMAGE_URL)
-		if err := downloadWithProgress(BASE_IMAGE_URL, baseImage); err != nil {
-			return fmt.Errorf("Failed to download base image: %v", err)
+	diskMode, err := ParseDiskMode(settings.Get(config.VM_DISK_MODE))
+	if err != nil {
+		return fmt.Errorf("%s: %v", config.VM_DISK_MODE, err)
+	}
+	if diskMode == DiskLinked {
+		baseVolumeMu.Lock()
+		defer baseVolumeMu.Unlock()
+		for _, t := range catalog.Templates {
+			if _, err := ensureBaseVolume(conn, filepath.Join(settings.Get(config.VDI_IMAGE_DIR), t.Image)); err != nil {
+				return fmt.Errorf("Failed to prepare base volume of template %s: %v", t.Name, err)
+			}
 		}
 	}
 
 	return nil
 }
 
-func BootNewVM(name string, user *types.User, settings *config.SettingsType) (vmName string, err error) {
-
-	vmName = user.GetName() + "-" + name
-
-	seedIso := vmName + "_seed.iso"
-
-	baseImage := settings.Get(config.VDI_IMAGE_DIR) + "/" + BASE_IMAGE
-
-	conn, err := libvirt.NewConnect(LibvirtURI())
+// BootNewVM creates and starts the VM name of user from tmpl with size,
+// replacing an earlier VM of the same name owned by user. It does not wait
+// for the guest.
+func BootNewVM(name string, user *types.User, tmpl Template, size vmsize.Size, settings *config.SettingsType) (vmName string, err error) {
+	b, err := NewBuild(name, user, tmpl, size, settings)
 	if err != nil {
-		return vmName, fmt.Errorf("Failed to connect to libvirt: %v", err)
-	}
-	defer conn.Close()
-
-	if err := DestroyExistingDomain(conn, vmName); err != nil {
-		return vmName, fmt.Errorf("Failed to destroy existing domain: %v", err)
-	}
-	if err := RemoveVolumes(conn, vmName, seedIso); err != nil {
-		return vmName, fmt.Errorf("Failed to remove existing volumes: %v", err)
-	}
-
-	if err := CopyAndResizeVolume(conn, vmName, baseImage, 40*1024*1024*1024); err != nil {
-		return vmName, fmt.Errorf("Failed to copy and resize base image: %v", err)
-	}
-
-	if err := CreateUbuntuSeedISOToPool(conn, seedIso, user.GetName(), user.GetCloudInitPasswordHash(), vmName); err != nil {
-		return vmName, fmt.Errorf("Failed to create seed ISO: %v", err)
+		return VMName(user.GetName(), name), err
 	}
-
-	if err := StartVM(vmName, seedIso); err != nil {
-		return vmName, fmt.Errorf("Failed to start VM: %v", err)
+	ctx := context.Background()
+	for _, step := range []func(context.Context) error{b.DestroyOld, b.CreateDisk, b.CreateSeed, b.Define, b.Start} {
+		if err := step(ctx); err != nil {
+			return b.VMName, err
+		}
 	}
-
-	return vmName, nil
+	return b.VMName, nil
 }
 
 func RemoveVM(name string) error {
@@ -5,6 +5,7 @@ import (
 	"remotegateway/internal/config"
 	typesUser "remotegateway/internal/types"
 	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
 	"testing"
 )
 
@@ -25,7 +26,7 @@ func TestStartVM(t *testing.T) {
 		t.Fatalf("Failed to create test user: %v", err)
 	}
 
-	vmName, err := virt.BootNewVM(testVMName, user, settings)
+	vmName, err := virt.BootNewVM(testVMName, user, virt.BuiltinTemplate(), vmsize.Default, settings)
 	if err != nil {
 		t.Fatalf("Failed to boot new VM %s: %v", vmName, err)
 	}
@@ -0,0 +1,296 @@
+package virt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TemplateManifest is the catalog file in VDI_IMAGE_DIR. Without it the
+// catalog holds only the built-in Ubuntu desktop template.
+const TemplateManifest = "templates.yaml"
+
+var (
+	// ErrInvalidCatalog is returned for malformed template manifests.
+	ErrInvalidCatalog = errors.New("invalid template catalog")
+	// ErrUnknownTemplate is returned when a requested template is not in
+	// the catalog.
+	ErrUnknownTemplate = errors.New("unknown template")
+)
+
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Template is a base image users create VMs from.
+type Template struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	// Image is the file name of the base image in VDI_IMAGE_DIR.
+	Image string `yaml:"image" json:"-"`
+	// URL is where InitVirt downloads a missing image from.
+	URL      string `yaml:"url" json:"-"`
+	OSFamily string `yaml:"os_family" json:"osFamily"`
+	// DefaultSize names the size profile preselected for the template.
+	DefaultSize string `yaml:"default_size" json:"defaultSize,omitempty"`
+	// CloudInit is the file name of a text/template in VDI_IMAGE_DIR
+	// rendering the user-data; empty uses the user-data of CLOUD_INIT_DIR
+	// or the built-in Ubuntu desktop one.
+	CloudInit string `yaml:"cloud_init" json:"-"`
+	// MetaDataFile is the file name of a text/template in VDI_IMAGE_DIR
+	// rendering the meta-data; empty uses the meta-data of CLOUD_INIT_DIR
+	// or the built-in one.
+	MetaDataFile string `yaml:"meta_data" json:"-"`
+
+	userData *template.Template
+	metaData *template.Template
+}
+
+// UserData renders the cloud-init user-data of t.
+func (t Template) UserData(data CloudInitData) ([]byte, error) {
+	tmpl := t.userData
+	if tmpl == nil {
+		tmpl = builtinUserData
+	}
+	out, err := renderCloudInit(tmpl, data)
+	if err != nil {
+		return nil, fmt.Errorf("render user-data of template %s: %w", t.Name, err)
+	}
+	return out, nil
+}
+
+// MetaData renders the cloud-init meta-data of t.
+func (t Template) MetaData(data CloudInitData) ([]byte, error) {
+	tmpl := t.metaData
+	if tmpl == nil {
+		tmpl = builtinMetaData
+	}
+	out, err := renderCloudInit(tmpl, data)
+	if err != nil {
+		return nil, fmt.Errorf("render meta-data of template %s: %w", t.Name, err)
+	}
+	return out, nil
+}
+
+// Catalog is the set of templates on offer.
+type Catalog struct {
+	// Default names the template used when none is requested.
+	Default   string     `yaml:"default" json:"default"`
+	Templates []Template `yaml:"templates" json:"templates"`
+}
+
+// BuiltinTemplate is the only template when there is no manifest.
+func BuiltinTemplate() Template {
+	return Template{
+		Name:        "ubuntu-desktop",
+		Description: "Ubuntu 24.04 GNOME desktop with xrdp",
+		Image:       BASE_IMAGE,
+		URL:         BASE_IMAGE_URL,
+		OSFamily:    "ubuntu",
+	}
+}
+
+// Files in CLOUD_INIT_DIR replacing the built-in
+// user-data and meta-data of templates that have none of their own.
+const (
+	CloudInitUserDataFile = "user-data"
+	CloudInitMetaDataFile = "meta-data"
+)
+
+// LoadCatalog reads TemplateManifest from imageDir and the cloud-init
+// templates it refers to, falling back to those in cloudInitDir when it is
+// not empty. Every template is rendered once and validated, so broken
+// templates fail here rather than when a VM is created.
+func LoadCatalog(imageDir, cloudInitDir string) (*Catalog, error) {
+	file := filepath.Join(imageDir, TemplateManifest)
+	raw, err := os.ReadFile(file)
+	var c *Catalog
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		builtin := BuiltinTemplate()
+		c = &Catalog{Default: builtin.Name, Templates: []Template{builtin}}
+	case err != nil:
+		return nil, err
+	default:
+		if c, err = ParseCatalog(raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	var defaultUserData, defaultMetaData *template.Template
+	if cloudInitDir != "" {
+		if defaultUserData, err = loadCloudInitTemplate(cloudInitDir, CloudInitUserDataFile, true); err != nil {
+			return nil, fmt.Errorf("%s: %w", cloudInitDir, err)
+		}
+		if defaultMetaData, err = loadCloudInitTemplate(cloudInitDir, CloudInitMetaDataFile, true); err != nil {
+			return nil, fmt.Errorf("%s: %w", cloudInitDir, err)
+		}
+	}
+	for i := range c.Templates {
+		t := &c.Templates[i]
+		t.userData, t.metaData = defaultUserData, defaultMetaData
+		if t.CloudInit != "" {
+			if t.userData, err = loadCloudInitTemplate(imageDir, t.CloudInit, false); err != nil {
+				return nil, fmt.Errorf("template %s: %w", t.Name, err)
+			}
+		}
+		if t.MetaDataFile != "" {
+			if t.metaData, err = loadCloudInitTemplate(imageDir, t.MetaDataFile, false); err != nil {
+				return nil, fmt.Errorf("template %s: %w", t.Name, err)
+			}
+		}
+		if err := t.check(); err != nil {
+			return nil, fmt.Errorf("%w: template %s: %v", ErrInvalidCatalog, t.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// loadCloudInitTemplate parses the template name in dir. A missing file is
+// only an error when optional is false.
+func loadCloudInitTemplate(dir, name string, optional bool) (*template.Template, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, name))
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseCloudInit(name, string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCatalog, err)
+	}
+	return tmpl, nil
+}
+
+// check renders the cloud-init templates of t with sample data.
+func (t Template) check() error {
+	userData, err := t.UserData(sampleCloudInitData)
+	if err != nil {
+		return err
+	}
+	metaData, err := t.MetaData(sampleCloudInitData)
+	if err != nil {
+		return err
+	}
+	return ValidateCloudInit(userData, metaData)
+}
+
+// ParseCatalog decodes and validates a manifest. Cloud-init templates are
+// not loaded.
+func ParseCatalog(raw []byte) (*Catalog, error) {
+	var c Catalog
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCatalog, err)
+	}
+	if len(c.Templates) == 0 {
+		return nil, fmt.Errorf("%w: no templates", ErrInvalidCatalog)
+	}
+	seen := make(map[string]bool)
+	for i := range c.Templates {
+		t := &c.Templates[i]
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("%w: template %d (%s): %v", ErrInvalidCatalog, i+1, t.Name, err)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("%w: duplicate template %q", ErrInvalidCatalog, t.Name)
+		}
+		seen[t.Name] = true
+	}
+	c.Default = strings.ToLower(strings.TrimSpace(c.Default))
+	if c.Default == "" {
+		c.Default = c.Templates[0].Name
+	}
+	if !seen[c.Default] {
+		return nil, fmt.Errorf("%w: default template %q is not defined", ErrInvalidCatalog, c.Default)
+	}
+	return &c, nil
+}
+
+func (t *Template) validate() error {
+	t.Name = strings.ToLower(strings.TrimSpace(t.Name))
+	t.OSFamily = strings.ToLower(strings.TrimSpace(t.OSFamily))
+	t.DefaultSize = strings.ToLower(strings.TrimSpace(t.DefaultSize))
+	if !templateNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("name must be lower case letters, digits, '.', '-' or '_', got %q", t.Name)
+	}
+	if t.OSFamily == "" {
+		return errors.New("os_family is required")
+	}
+	if !isPlainFileName(t.Image) {
+		return fmt.Errorf("image must be a file name in the image directory, got %q", t.Image)
+	}
+	if t.CloudInit != "" && !isPlainFileName(t.CloudInit) {
+		return fmt.Errorf("cloud_init must be a file name in the image directory, got %q", t.CloudInit)
+	}
+	if t.MetaDataFile != "" && !isPlainFileName(t.MetaDataFile) {
+		return fmt.Errorf("meta_data must be a file name in the image directory, got %q", t.MetaDataFile)
+	}
+	if t.URL != "" {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url must be an http or https URL, got %q", t.URL)
+		}
+	}
+	return nil
+}
+
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && !strings.ContainsAny(name, `/\`)
+}
+
+// Find returns the template name, or the default template when name is
+// empty.
+func (c *Catalog) Find(name string) (Template, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = c.Default
+	}
+	for _, t := range c.Templates {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return Template{}, fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+}
+
+// ensureTemplateImages downloads the images of the catalog in imageDir that
+// are missing.
+func ensureTemplateImages(imageDir string, c *Catalog) error {
+	for _, t := range c.Templates {
+		image := filepath.Join(imageDir, t.Image)
+		if _, err := os.Stat(image); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("template %s: %v", t.Name, err)
+		}
+		if t.URL == "" {
+			return fmt.Errorf("template %s: image %s not found and no url to download it from", t.Name, image)
+		}
+		if err := os.MkdirAll(imageDir, 0755); err != nil {
+			return fmt.Errorf("Failed to create image directory: %v", err)
+		}
+		log.Printf("Image %s of template %s not found, downloading %s...", t.Image, t.Name, t.URL)
+		// Download next to the image so a failed download is not mistaken
+		// for the image on the next start.
+		partial := image + ".part"
+		if err := downloadWithProgress(t.URL, partial); err != nil {
+			_ = os.Remove(partial)
+			return fmt.Errorf("Failed to download image of template %s: %v", t.Name, err)
+		}
+		if err := os.Rename(partial, image); err != nil {
+			return fmt.Errorf("Failed to move image of template %s into place: %v", t.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package virt_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remotegateway/internal/virt"
+)
+
+const testManifest = `
+default: Fedora-Workstation
+templates:
+  - name: ubuntu-desktop
+    description: Ubuntu desktop
+    image: noble.img
+    url: https://example.com/noble.img
+    os_family: Ubuntu
+    default_size: Medium
+  - name: fedora-workstation
+    image: fedora.qcow2
+    os_family: fedora
+    cloud_init: fedora.yaml
+`
+
+func TestParseCatalog(t *testing.T) {
+	c, err := virt.ParseCatalog([]byte(testManifest))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if c.Default != "fedora-workstation" || len(c.Templates) != 2 {
+		t.Fatalf("unexpected catalog %+v", c)
+	}
+	ubuntu, err := c.Find("Ubuntu-Desktop")
+	if err != nil || ubuntu.OSFamily != "ubuntu" || ubuntu.DefaultSize != "medium" || ubuntu.Image != "noble.img" {
+		t.Fatalf("unexpected template %+v %v", ubuntu, err)
+	}
+	if tmpl, err := c.Find(""); err != nil || tmpl.Name != "fedora-workstation" {
+		t.Fatalf("expected the default template, got %+v %v", tmpl, err)
+	}
+	if _, err := c.Find("windows"); !errors.Is(err, virt.ErrUnknownTemplate) {
+		t.Fatalf("expected ErrUnknownTemplate, got %v", err)
+	}
+}
+
+func TestParseCatalogRejectsInvalidManifests(t *testing.T) {
+	cases := map[string]string{
+		"empty":             "",
+		"unknown field":     "templates:\n  - {name: a, image: a.img, os_family: x, colour: red}\n",
+		"bad name":          "templates:\n  - {name: 'My Desktop', image: a.img, os_family: x}\n",
+		"missing image":     "templates:\n  - {name: a, os_family: x}\n",
+		"image path":        "templates:\n  - {name: a, image: ../a.img, os_family: x}\n",
+		"cloud-init path":   "templates:\n  - {name: a, image: a.img, os_family: x, cloud_init: /etc/passwd}\n",
+		"missing os family": "templates:\n  - {name: a, image: a.img}\n",
+		"bad url":           "templates:\n  - {name: a, image: a.img, os_family: x, url: 'ftp://host/a.img'}\n",
+		"duplicate":         "templates:\n  - {name: a, image: a.img, os_family: x}\n  - {name: A, image: b.img, os_family: x}\n",
+		"unknown default":   "default: b\ntemplates:\n  - {name: a, image: a.img, os_family: x}\n",
+	}
+	for name, raw := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := virt.ParseCatalog([]byte(raw)); !errors.Is(err, virt.ErrInvalidCatalog) {
+				t.Fatalf("expected ErrInvalidCatalog, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	dir := t.TempDir()
+	c, err := virt.LoadCatalog(dir, "")
+	if err != nil || len(c.Templates) != 1 || c.Templates[0].Image != virt.BASE_IMAGE {
+		t.Fatalf("expected the built-in template without a manifest, got %+v %v", c, err)
+	}
+	data := virt.CloudInitData{Username: "alice", PasswordHash: "$6$hash", Hostname: "alice-dev"}
+	userData, err := c.Templates[0].UserData(data)
+	if err != nil || !strings.Contains(string(userData), `name: "alice"`) || !strings.Contains(string(userData), `passwd: "$6$hash"`) {
+		t.Fatalf("unexpected built-in user-data %q %v", userData, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, virt.TemplateManifest), []byte(testManifest), 0o600); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	if _, err := virt.LoadCatalog(dir, ""); err == nil {
+		t.Fatal("expected a missing cloud-init template to fail")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fedora.yaml"), []byte("#cloud-config\nhostname: {{.Hostname}}\n"), 0o600); err != nil {
+		t.Fatalf("write cloud-init: %v", err)
+	}
+	c, err = virt.LoadCatalog(dir, "")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	fedora, _ := c.Find("fedora-workstation")
+	if userData, err := fedora.UserData(data); err != nil || string(userData) != "#cloud-config\nhostname: alice-dev\n" {
+		t.Fatalf("unexpected fedora user-data %q %v", userData, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "fedora.yaml"), []byte("hostname: {{.Hostname"), 0o600); err != nil {
+		t.Fatalf("write cloud-init: %v", err)
+	}
+	if _, err := virt.LoadCatalog(dir, ""); !errors.Is(err, virt.ErrInvalidCatalog) {
+		t.Fatalf("expected a broken cloud-init template to be invalid, got %v", err)
+	}
+}
+
+func TestLoadCatalogCloudInitDir(t *testing.T) {
+	imageDir, cloudInitDir := t.TempDir(), t.TempDir()
+	write := func(dir, name, raw string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(raw), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write(cloudInitDir, virt.CloudInitUserDataFile, "#cloud-config\ngroups: {{yaml .Groups}}\n")
+	write(cloudInitDir, virt.CloudInitMetaDataFile, "instance-id: {{yaml .InstanceID}}\nlocal-hostname: {{yaml .Hostname}}\nzone: lab\n")
+	c, err := virt.LoadCatalog(imageDir, cloudInitDir)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	data := virt.CloudInitData{Username: "alice", Groups: []string{"dev", "ops"}, Hostname: "alice-dev", InstanceID: "alice-dev"}
+	if userData, err := c.Templates[0].UserData(data); err != nil || string(userData) != "#cloud-config\ngroups: [\"dev\",\"ops\"]\n" {
+		t.Fatalf("expected the user-data of the directory, got %q %v", userData, err)
+	}
+	if metaData, err := c.Templates[0].MetaData(data); err != nil || !strings.HasSuffix(string(metaData), "zone: lab\n") {
+		t.Fatalf("expected the meta-data of the directory, got %q %v", metaData, err)
+	}
+
+	// A template's own files win over the directory.
+	write(imageDir, virt.TemplateManifest, "templates:\n  - {name: a, image: a.img, os_family: x, meta_data: a-meta}\n")
+	write(imageDir, "a-meta", "instance-id: {{.InstanceID}}\n")
+	if c, err = virt.LoadCatalog(imageDir, cloudInitDir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if metaData, err := c.Templates[0].MetaData(data); err != nil || string(metaData) != "instance-id: alice-dev\n" {
+		t.Fatalf("expected the meta-data of the template, got %q %v", metaData, err)
+	}
+
+	for name, raw := range map[string]string{
+		"not yaml":         "#cloud-config\nusers: [\n",
+		"not a mapping":    "#cloud-config\n- reboot\n",
+		"no header":        "users: []\n",
+		"unknown field":    "#cloud-config\nname: {{.Login}}\n",
+		"unknown function": "#cloud-config\nname: {{quote .Username}}\n",
+	} {
+		write(cloudInitDir, virt.CloudInitUserDataFile, raw)
+		if _, err := virt.LoadCatalog(imageDir, cloudInitDir); !errors.Is(err, virt.ErrInvalidCatalog) {
+			t.Fatalf("%s: expected ErrInvalidCatalog, got %v", name, err)
+		}
+	}
+}
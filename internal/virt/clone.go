@@ -0,0 +1,297 @@
+package virt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"libvirt.org/go/libvirt"
+)
+
+// Disk modes of new VMs, set with VM_DISK_MODE.
+const (
+	// DiskLinked creates the VM disk as a qcow2 overlay on a base volume
+	// shared by every VM of the template.
+	DiskLinked = "linked"
+	// DiskCopy uploads a full copy of the template image for every VM.
+	DiskCopy = "copy"
+)
+
+// baseVolumePrefix names the pool volumes holding imported template images.
+// Login names end before any '@', VM names cannot contain it, and NewBuild
+// refuses the odd VM name that still does, so no VM disk or seed ISO
+// starts with it.
+const baseVolumePrefix = "base@"
+
+var (
+	// ErrBaseInUse is returned when deleting a volume that linked clones
+	// are backed by.
+	ErrBaseInUse = errors.New("volume is the backing store of linked clones")
+	// ErrReservedName is returned for VM names in the base volume namespace.
+	ErrReservedName = errors.New("vm name is reserved for base volumes")
+)
+
+// baseVolumeMu keeps concurrent creations from importing an image twice and
+// keeps this process from removing a base volume while a clone is linked to it.
+var baseVolumeMu sync.Mutex
+
+// ParseDiskMode validates a VM_DISK_MODE value; empty means DiskLinked.
+func ParseDiskMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", DiskLinked:
+		return DiskLinked, nil
+	case DiskCopy:
+		return DiskCopy, nil
+	default:
+		return "", fmt.Errorf("unknown disk mode %q, want %s or %s", value, DiskLinked, DiskCopy)
+	}
+}
+
+// BaseVolumeName returns the pool volume the template image is imported
+// as. Images are imported once, so an updated image needs a new file name.
+func BaseVolumeName(image string) string {
+	return baseVolumePrefix + image
+}
+
+type storageVolXML struct {
+	Target struct {
+		Path string `xml:"path"`
+	} `xml:"target"`
+	BackingStore struct {
+		Path string `xml:"path"`
+	} `xml:"backingStore"`
+}
+
+// BackingPath returns the backing store path of a volume XML description,
+// empty for volumes without one.
+func BackingPath(volumeXML string) (string, error) {
+	var parsed storageVolXML
+	if err := xml.Unmarshal([]byte(volumeXML), &parsed); err != nil {
+		return "", fmt.Errorf("parse volume xml: %w", err)
+	}
+	return strings.TrimSpace(parsed.BackingStore.Path), nil
+}
+
+func volumePath(vol *libvirt.StorageVol) (string, error) {
+	desc, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return "", fmt.Errorf("get volume xml: %w", err)
+	}
+	var parsed storageVolXML
+	if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+		return "", fmt.Errorf("parse volume xml: %w", err)
+	}
+	return strings.TrimSpace(parsed.Target.Path), nil
+}
+
+// volumesBackedBy returns the names of the volumes in pool whose backing
+// store is path.
+func volumesBackedBy(pool *libvirt.StoragePool, path string) ([]string, error) {
+	vols, err := pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, fmt.Errorf("list volumes: %w", err)
+	}
+	var users []string
+	for i := range vols {
+		vol := &vols[i]
+		desc, err := vol.GetXMLDesc(0)
+		if err == nil {
+			var backing string
+			if backing, err = BackingPath(desc); err == nil && backing != "" && filepath.Clean(backing) == filepath.Clean(path) {
+				if name, err := vol.GetName(); err == nil {
+					users = append(users, name)
+				}
+			}
+		}
+		_ = vol.Free()
+	}
+	return users, nil
+}
+
+// ensureBaseVolume imports imagePath into the pool as BaseVolumeName unless
+// it is there already, and returns the path of the volume. Callers hold
+// baseVolumeMu until they are done with the path.
+func ensureBaseVolume(conn *libvirt.Connect, imagePath string) (string, error) {
+	name := BaseVolumeName(filepath.Base(imagePath))
+	pool, err := conn.LookupStoragePoolByName(DEFAULT_VIRT_STORAGE)
+	if err != nil {
+		return "", fmt.Errorf("lookup pool: %w", err)
+	}
+	defer func() {
+		_ = pool.Free()
+	}()
+
+	vol, err := pool.LookupStorageVolByName(name)
+	if err != nil {
+		log.Printf("Importing %s as base volume %s", imagePath, name)
+		if err := CopyAndResizeVolume(conn, name, imagePath, 0); err != nil {
+			_ = RemoveVolumes(conn, name)
+			return "", fmt.Errorf("import base volume %s: %w", name, err)
+		}
+		if vol, err = pool.LookupStorageVolByName(name); err != nil {
+			return "", fmt.Errorf("lookup base volume %s: %w", name, err)
+		}
+	}
+	defer func() {
+		_ = vol.Free()
+	}()
+	return volumePath(vol)
+}
+
+// createLinkedClone creates volumeName as an overlay on the base volume of
+// imagePath, importing the image first if needed. The base volume cannot be
+// removed in this process before the overlay exists.
+func createLinkedClone(conn *libvirt.Connect, volumeName, imagePath string, capacityBytes uint64) error {
+	baseVolumeMu.Lock()
+	defer baseVolumeMu.Unlock()
+
+	backingPath, err := ensureBaseVolume(conn, imagePath)
+	if err != nil {
+		return fmt.Errorf("prepare base volume: %w", err)
+	}
+	if err := CreateLinkedVolume(conn, volumeName, backingPath, capacityBytes); err != nil {
+		return fmt.Errorf("create linked clone: %w", err)
+	}
+	return nil
+}
+
+// CreateLinkedVolume creates volumeName as a qcow2 overlay on the volume at
+// backingPath. The overlay is at least as large as its backing store.
+func CreateLinkedVolume(conn *libvirt.Connect, volumeName, backingPath string, capacityBytes uint64) error {
+	pool, err := conn.LookupStoragePoolByName(DEFAULT_VIRT_STORAGE)
+	if err != nil {
+		return fmt.Errorf("lookup pool: %w", err)
+	}
+	defer func() {
+		_ = pool.Free()
+	}()
+
+	if base, err := conn.LookupStorageVolByPath(backingPath); err == nil {
+		if info, err := base.GetInfo(); err == nil && info.Capacity > capacityBytes {
+			capacityBytes = info.Capacity
+		}
+		_ = base.Free()
+	}
+
+	permXML, err := storageVolPermissionsXML()
+	if err != nil {
+		return err
+	}
+	pathXML := ""
+	if permXML != "" {
+		pathXML, err = storageVolPathXML(pool, volumeName)
+		if err != nil {
+			return err
+		}
+	}
+	volXML := fmt.Sprintf(`
+<volume>
+  <name>%s</name>
+  <capacity unit="bytes">%d</capacity>
+  <target>
+    <format type="qcow2"/>%s%s
+  </target>
+  <backingStore>
+    <path>%s</path>
+    <format type="qcow2"/>
+  </backingStore>
+</volume>`, volumeName, capacityBytes, pathXML, permXML, backingPath)
+
+	vol, err := pool.StorageVolCreateXML(volXML, 0)
+	if err != nil {
+		return fmt.Errorf("create linked volume: %w", err)
+	}
+	_ = vol.Free()
+	return nil
+}
+
+// BaseVolume is an imported template image.
+type BaseVolume struct {
+	Name       string
+	Path       string
+	CapacityGB int
+	// Clones are the volumes backed by the base volume.
+	Clones []string
+}
+
+// ListBaseVolumes returns the imported template images of the pool.
+func ListBaseVolumes() ([]BaseVolume, error) {
+	conn, err := libvirt.NewConnect(LibvirtURI())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(DEFAULT_VIRT_STORAGE)
+	if err != nil {
+		return nil, fmt.Errorf("lookup pool: %w", err)
+	}
+	defer func() {
+		_ = pool.Free()
+	}()
+
+	names, err := pool.ListStorageVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("list volumes: %w", err)
+	}
+	var bases []BaseVolume
+	for _, name := range names {
+		if !strings.HasPrefix(name, baseVolumePrefix) {
+			continue
+		}
+		vol, err := pool.LookupStorageVolByName(name)
+		if err != nil {
+			continue
+		}
+		base := BaseVolume{Name: name}
+		if base.Path, err = volumePath(vol); err == nil {
+			base.Clones, err = volumesBackedBy(pool, base.Path)
+		}
+		if info, infoErr := vol.GetInfo(); infoErr == nil {
+			base.CapacityGB = int((info.Capacity + (1 << 30) - 1) >> 30)
+		}
+		_ = vol.Free()
+		if err != nil {
+			return nil, err
+		}
+		bases = append(bases, base)
+	}
+	return bases, nil
+}
+
+// RemoveBaseVolume deletes the imported template image name. It fails with
+// ErrBaseInUse while linked clones are backed by it. baseVolumeMu only orders
+// it against clone creation in the same process; when it runs from the CLI,
+// the volumesBackedBy check in RemoveVolumes is the only guard against a
+// server creating a clone on the volume at the same time.
+func RemoveBaseVolume(name string) error {
+	if !strings.HasPrefix(name, baseVolumePrefix) {
+		return fmt.Errorf("%s is not a base volume", name)
+	}
+	conn, err := libvirt.NewConnect(LibvirtURI())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(DEFAULT_VIRT_STORAGE)
+	if err != nil {
+		return fmt.Errorf("lookup pool: %w", err)
+	}
+	defer func() {
+		_ = pool.Free()
+	}()
+	vol, err := pool.LookupStorageVolByName(name)
+	if err != nil {
+		return fmt.Errorf("base volume %s not found", name)
+	}
+	_ = vol.Free()
+
+	baseVolumeMu.Lock()
+	defer baseVolumeMu.Unlock()
+	return RemoveVolumes(conn, name)
+}
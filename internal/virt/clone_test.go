@@ -0,0 +1,60 @@
+package virt_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
+)
+
+func TestParseDiskMode(t *testing.T) {
+	for value, want := range map[string]string{"": virt.DiskLinked, " Linked ": virt.DiskLinked, "copy": virt.DiskCopy} {
+		if got, err := virt.ParseDiskMode(value); err != nil || got != want {
+			t.Fatalf("%q: got %q %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := virt.ParseDiskMode("thin"); err == nil {
+		t.Fatal("expected an unknown disk mode to fail")
+	}
+}
+
+func TestBackingPath(t *testing.T) {
+	overlay := `<volume type='file'>
+  <name>alice-dev</name>
+  <target>
+    <path>/var/lib/libvirt/images/alice-dev</path>
+    <format type='qcow2'/>
+  </target>
+  <backingStore>
+    <path>/var/lib/libvirt/images/base@noble.img</path>
+    <format type='qcow2'/>
+  </backingStore>
+</volume>`
+	if path, err := virt.BackingPath(overlay); err != nil || path != "/var/lib/libvirt/images/base@noble.img" {
+		t.Fatalf("unexpected backing path %q %v", path, err)
+	}
+	if path, err := virt.BackingPath(`<volume><name>base@noble.img</name></volume>`); err != nil || path != "" {
+		t.Fatalf("expected no backing path, got %q %v", path, err)
+	}
+	if _, err := virt.BackingPath(`<volume>`); err == nil {
+		t.Fatal("expected malformed xml to fail")
+	}
+	if name := virt.BaseVolumeName("noble.img"); name != "base@noble.img" {
+		t.Fatalf("unexpected base volume name %q", name)
+	}
+}
+
+func TestNewBuildRefusesBaseVolumeNames(t *testing.T) {
+	settings := config.NewSettingType(false)
+	if _, err := virt.NewBuild("x", &types.User{Name: "base@noble.img"}, virt.Template{Name: "ubuntu"}, vmsize.Default, settings); !errors.Is(err, virt.ErrReservedName) {
+		t.Fatalf("expected a name in the base volume namespace to be refused, got %v", err)
+	}
+	build, err := virt.NewBuild("dev", &types.User{Name: "base.x"}, virt.Template{Name: "ubuntu"}, vmsize.Default, settings)
+	if err != nil || strings.HasPrefix(build.VMName, virt.BaseVolumeName("")) {
+		t.Fatalf("expected a dotted username outside the base namespace, got %+v %v", build, err)
+	}
+}
@@ -0,0 +1,196 @@
+package virt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidCloudInit is returned when rendered user-data or meta-data is
+// not a valid NoCloud document.
+var ErrInvalidCloudInit = errors.New("invalid cloud-init data")
+
+// CloudInitData is what user-data and meta-data templates are rendered
+// with. Templates quote values with {{yaml .Field}}.
+type CloudInitData struct {
+	Username     string
+	Groups       []string
+	PasswordHash string
+	Hostname     string
+	InstanceID   string
+	// Locale, Keyboard and Timezone come from the CLOUD_INIT_* settings;
+	// empty keeps the default of the image.
+	Locale   string
+	Keyboard string
+	Timezone string
+	// SSHKeys are the public keys authorized for the user.
+	SSHKeys []string
+}
+
+// sampleCloudInitData checks templates when the catalog is loaded.
+var sampleCloudInitData = CloudInitData{
+	Username:     "user",
+	Groups:       []string{"users"},
+	PasswordHash: "$6$hash",
+	Hostname:     "user-vm",
+	InstanceID:   "user-vm",
+	Locale:       "en_US.UTF-8",
+	Keyboard:     "us",
+	Timezone:     "UTC",
+	SSHKeys:      []string{"ssh-ed25519 AAAA user@host"},
+}
+
+var cloudInitFuncs = template.FuncMap{"yaml": yamlValue}
+
+// yamlValue writes v as a flow value, which quotes strings safely.
+func yamlValue(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+func parseCloudInit(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(cloudInitFuncs).Parse(text)
+}
+
+func mustParseCloudInit(name, text string) *template.Template {
+	return template.Must(parseCloudInit(name, text))
+}
+
+// builtinMetaData is the meta-data of templates without a meta_data file
+// when CLOUD_INIT_DIR has none either.
+var builtinMetaData = mustParseCloudInit("meta-data", `instance-id: {{yaml .InstanceID}}
+local-hostname: {{yaml .Hostname}}
+`)
+
+// builtinUserData is the user-data of templates without a cloud_init file
+// when CLOUD_INIT_DIR has none either.
+var builtinUserData = mustParseCloudInit("ubuntu-desktop", `#cloud-config
+output:
+  all: '| tee -a /var/log/cloud-init-output.log'
+{{- with .Locale}}
+locale: {{yaml .}}
+{{- end}}
+{{- with .Timezone}}
+timezone: {{yaml .}}
+{{- end}}
+{{- with .Keyboard}}
+keyboard:
+  layout: {{yaml .}}
+  variant: ''
+{{- end}}
+users:
+  - name: {{yaml .Username}}
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    lock_passwd: false
+    passwd: {{yaml .PasswordHash}}
+{{- with .SSHKeys}}
+    ssh_authorized_keys:
+{{- range .}}
+      - {{yaml .}}
+{{- end}}
+{{- end}}
+ssh_pwauth: true
+package_update: true
+package_upgrade: true
+packages:
+  - gnome-session
+  - gnome-shell
+  - gnome-terminal
+  - gdm3
+  - xrdp
+  - xorgxrdp
+  - dbus-x11
+
+write_files:
+  # Disable Wayland (XRDP requires Xorg)
+  - path: /etc/gdm3/custom.conf
+    permissions: '0644'
+    content: |
+      [daemon]
+      WaylandEnable=false
+      DefaultSession=gnome-xorg.desktop
+
+  # Force GNOME to behave well under XRDP
+  - path: /etc/profile.d/gnome-xrdp.sh
+    permissions: '0644'
+    content: |
+      export XDG_SESSION_TYPE=x11
+      export GSK_RENDERER=cairo
+      export MUTTER_DEBUG_FORCE_KMS_MODE=simple
+
+  # Disable GNOME portal backend globally (avoid timeouts)
+  - path: /etc/systemd/user/xdg-desktop-portal-gnome.service
+    permissions: '0644'
+    content: |
+      [Unit]
+      Description=Disabled for XRDP
+
+  # Disable AppArmor at kernel level
+  - path: /etc/default/grub.d/99-disable-apparmor.cfg
+    permissions: '0644'
+    content: |
+      GRUB_CMDLINE_LINUX_DEFAULT="$GRUB_CMDLINE_LINUX_DEFAULT apparmor=0"
+
+runcmd:
+  # Enable XRDP
+  - systemctl enable xrdp
+  - systemctl restart xrdp
+
+  # Disable AppArmor service immediately (kernel param applies after reboot)
+  - systemctl disable --now apparmor || true
+
+  # Mask GNOME portal backend globally
+  - systemctl --global mask xdg-desktop-portal-gnome.service
+
+  # Update GRUB and reboot to apply kernel params
+  - update-grub
+  - reboot
+`)
+
+func renderCloudInit(tmpl *template.Template, data CloudInitData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ValidateCloudInit checks that userData is a #cloud-config mapping or a
+// script and that metaData is a mapping. Errors do not quote the documents,
+// which hold secrets.
+func ValidateCloudInit(userData, metaData []byte) error {
+	switch {
+	case bytes.HasPrefix(userData, []byte("#!")):
+	case bytes.HasPrefix(userData, []byte("#cloud-config")):
+		if err := validateMapping(userData); err != nil {
+			return fmt.Errorf("%w: user-data: %v", ErrInvalidCloudInit, err)
+		}
+	default:
+		return fmt.Errorf("%w: user-data must start with #cloud-config or #!", ErrInvalidCloudInit)
+	}
+	if err := validateMapping(metaData); err != nil {
+		return fmt.Errorf("%w: meta-data: %v", ErrInvalidCloudInit, err)
+	}
+	return nil
+}
+
+func validateMapping(raw []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) > 0 && doc.Content[0].Kind != yaml.MappingNode {
+		return errors.New("top level is not a mapping")
+	}
+	return nil
+}
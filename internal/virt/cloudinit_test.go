@@ -0,0 +1,126 @@
+package virt_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
+)
+
+func TestBuiltinCloudInit(t *testing.T) {
+	tmpl := virt.BuiltinTemplate()
+	data := virt.CloudInitData{
+		Username:     "alice",
+		PasswordHash: "$6$hash",
+		Hostname:     "alice-dev",
+		InstanceID:   "alice-dev",
+		Locale:       "da_DK.UTF-8",
+		Keyboard:     "dk",
+		Timezone:     "Europe/Copenhagen",
+		SSHKeys:      []string{"ssh-ed25519 AAAA alice@laptop", "ssh-rsa BBBB: #not a comment"},
+	}
+	userData, err := tmpl.UserData(data)
+	if err != nil {
+		t.Fatalf("user-data: %v", err)
+	}
+	metaData, err := tmpl.MetaData(data)
+	if err != nil {
+		t.Fatalf("meta-data: %v", err)
+	}
+	if err := virt.ValidateCloudInit(userData, metaData); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	var doc struct {
+		Locale   string `yaml:"locale"`
+		Timezone string `yaml:"timezone"`
+		Keyboard struct {
+			Layout string `yaml:"layout"`
+		} `yaml:"keyboard"`
+		Users []struct {
+			Name   string   `yaml:"name"`
+			Passwd string   `yaml:"passwd"`
+			Keys   []string `yaml:"ssh_authorized_keys"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(userData, &doc); err != nil {
+		t.Fatalf("parse user-data: %v", err)
+	}
+	if doc.Locale != data.Locale || doc.Timezone != data.Timezone || doc.Keyboard.Layout != "dk" ||
+		len(doc.Users) != 1 || doc.Users[0].Passwd != data.PasswordHash || strings.Join(doc.Users[0].Keys, "|") != strings.Join(data.SSHKeys, "|") {
+		t.Fatalf("unexpected user-data %+v", doc)
+	}
+	if string(metaData) != "instance-id: \"alice-dev\"\nlocal-hostname: \"alice-dev\"\n" {
+		t.Fatalf("unexpected meta-data %q", metaData)
+	}
+
+	// A name with YAML syntax stays a single scalar.
+	hostile := "eve\n  sudo: ALL=(ALL) NOPASSWD:ALL #"
+	userData, err = tmpl.UserData(virt.CloudInitData{Username: hostile, PasswordHash: "$6$hash"})
+	if err != nil {
+		t.Fatalf("user-data: %v", err)
+	}
+	doc.Users = nil
+	if err := yaml.Unmarshal(userData, &doc); err != nil {
+		t.Fatalf("parse user-data: %v", err)
+	}
+	if len(doc.Users) != 1 || doc.Users[0].Name != hostile {
+		t.Fatalf("expected the name to be quoted, got %q", userData)
+	}
+
+	// Empty settings leave the image defaults alone.
+	userData, err = tmpl.UserData(virt.CloudInitData{Username: "alice", PasswordHash: "$6$hash"})
+	if err != nil {
+		t.Fatalf("user-data: %v", err)
+	}
+	for _, key := range []string{"locale:", "timezone:", "keyboard:", "ssh_authorized_keys:"} {
+		if strings.Contains(string(userData), key) {
+			t.Fatalf("expected no %s without a value, got %q", key, userData)
+		}
+	}
+}
+
+func TestNewBuildKeyboard(t *testing.T) {
+	settings := config.NewSettingType(false)
+	build, err := virt.NewBuild("dev", &types.User{Name: "alice"}, virt.Template{Name: "ubuntu"}, vmsize.Default, settings)
+	if err != nil || build.CloudInit.Keyboard != "" {
+		t.Fatalf("expected the image keyboard layout by default, got %+v %v", build, err)
+	}
+
+	t.Setenv(config.CLOUD_INIT_KEYBOARD, "us")
+	settings = config.NewSettingType(false)
+	build, err = virt.NewBuild("dev", &types.User{Name: "alice"}, virt.Template{Name: "ubuntu"}, vmsize.Default, settings)
+	if err != nil || build.CloudInit.Keyboard != "us" {
+		t.Fatalf("expected the configured keyboard layout, got %+v %v", build, err)
+	}
+}
+
+func TestValidateCloudInit(t *testing.T) {
+	meta := []byte("instance-id: a\n")
+	for _, userData := range []string{"#cloud-config\n", "#cloud-config\nusers: []\n", "#!/bin/sh\necho hi\n"} {
+		if err := virt.ValidateCloudInit([]byte(userData), meta); err != nil {
+			t.Fatalf("%q: %v", userData, err)
+		}
+	}
+	for name, docs := range map[string][2]string{
+		"no header":        {"users: []\n", "instance-id: a\n"},
+		"broken user-data": {"#cloud-config\nusers: [\n", "instance-id: a\n"},
+		"scalar user-data": {"#cloud-config\nreboot\n", "instance-id: a\n"},
+		"list meta-data":   {"#cloud-config\n", "- a\n"},
+		"broken meta-data": {"#cloud-config\n", "instance-id: \"a\n"},
+	} {
+		err := virt.ValidateCloudInit([]byte(docs[0]), []byte(docs[1]))
+		if !errors.Is(err, virt.ErrInvalidCloudInit) {
+			t.Fatalf("%s: expected ErrInvalidCloudInit, got %v", name, err)
+		}
+		if strings.Contains(err.Error(), "instance-id") {
+			t.Fatalf("%s: expected the error not to quote the documents, got %v", name, err)
+		}
+	}
+}
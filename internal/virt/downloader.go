@@ -44,6 +44,9 @@ func downloadWithProgress(url, path string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
 
 	out, err := os.Create(path)
 	if err != nil {
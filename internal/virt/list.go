@@ -1,14 +1,17 @@
 package virt
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"libvirt.org/go/libvirt"
 )
 
-type vmInfo struct {
+// VMInfo is a domain as listed by ListVMs.
+type VMInfo struct {
 	Name      string
 	State     string
 	MemoryMiB int
@@ -16,9 +19,19 @@ type vmInfo struct {
 	VolumeGB  int
 	IP        string
 	PrimaryIP string
+	// Owner is empty for domains created before ownership metadata.
+	Owner     string
+	Creator   string
+	CreatedAt time.Time
+	Template  string
+	// Readiness is empty for VMs created without phone-home.
+	Readiness   string
+	KeepRunning bool
+	OwnerGroups []string
+	Grants      []Grant
 }
 
-func ListVMs(prefix string) ([]vmInfo, error) {
+func ListVMs(prefix string) ([]VMInfo, error) {
 	conn, err := libvirt.NewConnect(LibvirtURI())
 	if err != nil {
 		log.Printf("list vms connect: %v", err)
@@ -37,7 +50,7 @@ func ListVMs(prefix string) ([]vmInfo, error) {
 		}
 	}()
 
-	var result []vmInfo
+	var result []VMInfo
 	for _, d := range doms {
 		name, err := d.GetName()
 		if err != nil {
@@ -64,19 +77,66 @@ func ListVMs(prefix string) ([]vmInfo, error) {
 				ip = strings.Join(ips, ", ")
 			}
 		}
-		result = append(result, vmInfo{
-			Name:      name,
-			State:     formatState(state),
-			MemoryMiB: mem,
-			VCPU:      vcpu,
-			VolumeGB:  volGB,
-			IP:        ip,
-			PrimaryIP: primaryIP,
+		ownership, err := domainOwnership(d)
+		if err != nil && !errors.Is(err, ErrUnowned) {
+			log.Printf("domain metadata %s: %v", name, err)
+		}
+		result = append(result, VMInfo{
+			Name:        name,
+			State:       formatState(state),
+			MemoryMiB:   mem,
+			VCPU:        vcpu,
+			VolumeGB:    volGB,
+			IP:          ip,
+			PrimaryIP:   primaryIP,
+			Owner:       ownership.Owner,
+			Creator:     ownership.Creator,
+			Grants:      ownership.Grants,
+			CreatedAt:   ownership.CreatedAt,
+			Template:    ownership.Template,
+			Readiness:   ownership.Readiness,
+			KeepRunning: ownership.KeepRunning,
+			OwnerGroups: ownership.OwnerGroups,
 		})
 	}
 	return result, nil
 }
 
+// CPUTimes returns the CPU time each running domain has used since it
+// started.
+func CPUTimes() (map[string]time.Duration, error) {
+	conn, err := libvirt.NewConnect(LibvirtURI())
+	if err != nil {
+		return nil, fmt.Errorf("connect libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	doms, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_RUNNING)
+	if err != nil {
+		return nil, fmt.Errorf("list domains: %w", err)
+	}
+	defer func() {
+		for _, d := range doms {
+			_ = d.Free()
+		}
+	}()
+
+	times := make(map[string]time.Duration, len(doms))
+	for _, d := range doms {
+		name, err := d.GetName()
+		if err != nil {
+			continue
+		}
+		info, err := d.GetInfo()
+		if err != nil {
+			log.Printf("domain info %s: %v", name, err)
+			continue
+		}
+		times[name] = time.Duration(info.CpuTime)
+	}
+	return times, nil
+}
+
 func domainResources(d libvirt.Domain) (int, int) {
 	info, err := d.GetInfo()
 	if err != nil {
@@ -0,0 +1,314 @@
+package virt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"libvirt.org/go/libvirt"
+)
+
+// MetadataURI namespaces the gateway's element in the libvirt domain
+// <metadata> block.
+const MetadataURI = "https://github.com/define42/remotegateway/xmlns/vm/1.0"
+
+const metadataPrefix = "rgw"
+
+var (
+	// ErrVMNotFound is returned when no domain has the requested name.
+	ErrVMNotFound = errors.New("vm not found")
+	// ErrUnowned is returned for domains created before ownership metadata
+	// was recorded. They stay inaccessible until migrated.
+	ErrUnowned = errors.New("vm has no owner metadata")
+	// ErrNotOwner is returned when a domain belongs to another user.
+	ErrNotOwner = errors.New("vm is owned by another user")
+	// ErrInvalidGrant is returned for grants with an unknown type or right.
+	ErrInvalidGrant = errors.New("invalid vm grant")
+)
+
+// Rights checked against a VM. Owners hold all of them; grants give connect
+// or manage to other users and groups. RightOwner cannot be granted.
+const (
+	RightConnect = "connect"
+	RightManage  = "manage"
+	RightOwner   = "owner"
+)
+
+// Grant subjects.
+const (
+	GrantUser  = "user"
+	GrantGroup = "group"
+)
+
+// Grant gives a user or group a right on a VM it does not own.
+type Grant struct {
+	Type      string    `xml:"type,attr" json:"type"`
+	Name      string    `xml:"name,attr" json:"name"`
+	Right     string    `xml:"right,attr" json:"right"`
+	GrantedBy string    `xml:"by,attr" json:"grantedBy"`
+	GrantedAt time.Time `xml:"at,attr" json:"grantedAt"`
+}
+
+// NewGrant validates and normalizes a grant. User names are lower-cased as
+// they are at login; group names keep the directory's spelling.
+func NewGrant(kind, name, right, grantedBy string, now time.Time) (Grant, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	name = strings.TrimSpace(name)
+	right = strings.ToLower(strings.TrimSpace(right))
+	if kind != GrantUser && kind != GrantGroup {
+		return Grant{}, fmt.Errorf("%w: unknown type %q", ErrInvalidGrant, kind)
+	}
+	if right != RightConnect && right != RightManage {
+		return Grant{}, fmt.Errorf("%w: unknown right %q", ErrInvalidGrant, right)
+	}
+	if name == "" || len(name) > 256 || strings.ContainsAny(name, "\r\n") {
+		return Grant{}, fmt.Errorf("%w: invalid name", ErrInvalidGrant)
+	}
+	if kind == GrantUser {
+		name = strings.ToLower(name)
+	}
+	return Grant{Type: kind, Name: name, Right: right, GrantedBy: grantedBy, GrantedAt: now.UTC()}, nil
+}
+
+// Allows reports whether the grant satisfies right. Manage includes connect.
+func (g Grant) Allows(right string) bool {
+	switch right {
+	case RightConnect:
+		return g.Right == RightConnect || g.Right == RightManage
+	case RightManage:
+		return g.Right == RightManage
+	default:
+		return false
+	}
+}
+
+func (g Grant) appliesTo(username string, groups []string) bool {
+	switch g.Type {
+	case GrantUser:
+		return strings.EqualFold(g.Name, strings.TrimSpace(username))
+	case GrantGroup:
+		for _, group := range groups {
+			if strings.EqualFold(g.Name, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Ownership is stored in the domain metadata when a VM is created.
+type Ownership struct {
+	XMLName   xml.Name  `xml:"vm"`
+	Owner     string    `xml:"owner"`
+	Creator   string    `xml:"creator"`
+	CreatedAt time.Time `xml:"created"`
+	// Template is empty for VMs created before the template catalog.
+	Template string `xml:"template,omitempty"`
+	// Readiness is reported by the guest through phone-home.
+	Readiness string `xml:"readiness,omitempty"`
+	// PhoneHomeHash is the hash of the token the guest reports with.
+	PhoneHomeHash string `xml:"phoneHome,omitempty"`
+	// KeepRunning opts the VM out of the idle shutdown.
+	KeepRunning bool `xml:"keepRunning,omitempty"`
+	// OwnerGroups are the owner's groups when the VM was created. Quotas
+	// use them when someone else starts the VM.
+	OwnerGroups []string `xml:"ownerGroup,omitempty"`
+	Grants      []Grant  `xml:"grant"`
+}
+
+// OwnedBy reports whether username owns the VM.
+func (o Ownership) OwnedBy(username string) bool {
+	return o.Owner != "" && strings.EqualFold(o.Owner, strings.TrimSpace(username))
+}
+
+// Access reports whether username, a member of groups, holds right on the
+// VM. The owner holds every right and gets a nil grant; anyone else gets the
+// grant that allowed the access, preferring user grants over group grants.
+func (o Ownership) Access(username string, groups []string, right string) (*Grant, bool) {
+	if o.OwnedBy(username) {
+		return nil, true
+	}
+	for _, kind := range []string{GrantUser, GrantGroup} {
+		for i := range o.Grants {
+			g := o.Grants[i]
+			if g.Type == kind && g.Allows(right) && g.appliesTo(username, groups) {
+				return &g, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// SetGrant adds g, replacing an earlier grant for the same user or group.
+func (o *Ownership) SetGrant(g Grant) {
+	o.RemoveGrant(g.Type, g.Name)
+	o.Grants = append(o.Grants, g)
+}
+
+// RemoveGrant drops the grant for the user or group name and reports
+// whether there was one.
+func (o *Ownership) RemoveGrant(kind, name string) bool {
+	var kept []Grant
+	removed := false
+	for _, g := range o.Grants {
+		if g.Type == kind && strings.EqualFold(g.Name, strings.TrimSpace(name)) {
+			removed = true
+			continue
+		}
+		kept = append(kept, g)
+	}
+	o.Grants = kept
+	return removed
+}
+
+// ParseOwnership decodes the metadata element, whatever namespace prefix
+// libvirt returned it with.
+func ParseOwnership(data string) (Ownership, error) {
+	var o Ownership
+	if err := xml.Unmarshal([]byte(data), &o); err != nil {
+		return Ownership{}, fmt.Errorf("parse vm metadata: %w", err)
+	}
+	o.Owner = strings.TrimSpace(o.Owner)
+	if o.Owner == "" {
+		return Ownership{}, ErrUnowned
+	}
+	return o, nil
+}
+
+// metadataElement renders the element without a namespace, as
+// SetMetadata expects.
+func (o Ownership) metadataElement() (string, error) {
+	o.XMLName = xml.Name{Local: "vm"}
+	raw, err := xml.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// domainMetadataXML renders the <metadata> block for a new domain definition.
+func (o Ownership) domainMetadataXML() (string, error) {
+	o.XMLName = xml.Name{Space: MetadataURI, Local: "vm"}
+	raw, err := xml.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return "<metadata>" + string(raw) + "</metadata>", nil
+}
+
+// LegacyOwner guesses the owner of a domain created before ownership
+// metadata from its "<user>-<name>" form. Usernames containing '-' cannot be
+// told apart from the VM name, so the guess must be reviewed.
+func LegacyOwner(name string) (string, bool) {
+	owner, rest, ok := strings.Cut(name, "-")
+	if !ok || owner == "" || rest == "" {
+		return "", false
+	}
+	return owner, true
+}
+
+func domainOwnership(d libvirt.Domain) (Ownership, error) {
+	data, err := d.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, MetadataURI, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		var lverr libvirt.Error
+		if errors.As(err, &lverr) && lverr.Code == libvirt.ERR_NO_DOMAIN_METADATA {
+			return Ownership{}, ErrUnowned
+		}
+		return Ownership{}, err
+	}
+	return ParseOwnership(data)
+}
+
+func lookupDomain(conn *libvirt.Connect, name string) (*libvirt.Domain, error) {
+	dom, err := conn.LookupDomainByName(name)
+	if err != nil {
+		var lverr libvirt.Error
+		if errors.As(err, &lverr) && lverr.Code == libvirt.ERR_NO_DOMAIN {
+			return nil, ErrVMNotFound
+		}
+		return nil, fmt.Errorf("lookup domain %s: %w", name, err)
+	}
+	return dom, nil
+}
+
+// LookupOwnership returns the recorded ownership of the VM name.
+func LookupOwnership(name string) (Ownership, error) {
+	conn, err := libvirt.NewConnect(LibvirtURI())
+	if err != nil {
+		return Ownership{}, fmt.Errorf("connect libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupDomain(conn, name)
+	if err != nil {
+		return Ownership{}, err
+	}
+	defer func() {
+		_ = dom.Free()
+	}()
+	return domainOwnership(*dom)
+}
+
+// ownershipMu serializes read-modify-write updates of the metadata element,
+// which SetOwnership replaces as a whole. Other processes, e.g. the CLI, are
+// not covered.
+var ownershipMu sync.Mutex
+
+// LockOwnership holds the lock of UpdateOwnership until the returned func
+// is called, for callers that read and write the metadata themselves.
+func LockOwnership() (unlock func()) {
+	ownershipMu.Lock()
+	return ownershipMu.Unlock
+}
+
+// UpdateOwnership applies change to the recorded ownership of the VM name
+// and records the result when change reports true. Concurrent updates in
+// this process do not lose each other's changes.
+func UpdateOwnership(name string, change func(*Ownership) bool) (bool, error) {
+	defer LockOwnership()()
+	o, err := LookupOwnership(name)
+	if err != nil {
+		return false, err
+	}
+	if !change(&o) {
+		return false, nil
+	}
+	return true, SetOwnership(name, o)
+}
+
+// SetOwnership records o on the VM name, replacing any previous owner. It is
+// used to migrate domains created before ownership metadata.
+func SetOwnership(name string, o Ownership) error {
+	if strings.TrimSpace(o.Owner) == "" {
+		return ErrUnowned
+	}
+	conn, err := libvirt.NewConnect(LibvirtURI())
+	if err != nil {
+		return fmt.Errorf("connect libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupDomain(conn, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dom.Free()
+	}()
+
+	element, err := o.metadataElement()
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	if active, err := dom.IsActive(); err == nil && active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+	if err := dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, element, metadataPrefix, MetadataURI, flags); err != nil {
+		return fmt.Errorf("set metadata %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package virt_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
+)
+
+func TestParseOwnership(t *testing.T) {
+	data := `<rgw:vm xmlns:rgw="` + virt.MetadataURI + `"><rgw:owner> alice </rgw:owner><rgw:creator>admin</rgw:creator><rgw:created>2024-05-01T10:00:00Z</rgw:created>` +
+		`<rgw:ownerGroup>staff</rgw:ownerGroup><rgw:ownerGroup>Ops</rgw:ownerGroup></rgw:vm>`
+	o, err := virt.ParseOwnership(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if o.Owner != "alice" || o.Creator != "admin" || !o.CreatedAt.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) || len(o.OwnerGroups) != 2 || o.OwnerGroups[1] != "Ops" {
+		t.Fatalf("unexpected ownership %+v", o)
+	}
+	if !o.OwnedBy("Alice") || o.OwnedBy("bob") || o.OwnedBy("") {
+		t.Fatalf("unexpected OwnedBy result for %+v", o)
+	}
+
+	if _, err := virt.ParseOwnership(`<vm><owner></owner></vm>`); !errors.Is(err, virt.ErrUnowned) {
+		t.Fatalf("expected empty owner to be unowned, got %v", err)
+	}
+	if _, err := virt.ParseOwnership(`<vm>`); err == nil {
+		t.Fatalf("expected malformed metadata to fail")
+	}
+}
+
+func TestUbuntuDomainIncludesMetadata(t *testing.T) {
+	metadata := `<metadata><vm xmlns="` + virt.MetadataURI + `"><owner>alice</owner></vm></metadata>`
+	domain := virt.UbuntuDomain("alice-vm", "/seed.iso", metadata, vmsize.Default)
+	if !strings.Contains(domain, metadata) {
+		t.Fatalf("expected domain xml to carry the metadata, got %s", domain)
+	}
+}
+
+func TestUbuntuDomainUsesSize(t *testing.T) {
+	domain := virt.UbuntuDomain("alice-vm", "/seed.iso", "", vmsize.Size{VCPU: 2, MemoryMiB: 3072, DiskGB: 30})
+	for _, want := range []string{
+		"<memory unit='MiB'>3072</memory>",
+		"<currentMemory unit='MiB'>3072</currentMemory>",
+		"<vcpu placement='static'>2</vcpu>",
+	} {
+		if !strings.Contains(domain, want) {
+			t.Fatalf("expected domain xml to contain %s, got %s", want, domain)
+		}
+	}
+}
+
+func TestLegacyOwner(t *testing.T) {
+	for name, want := range map[string]string{
+		"alice-vm":     "alice",
+		"alice-dev-01": "alice",
+		"vm":           "",
+		"-vm":          "",
+		"alice-":       "",
+	} {
+		got, ok := virt.LegacyOwner(name)
+		if got != want || ok != (want != "") {
+			t.Fatalf("LegacyOwner(%q) = %q, %v; want %q", name, got, ok, want)
+		}
+	}
+}
+
+func TestOwnershipAccess(t *testing.T) {
+	data := `<rgw:vm xmlns:rgw="` + virt.MetadataURI + `"><rgw:owner>alice</rgw:owner>` +
+		`<rgw:grant type="user" name="bob" right="connect" by="alice" at="2024-05-01T10:00:00Z"></rgw:grant>` +
+		`<rgw:grant type="group" name="Ops" right="manage" by="alice" at="2024-05-01T10:00:00Z"></rgw:grant></rgw:vm>`
+	o, err := virt.ParseOwnership(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(o.Grants) != 2 || o.Grants[0].GrantedAt.IsZero() {
+		t.Fatalf("unexpected grants %+v", o.Grants)
+	}
+
+	if grant, ok := o.Access("alice", nil, virt.RightOwner); !ok || grant != nil {
+		t.Fatalf("expected owner access without a grant, got %+v %v", grant, ok)
+	}
+	if grant, ok := o.Access("Bob", nil, virt.RightConnect); !ok || grant.Name != "bob" {
+		t.Fatalf("expected bob to connect through his grant, got %+v %v", grant, ok)
+	}
+	if _, ok := o.Access("bob", nil, virt.RightManage); ok {
+		t.Fatalf("expected connect grant not to allow manage")
+	}
+	// Bob's user grant is preferred for connect; the group grant adds manage.
+	if grant, ok := o.Access("bob", []string{"ops"}, virt.RightConnect); !ok || grant.Type != virt.GrantUser {
+		t.Fatalf("expected user grant to be preferred, got %+v %v", grant, ok)
+	}
+	if grant, ok := o.Access("bob", []string{"ops"}, virt.RightManage); !ok || grant.Type != virt.GrantGroup {
+		t.Fatalf("expected group grant to allow manage, got %+v %v", grant, ok)
+	}
+	if _, ok := o.Access("carol", []string{"ops"}, virt.RightOwner); ok {
+		t.Fatalf("expected grants never to give owner rights")
+	}
+}
+
+func TestGrantEditing(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if _, err := virt.NewGrant("user", "bob", "owner", "alice", now); !errors.Is(err, virt.ErrInvalidGrant) {
+		t.Fatalf("expected owner right to be refused, got %v", err)
+	}
+	if _, err := virt.NewGrant("team", "bob", "connect", "alice", now); !errors.Is(err, virt.ErrInvalidGrant) {
+		t.Fatalf("expected unknown type to be refused, got %v", err)
+	}
+	if _, err := virt.NewGrant("user", " ", "connect", "alice", now); !errors.Is(err, virt.ErrInvalidGrant) {
+		t.Fatalf("expected empty name to be refused, got %v", err)
+	}
+
+	o := virt.Ownership{Owner: "alice"}
+	connect, err := virt.NewGrant("User", " Bob ", "Connect", "alice", now)
+	if err != nil || connect.Name != "bob" || connect.Type != virt.GrantUser || connect.Right != virt.RightConnect {
+		t.Fatalf("unexpected grant %+v %v", connect, err)
+	}
+	o.SetGrant(connect)
+	manage, _ := virt.NewGrant("user", "bob", "manage", "alice", now)
+	o.SetGrant(manage)
+	if len(o.Grants) != 1 || o.Grants[0].Right != virt.RightManage {
+		t.Fatalf("expected grant to be replaced, got %+v", o.Grants)
+	}
+	if !o.RemoveGrant(virt.GrantUser, "BOB") || len(o.Grants) != 0 {
+		t.Fatalf("expected grant to be removed, got %+v", o.Grants)
+	}
+	if o.RemoveGrant(virt.GrantUser, "bob") {
+		t.Fatalf("expected removing a missing grant to report false")
+	}
+}
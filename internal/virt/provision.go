@@ -0,0 +1,306 @@
+package virt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/types"
+	"remotegateway/internal/vmsize"
+
+	"libvirt.org/go/libvirt"
+)
+
+// RDPPort is where xrdp listens in the guest.
+const RDPPort = "3389"
+
+// readyPollInterval is how often WaitForIP and WaitForRDP look again.
+var readyPollInterval = 5 * time.Second
+
+// Build creates one VM. Its methods from DestroyOld to WaitForIP are the
+// steps of the creation, run in the order they are declared and followed by
+// WaitForReady with phone-home or WaitForRDP without. Each opens its own
+// libvirt connection so a build can be resumed step by step.
+type Build struct {
+	VMName   string
+	User     *types.User
+	Template Template
+	Size     vmsize.Size
+	ImageDir string
+	DiskMode string
+	// CloudInit is what the cloud-init templates are rendered with.
+	CloudInit CloudInitData
+	// PhoneHome is set when the guest reports its readiness.
+	PhoneHome *PhoneHome
+
+	phoneHomeHash string
+}
+
+// NewBuild prepares the build of the VM name of user from tmpl with size.
+func NewBuild(name string, user *types.User, tmpl Template, size vmsize.Size, settings *config.SettingsType) (*Build, error) {
+	diskMode, err := ParseDiskMode(settings.Get(config.VM_DISK_MODE))
+	if err != nil {
+		return nil, err
+	}
+	phoneHomeURL, err := ParsePhoneHomeURL(settings.Get(config.PHONE_HOME_URL))
+	if err != nil {
+		return nil, err
+	}
+	vmName := VMName(user.GetName(), name)
+	if strings.Contains(vmName, "@") {
+		return nil, fmt.Errorf("%w: %s", ErrReservedName, vmName)
+	}
+	b := &Build{
+		VMName:   vmName,
+		User:     user,
+		Template: tmpl,
+		Size:     size,
+		ImageDir: settings.Get(config.VDI_IMAGE_DIR),
+		DiskMode: diskMode,
+	}
+	b.CloudInit = CloudInitData{
+		Username:     user.GetName(),
+		Groups:       user.GetGroups(),
+		PasswordHash: user.GetCloudInitPasswordHash(),
+		Hostname:     b.VMName,
+		InstanceID:   b.VMName,
+		Locale:       settings.Get(config.CLOUD_INIT_LOCALE),
+		Keyboard:     settings.Get(config.CLOUD_INIT_KEYBOARD),
+		Timezone:     settings.Get(config.CLOUD_INIT_TIMEZONE),
+		SSHKeys:      user.GetSSHKeys(),
+	}
+	if phoneHomeURL != "" {
+		token, hash, err := NewPhoneHomeToken()
+		if err != nil {
+			return nil, err
+		}
+		b.PhoneHome = &PhoneHome{
+			URL:      phoneHomeURL,
+			VMName:   b.VMName,
+			Token:    token,
+			Insecure: settings.IsTrue(config.PHONE_HOME_SKIP_TLS_VERIFY),
+		}
+		b.phoneHomeHash = hash
+	}
+	return b, nil
+}
+
+func (b *Build) seedISO() string {
+	return b.VMName + "_seed.iso"
+}
+
+func (b *Build) connect(ctx context.Context) (*libvirt.Connect, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := libvirt.NewConnect(LibvirtURI())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to libvirt: %v", err)
+	}
+	return conn, nil
+}
+
+// DestroyOld removes an earlier VM of the same name. It fails with
+// ErrNotOwner when that VM belongs to someone else.
+func (b *Build) DestroyOld(ctx context.Context) error {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Names are "<user>-<name>", so bob's "by-dev" and bob-by's "dev" share
+	// a domain name. Only the owner may replace an existing domain.
+	if existing, err := lookupDomain(conn, b.VMName); err == nil {
+		ownership, err := domainOwnership(*existing)
+		_ = existing.Free()
+		if err != nil || !ownership.OwnedBy(b.User.GetName()) {
+			return ErrNotOwner
+		}
+	} else if !errors.Is(err, ErrVMNotFound) {
+		return err
+	}
+
+	if err := DestroyExistingDomain(conn, b.VMName); err != nil {
+		return fmt.Errorf("Failed to destroy existing domain: %v", err)
+	}
+	if err := RemoveVolumes(conn, b.VMName, b.seedISO()); err != nil {
+		return fmt.Errorf("Failed to remove existing volumes: %v", err)
+	}
+	return nil
+}
+
+// CreateDisk creates the VM disk from the template image.
+func (b *Build) CreateDisk(ctx context.Context) error {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	baseImage := filepath.Join(b.ImageDir, b.Template.Image)
+	if b.DiskMode == DiskLinked {
+		if err := createLinkedClone(conn, b.VMName, baseImage, b.Size.DiskBytes()); err != nil {
+			return fmt.Errorf("Failed to create disk: %v", err)
+		}
+		return nil
+	}
+	if err := CopyAndResizeVolume(conn, b.VMName, baseImage, b.Size.DiskBytes()); err != nil {
+		return fmt.Errorf("Failed to copy and resize base image: %v", err)
+	}
+	return nil
+}
+
+// CreateSeed uploads the cloud-init seed ISO.
+func (b *Build) CreateSeed(ctx context.Context) error {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	userData, err := b.Template.UserData(b.CloudInit)
+	if err != nil {
+		return err
+	}
+	metaData, err := b.Template.MetaData(b.CloudInit)
+	if err != nil {
+		return err
+	}
+	if b.PhoneHome != nil {
+		if userData, err = AddPhoneHome(userData, *b.PhoneHome); err != nil {
+			return fmt.Errorf("template %s: %w", b.Template.Name, err)
+		}
+	}
+	if err := CreateUbuntuSeedISOToPool(conn, b.seedISO(), userData, metaData); err != nil {
+		return fmt.Errorf("Failed to create seed ISO: %v", err)
+	}
+	return nil
+}
+
+// Define defines the domain with the ownership metadata of the user.
+func (b *Build) Define(ctx context.Context) error {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ownership := Ownership{
+		Owner:       b.User.GetName(),
+		Creator:     b.User.GetName(),
+		CreatedAt:   time.Now().UTC(),
+		Template:    b.Template.Name,
+		OwnerGroups: b.User.GetGroups(),
+	}
+	if b.PhoneHome != nil {
+		ownership.Readiness = ReadinessProvisioning
+		ownership.PhoneHomeHash = b.phoneHomeHash
+	}
+	metadata, err := ownership.domainMetadataXML()
+	if err != nil {
+		return err
+	}
+	dom, err := conn.DomainDefineXML(UbuntuDomain(b.VMName, b.seedISO(), metadata, b.Size))
+	if err != nil {
+		return fmt.Errorf("Failed to define domain: %v", err)
+	}
+	_ = dom.Free()
+	return nil
+}
+
+// Start boots the defined domain.
+func (b *Build) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := StartExistingVM(b.VMName); err != nil {
+		return fmt.Errorf("Failed to start VM: %v", err)
+	}
+	return nil
+}
+
+// WaitForIP waits until the guest has an address.
+func (b *Build) WaitForIP(ctx context.Context) error {
+	return poll(ctx, func() error {
+		_, err := GetIpOfVm(b.VMName)
+		return err
+	})
+}
+
+// WaitForRDP waits until xrdp accepts connections in the guest.
+func (b *Build) WaitForRDP(ctx context.Context) error {
+	var dialer net.Dialer
+	return poll(ctx, func() error {
+		ip, err := GetIpOfVm(b.VMName)
+		if err != nil {
+			return err
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, readyPollInterval)
+		defer cancel()
+		conn, err := dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(ip, RDPPort))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// WaitForReady waits until the guest reports through phone-home that
+// cloud-init finished. It fails when the guest reports a failure.
+func (b *Build) WaitForReady(ctx context.Context) error {
+	var readiness string
+	err := poll(ctx, func() error {
+		ownership, err := LookupOwnership(b.VMName)
+		if err != nil {
+			return err
+		}
+		readiness = ownership.Readiness
+		if readiness == ReadinessProvisioning {
+			return errors.New("guest has not reported yet")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if readiness != ReadinessReady {
+		return fmt.Errorf("guest reported readiness %q", readiness)
+	}
+	return nil
+}
+
+// MarkFailed records a failed provisioning on a VM still provisioning.
+func (b *Build) MarkFailed() error {
+	_, err := UpdateOwnership(b.VMName, func(o *Ownership) bool {
+		if o.Readiness != ReadinessProvisioning {
+			return false
+		}
+		o.Readiness = ReadinessFailed
+		return true
+	})
+	return err
+}
+
+// poll calls check until it succeeds or ctx ends, returning the last error
+// of check with the context error.
+func poll(ctx context.Context, check func() error) error {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package virt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Readiness of the guest, recorded in the ownership metadata. VMs created
+// without phone-home have none.
+const (
+	ReadinessProvisioning = "provisioning"
+	ReadinessReady        = "ready"
+	ReadinessFailed       = "failed"
+)
+
+// PhoneHomePath is where guests report their readiness on the gateway.
+const PhoneHomePath = "/api/phone-home"
+
+const (
+	phoneHomeScript = "/usr/local/sbin/remotegateway-phone-home"
+	phoneHomeUnit   = "remotegateway-phone-home.service"
+)
+
+// ErrNotCloudConfig is returned when phone-home is added to user-data that
+// is not a #cloud-config document.
+var ErrNotCloudConfig = errors.New("user-data is not #cloud-config")
+
+// ParsePhoneHomeURL validates the PHONE_HOME_URL setting; empty disables
+// phone-home.
+func ParsePhoneHomeURL(value string) (string, error) {
+	value = strings.TrimRight(strings.TrimSpace(value), "/")
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(value, "'\\") {
+		return "", fmt.Errorf("phone-home url must be an http or https URL, got %q", value)
+	}
+	return value, nil
+}
+
+// NewPhoneHomeToken returns a token for a guest to report with and the hash
+// kept in the VM metadata.
+func NewPhoneHomeToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, hashPhoneHomeToken(token), nil
+}
+
+func hashPhoneHomeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckPhoneHome reports whether token is the phone-home token of the VM.
+func (o Ownership) CheckPhoneHome(token string) bool {
+	if o.PhoneHomeHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPhoneHomeToken(token)), []byte(o.PhoneHomeHash)) == 1
+}
+
+// PhoneHome is what the guest reports with.
+type PhoneHome struct {
+	URL    string
+	VMName string
+	Token  string
+	// Insecure skips verifying the gateway certificate.
+	Insecure bool
+}
+
+type cloudConfigFile struct {
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	Content     string `yaml:"content"`
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// script waits for cloud-init to finish, which for the built-in template is
+// after the reboot that applies the kernel parameters, and reports the
+// result once.
+func (p PhoneHome) script() string {
+	insecure := ""
+	if p.Insecure {
+		insecure = "-k "
+	}
+	return fmt.Sprintf(`#!/bin/sh
+status=ready
+cloud-init status --wait >/dev/null 2>&1
+[ $? -eq 1 ] && status=failed
+curl -fsS %s--retry 30 --retry-delay 10 --retry-all-errors \
+  --data-urlencode vm=%s \
+  --data-urlencode token=%s \
+  --data-urlencode "status=$status" \
+  %s || exit 1
+systemctl disable %s
+rm -f %s
+`, insecure, shellQuote(p.VMName), shellQuote(p.Token), shellQuote(p.URL+PhoneHomePath), phoneHomeUnit, phoneHomeScript)
+}
+
+// The unit is a simple service so it does not hold up multi-user.target,
+// which cloud-final waits for.
+const phoneHomeUnitFile = `[Unit]
+Description=Report readiness to the remote gateway
+Wants=network-online.target
+After=network-online.target xrdp.service
+
+[Service]
+ExecStart=` + phoneHomeScript + `
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// AddPhoneHome adds a service reporting readiness to p.URL to the
+// cloud-config userData. Its commands run before those of the template, so
+// a reboot in them does not skip it.
+func AddPhoneHome(userData []byte, p PhoneHome) ([]byte, error) {
+	if !bytes.HasPrefix(userData, []byte("#cloud-config")) {
+		return nil, ErrNotCloudConfig
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(userData, &doc); err != nil {
+		return nil, fmt.Errorf("parse user-data: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%w: top level is not a mapping", ErrNotCloudConfig)
+	}
+
+	files, err := sequence(root, "write_files")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []cloudConfigFile{
+		{Path: phoneHomeScript, Permissions: "0700", Content: p.script()},
+		{Path: "/etc/systemd/system/" + phoneHomeUnit, Permissions: "0644", Content: phoneHomeUnitFile},
+	} {
+		var n yaml.Node
+		if err := n.Encode(f); err != nil {
+			return nil, err
+		}
+		files.Content = append(files.Content, &n)
+	}
+
+	runcmd, err := sequence(root, "runcmd")
+	if err != nil {
+		return nil, err
+	}
+	var commands []*yaml.Node
+	for _, cmd := range []string{
+		"systemctl daemon-reload",
+		"systemctl enable " + phoneHomeUnit,
+		"systemctl start --no-block " + phoneHomeUnit,
+	} {
+		commands = append(commands, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: cmd})
+	}
+	runcmd.Content = append(commands, runcmd.Content...)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	// The header survives as a comment unless the document was empty.
+	if !bytes.HasPrefix(buf.Bytes(), []byte("#cloud-config")) {
+		return append([]byte("#cloud-config\n"), buf.Bytes()...), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// sequence returns the sequence under key of mapping, adding an empty one
+// when the key is missing.
+func sequence(mapping *yaml.Node, key string) (*yaml.Node, error) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+		value := mapping.Content[i+1]
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			*value = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		}
+		if value.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("%w: %s is not a list", ErrNotCloudConfig, key)
+		}
+		return value, nil
+	}
+	value := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value, nil
+}
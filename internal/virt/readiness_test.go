@@ -0,0 +1,93 @@
+package virt_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"remotegateway/internal/virt"
+)
+
+func TestAddPhoneHome(t *testing.T) {
+	userData, err := virt.BuiltinTemplate().UserData(virt.CloudInitData{Username: "alice", PasswordHash: "$6$hash", Hostname: "alice-dev"})
+	if err != nil {
+		t.Fatalf("user-data: %v", err)
+	}
+	out, err := virt.AddPhoneHome(userData, virt.PhoneHome{URL: "https://192.168.122.1:8443", VMName: "alice-dev", Token: "secret"})
+	if err != nil {
+		t.Fatalf("add phone-home: %v", err)
+	}
+	if !strings.HasPrefix(string(out), "#cloud-config\n") || strings.Count(string(out), "#cloud-config") != 1 {
+		t.Fatalf("expected a single cloud-config header, got %q", out[:40])
+	}
+
+	var doc struct {
+		Users      []map[string]any `yaml:"users"`
+		Runcmd     []string         `yaml:"runcmd"`
+		WriteFiles []struct {
+			Path    string `yaml:"path"`
+			Content string `yaml:"content"`
+		} `yaml:"write_files"`
+	}
+	if err := yaml.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("parse result: %v", err)
+	}
+	if len(doc.Users) != 1 || doc.Users[0]["name"] != "alice" {
+		t.Fatalf("expected the template users to stay, got %+v", doc.Users)
+	}
+	// The built-in template reboots at the end of runcmd.
+	if len(doc.Runcmd) < 4 || doc.Runcmd[2] != "systemctl start --no-block remotegateway-phone-home.service" || doc.Runcmd[len(doc.Runcmd)-1] != "reboot" {
+		t.Fatalf("expected phone-home to be enabled before the reboot, got %q", doc.Runcmd)
+	}
+	script := doc.WriteFiles[len(doc.WriteFiles)-2]
+	if script.Path != "/usr/local/sbin/remotegateway-phone-home" ||
+		!strings.Contains(script.Content, "token='secret'") ||
+		!strings.Contains(script.Content, "'https://192.168.122.1:8443"+virt.PhoneHomePath+"'") ||
+		strings.Contains(script.Content, " -k ") {
+		t.Fatalf("unexpected phone-home script %+v", script)
+	}
+
+	out, err = virt.AddPhoneHome([]byte("#cloud-config\n"), virt.PhoneHome{URL: "https://gw", VMName: "bob-x", Token: "t", Insecure: true})
+	if err != nil || !strings.Contains(string(out), "curl -fsS -k ") || !strings.Contains(string(out), "runcmd:") {
+		t.Fatalf("expected phone-home in empty user-data, got %q %v", out, err)
+	}
+
+	if _, err := virt.AddPhoneHome([]byte("#!/bin/sh\necho hi\n"), virt.PhoneHome{}); !errors.Is(err, virt.ErrNotCloudConfig) {
+		t.Fatalf("expected a shell script to be refused, got %v", err)
+	}
+	if _, err := virt.AddPhoneHome([]byte("#cloud-config\nruncmd: reboot\n"), virt.PhoneHome{}); !errors.Is(err, virt.ErrNotCloudConfig) {
+		t.Fatalf("expected a scalar runcmd to be refused, got %v", err)
+	}
+}
+
+func TestParsePhoneHomeURL(t *testing.T) {
+	for value, want := range map[string]string{"": "", " https://gw:8443/ ": "https://gw:8443", "http://10.0.0.1": "http://10.0.0.1"} {
+		if got, err := virt.ParsePhoneHomeURL(value); err != nil || got != want {
+			t.Fatalf("%q: got %q %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"gw:8443", "ftp://gw", "https://gw/'x"} {
+		if _, err := virt.ParsePhoneHomeURL(value); err == nil {
+			t.Fatalf("expected %q to be refused", value)
+		}
+	}
+}
+
+func TestCheckPhoneHome(t *testing.T) {
+	token, hash, err := virt.NewPhoneHomeToken()
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	if strings.Contains(hash, token) {
+		t.Fatal("expected the token not to be stored in clear text")
+	}
+	o := virt.Ownership{Owner: "alice", PhoneHomeHash: hash}
+	if !o.CheckPhoneHome(token) || o.CheckPhoneHome(token+"x") || o.CheckPhoneHome("") {
+		t.Fatalf("unexpected token check for %+v", o)
+	}
+	if (virt.Ownership{Owner: "alice"}).CheckPhoneHome("") {
+		t.Fatal("expected VMs without phone-home to refuse every token")
+	}
+}
@@ -2,15 +2,21 @@ package virt
 
 import (
 	"fmt"
+
+	"remotegateway/internal/vmsize"
 )
 
-func UbuntuDomain(name, seedIso string) string {
+// UbuntuDomain returns the domain XML. metadata is inserted verbatim and
+// must be a complete <metadata> element or empty. size sets the vCPUs and
+// memory.
+func UbuntuDomain(name, seedIso, metadata string, size vmsize.Size) string {
 
 	return fmt.Sprintf(`<domain type='kvm'>
   <name>%s</name>
-  <memory unit='MiB'>4096</memory>
+  %s
+  <memory unit='MiB'>%d</memory>
   <currentMemory unit='MiB'>%d</currentMemory>
-  <vcpu placement='static'>4</vcpu>
+  <vcpu placement='static'>%d</vcpu>
 
   <os>
     <type arch='x86_64' machine='q35'>hvm</type>
@@ -70,5 +76,5 @@ func UbuntuDomain(name, seedIso string) string {
       <backend model='random'>/dev/urandom</backend>
     </rng>
   </devices>
-</domain>`, name, 4096, name, seedIso)
+</domain>`, name, metadata, size.MemoryMiB, size.MemoryMiB, size.VCPU, name, seedIso)
 }
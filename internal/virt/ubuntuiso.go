@@ -8,90 +8,17 @@ import (
 	"libvirt.org/go/libvirt"
 )
 
+// CreateUbuntuSeedISOToPool uploads a NoCloud seed ISO with userData and
+// metaData as the volume volumeName. Both hold secrets and are not logged.
 func CreateUbuntuSeedISOToPool(
 	conn *libvirt.Connect,
 	volumeName string,
-	username string,
-	cloudInitPasswordHash string,
-	hostname string,
+	userData []byte,
+	metaData []byte,
 ) error {
-
-	// 2. Build cloud-init data
-	userData := []byte(`#cloud-config
-output:
-  all: '| tee -a /var/log/cloud-init-output.log'
-keyboard:
-  layout: dk
-  variant: ''
-users:
-  - name: ` + username + `
-    sudo: ALL=(ALL) NOPASSWD:ALL
-    shell: /bin/bash
-    lock_passwd: false
-    passwd: ` + cloudInitPasswordHash + `
-ssh_pwauth: true
-package_update: true
-package_upgrade: true
-packages:
-  - gnome-session
-  - gnome-shell
-  - gnome-terminal
-  - gdm3
-  - xrdp
-  - xorgxrdp
-  - dbus-x11
-
-write_files:
-  # Disable Wayland (XRDP requires Xorg)
-  - path: /etc/gdm3/custom.conf
-    permissions: '0644'
-    content: |
-      [daemon]
-      WaylandEnable=false
-      DefaultSession=gnome-xorg.desktop
-
-  # Force GNOME to behave well under XRDP
-  - path: /etc/profile.d/gnome-xrdp.sh
-    permissions: '0644'
-    content: |
-      export XDG_SESSION_TYPE=x11
-      export GSK_RENDERER=cairo
-      export MUTTER_DEBUG_FORCE_KMS_MODE=simple
-
-  # Disable GNOME portal backend globally (avoid timeouts)
-  - path: /etc/systemd/user/xdg-desktop-portal-gnome.service
-    permissions: '0644'
-    content: |
-      [Unit]
-      Description=Disabled for XRDP
-
-  # Disable AppArmor at kernel level
-  - path: /etc/default/grub.d/99-disable-apparmor.cfg
-    permissions: '0644'
-    content: |
-      GRUB_CMDLINE_LINUX_DEFAULT="$GRUB_CMDLINE_LINUX_DEFAULT apparmor=0"
-
-runcmd:
-  # Enable XRDP
-  - systemctl enable xrdp
-  - systemctl restart xrdp
-
-  # Disable AppArmor service immediately (kernel param applies after reboot)
-  - systemctl disable --now apparmor || true
-
-  # Mask GNOME portal backend globally
-  - systemctl --global mask xdg-desktop-portal-gnome.service
-
-  # Update GRUB and reboot to apply kernel params
-  - update-grub
-  - reboot
-`)
-
-	fmt.Println("userData:", string(userData))
-
-	metaData := []byte(`instance-id: ubuntu-seed
-local-hostname: ` + hostname + `
-`)
+	if err := ValidateCloudInit(userData, metaData); err != nil {
+		return err
+	}
 
 	// 3. Create temporary ISO
 	tmpFile, err := os.CreateTemp("", "seed-*.iso")
@@ -0,0 +1,193 @@
+// Package vmsize holds the hardware profiles users pick when creating VMs.
+package vmsize
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalid is returned for malformed size settings.
+	ErrInvalid = errors.New("invalid VM size")
+	// ErrNotAllowed is returned when a requested size is not on offer.
+	ErrNotAllowed = errors.New("VM size not allowed")
+)
+
+// Custom is the profile name selecting explicit values.
+const Custom = "custom"
+
+// Smallest values any size may use. The disk holds the base image.
+const (
+	MinVCPU      = 1
+	MinMemoryMiB = 1024
+	MinDiskGB    = 20
+)
+
+// Size is the hardware of a VM.
+type Size struct {
+	Name      string `json:"name"`
+	VCPU      int    `json:"vcpu"`
+	MemoryMiB int    `json:"memoryMiB"`
+	DiskGB    int    `json:"diskGB"`
+}
+
+// Default is the size of VMs when no profiles are configured.
+var Default = Size{Name: "medium", VCPU: 4, MemoryMiB: 4096, DiskGB: 40}
+
+// DiskBytes returns the disk capacity in bytes.
+func (s Size) DiskBytes() uint64 {
+	return uint64(s.DiskGB) * 1024 * 1024 * 1024
+}
+
+// String returns s in the form ParseSize accepts.
+func (s Size) String() string {
+	return fmt.Sprintf("vcpu=%d,memory=%d,disk=%d", s.VCPU, s.MemoryMiB, s.DiskGB)
+}
+
+func (s Size) validate() error {
+	switch {
+	case s.VCPU < MinVCPU:
+		return fmt.Errorf("at least %d vCPU required", MinVCPU)
+	case s.MemoryMiB < MinMemoryMiB:
+		return fmt.Errorf("at least %d MiB memory required", MinMemoryMiB)
+	case s.DiskGB < MinDiskGB:
+		return fmt.Errorf("at least %d GB disk required", MinDiskGB)
+	}
+	return nil
+}
+
+// Catalog is the set of sizes on offer.
+type Catalog struct {
+	Profiles []Size `json:"profiles"`
+	// Default names the profile used when none is requested.
+	Default string `json:"default"`
+	// Max caps custom sizes; custom sizes are disabled when it is nil.
+	Max *Size `json:"customMax,omitempty"`
+}
+
+// Parse reads the size settings. profiles are "name:size" entries separated
+// by ";", for example "small:vcpu=2,memory=2048,disk=30". defaultName must
+// name one of them; an empty defaultName picks the first. customMax is a
+// size capping explicit values, empty to disable them.
+func Parse(profiles, defaultName, customMax string) (*Catalog, error) {
+	c := &Catalog{}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(profiles, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: want name:size, got %q", ErrInvalid, entry)
+		}
+		if name == Custom {
+			return nil, fmt.Errorf("%w: profile name %q is reserved", ErrInvalid, Custom)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%w: duplicate profile %q", ErrInvalid, name)
+		}
+		seen[name] = true
+		size, err := ParseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		size.Name = name
+		c.Profiles = append(c.Profiles, size)
+	}
+	if len(c.Profiles) == 0 {
+		c.Profiles = []Size{Default}
+	}
+
+	c.Default = strings.ToLower(strings.TrimSpace(defaultName))
+	if c.Default == "" {
+		c.Default = c.Profiles[0].Name
+	}
+	if _, ok := c.profile(c.Default); !ok {
+		return nil, fmt.Errorf("%w: default profile %q is not defined", ErrInvalid, c.Default)
+	}
+
+	if strings.TrimSpace(customMax) != "" {
+		limit, err := ParseSize(customMax)
+		if err != nil {
+			return nil, fmt.Errorf("custom max: %w", err)
+		}
+		limit.Name = Custom
+		c.Max = &limit
+	}
+	return c, nil
+}
+
+// ParseSize reads a comma separated list of vcpu, memory (MiB) and disk (GB)
+// values. Every value is required.
+func ParseSize(value string) (Size, error) {
+	var s Size
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		key, raw, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if !ok || err != nil || n < 0 {
+			return Size{}, fmt.Errorf("%w: want resource=number, got %q", ErrInvalid, item)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "vcpu":
+			s.VCPU = n
+		case "memory":
+			s.MemoryMiB = n
+		case "disk":
+			s.DiskGB = n
+		default:
+			return Size{}, fmt.Errorf("%w: unknown resource %q", ErrInvalid, key)
+		}
+	}
+	if err := s.validate(); err != nil {
+		return Size{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return s, nil
+}
+
+func (c *Catalog) profile(name string) (Size, bool) {
+	for _, size := range c.Profiles {
+		if size.Name == name {
+			return size, true
+		}
+	}
+	return Size{}, false
+}
+
+// Choose returns the profile name, or the default profile when name is empty.
+func (c *Catalog) Choose(name string) (Size, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = c.Default
+	}
+	if size, ok := c.profile(name); ok {
+		return size, nil
+	}
+	return Size{}, fmt.Errorf("%w: unknown size %q", ErrNotAllowed, name)
+}
+
+// CustomSize returns a size with explicit values when they lie between the
+// minimums and Max.
+func (c *Catalog) CustomSize(vcpu, memoryMiB, diskGB int) (Size, error) {
+	if c.Max == nil {
+		return Size{}, fmt.Errorf("%w: custom sizes are disabled", ErrNotAllowed)
+	}
+	s := Size{Name: Custom, VCPU: vcpu, MemoryMiB: memoryMiB, DiskGB: diskGB}
+	if err := s.validate(); err != nil {
+		return Size{}, fmt.Errorf("%w: %v", ErrNotAllowed, err)
+	}
+	switch {
+	case vcpu > c.Max.VCPU:
+		return Size{}, fmt.Errorf("%w: at most %d vCPU allowed", ErrNotAllowed, c.Max.VCPU)
+	case memoryMiB > c.Max.MemoryMiB:
+		return Size{}, fmt.Errorf("%w: at most %d MiB memory allowed", ErrNotAllowed, c.Max.MemoryMiB)
+	case diskGB > c.Max.DiskGB:
+		return Size{}, fmt.Errorf("%w: at most %d GB disk allowed", ErrNotAllowed, c.Max.DiskGB)
+	}
+	return s, nil
+}
@@ -0,0 +1,97 @@
+package vmsize
+
+import (
+	"errors"
+	"testing"
+)
+
+const testProfiles = "small:vcpu=2,memory=2048,disk=30; Large:vcpu=8,memory=8192,disk=80"
+
+func TestParse(t *testing.T) {
+	c, err := Parse(testProfiles, "", "vcpu=16,memory=32768,disk=200")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(c.Profiles) != 2 || c.Default != "small" {
+		t.Fatalf("unexpected catalog %+v", c)
+	}
+	if c.Profiles[1] != (Size{Name: "large", VCPU: 8, MemoryMiB: 8192, DiskGB: 80}) {
+		t.Fatalf("unexpected large profile %+v", c.Profiles[1])
+	}
+	if c.Max == nil || c.Max.VCPU != 16 {
+		t.Fatalf("unexpected custom max %+v", c.Max)
+	}
+
+	empty, err := Parse("", "", "")
+	if err != nil || len(empty.Profiles) != 1 || empty.Profiles[0] != Default || empty.Max != nil {
+		t.Fatalf("expected only the default size, got %+v %v", empty, err)
+	}
+}
+
+func TestParseRejectsInvalidSettings(t *testing.T) {
+	cases := map[string][3]string{
+		"missing name":      {"vcpu=2,memory=2048,disk=30", "", ""},
+		"reserved name":     {"custom:vcpu=2,memory=2048,disk=30", "", ""},
+		"duplicate":         {"a:vcpu=2,memory=2048,disk=30;A:vcpu=2,memory=2048,disk=30", "", ""},
+		"unknown resource":  {"a:vcpu=2,memory=2048,disk=30,gpu=1", "", ""},
+		"missing memory":    {"a:vcpu=2,disk=30", "", ""},
+		"below min disk":    {"a:vcpu=2,memory=2048,disk=5", "", ""},
+		"unknown default":   {testProfiles, "medium", ""},
+		"invalid max":       {testProfiles, "", "vcpu=x"},
+		"incomplete max":    {testProfiles, "", "vcpu=4"},
+		"negative resource": {"a:vcpu=-2,memory=2048,disk=30", "", ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse(tc[0], tc[1], tc[2]); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestChoose(t *testing.T) {
+	c, err := Parse(testProfiles, "large", "")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if size, err := c.Choose(""); err != nil || size.Name != "large" {
+		t.Fatalf("expected the default profile, got %+v %v", size, err)
+	}
+	if size, err := c.Choose(" SMALL "); err != nil || size.VCPU != 2 {
+		t.Fatalf("expected the small profile, got %+v %v", size, err)
+	}
+	if _, err := c.Choose("huge"); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected an unknown profile to be refused, got %v", err)
+	}
+}
+
+func TestCustomSize(t *testing.T) {
+	c, err := Parse(testProfiles, "", "")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if _, err := c.CustomSize(2, 2048, 30); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected custom sizes to be disabled, got %v", err)
+	}
+
+	c, err = Parse(testProfiles, "", "vcpu=8,memory=16384,disk=100")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	size, err := c.CustomSize(6, 12288, 100)
+	if err != nil || size != (Size{Name: Custom, VCPU: 6, MemoryMiB: 12288, DiskGB: 100}) {
+		t.Fatalf("unexpected custom size %+v %v", size, err)
+	}
+	for name, s := range map[string]Size{
+		"no vcpu":     {VCPU: 0, MemoryMiB: 2048, DiskGB: 30},
+		"small disk":  {VCPU: 2, MemoryMiB: 2048, DiskGB: 10},
+		"many vcpu":   {VCPU: 9, MemoryMiB: 2048, DiskGB: 30},
+		"much memory": {VCPU: 2, MemoryMiB: 16385, DiskGB: 30},
+		"large disk":  {VCPU: 2, MemoryMiB: 2048, DiskGB: 101},
+	} {
+		if _, err := c.CustomSize(s.VCPU, s.MemoryMiB, s.DiskGB); !errors.Is(err, ErrNotAllowed) {
+			t.Fatalf("%s: expected ErrNotAllowed, got %v", name, err)
+		}
+	}
+}
@@ -221,7 +221,7 @@ func setupLDAPProxyServer(t *testing.T, ctx context.Context) (string, *session.M
 	settings := configureLDAPEnv(t, ldapURL)
 
 	sessionManager := session.NewManager()
-	server := httptest.NewServer(getRemoteGatewayRotuer(sessionManager, settings))
+	server := httptest.NewServer(getRemoteGatewayRotuer(t.Context(), sessionManager, settings))
 	t.Cleanup(server.Close)
 
 	return server.URL, sessionManager
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/localusers"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/ntlm"
+	"remotegateway/internal/session"
+	"remotegateway/internal/totp"
+)
+
+// localLogin switches web logins to the local user database holding
+// password for every user the test logs in as.
+func localLogin(t *testing.T, password string, users ...string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	t.Setenv(config.AUTH_BACKENDS, "local")
+	t.Setenv(config.LOCAL_USERS_PATH, path)
+	t.Setenv(config.IDENTITY_STORE_PATH, filepath.Join(t.TempDir(), "identities.json"))
+	store := localusers.NewStore(path)
+	for _, user := range users {
+		if err := store.Add(user, password, nil, time.Now()); err != nil {
+			t.Fatalf("add %s: %v", user, err)
+		}
+	}
+}
+
+func postLogin(handler http.Handler, remoteAddr, username, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "https://gw.example.com/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginLockoutReturns429(t *testing.T) {
+	localLogin(t, "correct", "alice", "bob")
+	t.Setenv(config.LOCKOUT_USER_THRESHOLD, "3")
+	t.Setenv(config.LOCKOUT_IP_THRESHOLD, "10")
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), config.NewSettingType(false))
+
+	for i := 0; i < 3; i++ {
+		rec := postLogin(handler, "192.0.2.10:4000", "alice", "wrong")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Invalid credentials.") {
+			t.Fatalf("attempt %d: expected invalid credentials, got %d", i+1, rec.Code)
+		}
+	}
+
+	rec := postLogin(handler, "198.51.100.20:4000", "alice", "correct")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected locked account to get 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+	unknown := postLogin(handler, "198.51.100.20:4000", "nobody", "wrong")
+	if unknown.Code != http.StatusOK {
+		t.Fatalf("expected other usernames to be unaffected, got %d", unknown.Code)
+	}
+
+	rec = postLogin(handler, "198.51.100.20:4000", "bob", "correct")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected other user to log in, got %d", rec.Code)
+	}
+}
+
+func TestLoginLockoutPerClientIP(t *testing.T) {
+	localLogin(t, "correct", "carol")
+	t.Setenv(config.LOCKOUT_USER_THRESHOLD, "10")
+	t.Setenv(config.LOCKOUT_IP_THRESHOLD, "3")
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), config.NewSettingType(false))
+
+	for _, user := range []string{"u1", "u2", "u3"} {
+		postLogin(handler, "203.0.113.5:1000", user, "wrong")
+	}
+	if rec := postLogin(handler, "203.0.113.5:1001", "carol", "correct"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected sprayed address to be locked, got %d", rec.Code)
+	}
+	if rec := postLogin(handler, "203.0.113.6:1000", "carol", "correct"); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected other address to log in, got %d", rec.Code)
+	}
+}
+
+func TestNTLMLockoutKeepsChallengeResponse(t *testing.T) {
+	sessionManager := session.NewManager()
+	domain := defaultNTLMDomain()
+	seedSession(t, sessionManager, ntlm.StaticUser, ntlm.StaticPassword, domain)
+	auth := &ntlm.StaticAuth{
+		SessionManager: sessionManager,
+		Limiter: lockout.New(lockout.Config{
+			UserThreshold: 2,
+			IPThreshold:   10,
+			BaseDelay:     time.Minute,
+			MaxDelay:      time.Hour,
+			Window:        time.Hour,
+		}),
+	}
+
+	attempt := func(password string) error {
+		challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		req := &http.Request{RemoteAddr: "1.2.3.4:3389", Header: http.Header{}}
+		auth.Challenges = map[string]ntlm.NtlmChallengeState{
+			ntlm.NtlmChallengeKey(req): {Challenge: challenge, IssuedAt: time.Now()},
+		}
+		ntResponse := ntlm.BuildTestNTLMv2Response(challenge, ntlm.StaticUser, domain, password)
+		msg := ntlm.BuildTestNTLMAuthenticateMessage(ntlm.StaticUser, domain, ntResponse, true)
+		_, err := auth.VerifyNTLMAuthenticate(req, msg, "NTLM")
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := attempt("wrong"); err == nil {
+			t.Fatalf("expected wrong password to fail")
+		}
+	}
+	err := attempt(ntlm.StaticPassword)
+	var challenge ntlm.AuthChallenge
+	if !errors.As(err, &challenge) || !strings.HasPrefix(challenge.Header, "NTLM ") {
+		t.Fatalf("expected locked out user to get a plain NTLM challenge, got %v", err)
+	}
+
+	auth.Limiter.Clear(lockout.Key(lockout.KindUser, ntlm.StaticUser))
+	if err := attempt(ntlm.StaticPassword); err != nil {
+		t.Fatalf("expected login after clearing lockout: %v", err)
+	}
+}
+
+func TestAdminListsAndClearsLockouts(t *testing.T) {
+	localLogin(t, "correct", "victim")
+	secret, _ := preEnroll(t, "root-admin")
+	t.Setenv(config.ADMIN_USERS, "root-admin")
+	t.Setenv(config.LOCKOUT_USER_THRESHOLD, "1")
+	env := newOIDCTestEnv(t, "root-admin")
+
+	env.login(t)
+	code, _ := totp.Code(secret, time.Now())
+	env.postForm(t, "/login/mfa", url.Values{"code": {code}})
+
+	if resp, _ := env.postForm(t, "/login", url.Values{"username": {"victim"}, "password": {"wrong"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected failed login page, got %d", resp.StatusCode)
+	}
+
+	resp, err := env.client.Get(env.server.URL + "/api/admin/lockouts")
+	if err != nil {
+		t.Fatalf("list lockouts: %v", err)
+	}
+	var payload lockoutListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode lockouts: %v", err)
+	}
+	resp.Body.Close()
+	found := false
+	for _, entry := range payload.Lockouts {
+		if entry.Key == "user:victim" && entry.Locked {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected victim lockout in %+v", payload.Lockouts)
+	}
+
+	resp, _ = env.postForm(t, "/api/admin/lockouts/clear", url.Values{"key": {"user:victim"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected clear to succeed, got %d", resp.StatusCode)
+	}
+	resp, _ = env.postForm(t, "/api/admin/lockouts/clear", url.Values{"key": {"user:victim"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for cleared key, got %d", resp.StatusCode)
+	}
+}
+
+func TestMFAFailuresCountTowardsLockout(t *testing.T) {
+	localLogin(t, "correct", "grace")
+	secret, _ := preEnroll(t, "grace")
+	t.Setenv(config.LOCKOUT_USER_THRESHOLD, "3")
+	env := newOIDCTestEnv(t, "unused")
+
+	login := func() {
+		t.Helper()
+		resp, _ := env.postForm(t, "/login", url.Values{"username": {"grace"}, "password": {"correct"}})
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login/mfa" {
+			t.Fatalf("expected the second factor step, got %d", resp.StatusCode)
+		}
+	}
+	wrongCode := func() {
+		t.Helper()
+		if _, body := env.postForm(t, "/login/mfa", url.Values{"code": {"000000"}}); !strings.Contains(body, "Invalid authentication code.") {
+			t.Fatalf("expected invalid code message, got %q", body)
+		}
+	}
+
+	env.postForm(t, "/login", url.Values{"username": {"grace"}, "password": {"wrong"}})
+	// The correct password alone must not clear earlier failures.
+	login()
+	wrongCode()
+	login()
+	wrongCode()
+
+	code, _ := totp.Code(secret, time.Now())
+	resp, _ := env.postForm(t, "/login/mfa", url.Values{"code": {code}})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the locked out user to be refused, got %d", resp.StatusCode)
+	}
+	if _, ok := env.sessionManager.GetSessionFromUserName("grace"); ok {
+		t.Fatal("expected no session for the locked out user")
+	}
+	resp, _ = env.postForm(t, "/login", url.Values{"username": {"grace"}, "password": {"correct"}})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the password login to be locked out too, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoginLockoutSharesDomainSpellings(t *testing.T) {
+	localLogin(t, "correct", "henry")
+	t.Setenv(config.LOCKOUT_USER_THRESHOLD, "3")
+	t.Setenv(config.LOCKOUT_IP_THRESHOLD, "10")
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), config.NewSettingType(false))
+
+	for _, name := range []string{"henry", `VDI\henry`, "Henry@vdi"} {
+		if rec := postLogin(handler, "192.0.2.10:4000", name, "wrong"); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected invalid credentials, got %d", name, rec.Code)
+		}
+	}
+	if rec := postLogin(handler, "198.51.100.20:4000", "HENRY", "correct"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected one lockout for every spelling, got %d", rec.Code)
+	}
+}
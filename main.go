@@ -16,17 +16,30 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"remotegateway/internal/apitoken"
+	"remotegateway/internal/audit"
+	"remotegateway/internal/auth"
+	"remotegateway/internal/clientcert"
 	"remotegateway/internal/config"
 	"remotegateway/internal/contextKey"
+	"remotegateway/internal/identity"
+	"remotegateway/internal/jobs"
+	"remotegateway/internal/ldap"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/mfa"
 	"remotegateway/internal/ntlm"
+	"remotegateway/internal/radius"
 	"remotegateway/internal/rdpgw/common"
 	"remotegateway/internal/rdpgw/protocol"
 	"remotegateway/internal/session"
+	"remotegateway/internal/sshkeys"
 	"remotegateway/internal/virt"
 
 	"github.com/caddyserver/certmagic"
@@ -124,24 +137,52 @@ func intSetting(settings *config.SettingsType, key string, defaultValue int) int
 // getIPOfVm allows tests to stub VM lookups.
 var getIPOfVm = virt.GetIpOfVm
 
-func converToInternServer(ctx context.Context, host string) (string, error) {
+// lookupVMOwnership allows tests to stub the libvirt metadata lookup.
+var lookupVMOwnership = virt.LookupOwnership
 
-	user, ok := contextKey.AuthUserFromContext(ctx)
-	if !ok {
-		log.Printf("missing auth user for server policy")
-		return "", fmt.Errorf("missing auth user")
-	}
+// setVMOwnership allows tests to stub the libvirt metadata update.
+var setVMOwnership = virt.SetOwnership
 
-	if host == "" || user == "" {
-		log.Printf("empty host or user in server policy: host=%q user=%q", host, user)
-		return "", fmt.Errorf("empty host or user")
-	}
+// listVMs allows tests to stub the libvirt domain listing.
+var listVMs = virt.ListVMs
 
-	if strings.HasPrefix(host, user) {
-		return getIPOfVm(host)
-	}
+// serverConverter authorizes gateway tunnels: the user must own the target
+// VM or hold a connect grant on it. Grant use is audited. A shut-off VM is
+// started when the user may start it from the dashboard.
+func serverConverter(auditLog *audit.Logger, quotas *vmQuotas) func(context.Context, string) (string, error) {
+	return func(ctx context.Context, host string) (string, error) {
+		user, ok := contextKey.AuthUserFromContext(ctx)
+		if !ok {
+			log.Printf("missing auth user for server policy")
+			return "", fmt.Errorf("missing auth user")
+		}
+
+		if host == "" || user == "" {
+			log.Printf("empty host or user in server policy: host=%q user=%q", host, user)
+			return "", fmt.Errorf("empty host or user")
+		}
 
-	return "", fmt.Errorf("denying server for user=%s host=%s", user, host)
+		// Unknown groups match no group grant.
+		groups, _ := contextKey.AuthGroupsFromContext(ctx)
+		actor := vmActor{Name: user, Groups: groups, Remote: common.GetClientIp(ctx)}
+		if err := authorizeVM(auditLog, actor, host, virt.RightConnect, "vm.connect"); err != nil {
+			log.Printf("denying server for user=%s host=%s: %v", user, host, err)
+			return "", fmt.Errorf("denying server for user=%s host=%s: %w", user, host, err)
+		}
+		ip, err := getIPOfVm(host)
+		if err == nil {
+			return ip, nil
+		}
+		started, ok, startErr := startOnConnect(ctx, auditLog, quotas, actor, host)
+		if startErr != nil {
+			log.Printf("start vm %q on connect failed: %v", host, startErr)
+			return "", startErr
+		}
+		if !ok {
+			return "", err
+		}
+		return started, nil
+	}
 }
 
 func ensureTLSCert(certPath, keyPath string) error {
@@ -221,42 +262,213 @@ func ensureTLSCert(certPath, keyPath string) error {
    ---------------------------
 */
 
-func gatewayRouter(sessionManager *session.Manager, settings *config.SettingsType) http.Handler {
+// gatewaySecondFactor returns the RADIUS approver when RADIUS_SERVER is set.
+func gatewaySecondFactor(settings *config.SettingsType) ntlm.SecondFactor {
+	if settings == nil || !settings.Has(config.RADIUS_SERVER) {
+		return nil
+	}
+	if !settings.Has(config.RADIUS_SECRET) {
+		log.Printf("RADIUS disabled: %s is required", config.RADIUS_SECRET)
+		return nil
+	}
+	return &radius.Approver{
+		Client: &radius.Client{
+			Addr:          settings.Get(config.RADIUS_SERVER),
+			Secret:        []byte(settings.Get(config.RADIUS_SECRET)),
+			NASIdentifier: settings.Get(config.RADIUS_NAS_IDENTIFIER),
+			Timeout:       time.Duration(intSetting(settings, config.RADIUS_TIMEOUT_SECONDS, 25)) * time.Second,
+		},
+		Password:          settings.Get(config.RADIUS_PASSWORD),
+		ChallengeResponse: settings.Get(config.RADIUS_CHALLENGE_RESPONSE),
+		TTL:               time.Duration(intSetting(settings, config.RADIUS_APPROVAL_TTL_SECONDS, 120)) * time.Second,
+	}
+}
+
+func newLoginLimiter(settings *config.SettingsType) *lockout.Limiter {
+	return lockout.New(lockout.Config{
+		UserThreshold: intSetting(settings, config.LOCKOUT_USER_THRESHOLD, 5),
+		IPThreshold:   intSetting(settings, config.LOCKOUT_IP_THRESHOLD, 20),
+		BaseDelay:     time.Duration(intSetting(settings, config.LOCKOUT_BASE_SECONDS, 30)) * time.Second,
+		MaxDelay:      time.Duration(intSetting(settings, config.LOCKOUT_MAX_SECONDS, 900)) * time.Second,
+		Window:        time.Duration(intSetting(settings, config.LOCKOUT_WINDOW_SECONDS, 900)) * time.Second,
+	})
+}
+
+func gatewayRouter(sessionManager *session.Manager, mfaStore *mfa.Store, limiter *lockout.Limiter, authenticator auth.Authenticator, auditLog *audit.Logger, tunnels *protocol.TunnelRegistry, settings *config.SettingsType) http.Handler {
 	sendBuf := intSetting(settings, config.RDPGW_SEND_BUF, 0)
 	recvBuf := intSetting(settings, config.RDPGW_RECV_BUF, 0)
 	wsReadBuf := intSetting(settings, config.RDPGW_WS_READ_BUF, 32768)
 	wsWriteBuf := intSetting(settings, config.RDPGW_WS_WRITE_BUF, 32768)
 
+	redirects := loadRedirectPolicy(settings)
 	gw := protocol.Gateway{
 		ServerConf: &protocol.ServerConf{
 			IdleTimeout:                 0,
 			TokenAuth:                   false,
 			SmartCardAuth:               false,
-			RedirectFlags:               protocol.RedirectFlags{EnableAll: true},
-			ConvertToInternalServerFunc: converToInternServer,
+			RedirectFlags:               redirects.defaults,
+			ConvertToInternalServerFunc: serverConverter(auditLog, loadVMQuotas(settings)),
 			SendBuf:                     sendBuf,
 			ReceiveBuf:                  recvBuf,
 			WebsocketReadBuffer:         wsReadBuf,
 			WebsocketWriteBuffer:        wsWriteBuf,
+			TunnelSettingsFunc:          redirects.tunnelSettings,
+			Registry:                    tunnels,
 		},
 	}
+	loadGatewayPolicy(settings, tunnels).apply(gw.ServerConf)
 
 	var gatewayHandler http.Handler = http.HandlerFunc(gw.HandleGatewayProtocol)
-	gatewayHandler = ntlm.BasicAuthMiddleware(&ntlm.StaticAuth{SessionManager: sessionManager}, gatewayHandler)
+	certMode, certMapper, err := clientCertSettings(settings)
+	if err != nil {
+		// Fail closed: no certificate maps to a user.
+		log.Printf("client certificate settings: %v", err)
+		certMode, certMapper = clientcert.ModeRequired, clientcert.Mapper{}
+	}
+	auth := &ntlm.StaticAuth{
+		SessionManager:   sessionManager,
+		SecondFactor:     gatewaySecondFactor(settings),
+		Limiter:          limiter,
+		ClientCertMode:   certMode,
+		ClientCertMapper: certMapper,
+		Basic:            gatewayBasicAuth(mfaStore, authenticator, settings),
+		Groups:           gatewayGroups(authenticator),
+	}
+	gatewayHandler = ntlm.BasicAuthMiddleware(auth, gatewayHandler)
 	gatewayHandler = common.EnrichContext(gatewayHandler)
 	return gatewayHandler
 }
 
-func getRemoteGatewayRotuer(sessionManager *session.Manager, settings *config.SettingsType) http.Handler {
+// gatewayGroups looks up the groups of gateway users without a web session
+// in the local user database. Directory users need a session or a Basic
+// login, as the directory is only asked with the user's password.
+func gatewayGroups(authenticator auth.Authenticator) func(string) ([]string, bool) {
+	chain, ok := authenticator.(auth.Chain)
+	if !ok {
+		return nil
+	}
+	return func(user string) ([]string, bool) {
+		groups, known, err := chain.Groups(user)
+		if err != nil {
+			log.Printf("group lookup failed for %s: %v", user, err)
+			return nil, false
+		}
+		return groups, known
+	}
+}
+
+// gatewayDisabled reports local users disabled since their Basic login was
+// cached. Lookup failures count as disabled, which only costs a new check of
+// the password.
+func gatewayDisabled(authenticator auth.Authenticator) func(string) bool {
+	chain, ok := authenticator.(auth.Chain)
+	if !ok {
+		return nil
+	}
+	return func(user string) bool {
+		disabled, err := chain.Disabled(user)
+		if err != nil {
+			log.Printf("account lookup failed for %s: %v", user, err)
+			return true
+		}
+		return disabled
+	}
+}
+
+// gatewayBasicAuth configures HTTP Basic logins on the gateway, or returns
+// nil when GATEWAY_BASIC_AUTH is off. Directory passwords are only accepted
+// for users that need no second factor; the others must use an app password
+// from their MFA verified web session.
+func gatewayBasicAuth(mfaStore *mfa.Store, authenticator auth.Authenticator, settings *config.SettingsType) *ntlm.BasicAuth {
+	if !settings.IsTrue(config.GATEWAY_BASIC_AUTH) {
+		return nil
+	}
+	return &ntlm.BasicAuth{
+		Authenticator: authenticator,
+		Disabled:      gatewayDisabled(authenticator),
+		Domain:        ldap.GatewayDomain(settings),
+		CacheTTL:      time.Duration(intSetting(settings, config.GATEWAY_BASIC_CACHE_SECONDS, 300)) * time.Second,
+		DirectoryAllowed: func(username string) bool {
+			if settings.IsTrue(config.MFA_REQUIRED) {
+				return false
+			}
+			enrolled, err := mfaStore.Enrolled(username)
+			if err != nil {
+				log.Printf("mfa lookup failed for %s: %v", username, err)
+				return false
+			}
+			return !enrolled
+		},
+	}
+}
+
+// clientCertSettings returns the gateway client certificate mode and the
+// mapper that turns certificates into usernames.
+func clientCertSettings(settings *config.SettingsType) (string, clientcert.Mapper, error) {
+	mode, err := clientcert.ParseMode(settings.Get(config.CLIENT_CERT_MODE))
+	if err != nil || mode == clientcert.ModeOff {
+		return clientcert.ModeOff, clientcert.Mapper{}, err
+	}
+	sources, err := clientcert.ParseSources(settings.Get(config.CLIENT_CERT_USER_SOURCES))
+	if err != nil {
+		return "", clientcert.Mapper{}, err
+	}
+	domains := append(clientcert.ParseDomains(settings.Get(config.CLIENT_CERT_DOMAINS)), ldap.GatewayDomain(settings))
+	return mode, clientcert.Mapper{Sources: sources, Domains: domains}, nil
+}
+
+// serverTLSConfig returns the listener TLS settings, asking for client
+// certificates when CLIENT_CERT_MODE is enabled.
+func serverTLSConfig(settings *config.SettingsType, base *tls.Config) (*tls.Config, error) {
+	if base == nil {
+		base = &tls.Config{}
+	}
+	base.MinVersion = tls.VersionTLS12
+	mode, _, err := clientCertSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+	if mode == clientcert.ModeOff {
+		return base, nil
+	}
+	if !settings.Has(config.CLIENT_CERT_CA_FILE) {
+		return nil, fmt.Errorf("CLIENT_CERT_MODE=%s needs CLIENT_CERT_CA_FILE", mode)
+	}
+	pool, err := clientcert.LoadCAPool(settings.Get(config.CLIENT_CERT_CA_FILE))
+	if err != nil {
+		return nil, err
+	}
+	clientcert.Configure(base, pool)
+	return base, nil
+}
+
+// getRemoteGatewayRotuer builds the HTTP handler. Background workers, such
+// as the provisioning jobs, run until ctx ends.
+func getRemoteGatewayRotuer(ctx context.Context, sessionManager *session.Manager, settings *config.SettingsType) http.Handler {
 
 	router := chi.NewRouter()
 	router.Use(sessionManager.LoadAndSave)
 
 	router.Handle("/static/*", http.FileServer(http.FS(staticFiles)))
-	router.Post("/login", handleLoginPost(sessionManager, settings))
-	router.Get("/login", handleLoginGet)
+	mfaStore := mfa.NewStore(settings.Get(config.MFA_STORE_PATH))
+	identities := identity.NewStore(settings.Get(config.IDENTITY_STORE_PATH))
+	limiter := newLoginLimiter(settings)
+	auditLog := audit.NewLogger(settings.Get(config.AUDIT_LOG_PATH))
+	authenticator, err := auth.FromSettings(settings)
+	if err != nil {
+		log.Printf("authentication backends: %v", err)
+	}
+	router.Post("/login", handleLoginPost(sessionManager, mfaStore, identities, limiter, authenticator, settings))
+	router.Get("/login", handleLoginGet(settings))
+	router.Get("/login/mfa", handleMFAGet(sessionManager, mfaStore, settings))
+	router.Post("/login/mfa", handleMFAPost(sessionManager, mfaStore, limiter, settings))
+	if provider := newOIDCProvider(settings); provider != nil {
+		router.Get("/login/oidc", handleOIDCLogin(sessionManager, provider, settings))
+		router.Get("/login/oidc/callback", handleOIDCCallback(sessionManager, provider, mfaStore, limiter, identities, authenticator, settings))
+	}
 	router.HandleFunc("/logout", handleLogout(sessionManager))
 	router.HandleFunc("/KdcProxy", handleKdcProxy)
+	router.Post(virt.PhoneHomePath, handlePhoneHome(auditLog))
 
 	router.HandleFunc("/api/health", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -270,10 +482,11 @@ func getRemoteGatewayRotuer(sessionManager *session.Manager, settings *config.Se
 	apiCfg.DocsPath = ""
 	apiCfg.SchemasPath = ""
 	api := humachi.New(router, apiCfg)
-	registerAPI(api, sessionManager, settings)
+	tunnels := protocol.NewTunnelRegistry()
+	registerAPI(ctx, api, sessionManager, mfaStore, apitoken.NewStore(settings.Get(config.API_TOKEN_STORE_PATH)), limiter, auditLog, tunnels, settings)
 
 	//mux.Handle("/rdgateway/", gatewayHandler)
-	gatewayHandler := gatewayRouter(sessionManager, settings)
+	gatewayHandler := gatewayRouter(sessionManager, mfaStore, limiter, authenticator, auditLog, tunnels, settings)
 
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -291,14 +504,21 @@ func getRemoteGatewayRotuer(sessionManager *session.Manager, settings *config.Se
 
 }
 
-func registerAPI(api huma.API, sessionManager *session.Manager, settings *config.SettingsType) {
+func registerAPI(ctx context.Context, api huma.API, sessionManager *session.Manager, mfaStore *mfa.Store, tokens *apitoken.Store, limiter *lockout.Limiter, auditLog *audit.Logger, tunnels *protocol.TunnelRegistry, settings *config.SettingsType) {
+	quotas := loadVMQuotas(settings)
+	sizes := loadVMSizes(settings)
+	templates := loadVMTemplates(settings, sizes)
+	provisioner := startProvisioner(ctx, settings, templates)
+	sshKeys := sshkeys.NewStore(settings.Get(config.SSH_KEY_STORE_PATH))
+	idle := startIdleReconciler(ctx, settings, tunnels, auditLog)
 	group := huma.NewGroup(api, "/api")
-	group.UseMiddleware(sessionManager.SessionMiddleware())
+	group.UseMiddleware(apiAuthMiddleware(sessionManager, tokens))
+	group.UseMiddleware(csrfMiddleware(sessionManager))
 	huma.Get(group, "/rdpgw.rdp", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
 		return &huma.StreamResponse{
 			Body: func(ctx huma.Context) {
 				req, w := humachi.Unwrap(ctx)
-				user, ok := sessionManager.UserFromContext(req.Context())
+				user, ok := sessionManager.UserFromContext(ctx.Context())
 				if !ok {
 					http.Error(w, "unauthorized", http.StatusUnauthorized)
 					return
@@ -319,6 +539,7 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeRead)
 	})
 
 	huma.Get(group, "/dashboard", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
@@ -335,24 +556,53 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 	huma.Get(group, "/dashboard/data", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
 		return &huma.StreamResponse{
 			Body: func(ctx huma.Context) {
-				_, w := humachi.Unwrap(ctx)
-				vmRows, err := listDashboardVMs()
+				req, w := humachi.Unwrap(ctx)
+				mfaVerified := sessionManager.MFAVerified(req.Context())
+				// API token requests have no session to keep a CSRF token in.
+				var csrfToken string
+				if _, ok := apiTokenFromContext(ctx.Context()); !ok {
+					var err error
+					if csrfToken, err = sessionManager.CSRFToken(req.Context()); err != nil {
+						log.Printf("csrf token: %v", err)
+					}
+				}
+				user, ok := sessionManager.UserFromContext(ctx.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardDataResponse{
+						Filename: rdpFilename,
+						Error:    "Login required.",
+					})
+					return
+				}
+				vmList, err := listVMs("")
 				if err != nil {
 					log.Printf("list vms: %v", err)
 					writeJSON(w, http.StatusInternalServerError, dashboardDataResponse{
-						Filename: rdpFilename,
-						Error:    "Unable to load virtual machines right now.",
+						Filename:    rdpFilename,
+						Error:       "Unable to load virtual machines right now.",
+						MFAVerified: mfaVerified,
+						CSRFToken:   csrfToken,
 					})
 					return
 				}
+				rows := dashboardVMs(user, vmList)
+				markIdleVMs(rows, idle)
 				writeJSON(w, http.StatusOK, dashboardDataResponse{
-					Filename: rdpFilename,
-					VMs:      vmRows,
+					Filename:     rdpFilename,
+					VMs:          rows,
+					MFAVerified:  mfaVerified,
+					CSRFToken:    csrfToken,
+					IsAdmin:      isAdmin(settings, user),
+					Quota:        quotas.report(user, vmList),
+					Sizes:        sizes,
+					Templates:    templates,
+					IdleShutdown: idle != nil,
 				})
 			},
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeRead)
 	})
 
 	huma.Post(group, "/dashboard", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
@@ -378,7 +628,7 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 					return
 				}
 
-				user, ok := sessionManager.UserFromContext(req.Context())
+				user, ok := sessionManager.UserFromContext(ctx.Context())
 				if !ok {
 					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
 						OK:    false,
@@ -387,23 +637,175 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 					return
 				}
 
-				if vmName, err := virt.BootNewVM(name, user, settings); err != nil {
-					log.Printf("boot new vm %q failed: %v", vmName, err)
+				if templates == nil || provisioner == nil {
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "No VM templates are available right now.",
+					})
+					return
+				}
+				tmpl, err := templates.Find(req.FormValue("template"))
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Unknown VM template.",
+					})
+					return
+				}
+
+				size, err := vmSizeFromForm(sizes, req, tmpl.DefaultSize)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: err.Error() + ".",
+					})
+					return
+				}
+
+				vmName := virt.VMName(user.GetName(), name)
+				if err := checkReplaceable(user, vmName); err != nil {
+					log.Printf("create vm %q refused for %s: %v", vmName, user.GetName(), err)
+					writeJSON(w, http.StatusConflict, dashboardActionResponse{
+						OK:    false,
+						Error: "A VM with this name already exists.",
+					})
+					return
+				}
+
+				if err := quotas.checkCreate(user, name, size, pendingUsage(provisioner, user.GetName(), vmName)); err != nil {
+					writeQuotaError(w, "create vm "+name, err)
+					return
+				}
+
+				keys, err := authorizedKeys(user, sshKeys)
+				if err != nil {
+					log.Printf("load ssh keys of %s: %v", user.GetName(), err)
 					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
 						OK:    false,
-						Error: "Failed to create VM.",
+						Error: "Unable to load SSH keys.",
+					})
+					return
+				}
+
+				job, err := provisioner.Submit(jobs.Spec{
+					Owner:                 user.GetName(),
+					Groups:                user.GetGroups(),
+					CloudInitPasswordHash: user.GetCloudInitPasswordHash(),
+					SSHKeys:               keys,
+					Name:                  name,
+					VMName:                vmName,
+					Template:              tmpl.Name,
+					Size:                  size,
+				})
+				if err != nil {
+					writeSubmitError(w, vmName, err)
+					return
+				}
+
+				writeJSON(w, http.StatusAccepted, dashboardActionResponse{
+					OK:      true,
+					Message: "VM creation queued.",
+					JobID:   job.ID,
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeManage)
+	})
+
+	huma.Get(group, "/dashboard/jobs", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				_, w := humachi.Unwrap(ctx)
+				user, ok := sessionManager.UserFromContext(ctx.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardJobsResponse{
+						Jobs:  []dashboardJob{},
+						Error: "Login required.",
+					})
+					return
+				}
+				resp := dashboardJobsResponse{Jobs: []dashboardJob{}}
+				if provisioner != nil {
+					for _, job := range provisioner.List(user.GetName()) {
+						resp.Jobs = append(resp.Jobs, newDashboardJob(job))
+					}
+				}
+				writeJSON(w, http.StatusOK, resp)
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeRead)
+	})
+
+	huma.Post(group, "/dashboard/jobs/cancel", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				if err := req.ParseForm(); err != nil {
+					log.Printf("job cancel form parse failed: %v", err)
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				user, ok := sessionManager.UserFromContext(ctx.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+
+				var job jobs.Job
+				if provisioner != nil {
+					job, ok = provisioner.Get(strings.TrimSpace(req.FormValue("job_id")))
+				}
+				// Admins may cancel any job once they passed the second factor.
+				admin := isAdmin(settings, user) && sessionManager.MFAVerified(req.Context())
+				if provisioner == nil || !ok || (!strings.EqualFold(job.Spec.Owner, user.GetName()) && !admin) {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "Job not found.",
+					})
+					return
+				}
+
+				_, err := provisioner.Cancel(job.ID)
+				if !strings.EqualFold(job.Spec.Owner, user.GetName()) {
+					detail := map[string]string{"owner": job.Spec.Owner, "job": job.ID}
+					if err != nil {
+						detail["error"] = err.Error()
+					}
+					recordAdminAction(auditLog, req, user, "admin.job.cancel", job.Spec.VMName, detail)
+				}
+				if err != nil {
+					status, message := jobActionError(err)
+					if status == http.StatusInternalServerError {
+						log.Printf("cancel job %s failed: %v", job.ID, err)
+					}
+					writeJSON(w, status, dashboardActionResponse{
+						OK:    false,
+						Error: message,
 					})
 					return
 				}
 
 				writeJSON(w, http.StatusOK, dashboardActionResponse{
 					OK:      true,
-					Message: "VM creation started.",
+					Message: "VM creation canceled.",
+					JobID:   job.ID,
 				})
 			},
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeManage)
 	})
 
 	huma.Post(group, "/dashboard/remove", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
@@ -415,6 +817,9 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 				if handleDashboardFormError(w, "dashboard remove", err) {
 					return
 				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightOwner, "vm.remove") {
+					return
+				}
 
 				if err := virt.RemoveVM(name); err != nil {
 					log.Printf("remove vm %q failed: %v", name, err)
@@ -433,6 +838,7 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeManage)
 	})
 
 	huma.Post(group, "/dashboard/start", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
@@ -444,6 +850,14 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 				if handleDashboardFormError(w, "dashboard start", err) {
 					return
 				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightManage, "vm.start") {
+					return
+				}
+				user, _ := sessionManager.UserFromContext(ctx.Context())
+				if err := quotas.checkStart(user, name); err != nil {
+					writeQuotaError(w, "start vm "+name, err)
+					return
+				}
 
 				if err := virt.StartExistingVM(name); err != nil {
 					log.Printf("start vm %q failed: %v", name, err)
@@ -462,6 +876,7 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopePower)
 	})
 
 	huma.Post(group, "/dashboard/restart", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
@@ -473,6 +888,9 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 				if handleDashboardFormError(w, "dashboard restart", err) {
 					return
 				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightManage, "vm.restart") {
+					return
+				}
 
 				if err := virt.RestartVM(name); err != nil {
 					log.Printf("restart vm %q failed: %v", name, err)
@@ -491,6 +909,7 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopePower)
 	})
 
 	huma.Post(group, "/dashboard/shutdown", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
@@ -502,6 +921,9 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 				if handleDashboardFormError(w, "dashboard shutdown", err) {
 					return
 				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightManage, "vm.shutdown") {
+					return
+				}
 
 				if err := virt.ShutdownVM(name); err != nil {
 					log.Printf("shutdown vm %q failed: %v", name, err)
@@ -520,76 +942,913 @@ func registerAPI(api huma.API, sessionManager *session.Manager, settings *config
 		}, nil
 	}, func(op *huma.Operation) {
 		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopePower)
 	})
-}
 
-func validateVMName(name string) (string, error) {
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return "", fmt.Errorf("VM name is required.")
-	}
-	if len(name) > 64 {
-		return "", fmt.Errorf("VM name is too long.")
-	}
-	for _, r := range name {
-		if (r >= 'a' && r <= 'z') ||
-			(r >= 'A' && r <= 'Z') ||
-			(r >= '0' && r <= '9') ||
-			r == '-' || r == '_' {
-			continue
-		}
-		return "", fmt.Errorf("VM name may only use letters, numbers, '-' or '_'.")
-	}
-	return name, nil
-}
+	huma.Post(group, "/dashboard/keep-running", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
 
-var errInvalidDashboardForm = errors.New("invalid form submission")
+				name, err := parseDashboardVMName(req)
+				if handleDashboardFormError(w, "dashboard keep running", err) {
+					return
+				}
+				keep, err := strconv.ParseBool(strings.TrimSpace(req.FormValue("keep")))
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightManage, "vm.keep_running") {
+					return
+				}
 
-func parseDashboardVMName(req *http.Request) (string, error) {
-	if err := req.ParseForm(); err != nil {
-		return "", fmt.Errorf("%w: %v", errInvalidDashboardForm, err)
-	}
-	name := strings.TrimSpace(req.FormValue("vm_name"))
-	if name == "" {
-		return "", fmt.Errorf("VM name is required.")
-	}
-	if len(name) > 128 {
-		return "", fmt.Errorf("VM name is too long.")
-	}
-	return name, nil
-}
+				_, err = updateVMOwnership(name, func(o *virt.Ownership) bool {
+					o.KeepRunning = keep
+					return true
+				})
+				if err != nil {
+					log.Printf("set keep running of vm %q failed: %v", name, err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to update VM.",
+					})
+					return
+				}
 
-func handleDashboardFormError(w http.ResponseWriter, action string, err error) bool {
-	if err == nil {
-		return false
-	}
-	if errors.Is(err, errInvalidDashboardForm) {
-		log.Printf("%s form parse failed: %v", action, err)
-		writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
-			OK:    false,
-			Error: "Invalid form submission.",
-		})
-		return true
-	}
-	writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
-		OK:    false,
-		Error: err.Error(),
+				message := "VM is shut down when idle."
+				if keep {
+					message = "VM keeps running when idle."
+				}
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: message,
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopePower)
 	})
-	return true
-}
 
-func main() {
+	huma.Post(group, "/dashboard/share", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				user, ok := sessionManager.UserFromContext(ctx.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				name, grant, err := parseVMGrant(req, user.GetName(), false)
+				if handleShareFormError(w, "dashboard share", err) {
+					return
+				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightOwner, "vm.share") {
+					return
+				}
+
+				if _, err := updateVMOwnership(name, func(o *virt.Ownership) bool {
+					o.SetGrant(grant)
+					return true
+				}); err != nil {
+					log.Printf("share vm %q failed: %v", name, err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to share VM.",
+					})
+					return
+				}
+				auditLog.Record(audit.Event{
+					Actor:  user.GetName(),
+					Action: "vm.share",
+					Target: name,
+					Remote: common.RemoteHost(req),
+					Detail: map[string]string{"grantType": grant.Type, "grantName": grant.Name, "right": grant.Right},
+				})
+
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "VM shared with " + grant.Type + " " + grant.Name + ".",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeManage)
+	})
+
+	huma.Post(group, "/dashboard/unshare", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				user, ok := sessionManager.UserFromContext(ctx.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				name, grant, err := parseVMGrant(req, user.GetName(), true)
+				if handleShareFormError(w, "dashboard unshare", err) {
+					return
+				}
+				if !requireVMAccess(ctx, sessionManager, auditLog, name, virt.RightOwner, "vm.unshare") {
+					return
+				}
+
+				removed, err := updateVMOwnership(name, func(o *virt.Ownership) bool {
+					return o.RemoveGrant(grant.Type, grant.Name)
+				})
+				if err != nil {
+					log.Printf("unshare vm %q failed: %v", name, err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to update VM sharing.",
+					})
+					return
+				}
+				if !removed {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "The VM is not shared with " + grant.Type + " " + grant.Name + ".",
+					})
+					return
+				}
+				auditLog.Record(audit.Event{
+					Actor:  user.GetName(),
+					Action: "vm.unshare",
+					Target: name,
+					Remote: common.RemoteHost(req),
+					Detail: map[string]string{"grantType": grant.Type, "grantName": grant.Name},
+				})
+
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "Stopped sharing VM with " + grant.Type + " " + grant.Name + ".",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+		allowAPIToken(op, apitoken.ScopeManage)
+	})
+
+	huma.Post(group, "/dashboard/app-password", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				setNoCacheHeaders(w)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, appPasswordResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				if !sessionManager.MFAVerified(req.Context()) {
+					writeJSON(w, http.StatusForbidden, appPasswordResponse{
+						OK:    false,
+						Error: "Set up two-factor authentication before creating gateway passwords.",
+					})
+					return
+				}
+
+				password, err := generateAppPassword()
+				if err != nil {
+					log.Printf("generate app password for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, appPasswordResponse{
+						OK:    false,
+						Error: "Failed to create gateway password.",
+					})
+					return
+				}
+				domain := ldap.GatewayDomain(settings)
+				if err := user.AddAppPassword(password, domain); err != nil {
+					log.Printf("add app password for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, appPasswordResponse{
+						OK:    false,
+						Error: "Failed to create gateway password.",
+					})
+					return
+				}
+				if err := sessionManager.UpdateUser(req.Context(), user); err != nil {
+					log.Printf("store app password for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, appPasswordResponse{
+						OK:    false,
+						Error: "Failed to create gateway password.",
+					})
+					return
+				}
+
+				writeJSON(w, http.StatusOK, appPasswordResponse{
+					OK:       true,
+					Message:  "Gateway password created. It is shown only once and is valid until you log out.",
+					Username: domain + "\\" + user.GetName(),
+					Password: password,
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Get(group, "/tokens", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				setNoCacheHeaders(w)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, apiTokenListResponse{Error: "Login required."})
+					return
+				}
+				list, err := tokens.List(user.GetName())
+				if err != nil {
+					log.Printf("list api tokens for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, apiTokenListResponse{Error: "Unable to load API tokens."})
+					return
+				}
+				now := time.Now()
+				views := make([]apiTokenView, 0, len(list))
+				for _, token := range list {
+					views = append(views, newAPITokenView(token, now))
+				}
+				writeJSON(w, http.StatusOK, apiTokenListResponse{Tokens: views})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/tokens", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				setNoCacheHeaders(w)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, apiTokenCreateResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				if !sessionManager.MFAVerified(req.Context()) {
+					writeJSON(w, http.StatusForbidden, apiTokenCreateResponse{
+						OK:    false,
+						Error: "Set up two-factor authentication before creating API tokens.",
+					})
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, apiTokenCreateResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+
+				maxDays := intSetting(settings, config.API_TOKEN_MAX_DAYS, 90)
+				days := min(defaultAPITokenDays, maxDays)
+				if raw := strings.TrimSpace(req.FormValue("expires_days")); raw != "" {
+					value, err := strconv.Atoi(raw)
+					if err != nil || value < 1 || value > maxDays {
+						writeJSON(w, http.StatusBadRequest, apiTokenCreateResponse{
+							OK:    false,
+							Error: fmt.Sprintf("Lifetime must be between 1 and %d days.", maxDays),
+						})
+						return
+					}
+					days = value
+				}
+
+				now := time.Now()
+				raw, token, err := tokens.Create(user, req.FormValue("name"), req.Form["scope"], time.Duration(days)*24*time.Hour, now)
+				switch {
+				case errors.Is(err, apitoken.ErrInvalidName):
+					writeJSON(w, http.StatusBadRequest, apiTokenCreateResponse{
+						OK:    false,
+						Error: "Token name is required (up to 64 characters).",
+					})
+					return
+				case errors.Is(err, apitoken.ErrInvalidScope), errors.Is(err, apitoken.ErrInvalidTTL):
+					writeJSON(w, http.StatusBadRequest, apiTokenCreateResponse{
+						OK:    false,
+						Error: "Invalid token scope or lifetime.",
+					})
+					return
+				case err != nil:
+					log.Printf("create api token for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, apiTokenCreateResponse{
+						OK:    false,
+						Error: "Failed to create API token.",
+					})
+					return
+				}
+
+				log.Printf("api token created: user=%s id=%s scopes=%s expires=%s", user.GetName(), token.ID, strings.Join(token.Scopes, ","), token.ExpiresAt.Format(time.RFC3339))
+				view := newAPITokenView(token, now)
+				writeJSON(w, http.StatusOK, apiTokenCreateResponse{
+					OK:      true,
+					Message: "API token created. It is shown only once.",
+					Token:   raw,
+					Info:    &view,
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/tokens/revoke", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				id := strings.TrimSpace(req.FormValue("id"))
+				removed, err := tokens.Revoke(user.GetName(), id)
+				if err != nil {
+					log.Printf("revoke api token %s for %s: %v", id, user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to revoke API token.",
+					})
+					return
+				}
+				if !removed {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "API token not found.",
+					})
+					return
+				}
+
+				log.Printf("api token revoked: user=%s id=%s", user.GetName(), id)
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "API token revoked.",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Get(group, "/dashboard/ssh-keys", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				setNoCacheHeaders(w)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, sshKeyListResponse{Keys: []sshKeyView{}, Error: "Login required."})
+					return
+				}
+				extra, err := sshKeys.List(user.GetName())
+				if err != nil {
+					log.Printf("list ssh keys for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, sshKeyListResponse{Keys: []sshKeyView{}, Error: "Unable to load SSH keys."})
+					return
+				}
+				writeJSON(w, http.StatusOK, sshKeyListResponse{Keys: sshKeyViews(user, extra)})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/dashboard/ssh-keys", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				if !sessionManager.MFAVerified(req.Context()) {
+					writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+						OK:    false,
+						Error: "Set up two-factor authentication before adding SSH keys.",
+					})
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+
+				key, err := sshKeys.Add(user.GetName(), req.FormValue("key"), time.Now())
+				switch {
+				case errors.Is(err, sshkeys.ErrInvalidKey):
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Paste a single SSH public key, e.g. the contents of ~/.ssh/id_ed25519.pub.",
+					})
+					return
+				case errors.Is(err, sshkeys.ErrDuplicate):
+					writeJSON(w, http.StatusConflict, dashboardActionResponse{
+						OK:    false,
+						Error: "This SSH key is already added.",
+					})
+					return
+				case errors.Is(err, sshkeys.ErrTooMany):
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: fmt.Sprintf("You can add up to %d SSH keys.", sshkeys.MaxKeys),
+					})
+					return
+				case err != nil:
+					log.Printf("add ssh key for %s: %v", user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to add SSH key.",
+					})
+					return
+				}
+
+				auditLog.Record(audit.Event{
+					Actor:  user.GetName(),
+					Action: "ssh_key.add",
+					Target: key.Fingerprint,
+					Remote: common.RemoteHost(req),
+					Detail: map[string]string{"type": key.Type, "comment": key.Comment},
+				})
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "SSH key added. It is authorized in VMs created from now on.",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/dashboard/ssh-keys/remove", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				user, ok := sessionManager.UserFromContext(req.Context())
+				if !ok {
+					writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+						OK:    false,
+						Error: "Login required.",
+					})
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				fingerprint := strings.TrimSpace(req.FormValue("fingerprint"))
+				removed, err := sshKeys.Remove(user.GetName(), fingerprint)
+				if err != nil {
+					log.Printf("remove ssh key %s for %s: %v", fingerprint, user.GetName(), err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to remove SSH key.",
+					})
+					return
+				}
+				if !removed {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "SSH key not found.",
+					})
+					return
+				}
+
+				auditLog.Record(audit.Event{
+					Actor:  user.GetName(),
+					Action: "ssh_key.remove",
+					Target: fingerprint,
+					Remote: common.RemoteHost(req),
+				})
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "SSH key removed. VMs created earlier keep it until they are recreated.",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Get(group, "/admin/overview", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				if _, ok := requireAdmin(w, req, sessionManager, settings); !ok {
+					return
+				}
+				overview, err := adminOverview(sessionManager, tunnels)
+				if err != nil {
+					log.Printf("admin overview: %v", err)
+					writeJSON(w, http.StatusInternalServerError, adminOverviewResponse{
+						Error: "Unable to load the overview right now.",
+					})
+					return
+				}
+				setNoCacheHeaders(w)
+				writeJSON(w, http.StatusOK, overview)
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/admin/vm", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				admin, ok := requireAdmin(w, req, sessionManager, settings)
+				if !ok {
+					return
+				}
+				name, err := parseDashboardVMName(req)
+				if handleDashboardFormError(w, "admin vm", err) {
+					return
+				}
+				action := strings.TrimSpace(req.FormValue("action"))
+				run, ok := adminVMActions[action]
+				if !ok {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Unknown VM action.",
+					})
+					return
+				}
+				ownership, err := lookupVMOwnership(name)
+				if errors.Is(err, virt.ErrVMNotFound) {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "VM not found.",
+					})
+					return
+				}
+				if err != nil && !errors.Is(err, virt.ErrUnowned) {
+					log.Printf("admin %s vm %q lookup failed: %v", action, name, err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to " + action + " VM.",
+					})
+					return
+				}
+
+				detail := map[string]string{"owner": ownership.Owner}
+				if err := run(name); err != nil {
+					log.Printf("admin %s vm %q failed: %v", action, name, err)
+					detail["error"] = err.Error()
+					recordAdminAction(auditLog, req, admin, "admin.vm."+action, name, detail)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to " + action + " VM.",
+					})
+					return
+				}
+				recordAdminAction(auditLog, req, admin, "admin.vm."+action, name, detail)
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "VM " + action + " requested.",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/admin/sessions/revoke", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				admin, ok := requireAdmin(w, req, sessionManager, settings)
+				if !ok {
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				username := strings.TrimSpace(req.FormValue("username"))
+				if username == "" {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Username is required.",
+					})
+					return
+				}
+
+				revoked, err := sessionManager.RevokeUser(username)
+				if err != nil {
+					log.Printf("revoke sessions of %s failed: %v", username, err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to revoke sessions.",
+					})
+					return
+				}
+				if revoked == 0 {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "User has no sessions.",
+					})
+					return
+				}
+
+				recordAdminAction(auditLog, req, admin, "admin.session.revoke", username, map[string]string{
+					"sessions": strconv.Itoa(revoked),
+				})
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: fmt.Sprintf("Revoked %d session(s) of %s.", revoked, username),
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/admin/mfa/reset", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+
+				admin, ok := requireAdmin(w, req, sessionManager, settings)
+				if !ok {
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				username := strings.TrimSpace(req.FormValue("username"))
+				if username == "" {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Username is required.",
+					})
+					return
+				}
+
+				removed, err := mfaStore.Reset(username)
+				if err != nil {
+					log.Printf("mfa reset for %s failed: %v", username, err)
+					writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+						OK:    false,
+						Error: "Failed to reset two-factor authentication.",
+					})
+					return
+				}
+				if !removed {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "User has no two-factor enrollment.",
+					})
+					return
+				}
+
+				log.Printf("mfa reset: admin=%s user=%s", admin.GetName(), username)
+				recordAdminAction(auditLog, req, admin, "admin.mfa.reset", username, nil)
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "Two-factor authentication reset for " + username + ".",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Get(group, "/admin/lockouts", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				if _, ok := requireAdmin(w, req, sessionManager, settings); !ok {
+					return
+				}
+				setNoCacheHeaders(w)
+				writeJSON(w, http.StatusOK, lockoutListResponse{Lockouts: limiter.List(time.Now())})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+
+	huma.Post(group, "/admin/lockouts/clear", func(_ context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{
+			Body: func(ctx huma.Context) {
+				req, w := humachi.Unwrap(ctx)
+				admin, ok := requireAdmin(w, req, sessionManager, settings)
+				if !ok {
+					return
+				}
+				if err := req.ParseForm(); err != nil {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Invalid form submission.",
+					})
+					return
+				}
+				key := strings.TrimSpace(req.FormValue("key"))
+				if key == "" {
+					writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+						OK:    false,
+						Error: "Lockout key is required.",
+					})
+					return
+				}
+				if !limiter.Clear(key) {
+					writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+						OK:    false,
+						Error: "No lockout found for " + key + ".",
+					})
+					return
+				}
+
+				log.Printf("lockout cleared: admin=%s key=%s", admin.GetName(), key)
+				recordAdminAction(auditLog, req, admin, "admin.lockout.clear", key, nil)
+				writeJSON(w, http.StatusOK, dashboardActionResponse{
+					OK:      true,
+					Message: "Lockout cleared for " + key + ".",
+				})
+			},
+		}, nil
+	}, func(op *huma.Operation) {
+		op.Hidden = true
+	})
+}
+
+func validateVMName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("VM name is required.")
+	}
+	if len(name) > 64 {
+		return "", fmt.Errorf("VM name is too long.")
+	}
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') ||
+			(r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') ||
+			r == '-' || r == '_' {
+			continue
+		}
+		return "", fmt.Errorf("VM name may only use letters, numbers, '-' or '_'.")
+	}
+	return name, nil
+}
+
+var errInvalidDashboardForm = errors.New("invalid form submission")
+
+func parseDashboardVMName(req *http.Request) (string, error) {
+	if err := req.ParseForm(); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidDashboardForm, err)
+	}
+	name := strings.TrimSpace(req.FormValue("vm_name"))
+	if name == "" {
+		return "", fmt.Errorf("VM name is required.")
+	}
+	if len(name) > 128 {
+		return "", fmt.Errorf("VM name is too long.")
+	}
+	return name, nil
+}
+
+func handleDashboardFormError(w http.ResponseWriter, action string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errInvalidDashboardForm) {
+		log.Printf("%s form parse failed: %v", action, err)
+		writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+			OK:    false,
+			Error: "Invalid form submission.",
+		})
+		return true
+	}
+	writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+		OK:    false,
+		Error: err.Error(),
+	})
+	return true
+}
+
+// acmeHTTPHandler answers the HTTP-01 challenges of cfg and redirects
+// everything else to HTTPS, as certmagic.HTTPS does on :80.
+func acmeHTTPHandler(cfg *certmagic.Config) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	for _, issuer := range cfg.Issuers {
+		if am, ok := issuer.(*certmagic.ACMEIssuer); ok {
+			return am.HTTPChallengeHandler(redirect)
+		}
+	}
+	return redirect
+}
+
+func newHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  2 * time.Minute,
+
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			_ = c.SetDeadline(time.Now().Add(8 * time.Hour))
+			return ctx
+		},
+	}
+}
+
+func main() {
 
 	//	fmt.Println(virt.ListVMs())
 
-	sessionManager := session.NewManager()
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], config.NewSettingType(false), os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	settings := config.NewSettingType(true)
+	if _, err := auth.FromSettings(settings); err != nil {
+		log.Fatalf("Invalid AUTH_BACKENDS: %v", err)
+	}
+	sessionManager, err := session.NewManagerFromSettings(settings)
+	if err != nil {
+		log.Fatalf("Failed to open session store: %v", err)
+	}
+	defer sessionManager.Close()
 
 	if err := virt.InitVirt(settings); err != nil {
 		log.Fatalf("Failed to initialize virtualization: %v", err)
 	}
+	if rows, err := listVMOwners(); err != nil {
+		log.Printf("Failed to check vm ownership: %v", err)
+	} else if migrations, skipped := planOwnerMigration(rows); len(migrations)+len(skipped) > 0 {
+		log.Printf("%d vms have no owner metadata and are hidden from users; run \"remotegateway vm migrate\"", len(migrations)+len(skipped))
+	}
 
-	mux := getRemoteGatewayRotuer(sessionManager, settings)
+	// Stopping the server also stops the background workers.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	mux := getRemoteGatewayRotuer(ctx, sessionManager, settings)
 
 	if settings.Has(config.ACME_DOMAINS) {
 
@@ -605,25 +1864,41 @@ func main() {
 		}
 
 		domainList := strings.Split(domains, ",")
-		log.Fatal(certmagic.HTTPS(domainList, mux))
+		if mode, _, _ := clientCertSettings(settings); mode == clientcert.ModeOff {
+			serveUntilDone(ctx, nil, func() error { return certmagic.HTTPS(domainList, mux) })
+			return
+		}
+		// certmagic.HTTPS owns its listener, so serve the managed
+		// certificates ourselves to add client certificate verification,
+		// with the :80 listener it would run for HTTP-01 challenges.
+		certmagic.DefaultACME.Agreed = true
+		acme := certmagic.NewDefault()
+		challengeSrv := &http.Server{
+			Addr:              ":80",
+			Handler:           acmeHTTPHandler(acme),
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       5 * time.Second,
+			WriteTimeout:      5 * time.Second,
+			IdleTimeout:       5 * time.Second,
+		}
+		go func() {
+			log.Fatal(challengeSrv.ListenAndServe())
+		}()
+		if err := acme.ManageSync(ctx, domainList); err != nil {
+			log.Fatalf("Failed to set up ACME certificates: %v", err)
+		}
+		tlsConfig, err := serverTLSConfig(settings, acme.TLSConfig())
+		if err != nil {
+			log.Fatalf("Invalid client certificate settings: %v", err)
+		}
+		srv := newHTTPServer(":443", mux, tlsConfig)
+		serveUntilDone(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
 	} else {
-
-		srv := &http.Server{
-			Addr:      ":8443",
-			Handler:   mux,
-			TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
-
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-			IdleTimeout:  2 * time.Minute,
-
-			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
-				_ = c.SetDeadline(time.Now().Add(8 * time.Hour))
-				return ctx
-			},
+		tlsConfig, err := serverTLSConfig(settings, nil)
+		if err != nil {
+			log.Fatalf("Invalid client certificate settings: %v", err)
 		}
+		srv := newHTTPServer(":8443", mux, tlsConfig)
 
 		certPath := "certs/server.crt"
 		keyPath := "certs/server.key"
@@ -633,6 +1908,27 @@ func main() {
 		}
 
 		log.Println("Starting RDP Gateway with LDAP auth on :443")
-		log.Fatal(srv.ListenAndServeTLS(certPath, keyPath))
+		serveUntilDone(ctx, srv, func() error { return srv.ListenAndServeTLS(certPath, keyPath) })
+	}
+}
+
+// serveUntilDone runs serve until it fails or ctx ends, then shuts srv down
+// when it is set.
+func serveUntilDone(ctx context.Context, srv *http.Server, serve func() error) {
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down")
+	if srv == nil {
+		return
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
 	}
 }
@@ -2,15 +2,63 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
+	"remotegateway/internal/audit"
 	"remotegateway/internal/contextKey"
+	"remotegateway/internal/quota"
+	"remotegateway/internal/virt"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestConverToInternServer(t *testing.T) {
+// stubVMOwners makes lookupVMOwnership answer from owners, keyed by VM name.
+// An empty owner stands for a domain without ownership metadata.
+func stubVMOwners(t *testing.T, owners map[string]string) {
+	t.Helper()
+	records := make(map[string]virt.Ownership, len(owners))
+	for name, owner := range owners {
+		records[name] = virt.Ownership{Owner: owner}
+	}
+	stubVMOwnership(t, records)
+}
+
+// stubVMOwnership backs lookupVMOwnership and setVMOwnership with records.
+// Like libvirt, each call is atomic on its own.
+func stubVMOwnership(t *testing.T, records map[string]virt.Ownership) {
+	t.Helper()
+	prevLookup, prevSet := lookupVMOwnership, setVMOwnership
+	var mu sync.Mutex
+	lookupVMOwnership = func(name string) (virt.Ownership, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		o, ok := records[name]
+		if !ok {
+			return virt.Ownership{}, virt.ErrVMNotFound
+		}
+		if o.Owner == "" {
+			return virt.Ownership{}, virt.ErrUnowned
+		}
+		o.Grants = slices.Clone(o.Grants)
+		return o, nil
+	}
+	setVMOwnership = func(name string, o virt.Ownership) error {
+		mu.Lock()
+		defer mu.Unlock()
+		records[name] = o
+		return nil
+	}
+	t.Cleanup(func() { lookupVMOwnership, setVMOwnership = prevLookup, prevSet })
+}
+
+func TestServerConverter(t *testing.T) {
 	t.Run("missing-auth-user", func(t *testing.T) {
-		got, err := converToInternServer(context.Background(), "alice-vm")
+		got, err := serverConverter(nil, &vmQuotas{})(context.Background(), "alice-vm")
 		if err == nil {
 			t.Fatalf("expected error for missing user")
 		}
@@ -24,7 +72,7 @@ func TestConverToInternServer(t *testing.T) {
 
 	t.Run("empty-host", func(t *testing.T) {
 		ctx := contextKey.WithAuthUser(context.Background(), "alice")
-		got, err := converToInternServer(ctx, "")
+		got, err := serverConverter(nil, &vmQuotas{})(ctx, "")
 		if err == nil {
 			t.Fatalf("expected error for empty host")
 		}
@@ -36,7 +84,8 @@ func TestConverToInternServer(t *testing.T) {
 		}
 	})
 
-	t.Run("prefix-allows", func(t *testing.T) {
+	t.Run("owner-allows", func(t *testing.T) {
+		stubVMOwners(t, map[string]string{"alice-vm": "alice"})
 		ctx := contextKey.WithAuthUser(context.Background(), "alice")
 		prev := getIPOfVm
 		called := ""
@@ -46,7 +95,7 @@ func TestConverToInternServer(t *testing.T) {
 		}
 		t.Cleanup(func() { getIPOfVm = prev })
 
-		got, err := converToInternServer(ctx, "alice-vm")
+		got, err := serverConverter(nil, &vmQuotas{})(ctx, "alice-vm")
 		if err != nil {
 			t.Fatalf("expected success, got %v", err)
 		}
@@ -58,7 +107,9 @@ func TestConverToInternServer(t *testing.T) {
 		}
 	})
 
-	t.Run("prefix-propagates-error", func(t *testing.T) {
+	t.Run("owner-propagates-error", func(t *testing.T) {
+		stubVMOwners(t, map[string]string{"alice-vm": "alice"})
+		stubListVMs(t, []virt.VMInfo{{Name: "alice-vm", Owner: "alice", State: "running"}})
 		ctx := contextKey.WithAuthUser(context.Background(), "alice")
 		prev := getIPOfVm
 		stubErr := errors.New("boom")
@@ -67,7 +118,7 @@ func TestConverToInternServer(t *testing.T) {
 		}
 		t.Cleanup(func() { getIPOfVm = prev })
 
-		got, err := converToInternServer(ctx, "alice-vm")
+		got, err := serverConverter(nil, &vmQuotas{})(ctx, "alice-vm")
 		if got != "" {
 			t.Fatalf("expected empty result, got %q", got)
 		}
@@ -76,17 +127,129 @@ func TestConverToInternServer(t *testing.T) {
 		}
 	})
 
-	t.Run("denies-non-prefix", func(t *testing.T) {
+	t.Run("denies-non-owner", func(t *testing.T) {
+		// The name prefix no longer grants access; only the recorded owner does.
+		stubVMOwners(t, map[string]string{"bob-vm": "bob", "alice-vm": "bob", "alice-old": "", "alice2-vm": "alice2"})
+		prev := getIPOfVm
+		getIPOfVm = func(vmName string) (string, error) {
+			t.Fatalf("unexpected ip lookup for %q", vmName)
+			return "", nil
+		}
+		t.Cleanup(func() { getIPOfVm = prev })
+
 		ctx := contextKey.WithAuthUser(context.Background(), "alice")
-		got, err := converToInternServer(ctx, "bob-vm")
-		if err == nil {
-			t.Fatalf("expected deny error")
+		for _, host := range []string{"bob-vm", "alice-vm", "alice-old", "alice2-vm", "missing"} {
+			got, err := serverConverter(nil, &vmQuotas{})(ctx, host)
+			if err == nil {
+				t.Fatalf("expected deny error for %q", host)
+			}
+			if got != "" {
+				t.Fatalf("expected empty result, got %q", got)
+			}
+			if !strings.Contains(err.Error(), "denying server") {
+				t.Fatalf("expected deny error, got %v", err)
+			}
 		}
-		if got != "" {
-			t.Fatalf("expected empty result, got %q", got)
+	})
+
+	t.Run("grant-allows-and-audits", func(t *testing.T) {
+		stubVMOwnership(t, map[string]virt.Ownership{"alice-vm": {
+			Owner:  "alice",
+			Grants: []virt.Grant{{Type: virt.GrantGroup, Name: "Support", Right: virt.RightConnect}},
+		}})
+		prev := getIPOfVm
+		getIPOfVm = func(string) (string, error) { return "10.0.0.5", nil }
+		t.Cleanup(func() { getIPOfVm = prev })
+		auditPath := filepath.Join(t.TempDir(), "audit.log")
+		convert := serverConverter(audit.NewLogger(auditPath), &vmQuotas{})
+
+		ctx := contextKey.WithAuthUser(context.Background(), "bob")
+		if _, err := convert(ctx, "alice-vm"); err == nil {
+			t.Fatalf("expected bob without groups to be denied")
+		}
+		if got, err := convert(contextKey.WithAuthGroups(ctx, []string{"support"}), "alice-vm"); err != nil || got != "10.0.0.5" {
+			t.Fatalf("expected group grant to allow bob, got %q %v", got, err)
 		}
-		if !strings.Contains(err.Error(), "denying server") {
-			t.Fatalf("expected deny error, got %v", err)
+		raw, err := os.ReadFile(auditPath)
+		if err != nil {
+			t.Fatalf("read audit log: %v", err)
+		}
+		var event audit.Event
+		if err := json.Unmarshal(raw, &event); err != nil {
+			t.Fatalf("decode audit event %q: %v", raw, err)
+		}
+		if event.Actor != "bob" || event.Action != "vm.connect" || event.Target != "alice-vm" || event.Detail["grantName"] != "Support" || event.Detail["owner"] != "alice" {
+			t.Fatalf("unexpected audit event %+v", event)
+		}
+	})
+
+	t.Run("starts-shut-off-vm", func(t *testing.T) {
+		stubVMOwnership(t, map[string]virt.Ownership{"alice-vm": {
+			Owner:  "alice",
+			Grants: []virt.Grant{{Type: virt.GrantUser, Name: "bob", Right: virt.RightConnect}},
+		}})
+		stubListVMs(t, []virt.VMInfo{{Name: "alice-vm", Owner: "alice", State: "shut off", VCPU: 2, MemoryMiB: 2048}})
+		prevIP, prevStart, prevPoll := getIPOfVm, startConnectVM, connectBootPoll
+		started := 0
+		startConnectVM = func(name string) error {
+			if name != "alice-vm" {
+				t.Fatalf("unexpected start of %q", name)
+			}
+			started++
+			return nil
+		}
+		lookups := 0
+		getIPOfVm = func(string) (string, error) {
+			lookups++
+			if started == 0 || lookups < 3 {
+				return "", errors.New("no IP addresses found")
+			}
+			return "10.0.0.5", nil
+		}
+		connectBootPoll = time.Millisecond
+		t.Cleanup(func() { getIPOfVm, startConnectVM, connectBootPoll = prevIP, prevStart, prevPoll })
+		auditPath := filepath.Join(t.TempDir(), "audit.log")
+		convert := serverConverter(audit.NewLogger(auditPath), &vmQuotas{})
+
+		// A connect grant does not allow starting the VM.
+		if _, err := convert(contextKey.WithAuthUser(context.Background(), "bob"), "alice-vm"); err == nil || started != 0 {
+			t.Fatalf("expected bob to fail without starting the vm, got %v after %d starts", err, started)
+		}
+		got, err := convert(contextKey.WithAuthUser(context.Background(), "alice"), "alice-vm")
+		if err != nil || got != "10.0.0.5" || started != 1 {
+			t.Fatalf("expected alice to start the vm and get its ip, got %q %v after %d starts", got, err, started)
+		}
+		raw, err := os.ReadFile(auditPath)
+		if err != nil {
+			t.Fatalf("read audit log: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+		var event audit.Event
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &event); err != nil {
+			t.Fatalf("decode audit event %q: %v", raw, err)
+		}
+		if event.Actor != "alice" || event.Action != "vm.connect_start" || event.Target != "alice-vm" {
+			t.Fatalf("unexpected audit event %+v", event)
+		}
+	})
+
+	t.Run("start-respects-quota", func(t *testing.T) {
+		stubVMOwners(t, map[string]string{"alice-vm": "alice"})
+		stubListVMs(t, []virt.VMInfo{
+			{Name: "alice-vm", Owner: "alice", State: "shut off", VCPU: 2, MemoryMiB: 2048},
+			{Name: "alice-dev", Owner: "alice", State: "running", VCPU: 2, MemoryMiB: 2048},
+		})
+		prevIP, prevStart := getIPOfVm, startConnectVM
+		getIPOfVm = func(string) (string, error) { return "", errors.New("no IP addresses found") }
+		startConnectVM = func(name string) error {
+			t.Fatalf("unexpected start of %q over quota", name)
+			return nil
+		}
+		t.Cleanup(func() { getIPOfVm, startConnectVM = prevIP, prevStart })
+
+		quotas := &vmQuotas{config: quota.Config{Default: quota.Limits{VCPU: 2}}}
+		if _, err := serverConverter(nil, quotas)(contextKey.WithAuthUser(context.Background(), "alice"), "alice-vm"); err == nil {
+			t.Fatalf("expected the connect to fail over quota")
 		}
 	})
 }
@@ -124,7 +124,7 @@ func TestAuthenticateNTLMAuthenticateSuccess(t *testing.T) {
 }
 
 func TestBasicAuthMiddlewareMissingCredentials(t *testing.T) {
-	auth := &ntlm.StaticAuth{}
+	auth := &ntlm.StaticAuth{Basic: &ntlm.BasicAuth{}}
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 
 	nextCalled := false
@@ -148,7 +148,7 @@ func TestBasicAuthMiddlewareMissingCredentials(t *testing.T) {
 }
 
 func TestBasicAuthMiddlewareChallenge(t *testing.T) {
-	auth := &ntlm.StaticAuth{}
+	auth := &ntlm.StaticAuth{Basic: &ntlm.BasicAuth{}}
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 	req.Header.Set("Authorization", "NTLM")
 
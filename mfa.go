@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+	"remotegateway/internal/totp"
+	"remotegateway/internal/types"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	mfaSetupSecretKey = "mfa_setup_secret"
+	mfaMaxAttempts    = 5
+)
+
+const mfaCodeForm = `<form method="post" action="/login/mfa">
+      <div class="field">
+        <label for="code">Authentication code</label>
+        <input id="code" name="code" inputmode="numeric" autocomplete="one-time-code" maxlength="16" required autofocus>
+      </div>
+      <button type="submit">Verify</button>
+    </form>`
+
+// completeLogin finishes a login after the first factor succeeded. Users with
+// a TOTP enrollment, or every user when MFA_REQUIRED is set, continue to the
+// second step before a session is created. The failed login counter of the
+// user is only cleared once the login is complete.
+func completeLogin(w http.ResponseWriter, r *http.Request, sessionManager *session.Manager, mfaStore *mfa.Store, limiter *lockout.Limiter, settings *config.SettingsType, user *types.User) {
+	enrolled, err := mfaStore.Enrolled(user.GetName())
+	if err != nil {
+		log.Printf("mfa lookup failed for %s: %v", user.GetName(), err)
+		serveLogin(w, settings, "Login failed.")
+		return
+	}
+
+	if !enrolled && !settings.IsTrue(config.MFA_REQUIRED) {
+		if err := sessionManager.CreateSession(r.Context(), user); err != nil {
+			log.Printf("session create failed for %s: %v", user.GetName(), err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+		limiter.Success(loginLimitUser(user.GetName()))
+		http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	if err := sessionManager.BeginPendingLogin(r.Context(), user); err != nil {
+		log.Printf("pending login failed for %s: %v", user.GetName(), err)
+		serveLogin(w, settings, "Login failed.")
+		return
+	}
+	http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+}
+
+// mfaUser returns the user for the second factor step: either a pending
+// login or a signed-in session that has not been verified yet.
+func mfaUser(sessionManager *session.Manager, r *http.Request) (*types.User, bool) {
+	if user, ok := sessionManager.PendingLogin(r.Context()); ok {
+		return user, true
+	}
+	if sessionManager.MFAVerified(r.Context()) {
+		return nil, false
+	}
+	return sessionManager.UserFromContext(r.Context())
+}
+
+func handleMFAGet(sessionManager *session.Manager, mfaStore *mfa.Store, settings *config.SettingsType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := mfaUser(sessionManager, r)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		enrolled, err := mfaStore.Enrolled(user.GetName())
+		if err != nil {
+			log.Printf("mfa lookup failed for %s: %v", user.GetName(), err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+		if enrolled {
+			serveMFAChallenge(w, "")
+			return
+		}
+		serveMFASetup(w, r, sessionManager, settings, user, "")
+	}
+}
+
+func handleMFAPost(sessionManager *session.Manager, mfaStore *mfa.Store, limiter *lockout.Limiter, settings *config.SettingsType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user, ok := mfaUser(sessionManager, r)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			serveMFAChallenge(w, "Invalid form submission.")
+			return
+		}
+		code := strings.TrimSpace(r.FormValue("code"))
+		now := time.Now()
+		clientIP := common.RemoteHost(r)
+
+		// Codes count against the same lockout as passwords, so knowing the
+		// password does not give unlimited guesses at the second factor.
+		if wait, locked := limiter.Check(loginLimitUser(user.GetName()), clientIP, now); locked {
+			log.Printf("mfa locked out: user=%s ip=%s retry_after=%s", user.GetName(), clientIP, wait.Truncate(time.Second))
+			sessionManager.ClearPendingLogin(ctx)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			serveLoginStatus(w, settings, http.StatusTooManyRequests, "Too many failed attempts. Try again later.")
+			return
+		}
+
+		enrolled, err := mfaStore.Enrolled(user.GetName())
+		if err != nil {
+			log.Printf("mfa lookup failed for %s: %v", user.GetName(), err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+
+		if enrolled {
+			usedRecovery, err := mfaStore.Verify(user.GetName(), code, now)
+			if err != nil {
+				if !errors.Is(err, mfa.ErrInvalidCode) {
+					log.Printf("mfa verify failed for %s: %v", user.GetName(), err)
+				}
+				recordMFAFailure(limiter, user, clientIP, now)
+				if mfaAttemptsExceeded(w, r, sessionManager, settings, user) {
+					return
+				}
+				serveMFAChallenge(w, "Invalid authentication code.")
+				return
+			}
+			if usedRecovery {
+				log.Printf("mfa recovery code used by %s", user.GetName())
+			}
+			if err := sessionManager.CreateVerifiedSession(ctx, user); err != nil {
+				log.Printf("session create failed for %s: %v", user.GetName(), err)
+				serveLogin(w, settings, "Login failed.")
+				return
+			}
+			limiter.Success(loginLimitUser(user.GetName()))
+			http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+			return
+		}
+
+		secret := sessionManager.GetString(ctx, mfaSetupSecretKey)
+		if secret == "" {
+			http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+			return
+		}
+		if _, ok := totp.Validate(secret, code, now); !ok {
+			recordMFAFailure(limiter, user, clientIP, now)
+			if mfaAttemptsExceeded(w, r, sessionManager, settings, user) {
+				return
+			}
+			serveMFASetup(w, r, sessionManager, settings, user, "Invalid authentication code.")
+			return
+		}
+
+		recoveryCodes, err := mfaStore.Enroll(user.GetName(), secret, now)
+		if err != nil {
+			log.Printf("mfa enroll failed for %s: %v", user.GetName(), err)
+			serveMFASetup(w, r, sessionManager, settings, user, "Failed to save two-factor enrollment.")
+			return
+		}
+		sessionManager.Remove(ctx, mfaSetupSecretKey)
+		if err := sessionManager.CreateVerifiedSession(ctx, user); err != nil {
+			log.Printf("session create failed for %s: %v", user.GetName(), err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+		limiter.Success(loginLimitUser(user.GetName()))
+		log.Printf("mfa enrolled: user=%s", user.GetName())
+		serveRecoveryCodes(w, recoveryCodes)
+	}
+}
+
+// recordMFAFailure counts a wrong TOTP or recovery code as a failed login.
+func recordMFAFailure(limiter *lockout.Limiter, user *types.User, clientIP string, now time.Time) {
+	if wait := limiter.Failure(loginLimitUser(user.GetName()), clientIP, now); wait > 0 {
+		log.Printf("mfa lockout: user=%s ip=%s duration=%s", user.GetName(), clientIP, wait)
+	}
+}
+
+// mfaAttemptsExceeded drops a pending login after too many wrong codes.
+func mfaAttemptsExceeded(w http.ResponseWriter, r *http.Request, sessionManager *session.Manager, settings *config.SettingsType, user *types.User) bool {
+	if sessionManager.RecordFailedMFA(r.Context()) < mfaMaxAttempts {
+		return false
+	}
+	sessionManager.ClearPendingLogin(r.Context())
+	log.Printf("mfa attempts exceeded for %s from %s", user.GetName(), r.RemoteAddr)
+	serveLogin(w, settings, "Too many invalid codes. Sign in again.")
+	return true
+}
+
+func serveMFASetup(w http.ResponseWriter, r *http.Request, sessionManager *session.Manager, settings *config.SettingsType, user *types.User, message string) {
+	secret := sessionManager.GetString(r.Context(), mfaSetupSecretKey)
+	if secret == "" {
+		generated, err := totp.GenerateSecret()
+		if err != nil {
+			log.Printf("mfa secret for %s: %v", user.GetName(), err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+		secret = generated
+		sessionManager.Put(r.Context(), mfaSetupSecretKey, secret)
+	}
+
+	uri := totp.KeyURI(settings.Get(config.MFA_ISSUER), user.GetName(), secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("mfa qr code for %s: %v", user.GetName(), err)
+		serveLogin(w, settings, "Login failed.")
+		return
+	}
+
+	content := `<p>Scan the QR code with your authenticator app, then enter the 6-digit code to finish setup.</p>` +
+		`<img class="mfa-qr" alt="Authenticator QR code" src="data:image/png;base64,` + base64.StdEncoding.EncodeToString(png) + `">` +
+		`<p>Setup key: <code id="mfa-secret">` + html.EscapeString(secret) + `</code></p>`
+	serveMFAPage(w, content, message, mfaCodeForm)
+}
+
+func serveMFAChallenge(w http.ResponseWriter, message string) {
+	content := `<p>Enter the 6-digit code from your authenticator app, or one of your recovery codes.</p>`
+	serveMFAPage(w, content, message, mfaCodeForm)
+}
+
+func serveRecoveryCodes(w http.ResponseWriter, codes []string) {
+	var b strings.Builder
+	b.WriteString(`<p>Two-factor authentication is enabled. Store these recovery codes somewhere safe; each one can be used once if you lose your authenticator.</p>`)
+	b.WriteString(`<ul class="recovery">`)
+	for _, code := range codes {
+		fmt.Fprintf(&b, `<li><code>%s</code></li>`, html.EscapeString(code))
+	}
+	b.WriteString(`</ul><a class="continue" href="/api/dashboard">Continue to dashboard</a>`)
+	serveMFAPage(w, b.String(), "", "")
+}
+
+func serveMFAPage(w http.ResponseWriter, content, message, form string) {
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	errorHTML := ""
+	if message != "" {
+		errorHTML = `<div class="error">` + html.EscapeString(message) + `</div>`
+	}
+	page := strings.Replace(mfaHTML, "{{CONTENT}}", content, 1)
+	page = strings.Replace(page, "{{ERROR}}", errorHTML, 1)
+	fmt.Fprint(w, strings.Replace(page, "{{FORM}}", form, 1))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/totp"
+)
+
+var mfaSecretPattern = regexp.MustCompile(`id="mfa-secret">([A-Z2-7]+)<`)
+
+// enrollTOTP completes the enrollment page for the current session and
+// returns the shared secret.
+func enrollTOTP(t *testing.T, env *oidcTestEnv) string {
+	t.Helper()
+	resp, err := env.client.Get(env.server.URL + "/login/mfa")
+	if err != nil {
+		t.Fatalf("mfa setup page: %v", err)
+	}
+	defer resp.Body.Close()
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read setup page: %v", err)
+	}
+	match := mfaSecretPattern.FindSubmatch(page)
+	if match == nil {
+		t.Fatalf("expected setup secret in page, got %q", page)
+	}
+	secret := string(match[1])
+
+	code, _ := totp.Code(secret, time.Now())
+	resp, body := env.postForm(t, "/login/mfa", url.Values{"code": {code}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `class="recovery"`) {
+		t.Fatalf("expected recovery codes after enrollment, got %d %q", resp.StatusCode, body)
+	}
+	return secret
+}
+
+func preEnroll(t *testing.T, username string) (string, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mfa.json")
+	t.Setenv(config.MFA_STORE_PATH, path)
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("secret: %v", err)
+	}
+	codes, err := mfa.NewStore(path).Enroll(username, secret, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	return secret, codes
+}
+
+func TestMFARequiredDefersSessionUntilEnrolled(t *testing.T) {
+	t.Setenv(config.MFA_REQUIRED, "true")
+	env := newOIDCTestEnv(t, "dave")
+
+	if loc := env.login(t); loc != "/login/mfa" {
+		t.Fatalf("expected second factor step, got %q", loc)
+	}
+	if _, ok := env.sessionManager.GetSessionFromUserName("dave"); ok {
+		t.Fatalf("expected no gateway session before the second factor")
+	}
+
+	resp, err := env.client.Get(env.server.URL + "/api/dashboard")
+	if err != nil {
+		t.Fatalf("dashboard: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/login" {
+		t.Fatalf("expected pending login to be sent to /login, got %q", resp.Request.URL.Path)
+	}
+
+	enrollTOTP(t, env)
+	if _, ok := env.sessionManager.GetSessionFromUserName("dave"); !ok {
+		t.Fatalf("expected session after enrollment")
+	}
+}
+
+func TestMFAChallengeLimitsAttemptsAndAcceptsRecoveryCode(t *testing.T) {
+	_, recoveryCodes := preEnroll(t, "erin")
+	// Wrong codes also count towards the login lockout; keep it out of the way.
+	t.Setenv(config.LOCKOUT_USER_THRESHOLD, "10")
+	env := newOIDCTestEnv(t, "erin")
+
+	if loc := env.login(t); loc != "/login/mfa" {
+		t.Fatalf("expected second factor step, got %q", loc)
+	}
+	for i := 1; i < mfaMaxAttempts; i++ {
+		_, body := env.postForm(t, "/login/mfa", url.Values{"code": {"000000"}})
+		if !strings.Contains(body, "Invalid authentication code.") {
+			t.Fatalf("attempt %d: expected invalid code message, got %q", i, body)
+		}
+	}
+	_, body := env.postForm(t, "/login/mfa", url.Values{"code": {"000000"}})
+	if !strings.Contains(body, "Too many invalid codes.") {
+		t.Fatalf("expected lockout message, got %q", body)
+	}
+
+	if loc := env.login(t); loc != "/login/mfa" {
+		t.Fatalf("expected second factor step, got %q", loc)
+	}
+	resp, _ := env.postForm(t, "/login/mfa", url.Values{"code": {recoveryCodes[0]}})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/api/dashboard" {
+		t.Fatalf("expected recovery code to complete login, got %d", resp.StatusCode)
+	}
+	sess, ok := env.sessionManager.GetSessionFromUserName("erin")
+	if !ok || !sess.MFAVerified {
+		t.Fatalf("expected verified session")
+	}
+}
+
+func TestAdminResetMFA(t *testing.T) {
+	secret, _ := preEnroll(t, "root-admin")
+	store := mfa.NewStore(config.NewSettingType(false).Get(config.MFA_STORE_PATH))
+	other, _ := totp.GenerateSecret()
+	if _, err := store.Enroll("frank", other, time.Now()); err != nil {
+		t.Fatalf("enroll frank: %v", err)
+	}
+	t.Setenv(config.ADMIN_USERS, "someone, Root-Admin")
+	env := newOIDCTestEnv(t, "root-admin")
+
+	env.login(t)
+	code, _ := totp.Code(secret, time.Now())
+	env.postForm(t, "/login/mfa", url.Values{"code": {code}})
+
+	resp, _ := env.postForm(t, "/api/admin/mfa/reset", url.Values{"username": {"frank"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected reset to succeed, got %d", resp.StatusCode)
+	}
+	if enrolled, _ := mfa.NewStore(config.NewSettingType(false).Get(config.MFA_STORE_PATH)).Enrolled("frank"); enrolled {
+		t.Fatalf("expected frank's enrollment to be removed")
+	}
+	resp, _ = env.postForm(t, "/api/admin/mfa/reset", url.Values{"username": {"frank"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing enrollment, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminResetMFARequiresAdmin(t *testing.T) {
+	env := newOIDCTestEnv(t, "mallory")
+	env.login(t)
+
+	resp, _ := env.postForm(t, "/api/admin/mfa/reset", url.Values{"username": {"frank"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin, got %d", resp.StatusCode)
+	}
+}
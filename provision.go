@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"remotegateway/internal/audit"
+	"remotegateway/internal/config"
+	"remotegateway/internal/jobs"
+	"remotegateway/internal/quota"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+)
+
+// jobQueueSize is how many provisioning jobs may wait for a worker.
+const jobQueueSize = 64
+
+// dashboardJob is a provisioning job as the dashboard shows it; the spec is
+// left out because it holds the cloud-init password hash.
+type dashboardJob struct {
+	ID        string      `json:"id"`
+	Owner     string      `json:"owner"`
+	VM        string      `json:"vm"`
+	Template  string      `json:"template"`
+	Size      string      `json:"size"`
+	State     string      `json:"state"`
+	Steps     []jobs.Step `json:"steps"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+}
+
+type dashboardJobsResponse struct {
+	Jobs  []dashboardJob `json:"jobs"`
+	Error string         `json:"error,omitempty"`
+}
+
+func newDashboardJob(job jobs.Job) dashboardJob {
+	return dashboardJob{
+		ID:        job.ID,
+		Owner:     job.Spec.Owner,
+		VM:        job.Spec.VMName,
+		Template:  job.Spec.Template,
+		Size:      job.Spec.Size.Name,
+		State:     job.State,
+		Steps:     job.Steps,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+}
+
+// provisionSteps returns the steps creating the VM of job. Tests replace it
+// to avoid libvirt.
+var provisionSteps = func(job jobs.Job, templates *virt.Catalog, settings *config.SettingsType) []jobs.StepFunc {
+	user := &types.User{
+		Name:                  job.Spec.Owner,
+		Groups:                job.Spec.Groups,
+		CloudInitPasswordHash: job.Spec.CloudInitPasswordHash,
+		SSHKeys:               job.Spec.SSHKeys,
+	}
+	tmpl, err := templates.Find(job.Spec.Template)
+	var build *virt.Build
+	if err == nil {
+		build, err = virt.NewBuild(job.Spec.Name, user, tmpl, job.Spec.Size, settings)
+	}
+	if err != nil {
+		// The template or disk mode changed since the job was queued.
+		return []jobs.StepFunc{{Name: "prepare", Run: func(context.Context) error { return err }}}
+	}
+
+	timeout := time.Duration(intSetting(settings, config.VM_READY_TIMEOUT_SECONDS, 1800)) * time.Second
+	withTimeout := func(step func(context.Context) error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return step(ctx)
+		}
+	}
+	// Once defined the VM is listed, so a failure is recorded on it.
+	markFailed := func(step func(context.Context) error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			err := step(ctx)
+			if err != nil && build.PhoneHome != nil {
+				if markErr := build.MarkFailed(); markErr != nil {
+					log.Printf("mark vm %q failed: %v", build.VMName, markErr)
+				}
+			}
+			return err
+		}
+	}
+	wait := jobs.StepFunc{Name: "wait for rdp", Run: markFailed(withTimeout(build.WaitForRDP))}
+	if build.PhoneHome != nil {
+		wait = jobs.StepFunc{Name: "wait for ready", Run: markFailed(withTimeout(build.WaitForReady))}
+	}
+	// A canceled or failed job removes the half-built VM, with the owner
+	// check of DestroyOld. A VM that booted is complete and kept, showing
+	// its failed readiness.
+	booted := false
+	start := func(ctx context.Context) error {
+		err := build.Start(ctx)
+		booted = err == nil
+		return err
+	}
+	cleanup := func(ctx context.Context) error {
+		if booted {
+			return nil
+		}
+		return build.DestroyOld(ctx)
+	}
+	return []jobs.StepFunc{
+		{Name: "destroy old", Run: build.DestroyOld},
+		{Name: "create disk", Run: build.CreateDisk, Cleanup: cleanup},
+		{Name: "seed iso", Run: build.CreateSeed},
+		{Name: "define", Run: build.Define},
+		{Name: "start", Run: markFailed(start)},
+		{Name: "wait for ip", Run: markFailed(withTimeout(build.WaitForIP))},
+		wait,
+	}
+}
+
+// startProvisioner opens the job store and starts the workers, which run
+// until ctx ends. It returns nil, refusing every VM creation, when the store
+// cannot be read.
+func startProvisioner(ctx context.Context, settings *config.SettingsType, templates *virt.Catalog) *jobs.Manager {
+	if templates == nil {
+		return nil
+	}
+	manager, err := jobs.Open(
+		settings.Get(config.JOB_STORE_PATH),
+		intSetting(settings, config.JOB_WORKERS, 2),
+		jobQueueSize,
+		func(job jobs.Job) []jobs.StepFunc { return provisionSteps(job, templates, settings) },
+	)
+	if err != nil {
+		log.Printf("job store: %v; refusing to create VMs", err)
+		return nil
+	}
+	manager.Start(ctx)
+	return manager
+}
+
+// pendingUsage sums the resources of the active jobs of username, leaving
+// out the VM named skip. Their VMs may not exist yet, so listVMs misses them.
+func pendingUsage(manager *jobs.Manager, username, skip string) quota.Usage {
+	var usage quota.Usage
+	for _, job := range manager.List(username) {
+		if !job.Active() || strings.EqualFold(job.Spec.VMName, skip) {
+			continue
+		}
+		usage = usage.Add(quota.Usage{
+			VMs:       1,
+			VCPU:      job.Spec.Size.VCPU,
+			MemoryMiB: job.Spec.Size.MemoryMiB,
+			DiskGB:    job.Spec.Size.DiskGB,
+		})
+	}
+	return usage
+}
+
+// checkReplaceable fails with virt.ErrNotOwner when the VM vmName exists and
+// is not owned by user. Lookup failures are left to the job, which checks
+// again before destroying anything.
+func checkReplaceable(user *types.User, vmName string) error {
+	ownership, err := lookupVMOwnership(vmName)
+	switch {
+	case err == nil && !ownership.OwnedBy(user.GetName()), errors.Is(err, virt.ErrUnowned):
+		return virt.ErrNotOwner
+	}
+	return nil
+}
+
+// writeSubmitError reports a failed job submission for vmName.
+func writeSubmitError(w http.ResponseWriter, vmName string, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrBusy):
+		writeJSON(w, http.StatusConflict, dashboardActionResponse{
+			OK:    false,
+			Error: "This VM is already being created.",
+		})
+	case errors.Is(err, jobs.ErrQueueFull):
+		writeJSON(w, http.StatusServiceUnavailable, dashboardActionResponse{
+			OK:    false,
+			Error: "Too many VMs are being created right now. Try again later.",
+		})
+	default:
+		log.Printf("queue vm %q failed: %v", vmName, err)
+		writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+			OK:    false,
+			Error: "Failed to create VM.",
+		})
+	}
+}
+
+// handlePhoneHome records the readiness a guest reports with the token of
+// its VM. Guests have no session, so the route is outside the API group.
+func handlePhoneHome(auditLog *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.PostFormValue("vm"))
+		status := strings.TrimSpace(r.PostFormValue("status"))
+		if status != virt.ReadinessReady && status != virt.ReadinessFailed {
+			http.Error(w, "status must be ready or failed", http.StatusBadRequest)
+			return
+		}
+		token := r.PostFormValue("token")
+		var refused, notProvisioning bool
+		recorded, err := updateVMOwnership(name, func(o *virt.Ownership) bool {
+			switch {
+			case !o.CheckPhoneHome(token):
+				refused = true
+				return false
+			case o.Readiness == status:
+				// Retries after a lost response repeat the report.
+				return false
+			case o.Readiness != virt.ReadinessProvisioning:
+				notProvisioning = true
+				return false
+			}
+			o.Readiness = status
+			return true
+		})
+		switch {
+		case err != nil && recorded:
+			log.Printf("phone-home record %q failed: %v", name, err)
+			http.Error(w, "record failed", http.StatusInternalServerError)
+			return
+		case err != nil && !errors.Is(err, virt.ErrVMNotFound) && !errors.Is(err, virt.ErrUnowned):
+			log.Printf("phone-home lookup %q failed: %v", name, err)
+			http.Error(w, "lookup failed", http.StatusInternalServerError)
+			return
+		case err != nil || refused:
+			log.Printf("phone-home for %q from %s refused", name, common.RemoteHost(r))
+			auditLog.Record(audit.Event{
+				Actor:  "guest",
+				Action: "vm.phone_home.denied",
+				Target: name,
+				Remote: common.RemoteHost(r),
+			})
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		case notProvisioning:
+			http.Error(w, "vm is not provisioning", http.StatusConflict)
+			return
+		case !recorded:
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		log.Printf("vm %q reported %s", name, status)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// jobActionError maps a cancel failure to a status and message.
+func jobActionError(err error) (int, string) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		return http.StatusNotFound, "Job not found."
+	case errors.Is(err, jobs.ErrFinished):
+		return http.StatusConflict, "Job already finished."
+	}
+	return http.StatusInternalServerError, "Failed to cancel job."
+}
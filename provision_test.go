@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/audit"
+	"remotegateway/internal/config"
+	"remotegateway/internal/jobs"
+	"remotegateway/internal/virt"
+)
+
+// stubProvisionSteps replaces the libvirt steps of provisioning jobs with a
+// single step waiting for release.
+func stubProvisionSteps(t *testing.T) chan struct{} {
+	t.Helper()
+	release := make(chan struct{})
+	prev := provisionSteps
+	provisionSteps = func(jobs.Job, *virt.Catalog, *config.SettingsType) []jobs.StepFunc {
+		return []jobs.StepFunc{{Name: "boot", Run: func(ctx context.Context) error {
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}}}
+	}
+	t.Cleanup(func() { provisionSteps = prev })
+	return release
+}
+
+func (e *oidcTestEnv) jobs(t *testing.T) dashboardJobsResponse {
+	t.Helper()
+	resp, err := e.client.Get(e.server.URL + "/api/dashboard/jobs")
+	if err != nil {
+		t.Fatalf("dashboard jobs: %v", err)
+	}
+	defer resp.Body.Close()
+	var data dashboardJobsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatalf("decode dashboard jobs: %v", err)
+	}
+	return data
+}
+
+func waitForJobState(t *testing.T, env *oidcTestEnv, id, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, job := range env.jobs(t).Jobs {
+			if job.ID == id && job.State == state {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s never reached %s: %+v", id, state, env.jobs(t))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCreateVMQueuesJob(t *testing.T) {
+	stubListVMs(t, nil)
+	stubVMOwners(t, map[string]string{"alice-old": "bob"})
+	release := stubProvisionSteps(t)
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"dev"}})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected the creation to be queued, got %d %q", resp.StatusCode, body)
+	}
+	var created dashboardActionResponse
+	if err := json.Unmarshal([]byte(body), &created); err != nil || !created.OK || created.JobID == "" {
+		t.Fatalf("unexpected create response %q: %v", body, err)
+	}
+
+	resp, body = env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"dev"}})
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(body, "already being created") {
+		t.Fatalf("expected a second job for the vm to be refused, got %d %q", resp.StatusCode, body)
+	}
+	resp, body = env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"old"}})
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(body, "already exists") {
+		t.Fatalf("expected another user's vm to be kept, got %d %q", resp.StatusCode, body)
+	}
+
+	list := env.jobs(t)
+	if len(list.Jobs) != 1 || list.Jobs[0].VM != "alice-dev" || list.Jobs[0].Template != "ubuntu-desktop" || len(list.Jobs[0].Steps) != 1 {
+		t.Fatalf("unexpected jobs %+v", list)
+	}
+	close(release)
+	waitForJobState(t, env, created.JobID, jobs.StateSucceeded)
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	t.Setenv(config.JOB_WORKERS, "1")
+	stubListVMs(t, nil)
+	stubVMOwners(t, nil)
+	release := stubProvisionSteps(t)
+	defer close(release)
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	var ids []string
+	for _, name := range []string{"first", "second"} {
+		resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {name}})
+		var created dashboardActionResponse
+		if resp.StatusCode != http.StatusAccepted || json.Unmarshal([]byte(body), &created) != nil {
+			t.Fatalf("create %s: %d %q", name, resp.StatusCode, body)
+		}
+		ids = append(ids, created.JobID)
+	}
+
+	resp, body := env.postForm(t, "/api/dashboard/jobs/cancel", url.Values{"job_id": {"missing"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown job to be missing, got %d %q", resp.StatusCode, body)
+	}
+	for _, id := range ids {
+		resp, body = env.postForm(t, "/api/dashboard/jobs/cancel", url.Values{"job_id": {id}})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("cancel %s: %d %q", id, resp.StatusCode, body)
+		}
+		waitForJobState(t, env, id, jobs.StateCanceled)
+	}
+	resp, body = env.postForm(t, "/api/dashboard/jobs/cancel", url.Values{"job_id": {ids[0]}})
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(body, "already finished") {
+		t.Fatalf("expected finished job to stay, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestQuotaCountsQueuedJobs(t *testing.T) {
+	t.Setenv(config.QUOTA_DEFAULT, "vms=1")
+	stubListVMs(t, nil)
+	stubVMOwners(t, nil)
+	release := stubProvisionSteps(t)
+	defer close(release)
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	if resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"first"}}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("create first: %d %q", resp.StatusCode, body)
+	}
+	resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"second"}})
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "VM quota is 1, 1 in use") {
+		t.Fatalf("expected the queued vm to count against the quota, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestPhoneHome(t *testing.T) {
+	token, hash, err := virt.NewPhoneHomeToken()
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	records := map[string]virt.Ownership{
+		"alice-dev": {Owner: "alice", Readiness: virt.ReadinessProvisioning, PhoneHomeHash: hash},
+		"alice-old": {Owner: "alice"},
+	}
+	stubVMOwnership(t, records)
+	handler := handlePhoneHome(audit.NewLogger(""))
+	report := func(vm, token, status string) int {
+		form := url.Values{"vm": {vm}, "token": {token}, "status": {status}}
+		req := httptest.NewRequest(http.MethodPost, virt.PhoneHomePath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	if code := report("alice-dev", token, "done"); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown status to be refused, got %d", code)
+	}
+	for _, vm := range []string{"alice-old", "missing"} {
+		if code := report(vm, token, virt.ReadinessReady); code != http.StatusForbidden {
+			t.Fatalf("%s: expected the token to be refused, got %d", vm, code)
+		}
+	}
+	if code := report("alice-dev", "wrong", virt.ReadinessReady); code != http.StatusForbidden || records["alice-dev"].Readiness != virt.ReadinessProvisioning {
+		t.Fatalf("expected a wrong token to be refused, got %d %+v", code, records["alice-dev"])
+	}
+	if code := report("alice-dev", token, virt.ReadinessReady); code != http.StatusOK || records["alice-dev"].Readiness != virt.ReadinessReady {
+		t.Fatalf("expected the vm to be ready, got %d %+v", code, records["alice-dev"])
+	}
+	if code := report("alice-dev", token, virt.ReadinessReady); code != http.StatusOK {
+		t.Fatalf("expected a repeated report to succeed, got %d", code)
+	}
+	if code := report("alice-dev", token, virt.ReadinessFailed); code != http.StatusConflict || records["alice-dev"].Readiness != virt.ReadinessReady {
+		t.Fatalf("expected a ready vm to stay ready, got %d %+v", code, records["alice-dev"])
+	}
+}
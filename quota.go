@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/quota"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
+)
+
+// vmQuotas checks VM creation and start against the quota settings.
+type vmQuotas struct {
+	config quota.Config
+	// err fails every check when the settings are invalid.
+	err error
+}
+
+type quotaReport struct {
+	Limits quota.Limits `json:"limits"`
+	Usage  quota.Usage  `json:"usage"`
+}
+
+func loadVMQuotas(settings *config.SettingsType) *vmQuotas {
+	c, err := quota.Parse(
+		settings.Get(config.QUOTA_DEFAULT),
+		settings.Get(config.QUOTA_GROUPS),
+		settings.Get(config.QUOTA_USERS),
+	)
+	if err != nil {
+		log.Printf("quota settings: %v; refusing to create or start VMs", err)
+	}
+	return &vmQuotas{config: c, err: err}
+}
+
+// vmHoldsResources reports whether a VM in state uses its vCPUs and memory.
+func vmHoldsResources(state string) bool {
+	switch strings.ToLower(strings.TrimSpace(state)) {
+	case "running", "paused", "suspended":
+		return true
+	}
+	return false
+}
+
+// quotaUsage sums the VMs owned by username, leaving out the VM named skip.
+func quotaUsage(vms []virt.VMInfo, username, skip string) quota.Usage {
+	var usage quota.Usage
+	for _, vm := range vms {
+		if vm.Name == skip || !strings.EqualFold(vm.Owner, username) {
+			continue
+		}
+		usage.VMs++
+		usage.DiskGB += vm.VolumeGB
+		if vmHoldsResources(vm.State) {
+			usage.VCPU += vm.VCPU
+			usage.MemoryMiB += vm.MemoryMiB
+		}
+	}
+	return usage
+}
+
+// report returns the quota and usage of user for the dashboard.
+func (q *vmQuotas) report(user *types.User, vms []virt.VMInfo) *quotaReport {
+	return &quotaReport{
+		Limits: q.config.For(user.GetName(), user.GetGroups()),
+		Usage:  quotaUsage(vms, user.GetName(), ""),
+	}
+}
+
+// checkCreate returns an error wrapping quota.ErrExceeded when user may not
+// create the VM name of size. A VM of the same name is replaced and not
+// counted. pending is the usage of VMs still being provisioned.
+func (q *vmQuotas) checkCreate(user *types.User, name string, size vmsize.Size, pending quota.Usage) error {
+	if q.err != nil {
+		return q.err
+	}
+	limits := q.config.For(user.GetName(), user.GetGroups())
+	if limits == (quota.Limits{}) {
+		return nil
+	}
+	vms, err := listVMs("")
+	if err != nil {
+		return err
+	}
+	usage := quotaUsage(vms, user.GetName(), virt.VMName(user.GetName(), name)).Add(pending)
+	return limits.Check(usage, quota.Usage{
+		VMs:       1,
+		VCPU:      size.VCPU,
+		MemoryMiB: size.MemoryMiB,
+		DiskGB:    size.DiskGB,
+	})
+}
+
+// checkStart returns an error wrapping quota.ErrExceeded when starting the
+// VM name would take its owner over quota. actor is the user starting it;
+// the groups of other owners are those recorded when the VM was created.
+func (q *vmQuotas) checkStart(actor *types.User, name string) error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.config.Unlimited() {
+		return nil
+	}
+	vms, err := listVMs("")
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if vm.Name != name {
+			continue
+		}
+		if vmHoldsResources(vm.State) || vm.Owner == "" {
+			return nil
+		}
+		groups := vm.OwnerGroups
+		if strings.EqualFold(vm.Owner, actor.GetName()) {
+			groups = actor.GetGroups()
+		}
+		usage := quotaUsage(vms, vm.Owner, "")
+		return q.config.For(vm.Owner, groups).Check(usage, quota.Usage{VCPU: vm.VCPU, MemoryMiB: vm.MemoryMiB})
+	}
+	return nil
+}
+
+// writeQuotaError reports a failed quota check of action.
+func writeQuotaError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, quota.ErrExceeded) {
+		log.Printf("%s refused: %v", action, err)
+		writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+			OK:    false,
+			Error: "Quota exceeded: " + strings.TrimPrefix(err.Error(), quota.ErrExceeded.Error()+": ") + ".",
+		})
+		return
+	}
+	log.Printf("%s quota check failed: %v", action, err)
+	writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+		OK:    false,
+		Error: "Unable to check your quota right now.",
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/quota"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
+)
+
+func stubListVMs(t *testing.T, vms []virt.VMInfo) {
+	t.Helper()
+	prev := listVMs
+	listVMs = func(string) ([]virt.VMInfo, error) { return vms, nil }
+	t.Cleanup(func() { listVMs = prev })
+}
+
+func TestQuotaUsage(t *testing.T) {
+	vms := []virt.VMInfo{
+		{Name: "alice-a", Owner: "alice", State: "running", VCPU: 4, MemoryMiB: 4096, VolumeGB: 40},
+		{Name: "alice-b", Owner: "alice", State: "shut off", VCPU: 2, MemoryMiB: 2048, VolumeGB: 20},
+		{Name: "bob-a", Owner: "bob", State: "running", VCPU: 4, MemoryMiB: 4096, VolumeGB: 40},
+	}
+	want := quota.Usage{VMs: 2, VCPU: 4, MemoryMiB: 4096, DiskGB: 60}
+	if got := quotaUsage(vms, "Alice", ""); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	want = quota.Usage{VMs: 1, DiskGB: 20}
+	if got := quotaUsage(vms, "alice", "alice-a"); got != want {
+		t.Fatalf("got %+v with alice-a skipped, want %+v", got, want)
+	}
+}
+
+func TestQuotaChecks(t *testing.T) {
+	t.Setenv(config.QUOTA_DEFAULT, "vms=2,vcpu=4")
+	t.Setenv(config.QUOTA_GROUPS, "staff:vms=5,vcpu=8")
+	stubListVMs(t, []virt.VMInfo{
+		{Name: "alice-dev", Owner: "alice", State: "running", VCPU: 4, MemoryMiB: 4096, VolumeGB: 40},
+		{Name: "alice-old", Owner: "alice", State: "shut off", VCPU: 4, MemoryMiB: 4096, VolumeGB: 40},
+		{Name: "carol-old", Owner: "carol", OwnerGroups: []string{"staff"}, State: "shut off", VCPU: 4, MemoryMiB: 4096, VolumeGB: 40},
+	})
+	quotas := loadVMQuotas(config.NewSettingType(false))
+	alice := &types.User{Name: "alice"}
+
+	if err := quotas.checkCreate(alice, "new", vmsize.Default, quota.Usage{}); !strings.Contains(err.Error(), "VM quota is 2") {
+		t.Fatalf("expected the VM count to be exceeded, got %v", err)
+	}
+	// Recreating an existing VM replaces it.
+	if err := quotas.checkCreate(alice, "old", vmsize.Default, quota.Usage{}); !strings.Contains(err.Error(), "vCPU quota is 4") {
+		t.Fatalf("expected only the vCPU quota to be exceeded, got %v", err)
+	}
+	if err := quotas.checkStart(alice, "alice-old"); err == nil {
+		t.Fatal("expected start to exceed the vCPU quota")
+	}
+	if err := quotas.checkStart(alice, "alice-dev"); err != nil {
+		t.Fatalf("expected a running vm to need nothing, got %v", err)
+	}
+	staff := &types.User{Name: "alice", Groups: []string{"staff"}}
+	if err := quotas.checkStart(staff, "alice-old"); err != nil {
+		t.Fatalf("expected the staff quota to allow the start, got %v", err)
+	}
+	// Another user starting carol's VM applies carol's recorded groups, not
+	// their own and not whether carol is logged in.
+	if err := quotas.checkStart(alice, "carol-old"); err != nil {
+		t.Fatalf("expected the owner's recorded staff quota, got %v", err)
+	}
+
+	t.Setenv(config.QUOTA_USERS, "alice")
+	if err := loadVMQuotas(config.NewSettingType(false)).checkCreate(alice, "new", vmsize.Default, quota.Usage{}); !errors.Is(err, quota.ErrInvalid) {
+		t.Fatalf("expected invalid settings to refuse creation, got %v", err)
+	}
+}
+
+func TestDashboardReportsAndEnforcesQuota(t *testing.T) {
+	t.Setenv(config.QUOTA_DEFAULT, "vms=1,memory=8192")
+	stubListVMs(t, []virt.VMInfo{
+		{Name: "alice-dev", Owner: "alice", State: "running", VCPU: 4, MemoryMiB: 4096, VolumeGB: 40},
+	})
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	resp, err := env.client.Get(env.server.URL + "/api/dashboard/data")
+	if err != nil {
+		t.Fatalf("dashboard data: %v", err)
+	}
+	var data dashboardDataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatalf("decode dashboard data: %v", err)
+	}
+	resp.Body.Close()
+	if data.Quota == nil || data.Quota.Limits != (quota.Limits{VMs: 1, MemoryMiB: 8192}) || data.Quota.Usage.VMs != 1 || data.Quota.Usage.MemoryMiB != 4096 {
+		t.Fatalf("unexpected quota report %+v", data.Quota)
+	}
+
+	resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"second"}})
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "Quota exceeded: VM quota is 1, 1 in use and 1 requested.") {
+		t.Fatalf("expected quota refusal, got %d %q", resp.StatusCode, body)
+	}
+}
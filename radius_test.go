@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/ntlm"
+	"remotegateway/internal/radius"
+	"remotegateway/internal/radius/radiustest"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+)
+
+// serveNTLMWithRadius sends a valid NTLM authenticate message for the seeded
+// static user through the gateway middleware with RADIUS approval enabled.
+func serveNTLMWithRadius(t *testing.T, radiusAddr string) (*httptest.ResponseRecorder, bool) {
+	t.Helper()
+	t.Setenv(config.RADIUS_SERVER, radiusAddr)
+	t.Setenv(config.RADIUS_SECRET, "s3cret")
+	t.Setenv(config.RADIUS_TIMEOUT_SECONDS, "2")
+	settings := config.NewSettingType(false)
+
+	sessionManager := session.NewManager()
+	domain := defaultNTLMDomain()
+	seedSession(t, sessionManager, ntlm.StaticUser, ntlm.StaticPassword, domain)
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	req := httptest.NewRequest(http.MethodGet, "https://gw.example.com/remoteDesktopGateway/", nil)
+	req.RemoteAddr = "10.1.2.3:50000"
+	auth := &ntlm.StaticAuth{
+		Challenges: map[string]ntlm.NtlmChallengeState{
+			ntlm.NtlmChallengeKey(req): {Challenge: challenge, IssuedAt: time.Now()},
+		},
+		SessionManager: sessionManager,
+		SecondFactor:   gatewaySecondFactor(settings),
+	}
+	ntResponse := ntlm.BuildTestNTLMv2Response(challenge, ntlm.StaticUser, domain, ntlm.StaticPassword)
+	msg := ntlm.BuildTestNTLMAuthenticateMessage(ntlm.StaticUser, domain, ntResponse, true)
+	req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(msg))
+
+	nextCalled := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+	})
+	rec := httptest.NewRecorder()
+	common.EnrichContext(ntlm.BasicAuthMiddleware(auth, next)).ServeHTTP(rec, req)
+	return rec, nextCalled
+}
+
+func TestGatewayRadiusApprovalAccepts(t *testing.T) {
+	server := radiustest.NewServer("s3cret", func(req radiustest.Request) radiustest.Reply {
+		if req.Username == ntlm.StaticUser && req.Password == "push" && req.CallingStationID == "10.1.2.3" {
+			return radiustest.Reply{Code: radius.CodeAccessAccept}
+		}
+		return radiustest.Reply{Code: radius.CodeAccessReject}
+	})
+	defer server.Close()
+
+	rec, nextCalled := serveNTLMWithRadius(t, server.Addr())
+	if !nextCalled {
+		t.Fatalf("expected approved connection to reach the gateway, got %d", rec.Code)
+	}
+	if len(server.Requests()) != 1 {
+		t.Fatalf("expected one RADIUS request, got %d", len(server.Requests()))
+	}
+}
+
+func TestGatewayRadiusApprovalRejects(t *testing.T) {
+	server := radiustest.NewServer("s3cret", func(radiustest.Request) radiustest.Reply {
+		return radiustest.Reply{Code: radius.CodeAccessReject, ReplyMessage: "push denied"}
+	})
+	defer server.Close()
+
+	rec, nextCalled := serveNTLMWithRadius(t, server.Addr())
+	if nextCalled {
+		t.Fatalf("expected rejected connection to be blocked")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestGatewaySecondFactorDisabledWithoutServer(t *testing.T) {
+	if sf := gatewaySecondFactor(config.NewSettingType(false)); sf != nil {
+		t.Fatalf("expected no second factor by default, got %T", sf)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"net/http"
 	"remotegateway/internal/config"
+	"remotegateway/internal/ldap"
 	"strings"
 )
 
@@ -82,7 +83,7 @@ func rdpFileContent(gatewayHost, targetHost string, settings *config.SettingsTyp
 	write("prompt for credentials:i:1")
 
 	write("username:s:" + username)
-	write("gatewayusername:s:" + settings.Get(config.NTLM_DOMAIN) + "\\" + username)
+	write("gatewayusername:s:" + ldap.GatewayDomain(settings) + "\\" + username)
 	//write("use redirection server name:i:1")
 	return b.String()
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/contextKey"
+	"remotegateway/internal/rdpgw/protocol"
+)
+
+// groupRedirect is one entry of REDIRECT_GROUPS.
+type groupRedirect struct {
+	group string
+	flags protocol.RedirectFlags
+}
+
+// redirectPolicy picks the device redirection of a tunnel from the groups
+// of its user.
+type redirectPolicy struct {
+	defaults protocol.RedirectFlags
+	groups   []groupRedirect
+}
+
+// loadRedirectPolicy reads REDIRECT_DEFAULT and REDIRECT_GROUPS. Invalid
+// settings disable every redirection.
+func loadRedirectPolicy(settings *config.SettingsType) *redirectPolicy {
+	p, err := parseRedirectPolicy(settings.Get(config.REDIRECT_DEFAULT), settings.Get(config.REDIRECT_GROUPS))
+	if err != nil {
+		log.Printf("redirect settings: %v; disabling device redirection", err)
+		return &redirectPolicy{defaults: protocol.RedirectFlags{DisableAll: true}}
+	}
+	return p
+}
+
+func parseRedirectPolicy(defaults, groups string) (*redirectPolicy, error) {
+	flags, err := protocol.ParseRedirectFlags(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", config.REDIRECT_DEFAULT, err)
+	}
+	p := &redirectPolicy{defaults: flags}
+	for _, entry := range strings.Split(groups, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		group, value, ok := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("%s: want group=flags, got %q", config.REDIRECT_GROUPS, entry)
+		}
+		flags, err := protocol.ParseRedirectFlags(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", config.REDIRECT_GROUPS, group, err)
+		}
+		p.groups = append(p.groups, groupRedirect{group: group, flags: flags})
+	}
+	return p, nil
+}
+
+// flagsFor returns the flags of the first configured group among groups,
+// and that group; the group is empty when the default applies.
+func (p *redirectPolicy) flagsFor(groups []string) (protocol.RedirectFlags, string) {
+	for _, entry := range p.groups {
+		for _, group := range groups {
+			if strings.EqualFold(entry.group, group) {
+				return entry.flags, entry.group
+			}
+		}
+	}
+	return p.defaults, ""
+}
+
+// tunnelSettings is the protocol.TunnelSettingsFunc applying the policy.
+func (p *redirectPolicy) tunnelSettings(ctx context.Context, client string) (*protocol.TunnelSettings, error) {
+	user, _ := contextKey.AuthUserFromContext(ctx)
+	groups, known := contextKey.AuthGroupsFromContext(ctx)
+	if !known && len(p.groups) > 0 {
+		// A restricted group must not get the default by its groups
+		// being unknown.
+		log.Printf("redirect for user=%s client=%q: groups unknown; disabling device redirection", user, client)
+		return &protocol.TunnelSettings{RedirectFlags: &protocol.RedirectFlags{DisableAll: true}}, nil
+	}
+	flags, group := p.flagsFor(groups)
+	source := "default"
+	if group != "" {
+		source = "group " + group
+	}
+	log.Printf("redirect for user=%s client=%q: %s from %s", user, client, flags, source)
+	return &protocol.TunnelSettings{RedirectFlags: &flags}, nil
+}
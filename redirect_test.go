@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"remotegateway/internal/clientcert"
+	"remotegateway/internal/config"
+	"remotegateway/internal/contextKey"
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/ntlm"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/rdpgw/protocol"
+	"remotegateway/internal/session"
+	"remotegateway/internal/types"
+)
+
+func TestRedirectPolicyByGroup(t *testing.T) {
+	p, err := parseRedirectPolicy("all", "contractors=none; staff=clipboard,printer")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	tests := []struct {
+		groups []string
+		want   string
+		group  string
+	}{
+		{groups: nil, want: "all"},
+		{groups: []string{"Staff"}, want: "clipboard,printer", group: "staff"},
+		{groups: []string{"staff", "contractors"}, want: "none", group: "contractors"},
+	}
+	for _, tt := range tests {
+		flags, group := p.flagsFor(tt.groups)
+		if flags.String() != tt.want || group != tt.group {
+			t.Fatalf("groups %v: got %s from %q, want %s from %q", tt.groups, flags, group, tt.want, tt.group)
+		}
+	}
+
+	ctx := contextKey.WithAuthGroups(contextKey.WithAuthUser(context.Background(), "carol"), []string{"contractors"})
+	settings, err := p.tunnelSettings(ctx, "laptop")
+	if err != nil || settings.RedirectFlags == nil || !settings.RedirectFlags.DisableAll {
+		t.Fatalf("expected redirection disabled for contractors, got %+v %v", settings, err)
+	}
+}
+
+type groupAuthenticator map[string][]string
+
+func (a groupAuthenticator) Authenticate(username, password string) (*types.User, error) {
+	user, err := types.NewUser(username, password, "vdi")
+	if err != nil {
+		return nil, err
+	}
+	user.Groups = a[username]
+	return user, nil
+}
+
+func TestRedirectPolicyForTunnelWithoutWebSession(t *testing.T) {
+	t.Setenv(config.GATEWAY_BASIC_AUTH, "true")
+	p, err := parseRedirectPolicy("all", "contractors=none")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	settings := config.NewSettingType(false)
+	auth := &ntlm.StaticAuth{
+		SessionManager:   session.NewManager(),
+		ClientCertMode:   clientcert.ModeOptional,
+		ClientCertMapper: clientcert.Mapper{Sources: []string{clientcert.SourceUPN}, Domains: []string{"corp.example.com"}},
+		Basic:            gatewayBasicAuth(mfa.NewStore(t.TempDir()+"/mfa.json"), groupAuthenticator{"carol": {"contractors"}}, settings),
+	}
+	serve := func(req *http.Request) protocol.RedirectFlags {
+		t.Helper()
+		var flags protocol.RedirectFlags
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tunnel, err := p.tunnelSettings(r.Context(), "laptop")
+			if err != nil {
+				t.Fatalf("tunnel settings: %v", err)
+			}
+			flags = *tunnel.RedirectFlags
+		})
+		rec := httptest.NewRecorder()
+		common.EnrichContext(ntlm.BasicAuthMiddleware(auth, next)).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected the tunnel to be authenticated, got status %d", rec.Code)
+		}
+		return flags
+	}
+
+	// The directory login reveals the groups.
+	req := httptest.NewRequest(http.MethodGet, "https://gw.example.com/remoteDesktopGateway/", nil)
+	req.SetBasicAuth("carol", "secret")
+	if flags := serve(req); !flags.DisableAll {
+		t.Fatalf("expected no redirection for a contractor, got %s", flags)
+	}
+
+	// A certificate login without a web session has no known groups.
+	req = httptest.NewRequest(http.MethodGet, "https://gw.example.com/remoteDesktopGateway/", nil)
+	presentClientCert(t, req, "carol")
+	if flags := serve(req); !flags.DisableAll {
+		t.Fatalf("expected unknown groups to disable redirection, got %s", flags)
+	}
+
+	auth.Groups = func(user string) ([]string, bool) { return []string{"staff"}, user == "carol" }
+	if flags := serve(req); flags.String() != "all" {
+		t.Fatalf("expected the looked up groups to apply, got %s", flags)
+	}
+}
+
+func TestRedirectPolicyInvalidSettings(t *testing.T) {
+	for _, groups := range []string{"contractors", "=all", "staff=webcam"} {
+		if _, err := parseRedirectPolicy("all", groups); err == nil {
+			t.Fatalf("expected %q to be rejected", groups)
+		}
+	}
+
+	t.Setenv(config.REDIRECT_DEFAULT, "everything")
+	p := loadRedirectPolicy(config.NewSettingType(false))
+	if flags, _ := p.flagsFor([]string{"staff"}); !flags.DisableAll {
+		t.Fatalf("expected invalid settings to disable redirection, got %s", flags)
+	}
+}
+
+func TestGatewayPolicyOverridesGroupRedirect(t *testing.T) {
+	t.Setenv(config.GATEWAY_POLICY_PATH, writeGatewayPolicy(t, gatewayPolicyYAML))
+	redirects, err := parseRedirectPolicy("none", "ops=drive;lab=printer")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	conf := &protocol.ServerConf{TunnelSettingsFunc: redirects.tunnelSettings}
+	loadGatewayPolicy(config.NewSettingType(false), nil).apply(conf)
+
+	// The ops rule sets its own redirect flags.
+	opsCtx := contextKey.WithAuthGroups(contextKey.WithAuthUser(context.Background(), "bob"), []string{"ops"})
+	settings, err := conf.TunnelSettingsFunc(opsCtx, "laptop")
+	if err != nil || settings.RedirectFlags.String() != "clipboard" || settings.IdleTimeout != 10 {
+		t.Fatalf("expected the policy rule to win, got %+v %v", settings, err)
+	}
+
+	// No rule applies to alice before she names a target, so her group decides.
+	aliceCtx := contextKey.WithAuthGroups(contextKey.WithAuthUser(context.Background(), "alice"), []string{"lab"})
+	settings, err = conf.TunnelSettingsFunc(aliceCtx, "laptop")
+	if err != nil || settings.RedirectFlags.String() != "printer" {
+		t.Fatalf("expected the group redirect, got %+v %v", settings, err)
+	}
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"remotegateway/internal/config"
 	"remotegateway/internal/session"
 	"testing"
+	"time"
 )
 
 func TestGetRemoteGatewayRotuerHealth(t *testing.T) {
 	settings := config.NewSettingType(false)
-	handler := getRemoteGatewayRotuer(session.NewManager(), settings)
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), settings)
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/health", nil)
 	rec := httptest.NewRecorder()
 
@@ -26,7 +30,7 @@ func TestGetRemoteGatewayRotuerHealth(t *testing.T) {
 
 func TestGetRemoteGatewayRotuerRDPFile(t *testing.T) {
 	settings := config.NewSettingType(false)
-	handler := getRemoteGatewayRotuer(session.NewManager(), settings)
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), settings)
 	req := httptest.NewRequest(http.MethodGet, "http://gw.example.com:8443/api/rdpgw.rdp", nil)
 	req.Host = "gw.example.com:8443"
 	rec := httptest.NewRecorder()
@@ -43,7 +47,7 @@ func TestGetRemoteGatewayRotuerRDPFile(t *testing.T) {
 
 func TestGetRemoteGatewayRotuerRoot(t *testing.T) {
 	settings := config.NewSettingType(false)
-	handler := getRemoteGatewayRotuer(session.NewManager(), settings)
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), settings)
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 	rec := httptest.NewRecorder()
 
@@ -59,7 +63,7 @@ func TestGetRemoteGatewayRotuerRoot(t *testing.T) {
 
 func TestGetRemoteGatewayRotuerNotFound(t *testing.T) {
 	settings := config.NewSettingType(false)
-	handler := getRemoteGatewayRotuer(session.NewManager(), settings)
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), settings)
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/not-found", nil)
 	rec := httptest.NewRecorder()
 
@@ -72,7 +76,7 @@ func TestGetRemoteGatewayRotuerNotFound(t *testing.T) {
 
 func TestGetRemoteGatewayRotuerGatewayRoute(t *testing.T) {
 	settings := config.NewSettingType(false)
-	handler := getRemoteGatewayRotuer(session.NewManager(), settings)
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), settings)
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/remoteDesktopGateway/", nil)
 	rec := httptest.NewRecorder()
 
@@ -96,3 +100,32 @@ func TestGetRemoteGatewayRotuerGatewayRoute(t *testing.T) {
 		t.Fatalf("expected NTLM and Negotiate challenges, got %v", values)
 	}
 }
+
+func TestServeUntilDoneShutsDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		serveUntilDone(ctx, srv, func() error {
+			err := srv.Serve(ln)
+			served <- err
+			return err
+		})
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to shut down with its context")
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("expected the server to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"remotegateway/internal/audit"
+	"remotegateway/internal/rdpgw/common"
+	"remotegateway/internal/session"
+	"remotegateway/internal/virt"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/adapters/humachi"
+)
+
+// vmActor is the user acting on a VM.
+type vmActor struct {
+	Name   string
+	Groups []string
+	Remote string
+}
+
+// authorizeVM returns nil when actor owns the VM name or holds right through
+// a grant in its libvirt metadata. Access through a grant is recorded in the
+// audit log as action. Domains without metadata are refused until migrated.
+func authorizeVM(auditLog *audit.Logger, actor vmActor, name, right, action string) error {
+	ownership, err := lookupVMOwnership(name)
+	if err != nil {
+		return err
+	}
+	grant, ok := ownership.Access(actor.Name, actor.Groups, right)
+	if !ok {
+		return virt.ErrNotOwner
+	}
+	if grant != nil {
+		auditLog.Record(audit.Event{
+			Actor:  strings.ToLower(actor.Name),
+			Action: action,
+			Target: name,
+			Remote: actor.Remote,
+			Detail: map[string]string{
+				"owner":     ownership.Owner,
+				"grantType": grant.Type,
+				"grantName": grant.Name,
+				"right":     grant.Right,
+			},
+		})
+	}
+	return nil
+}
+
+// requireVMAccess writes an error unless the caller holds right on the VM
+// name. VMs the caller cannot see are reported as missing so their names do
+// not leak.
+func requireVMAccess(ctx huma.Context, sessionManager *session.Manager, auditLog *audit.Logger, name, right, action string) bool {
+	req, w := humachi.Unwrap(ctx)
+	user, ok := sessionManager.UserFromContext(ctx.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, dashboardActionResponse{
+			OK:    false,
+			Error: "Login required.",
+		})
+		return false
+	}
+	actor := vmActor{Name: user.GetName(), Groups: user.GetGroups(), Remote: common.RemoteHost(req)}
+	err := authorizeVM(auditLog, actor, name, right, action)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, virt.ErrNotOwner) && right != virt.RightConnect && canConnectVM(actor, name):
+		log.Printf("vm action denied: user=%s vm=%s right=%s", actor.Name, name, right)
+		writeJSON(w, http.StatusForbidden, dashboardActionResponse{
+			OK:    false,
+			Error: "You do not have permission for this action on the VM.",
+		})
+	case errors.Is(err, virt.ErrVMNotFound), errors.Is(err, virt.ErrNotOwner), errors.Is(err, virt.ErrUnowned):
+		log.Printf("vm access denied: user=%s vm=%s: %v", actor.Name, name, err)
+		writeJSON(w, http.StatusNotFound, dashboardActionResponse{
+			OK:    false,
+			Error: "VM not found.",
+		})
+	default:
+		log.Printf("vm ownership lookup %q failed: %v", name, err)
+		writeJSON(w, http.StatusInternalServerError, dashboardActionResponse{
+			OK:    false,
+			Error: "Unable to check VM ownership.",
+		})
+	}
+	return false
+}
+
+// canConnectVM reports whether the VM is visible to actor, without auditing.
+func canConnectVM(actor vmActor, name string) bool {
+	ownership, err := lookupVMOwnership(name)
+	if err != nil {
+		return false
+	}
+	_, ok := ownership.Access(actor.Name, actor.Groups, virt.RightConnect)
+	return ok
+}
+
+var (
+	errInvalidGrant = errors.New("invalid grant")
+	errGrantToOwner = errors.New("grant to the owner")
+)
+
+// parseVMGrant reads the share form. revoke forms carry no right.
+func parseVMGrant(req *http.Request, grantedBy string, revoke bool) (string, virt.Grant, error) {
+	name, err := parseDashboardVMName(req)
+	if err != nil {
+		return "", virt.Grant{}, err
+	}
+	right := req.FormValue("right")
+	if revoke {
+		right = virt.RightConnect
+	}
+	grant, err := virt.NewGrant(req.FormValue("type"), req.FormValue("name"), right, grantedBy, time.Now())
+	if err != nil {
+		return "", virt.Grant{}, fmt.Errorf("%w: %v", errInvalidGrant, err)
+	}
+	if grant.Type == virt.GrantUser && strings.EqualFold(grant.Name, grantedBy) {
+		return "", virt.Grant{}, errGrantToOwner
+	}
+	return name, grant, nil
+}
+
+// handleShareFormError writes the message for a share form error and
+// reports whether there was one.
+func handleShareFormError(w http.ResponseWriter, action string, err error) bool {
+	var message string
+	switch {
+	case errors.Is(err, errInvalidGrant):
+		message = "Choose a user or group and a connect or manage right."
+	case errors.Is(err, errGrantToOwner):
+		message = "You already own this VM."
+	default:
+		return handleDashboardFormError(w, action, err)
+	}
+	writeJSON(w, http.StatusBadRequest, dashboardActionResponse{
+		OK:    false,
+		Error: message,
+	})
+	return true
+}
+
+// updateVMOwnership applies change to the recorded ownership of the VM name
+// under the lock of virt.UpdateOwnership, so grant, keep-running and
+// readiness changes do not overwrite each other.
+func updateVMOwnership(name string, change func(*virt.Ownership) bool) (bool, error) {
+	defer virt.LockOwnership()()
+	ownership, err := lookupVMOwnership(name)
+	if err != nil {
+		return false, err
+	}
+	if !change(&ownership) {
+		return false, nil
+	}
+	return true, setVMOwnership(name, ownership)
+}
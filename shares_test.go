@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/virt"
+)
+
+func TestDashboardShareAndUnshare(t *testing.T) {
+	t.Setenv(config.AUDIT_LOG_PATH, filepath.Join(t.TempDir(), "audit.log"))
+	records := map[string]virt.Ownership{
+		"alice-vm": {Owner: "alice"},
+		"bob-vm": {Owner: "bob", Grants: []virt.Grant{
+			{Type: virt.GrantUser, Name: "alice", Right: virt.RightConnect},
+		}},
+	}
+	stubVMOwnership(t, records)
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	share := url.Values{"vm_name": {"alice-vm"}, "type": {"user"}, "name": {"Dave"}, "right": {"manage"}}
+	if resp, body := env.postForm(t, "/api/dashboard/share", share); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected share to succeed, got %d %q", resp.StatusCode, body)
+	}
+	grants := records["alice-vm"].Grants
+	if len(grants) != 1 || grants[0].Name != "dave" || grants[0].Right != virt.RightManage || grants[0].GrantedBy != "alice" {
+		t.Fatalf("unexpected grants %+v", grants)
+	}
+
+	bad := url.Values{"vm_name": {"alice-vm"}, "type": {"user"}, "name": {"dave"}, "right": {"owner"}}
+	if resp, body := env.postForm(t, "/api/dashboard/share", bad); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "Choose a user or group") {
+		t.Fatalf("expected owner right to be refused, got %d %q", resp.StatusCode, body)
+	}
+	// A connect grant does not allow resharing or power actions, and VMs
+	// without any access look missing.
+	share.Set("vm_name", "bob-vm")
+	if resp, _ := env.postForm(t, "/api/dashboard/share", share); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected share of a granted vm to be forbidden, got %d", resp.StatusCode)
+	}
+	if resp, _ := env.postForm(t, "/api/dashboard/shutdown", url.Values{"vm_name": {"bob-vm"}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected shutdown with a connect grant to be forbidden, got %d", resp.StatusCode)
+	}
+	share.Set("vm_name", "carol-vm")
+	if resp, _ := env.postForm(t, "/api/dashboard/share", share); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown vm to be reported missing, got %d", resp.StatusCode)
+	}
+
+	unshare := url.Values{"vm_name": {"alice-vm"}, "type": {"user"}, "name": {"dave"}}
+	if resp, body := env.postForm(t, "/api/dashboard/unshare", unshare); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected unshare to succeed, got %d %q", resp.StatusCode, body)
+	}
+	if len(records["alice-vm"].Grants) != 0 {
+		t.Fatalf("expected grant to be removed, got %+v", records["alice-vm"].Grants)
+	}
+	if resp, _ := env.postForm(t, "/api/dashboard/unshare", unshare); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected second unshare to report no grant, got %d", resp.StatusCode)
+	}
+}
+
+func TestConcurrentShareAndKeepRunning(t *testing.T) {
+	t.Setenv(config.AUDIT_LOG_PATH, filepath.Join(t.TempDir(), "audit.log"))
+	records := map[string]virt.Ownership{"alice-vm": {Owner: "alice"}}
+	stubVMOwnership(t, records)
+	// Widen the window between reading and writing the metadata.
+	lookup := lookupVMOwnership
+	lookupVMOwnership = func(name string) (virt.Ownership, error) {
+		o, err := lookup(name)
+		time.Sleep(time.Millisecond)
+		return o, err
+	}
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+	csrf := env.csrfToken(t)
+
+	post := func(path string, form url.Values) {
+		req, err := http.NewRequest(http.MethodPost, env.server.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Errorf("new request %s: %v", path, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(csrfHeader, csrf)
+		resp, err := env.client.Do(req)
+		if err != nil {
+			t.Errorf("post %s: %v", path, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("post %s %v: got %d", path, form, resp.StatusCode)
+		}
+	}
+
+	const shares = 20
+	var wg sync.WaitGroup
+	for i := 0; i < shares; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			post("/api/dashboard/share", url.Values{"vm_name": {"alice-vm"}, "type": {"user"}, "name": {fmt.Sprintf("user%d", i)}, "right": {"connect"}})
+		}()
+		go func() {
+			defer wg.Done()
+			post("/api/dashboard/keep-running", url.Values{"vm_name": {"alice-vm"}, "keep": {fmt.Sprint(i%2 == 0)}})
+		}()
+	}
+	wg.Wait()
+
+	// A keep-running toggle must neither drop a new grant nor bring back
+	// an old one.
+	if got := len(records["alice-vm"].Grants); got != shares {
+		t.Fatalf("expected %d grants, got %d", shares, got)
+	}
+}
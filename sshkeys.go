@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"remotegateway/internal/sshkeys"
+	"remotegateway/internal/types"
+)
+
+// SSH key sources shown on the dashboard.
+const (
+	// sshKeySourceDirectory keys are read from LDAP at login and can only be
+	// changed in the directory.
+	sshKeySourceDirectory = "directory"
+	sshKeySourceDashboard = "dashboard"
+)
+
+type sshKeyView struct {
+	Fingerprint string     `json:"fingerprint"`
+	Type        string     `json:"type"`
+	Comment     string     `json:"comment,omitempty"`
+	Source      string     `json:"source"`
+	AddedAt     *time.Time `json:"addedAt,omitempty"`
+}
+
+type sshKeyListResponse struct {
+	Keys  []sshKeyView `json:"keys"`
+	Error string       `json:"error,omitempty"`
+}
+
+func newSSHKeyView(key sshkeys.Key, source string) sshKeyView {
+	view := sshKeyView{
+		Fingerprint: key.Fingerprint,
+		Type:        key.Type,
+		Comment:     key.Comment,
+		Source:      source,
+	}
+	if !key.AddedAt.IsZero() {
+		added := key.AddedAt
+		view.AddedAt = &added
+	}
+	return view
+}
+
+// sshKeyViews lists the directory keys of user followed by the extra keys.
+func sshKeyViews(user *types.User, extra []sshkeys.Key) []sshKeyView {
+	directory, _ := sshkeys.ParseAll(user.GetSSHKeys())
+	views := make([]sshKeyView, 0, len(directory)+len(extra))
+	for _, key := range directory {
+		views = append(views, newSSHKeyView(key, sshKeySourceDirectory))
+	}
+	for _, key := range extra {
+		views = append(views, newSSHKeyView(key, sshKeySourceDashboard))
+	}
+	return views
+}
+
+// authorizedKeys returns the keys authorized in new VMs of user: the keys
+// from the directory and those added on the dashboard.
+func authorizedKeys(user *types.User, store *sshkeys.Store) ([]string, error) {
+	extra, err := store.List(user.GetName())
+	if err != nil {
+		return nil, err
+	}
+	keys, _ := sshkeys.ParseAll(append(append([]string(nil), user.GetSSHKeys()...), sshkeys.Lines(extra)...))
+	return sshkeys.Lines(keys), nil
+}
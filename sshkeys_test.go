@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/jobs"
+	"remotegateway/internal/sshkeys"
+	"remotegateway/internal/types"
+	"remotegateway/internal/virt"
+)
+
+func newTestSSHKey(t *testing.T, comment string) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh key: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+}
+
+func (e *oidcTestEnv) sshKeys(t *testing.T) sshKeyListResponse {
+	t.Helper()
+	resp, err := e.client.Get(e.server.URL + "/api/dashboard/ssh-keys")
+	if err != nil {
+		t.Fatalf("ssh keys: %v", err)
+	}
+	defer resp.Body.Close()
+	var data sshKeyListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatalf("decode ssh keys: %v", err)
+	}
+	return data
+}
+
+func TestSSHKeysAreAuthorizedInNewVMs(t *testing.T) {
+	stubListVMs(t, nil)
+	stubVMOwners(t, nil)
+	specs := make(chan jobs.Spec, 1)
+	prev := provisionSteps
+	provisionSteps = func(job jobs.Job, _ *virt.Catalog, _ *config.SettingsType) []jobs.StepFunc {
+		specs <- job.Spec
+		return nil
+	}
+	t.Cleanup(func() { provisionSteps = prev })
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	key := newTestSSHKey(t, "alice@laptop")
+	if resp, _ := env.postForm(t, "/api/dashboard/ssh-keys", url.Values{"key": {key}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected adding keys to require mfa, got %d", resp.StatusCode)
+	}
+	enrollTOTP(t, env)
+	if resp, body := env.postForm(t, "/api/dashboard/ssh-keys", url.Values{"key": {"ssh-rsa nope"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid key to be refused, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := env.postForm(t, "/api/dashboard/ssh-keys", url.Values{"key": {key}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("add key: %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := env.postForm(t, "/api/dashboard/ssh-keys", url.Values{"key": {key}}); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a duplicate key to be refused, got %d", resp.StatusCode)
+	}
+	list := env.sshKeys(t)
+	if len(list.Keys) != 1 || list.Keys[0].Source != sshKeySourceDashboard || list.Keys[0].Comment != "alice@laptop" {
+		t.Fatalf("unexpected keys %+v", list)
+	}
+
+	resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"dev"}})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("create: %d %q", resp.StatusCode, body)
+	}
+	if spec := <-specs; len(spec.SSHKeys) != 1 || spec.SSHKeys[0] != key {
+		t.Fatalf("expected the key in the job, got %q", spec.SSHKeys)
+	}
+
+	if resp, _ := env.postForm(t, "/api/dashboard/ssh-keys/remove", url.Values{"fingerprint": {"SHA256:missing"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown key to be missing, got %d", resp.StatusCode)
+	}
+	if resp, body := env.postForm(t, "/api/dashboard/ssh-keys/remove", url.Values{"fingerprint": {list.Keys[0].Fingerprint}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("remove key: %d %q", resp.StatusCode, body)
+	}
+	if list := env.sshKeys(t); len(list.Keys) != 0 {
+		t.Fatalf("expected no keys left, got %+v", list)
+	}
+}
+
+func TestAuthorizedKeysMergesDirectoryKeys(t *testing.T) {
+	store := sshkeys.NewStore(filepath.Join(t.TempDir(), "keys.json"))
+	directory, extra := newTestSSHKey(t, "directory"), newTestSSHKey(t, "extra")
+	user := &types.User{Name: "alice", SSHKeys: []string{directory}}
+	if _, err := store.Add("alice", extra, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	// A key added on the dashboard that is also in the directory is only
+	// authorized once.
+	if _, err := store.Add("alice", directory, time.Now()); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	keys, err := authorizedKeys(user, store)
+	if err != nil || len(keys) != 2 || keys[0] != directory || keys[1] != extra {
+		t.Fatalf("unexpected keys %q %v", keys, err)
+	}
+	extraKeys, _ := store.List("alice")
+	views := sshKeyViews(user, extraKeys)
+	if len(views) != 3 || views[0].Source != sshKeySourceDirectory || views[0].AddedAt != nil || views[1].Source != sshKeySourceDashboard {
+		t.Fatalf("unexpected views %+v", views)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"remotegateway/internal/auth"
+	"remotegateway/internal/config"
+	"remotegateway/internal/identity"
+	"remotegateway/internal/lockout"
+	"remotegateway/internal/mfa"
+	"remotegateway/internal/oidc"
+	"remotegateway/internal/session"
+	"remotegateway/internal/types"
+)
+
+const (
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcVerifierKey = "oidc_verifier"
+)
+
+func newOIDCProvider(settings *config.SettingsType) *oidc.Provider {
+	if settings == nil || !settings.Has(config.OIDC_ISSUER_URL) {
+		return nil
+	}
+	if !settings.Has(config.OIDC_CLIENT_ID) || !settings.Has(config.OIDC_REDIRECT_URL) {
+		log.Printf("OIDC disabled: %s and %s are required", config.OIDC_CLIENT_ID, config.OIDC_REDIRECT_URL)
+		return nil
+	}
+	return oidc.NewProvider(oidc.Config{
+		IssuerURL:     settings.Get(config.OIDC_ISSUER_URL),
+		ClientID:      settings.Get(config.OIDC_CLIENT_ID),
+		ClientSecret:  settings.Get(config.OIDC_CLIENT_SECRET),
+		RedirectURL:   settings.Get(config.OIDC_REDIRECT_URL),
+		Scopes:        strings.Fields(settings.Get(config.OIDC_SCOPES)),
+		UsernameClaim: settings.Get(config.OIDC_USERNAME_CLAIM),
+		GroupsClaim:   settings.Get(config.OIDC_GROUPS_CLAIM),
+	})
+}
+
+func handleOIDCLogin(sessionManager *session.Manager, provider *oidc.Provider, settings *config.SettingsType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := oidc.NewState()
+		if err != nil {
+			log.Printf("oidc state: %v", err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+		nonce, err := oidc.NewState()
+		if err != nil {
+			log.Printf("oidc nonce: %v", err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+		verifier, err := oidc.NewPKCEVerifier()
+		if err != nil {
+			log.Printf("oidc verifier: %v", err)
+			serveLogin(w, settings, "Login failed.")
+			return
+		}
+
+		authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+		if err != nil {
+			log.Printf("oidc auth url: %v", err)
+			serveLogin(w, settings, "Single sign-on is unavailable right now.")
+			return
+		}
+
+		sessionManager.Put(r.Context(), oidcStateKey, state)
+		sessionManager.Put(r.Context(), oidcNonceKey, nonce)
+		sessionManager.Put(r.Context(), oidcVerifierKey, verifier)
+		setNoCacheHeaders(w)
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+func handleOIDCCallback(sessionManager *session.Manager, provider *oidc.Provider, mfaStore *mfa.Store, limiter *lockout.Limiter, identities *identity.Store, backends auth.Chain, settings *config.SettingsType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		state := sessionManager.PopString(ctx, oidcStateKey)
+		nonce := sessionManager.PopString(ctx, oidcNonceKey)
+		verifier := sessionManager.PopString(ctx, oidcVerifierKey)
+
+		q := r.URL.Query()
+		if errCode := q.Get("error"); errCode != "" {
+			log.Printf("oidc callback error: %s %s", errCode, q.Get("error_description"))
+			serveLogin(w, settings, "Single sign-on was cancelled or denied.")
+			return
+		}
+		if state == "" || q.Get("state") != state || q.Get("code") == "" {
+			log.Printf("oidc callback state mismatch from %s", r.RemoteAddr)
+			serveLogin(w, settings, "Single sign-on session expired. Please try again.")
+			return
+		}
+
+		claims, err := provider.Exchange(ctx, q.Get("code"), verifier, nonce)
+		if err != nil {
+			log.Printf("oidc exchange failed: %v", err)
+			serveLogin(w, settings, "Single sign-on failed.")
+			return
+		}
+
+		username := strings.ToLower(strings.TrimSpace(claims.Username))
+		if message := bindOIDCIdentity(identities, backends, settings, username, claims.Subject); message != "" {
+			serveLogin(w, settings, message)
+			return
+		}
+
+		mapping := oidc.ParseRoleMapping(settings.Get(config.OIDC_ROLE_MAPPING))
+		user := &types.User{
+			Name:   username,
+			Groups: oidc.MapRoles(claims.Groups, mapping, settings.IsTrue(config.OIDC_GROUP_PASSTHROUGH)),
+		}
+		log.Printf("oidc login: user=%s sub=%s groups=%v", user.Name, claims.Subject, user.Groups)
+		completeLogin(w, r, sessionManager, mfaStore, limiter, settings, user)
+	}
+}
+
+// bindOIDCIdentity ties username to the issuer and subject of the single
+// sign-on account, so the username claim cannot be used to take over a
+// local, directory or other single sign-on user. It returns the login error
+// to show, empty when the login may continue.
+func bindOIDCIdentity(identities *identity.Store, backends auth.Chain, settings *config.SettingsType, username, subject string) string {
+	if !identity.ValidUsername(username) {
+		log.Printf("oidc login refused: invalid username %q for sub=%s", username, subject)
+		return "Your single sign-on account name cannot be used here."
+	}
+	local, err := backends.HasUser(username)
+	if err != nil {
+		log.Printf("oidc login: local user lookup for %s: %v", username, err)
+		return "Login failed."
+	}
+	if local {
+		log.Printf("oidc login refused: %s is a local user, sub=%s", username, subject)
+		return "This account name belongs to another login."
+	}
+	err = identities.Bind(username, identity.BackendOIDC, identity.OIDCSubject(settings.Get(config.OIDC_ISSUER_URL), subject), time.Now())
+	switch {
+	case errors.Is(err, identity.ErrConflict):
+		log.Printf("oidc login refused: %s is bound to another account, sub=%s", username, subject)
+		return "This account name belongs to another login."
+	case err != nil:
+		log.Printf("oidc login: bind identity %s: %v", username, err)
+		return "Login failed."
+	}
+	return ""
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/identity"
+	"remotegateway/internal/oidc/oidctest"
+	"remotegateway/internal/session"
+)
+
+type oidcTestEnv struct {
+	mock           *oidctest.Provider
+	server         *httptest.Server
+	client         *http.Client
+	sessionManager *session.Manager
+}
+
+// newOIDCTestEnv serves the gateway router over TLS with single sign-on
+// pointed at an in-process provider. Extra settings can be set with t.Setenv
+// before calling.
+func newOIDCTestEnv(t *testing.T, username string) *oidcTestEnv {
+	t.Helper()
+	mock := oidctest.NewProvider("gateway")
+	t.Cleanup(mock.Close)
+	mock.Username = username
+
+	env := &oidcTestEnv{mock: mock, sessionManager: session.NewManager()}
+	var handler http.Handler
+	env.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(env.server.Close)
+
+	t.Setenv(config.OIDC_ISSUER_URL, mock.Issuer())
+	t.Setenv(config.OIDC_CLIENT_ID, "gateway")
+	t.Setenv(config.OIDC_REDIRECT_URL, env.server.URL+"/login/oidc/callback")
+	if _, ok := os.LookupEnv(config.MFA_STORE_PATH); !ok {
+		t.Setenv(config.MFA_STORE_PATH, filepath.Join(t.TempDir(), "mfa.json"))
+	}
+	if _, ok := os.LookupEnv(config.JOB_STORE_PATH); !ok {
+		t.Setenv(config.JOB_STORE_PATH, filepath.Join(t.TempDir(), "jobs.json"))
+	}
+	if _, ok := os.LookupEnv(config.IDENTITY_STORE_PATH); !ok {
+		t.Setenv(config.IDENTITY_STORE_PATH, filepath.Join(t.TempDir(), "identities.json"))
+	}
+	if _, ok := os.LookupEnv(config.SSH_KEY_STORE_PATH); !ok {
+		t.Setenv(config.SSH_KEY_STORE_PATH, filepath.Join(t.TempDir(), "keys.json"))
+	}
+	handler = getRemoteGatewayRotuer(t.Context(), env.sessionManager, config.NewSettingType(false))
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookie jar: %v", err)
+	}
+	env.client = env.server.Client()
+	env.client.Jar = jar
+	env.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/api/dashboard" || req.URL.Path == "/login/mfa" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	return env
+}
+
+// login runs the single sign-on flow and returns the final gateway redirect.
+func (e *oidcTestEnv) login(t *testing.T) string {
+	t.Helper()
+	resp, err := e.client.Get(e.server.URL + "/login/oidc")
+	if err != nil {
+		t.Fatalf("oidc login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected 303 after callback, got %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// csrfToken fetches the session's CSRF token the way the dashboard does.
+func (e *oidcTestEnv) csrfToken(t *testing.T) string {
+	t.Helper()
+	resp, err := e.client.Get(e.server.URL + "/api/dashboard/data")
+	if err != nil {
+		t.Fatalf("dashboard data: %v", err)
+	}
+	defer resp.Body.Close()
+	var payload dashboardDataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode dashboard data: %v", err)
+	}
+	return payload.CSRFToken
+}
+
+// postForm posts form to path, adding the CSRF token for API endpoints.
+func (e *oidcTestEnv) postForm(t *testing.T, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, e.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("new request %s: %v", path, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if strings.HasPrefix(path, "/api/") {
+		req.Header.Set(csrfHeader, e.csrfToken(t))
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		t.Fatalf("post %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return resp, string(body)
+}
+
+func TestOIDCLoginCreatesSessionAndAppPassword(t *testing.T) {
+	t.Setenv(config.OIDC_ROLE_MAPPING, "vdi-admins=admin")
+	env := newOIDCTestEnv(t, "alice")
+	env.mock.Groups = []string{"vdi-admins"}
+
+	if loc := env.login(t); loc != "/api/dashboard" {
+		t.Fatalf("expected redirect to dashboard, got %q", loc)
+	}
+
+	sess, ok := env.sessionManager.GetSessionFromUserName("alice")
+	if !ok {
+		t.Fatalf("expected session for alice")
+	}
+	if !sess.User.InGroup("admin") {
+		t.Fatalf("expected mapped admin role, got %v", sess.User.Groups)
+	}
+	if len(sess.User.NtlmHashes()) != 0 {
+		t.Fatalf("expected no gateway credentials before app password")
+	}
+
+	resp, _ := env.postForm(t, "/api/dashboard/app-password", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected app password to require mfa, got %d", resp.StatusCode)
+	}
+
+	enrollTOTP(t, env)
+
+	resp, body := env.postForm(t, "/api/dashboard/app-password", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for app password, got %d", resp.StatusCode)
+	}
+	var payload appPasswordResponse
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatalf("decode app password: %v", err)
+	}
+	if !payload.OK || len(payload.Password) != 23 || !strings.HasSuffix(payload.Username, `\alice`) {
+		t.Fatalf("unexpected app password response %+v", payload)
+	}
+
+	sess, ok = env.sessionManager.GetSessionFromUserName("alice")
+	if !ok || len(sess.User.NtlmHashes()) != 1 || sess.User.GetCloudInitPasswordHash() == "" {
+		t.Fatalf("expected app password to be stored in session")
+	}
+}
+
+func TestOIDCUnmappedGroupsAreDropped(t *testing.T) {
+	t.Setenv(config.ADMIN_GROUPS, "vdi-admins")
+	t.Setenv(config.OIDC_ROLE_MAPPING, "idp-staff=staff")
+	env := newOIDCTestEnv(t, "mallory")
+	// A group anyone can create in the IdP grants nothing without a mapping.
+	env.mock.Groups = []string{"vdi-admins", "idp-staff"}
+	env.login(t)
+
+	sess, ok := env.sessionManager.GetSessionFromUserName("mallory")
+	if !ok {
+		t.Fatalf("expected session for mallory")
+	}
+	if !reflect.DeepEqual(sess.User.Groups, []string{"staff"}) {
+		t.Fatalf("expected only the mapped group, got %v", sess.User.Groups)
+	}
+
+	t.Setenv(config.OIDC_GROUP_PASSTHROUGH, "true")
+	env = newOIDCTestEnv(t, "trent")
+	env.mock.Groups = []string{"vdi-admins", "idp-staff"}
+	env.login(t)
+	if sess, ok = env.sessionManager.GetSessionFromUserName("trent"); !ok || !reflect.DeepEqual(sess.User.Groups, []string{"vdi-admins", "staff"}) {
+		t.Fatalf("expected unmapped groups with passthrough, got %v", sess.User.Groups)
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	mock := oidctest.NewProvider("gateway")
+	defer mock.Close()
+	t.Setenv(config.OIDC_ISSUER_URL, mock.Issuer())
+	t.Setenv(config.OIDC_CLIENT_ID, "gateway")
+	t.Setenv(config.OIDC_REDIRECT_URL, "https://gw.example.com/login/oidc/callback")
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), config.NewSettingType(false))
+
+	req := httptest.NewRequest(http.MethodGet, "https://gw.example.com/login/oidc/callback?code=x&state=forged", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected login page, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "Single sign-on session expired") {
+		t.Fatalf("expected state error, got %q", rec.Body.String())
+	}
+}
+
+func TestOIDCLoginRefusesTakenUsernames(t *testing.T) {
+	localLogin(t, "secret", "bob")
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	callback := func() string {
+		t.Helper()
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatalf("cookie jar: %v", err)
+		}
+		env.client.Jar = jar
+		resp, err := env.client.Get(env.server.URL + "/login/oidc")
+		if err != nil {
+			t.Fatalf("oidc login: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the login page, got %d", resp.StatusCode)
+		}
+		return string(body)
+	}
+
+	env.mock.Subject = "someone-else"
+	if body := callback(); !strings.Contains(body, "belongs to another login") {
+		t.Fatalf("expected a renamed account to be refused, got %q", body)
+	}
+	env.mock.Subject = ""
+	env.mock.Username = "bob"
+	if body := callback(); !strings.Contains(body, "belongs to another login") {
+		t.Fatalf("expected a local username to be refused, got %q", body)
+	}
+	env.mock.Username = "Eve Admin"
+	if body := callback(); !strings.Contains(body, "cannot be used here") {
+		t.Fatalf("expected an invalid username to be refused, got %q", body)
+	}
+	if _, ok := env.sessionManager.GetSessionFromUserName("bob"); ok {
+		t.Fatal("expected no session for the local user")
+	}
+}
+
+func TestPasswordLoginRefusesSingleSignOnUsername(t *testing.T) {
+	localLogin(t, "secret", "carol")
+	identities := identity.NewStore(config.NewSettingType(false).Get(config.IDENTITY_STORE_PATH))
+	if err := identities.Bind("carol", identity.BackendOIDC, "https://idp#carol", time.Now()); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	handler := getRemoteGatewayRotuer(t.Context(), session.NewManager(), config.NewSettingType(false))
+	rec := postLogin(handler, "192.0.2.10:4000", "carol", "secret")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "signs in with single sign-on") {
+		t.Fatalf("expected the login to be refused, got %d %q", rec.Code, rec.Body.String())
+	}
+}
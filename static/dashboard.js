@@ -1,6 +1,8 @@
 "use strict";
 const DEFAULT_VM_ERROR = "Unable to load virtual machines right now.";
 const AUTO_REFRESH_INTERVAL_MS = 10000;
+const JOB_REFRESH_INTERVAL_MS = 2000;
+const RECENT_JOBS = 5;
 const state = {
     vms: [],
     filename: "rdpgw.rdp",
@@ -9,8 +11,18 @@ const state = {
     actionError: "",
     loading: true,
     busy: false,
+    tokens: [],
+    tokenError: "",
+    sshKeys: [],
+    sshKeyError: "",
+    jobs: [],
+    isAdmin: false,
+    idleShutdown: false,
+    admin: null,
+    adminError: "",
 };
 let loadInFlight = false;
+let csrfToken = "";
 function isValidIPv4(value) {
     const trimmed = value.trim();
     if (!trimmed) {
@@ -32,6 +44,13 @@ function isActiveState(state) {
     const normalized = state.trim().toLowerCase();
     return normalized === "running" || normalized === "paused" || normalized === "suspended";
 }
+function formatTimestamp(value) {
+    if (!value) {
+        return "never";
+    }
+    const date = new Date(value);
+    return Number.isNaN(date.getTime()) ? value : date.toLocaleString();
+}
 function bootstrap() {
     const root = document.getElementById("app");
     if (!root) {
@@ -42,34 +61,214 @@ function bootstrap() {
       <section class="vm-panel">
         <div class="vm-header">
           <h2>Available VMs</h2>
-          <a class="logout-button" href="/logout">Logout</a>
+          <div class="vm-header-actions">
+            <a class="logout-button" id="mfa-setup-link" href="/login/mfa" hidden>Set up two-factor</a>
+            <button class="logout-button" id="app-password-button" type="button">Gateway password</button>
+            <a class="logout-button" href="/logout">Logout</a>
+          </div>
         </div>
         <p class="vm-subtitle">Live inventory from libvirt.</p>
+        <p class="vm-subtitle" id="quota-summary" hidden></p>
         <form class="vm-form" id="create-form">
           <div class="field">
             <label for="vm-name">New VM Name</label>
             <input id="vm-name" name="vm_name" autocomplete="off" pattern="[A-Za-z0-9_-]+" maxlength="64" title="Letters, numbers, '-' or '_' only" required>
           </div>
+          <div class="field size-option">
+            <label for="vm-template">Template</label>
+            <select id="vm-template" name="template"></select>
+          </div>
+          <div class="field size-option">
+            <label for="vm-size">Size</label>
+            <select id="vm-size" name="size"></select>
+          </div>
+          <div class="field size-custom" hidden>
+            <label for="vm-vcpu">vCPU</label>
+            <input id="vm-vcpu" name="vcpu" type="number" min="1" step="1">
+          </div>
+          <div class="field size-custom" hidden>
+            <label for="vm-memory">Memory MiB</label>
+            <input id="vm-memory" name="memory" type="number" min="1024" step="256">
+          </div>
+          <div class="field size-custom" hidden>
+            <label for="vm-disk">Disk GB</label>
+            <input id="vm-disk" name="disk" type="number" min="20" step="1">
+          </div>
           <button id="create-button" type="submit">Create VM</button>
         </form>
         <div id="action-area" aria-live="polite"></div>
+        <div id="job-list"></div>
         <div id="vm-list"></div>
       </section>
+      <section class="vm-panel share-panel">
+        <div class="vm-header">
+          <h2>Sharing</h2>
+        </div>
+        <p class="vm-subtitle">Let another user or group connect to one of your VMs. Power rights also allow start, restart and shutdown.</p>
+        <form class="vm-form" id="share-form">
+          <div class="field">
+            <label for="share-vm">VM</label>
+            <select id="share-vm" name="vm_name" required></select>
+          </div>
+          <div class="field share-option">
+            <label for="share-type">Share With</label>
+            <select id="share-type" name="type">
+              <option value="user">User</option>
+              <option value="group">Group</option>
+            </select>
+          </div>
+          <div class="field">
+            <label for="share-name">User or Group Name</label>
+            <input id="share-name" name="name" autocomplete="off" maxlength="256" required>
+          </div>
+          <div class="field share-option">
+            <label for="share-right">Right</label>
+            <select id="share-right" name="right">
+              <option value="connect">Connect</option>
+              <option value="manage">Connect and power</option>
+            </select>
+          </div>
+          <button id="share-button" type="submit">Share</button>
+        </form>
+        <div id="share-list"></div>
+      </section>
+      <section class="vm-panel token-panel">
+        <div class="vm-header">
+          <h2>API tokens</h2>
+        </div>
+        <p class="vm-subtitle">Send a token as <code>Authorization: Bearer &lt;token&gt;</code> to script the VM API. Every token can list VMs.</p>
+        <form class="vm-form" id="token-form">
+          <div class="field">
+            <label for="token-name">Token Name</label>
+            <input id="token-name" name="name" autocomplete="off" maxlength="64" required>
+          </div>
+          <div class="field token-days">
+            <label for="token-days">Valid Days</label>
+            <input id="token-days" name="expires_days" type="number" min="1" value="30" required>
+          </div>
+          <label class="token-scope"><input type="checkbox" name="scope" value="power"> Start/stop</label>
+          <label class="token-scope"><input type="checkbox" name="scope" value="manage"> Create/remove</label>
+          <button id="token-button" type="submit">Create token</button>
+        </form>
+        <div id="token-list"></div>
+      </section>
+      <section class="vm-panel ssh-key-panel">
+        <div class="vm-header">
+          <h2>SSH keys</h2>
+        </div>
+        <p class="vm-subtitle">Keys from the directory and keys added here are authorized for SSH in VMs created from now on.</p>
+        <form class="vm-form" id="ssh-key-form">
+          <div class="field">
+            <label for="ssh-key">Public Key</label>
+            <input id="ssh-key" name="key" autocomplete="off" placeholder="ssh-ed25519 AAAA... user@host" required>
+          </div>
+          <button id="ssh-key-button" type="submit">Add key</button>
+        </form>
+        <div id="ssh-key-list"></div>
+      </section>
+      <section class="vm-panel admin-panel" id="admin-panel" hidden>
+        <div class="vm-header">
+          <h2>Administration</h2>
+        </div>
+        <p class="vm-subtitle">Every VM by owner, logged in users and open gateway tunnels. Admin actions are recorded in the audit log.</p>
+        <div id="admin-vms"></div>
+        <h3>Sessions</h3>
+        <div id="admin-sessions"></div>
+        <h3>Gateway tunnels</h3>
+        <div id="admin-tunnels"></div>
+      </section>
     </main>
   `;
     const form = root.querySelector("#create-form");
     const input = root.querySelector("#vm-name");
+    const templateSelect = root.querySelector("#vm-template");
+    const sizeSelect = root.querySelector("#vm-size");
+    const vcpuInput = root.querySelector("#vm-vcpu");
+    const memoryInput = root.querySelector("#vm-memory");
+    const diskInput = root.querySelector("#vm-disk");
     const createButton = root.querySelector("#create-button");
     const actionArea = root.querySelector("#action-area");
+    const jobList = root.querySelector("#job-list");
     const listArea = root.querySelector("#vm-list");
-    if (!form || !input || !createButton || !actionArea || !listArea) {
+    const appPasswordButton = root.querySelector("#app-password-button");
+    const mfaSetupLink = root.querySelector("#mfa-setup-link");
+    const tokenForm = root.querySelector("#token-form");
+    const tokenButton = root.querySelector("#token-button");
+    const tokenList = root.querySelector("#token-list");
+    const sshKeyForm = root.querySelector("#ssh-key-form");
+    const sshKeyButton = root.querySelector("#ssh-key-button");
+    const sshKeyList = root.querySelector("#ssh-key-list");
+    const shareForm = root.querySelector("#share-form");
+    const shareVM = root.querySelector("#share-vm");
+    const shareButton = root.querySelector("#share-button");
+    const shareList = root.querySelector("#share-list");
+    const adminPanel = root.querySelector("#admin-panel");
+    const adminVMs = root.querySelector("#admin-vms");
+    const adminSessions = root.querySelector("#admin-sessions");
+    const adminTunnels = root.querySelector("#admin-tunnels");
+    const quotaSummary = root.querySelector("#quota-summary");
+    if (!form ||
+        !input ||
+        !templateSelect ||
+        !sizeSelect ||
+        !vcpuInput ||
+        !memoryInput ||
+        !diskInput ||
+        !createButton ||
+        !actionArea ||
+        !jobList ||
+        !listArea ||
+        !appPasswordButton ||
+        !mfaSetupLink ||
+        !tokenForm ||
+        !tokenButton ||
+        !tokenList ||
+        !sshKeyForm ||
+        !sshKeyButton ||
+        !sshKeyList ||
+        !shareForm ||
+        !shareVM ||
+        !shareButton ||
+        !shareList ||
+        !adminPanel ||
+        !adminVMs ||
+        !adminSessions ||
+        !adminTunnels ||
+        !quotaSummary) {
         return;
     }
     const formEl = form;
     const inputEl = input;
+    const templateSelectEl = templateSelect;
+    const sizeSelectEl = sizeSelect;
+    let templates = [];
+    let defaultSize = "";
+    const customInputs = [
+        [vcpuInput, "vcpu"],
+        [memoryInput, "memoryMiB"],
+        [diskInput, "diskGB"],
+    ];
     const createButtonEl = createButton;
     const actionAreaEl = actionArea;
+    const jobListEl = jobList;
     const listAreaEl = listArea;
+    const appPasswordButtonEl = appPasswordButton;
+    const mfaSetupLinkEl = mfaSetupLink;
+    const tokenFormEl = tokenForm;
+    const tokenButtonEl = tokenButton;
+    const tokenListEl = tokenList;
+    const sshKeyFormEl = sshKeyForm;
+    const sshKeyButtonEl = sshKeyButton;
+    const sshKeyListEl = sshKeyList;
+    const shareFormEl = shareForm;
+    const shareVMEl = shareVM;
+    const shareButtonEl = shareButton;
+    const shareListEl = shareList;
+    const adminPanelEl = adminPanel;
+    const adminVMsEl = adminVMs;
+    const adminSessionsEl = adminSessions;
+    const adminTunnelsEl = adminTunnels;
+    const quotaSummaryEl = quotaSummary;
     function renderAction() {
         actionAreaEl.innerHTML = "";
         if (state.actionError) {
@@ -86,6 +285,87 @@ function bootstrap() {
             actionAreaEl.appendChild(message);
         }
     }
+    function renderQuota(quota) {
+        if (!quota) {
+            quotaSummaryEl.hidden = true;
+            return;
+        }
+        const { limits, usage } = quota;
+        const parts = [];
+        const resources = [
+            ["VMs", usage.vms, limits.vms, ""],
+            ["vCPU", usage.vcpu, limits.vcpu, ""],
+            ["memory", usage.memoryMiB, limits.memoryMiB, " MiB"],
+            ["disk", usage.diskGB, limits.diskGB, " GB"],
+        ];
+        for (const [label, used, limit, unit] of resources) {
+            if (limit) {
+                parts.push(`${label} ${used}/${limit}${unit}`);
+            }
+        }
+        quotaSummaryEl.textContent = parts.length > 0 ? `Quota used: ${parts.join(", ")}.` : "";
+        quotaSummaryEl.hidden = parts.length === 0;
+    }
+    function describeSize(size) {
+        return `${size.vcpu} vCPU, ${size.memoryMiB} MiB, ${size.diskGB} GB`;
+    }
+    function toggleCustomSize() {
+        const custom = sizeSelectEl.value === "custom";
+        for (const [field] of customInputs) {
+            const wrapper = field.closest(".size-custom");
+            if (wrapper) {
+                wrapper.hidden = !custom;
+            }
+            field.required = custom;
+        }
+    }
+    function renderSizes(sizes) {
+        const previous = sizeSelectEl.value;
+        sizeSelectEl.innerHTML = "";
+        if (!sizes) {
+            toggleCustomSize();
+            return;
+        }
+        for (const size of sizes.profiles) {
+            const option = document.createElement("option");
+            option.value = size.name;
+            option.textContent = `${size.name} (${describeSize(size)})`;
+            sizeSelectEl.appendChild(option);
+        }
+        const customMax = sizes.customMax;
+        if (customMax) {
+            const option = document.createElement("option");
+            option.value = "custom";
+            option.textContent = `custom (up to ${describeSize(customMax)})`;
+            sizeSelectEl.appendChild(option);
+            for (const [field, key] of customInputs) {
+                field.max = String(customMax[key]);
+            }
+        }
+        const options = Array.from(sizeSelectEl.options).map((option) => option.value);
+        defaultSize = sizes.default;
+        sizeSelectEl.value = options.includes(previous) ? previous : templateSize();
+        toggleCustomSize();
+    }
+    function templateSize() {
+        const chosen = templates.find((template) => template.name === templateSelectEl.value);
+        const size = chosen?.defaultSize || defaultSize;
+        return Array.from(sizeSelectEl.options).some((option) => option.value === size) ? size : sizeSelectEl.value;
+    }
+    function renderTemplates(catalog) {
+        const previous = templateSelectEl.value;
+        templateSelectEl.innerHTML = "";
+        templates = catalog ? catalog.templates : [];
+        for (const template of templates) {
+            const option = document.createElement("option");
+            option.value = template.name;
+            option.textContent = template.description ? `${template.name} (${template.description})` : template.name;
+            templateSelectEl.appendChild(option);
+        }
+        if (catalog) {
+            templateSelectEl.value = templates.some((template) => template.name === previous) ? previous : catalog.default;
+        }
+    }
     function renderVMList() {
         listAreaEl.innerHTML = "";
         if (state.loading) {
@@ -137,6 +417,15 @@ function bootstrap() {
             const nameCell = document.createElement("td");
             nameCell.className = "vm-name";
             nameCell.textContent = vm.name || "n/a";
+            if (vm.access !== "owner") {
+                const shared = document.createElement("span");
+                shared.className = "vm-shared";
+                shared.textContent = `shared by ${vm.owner}`;
+                nameCell.appendChild(shared);
+            }
+            if (vm.template) {
+                nameCell.title = `Template: ${vm.template}`;
+            }
             row.appendChild(nameCell);
             const ipCell = document.createElement("td");
             ipCell.textContent = vm.ip || "n/a";
@@ -144,6 +433,23 @@ function bootstrap() {
             const stateCell = document.createElement("td");
             stateCell.className = "vm-state";
             stateCell.textContent = vm.state || "n/a";
+            if (vm.readiness && vm.readiness !== "ready") {
+                const readiness = document.createElement("span");
+                readiness.className = `vm-readiness vm-readiness-${vm.readiness}`;
+                readiness.textContent = vm.readiness;
+                stateCell.appendChild(readiness);
+            }
+            if (vm.idleShutdownAt) {
+                const idle = document.createElement("span");
+                idle.className = "vm-idle";
+                idle.textContent = `idle, stops ${formatTimestamp(vm.idleShutdownAt)}`;
+                stateCell.appendChild(idle);
+            } else if (state.idleShutdown && vm.keepRunning) {
+                const idle = document.createElement("span");
+                idle.className = "vm-idle";
+                idle.textContent = "kept running when idle";
+                stateCell.appendChild(idle);
+            }
             row.appendChild(stateCell);
             const memoryCell = document.createElement("td");
             memoryCell.textContent = vm.memoryMiB ? `${vm.memoryMiB} MiB` : "n/a";
@@ -157,6 +463,7 @@ function bootstrap() {
             const hasIPv4 = vm.ip ? isValidIPv4(vm.ip) : false;
             const hasName = vm.name.trim() !== "";
             const isActive = isActiveState(vm.state || "");
+            const canPower = vm.access === "owner" || vm.access === "manage";
             const actionCell = document.createElement("td");
             const actions = document.createElement("div");
             actions.className = "vm-actions";
@@ -164,7 +471,7 @@ function bootstrap() {
             startButton.type = "button";
             startButton.className = "vm-power vm-start";
             startButton.textContent = "Start";
-            startButton.disabled = state.busy || !hasName || isActive;
+            startButton.disabled = state.busy || !hasName || !canPower || isActive;
             startButton.addEventListener("click", () => {
                 void startVM(vm.name);
             });
@@ -173,7 +480,7 @@ function bootstrap() {
             restartButton.type = "button";
             restartButton.className = "vm-power vm-restart";
             restartButton.textContent = "Restart";
-            restartButton.disabled = state.busy || !hasName || !isActive;
+            restartButton.disabled = state.busy || !hasName || !canPower || !isActive;
             restartButton.addEventListener("click", () => {
                 void restartVM(vm.name);
             });
@@ -182,13 +489,33 @@ function bootstrap() {
             shutdownButton.type = "button";
             shutdownButton.className = "vm-power vm-shutdown";
             shutdownButton.textContent = "Shutdown";
-            shutdownButton.disabled = state.busy || !hasName || !isActive;
+            shutdownButton.disabled = state.busy || !hasName || !canPower || !isActive;
             shutdownButton.addEventListener("click", () => {
                 void shutdownVM(vm.name);
             });
             actions.appendChild(shutdownButton);
+            if (state.idleShutdown && canPower) {
+                const keepButton = document.createElement("button");
+                keepButton.type = "button";
+                keepButton.className = "vm-power vm-keep";
+                keepButton.textContent = vm.keepRunning ? "Allow idle stop" : "Keep running";
+                keepButton.title = vm.keepRunning
+                    ? "Shut this VM down when it is idle"
+                    : "Never shut this VM down when it is idle";
+                keepButton.disabled = state.busy || !hasName;
+                keepButton.addEventListener("click", () => {
+                    void setKeepRunning(vm.name, !vm.keepRunning);
+                });
+                actions.appendChild(keepButton);
+            }
             if (hasIPv4) {
-                if (vm.rdpHost) {
+                // The guest is still installing its desktop.
+                if (vm.readiness === "provisioning") {
+                    const pending = document.createElement("span");
+                    pending.className = "vm-disabled";
+                    pending.textContent = "Provisioning";
+                    actions.appendChild(pending);
+                } else if (vm.rdpHost) {
                     const download = document.createElement("a");
                     download.className = "vm-download";
                     download.href = `/api/${state.filename}?target=${encodeURIComponent(vm.rdpHost)}`;
@@ -201,15 +528,17 @@ function bootstrap() {
                     disabled.textContent = "n/a";
                     actions.appendChild(disabled);
                 }
-                const removeButton = document.createElement("button");
-                removeButton.type = "button";
-                removeButton.className = "vm-remove";
-                removeButton.textContent = "Remove";
-                removeButton.disabled = state.busy || !hasName;
-                removeButton.addEventListener("click", () => {
-                    void removeVM(vm.name);
-                });
-                actions.appendChild(removeButton);
+                if (vm.access === "owner") {
+                    const removeButton = document.createElement("button");
+                    removeButton.type = "button";
+                    removeButton.className = "vm-remove";
+                    removeButton.textContent = "Remove";
+                    removeButton.disabled = state.busy || !hasName;
+                    removeButton.addEventListener("click", () => {
+                        void removeVM(vm.name);
+                    });
+                    actions.appendChild(removeButton);
+                }
             }
             else {
                 const disabled = document.createElement("span");
@@ -225,11 +554,397 @@ function bootstrap() {
         wrap.appendChild(table);
         listAreaEl.appendChild(wrap);
     }
+    function renderShareList() {
+        const owned = state.vms.filter((vm) => vm.access === "owner");
+        const names = owned.map((vm) => vm.name).join("\n");
+        if (shareVMEl.dataset.names !== names) {
+            const selected = shareVMEl.value;
+            shareVMEl.innerHTML = "";
+            for (const vm of owned) {
+                const option = document.createElement("option");
+                option.value = vm.name;
+                option.textContent = vm.name;
+                shareVMEl.appendChild(option);
+            }
+            if (owned.some((vm) => vm.name === selected)) {
+                shareVMEl.value = selected;
+            }
+            shareVMEl.dataset.names = names;
+        }
+        shareButtonEl.disabled = state.busy || owned.length === 0;
+        shareListEl.innerHTML = "";
+        const shares = owned.flatMap((vm) => (vm.grants || []).map((grant) => ({ vm: vm.name, grant })));
+        if (shares.length === 0) {
+            const empty = document.createElement("p");
+            empty.className = "vm-empty";
+            empty.textContent = "Your VMs are not shared.";
+            shareListEl.appendChild(empty);
+            return;
+        }
+        const wrap = document.createElement("div");
+        wrap.className = "vm-table-wrap";
+        const table = document.createElement("table");
+        table.className = "vm-table";
+        const thead = document.createElement("thead");
+        const headRow = document.createElement("tr");
+        for (const label of ["VM", "Shared With", "Right", "Since", "Actions"]) {
+            const th = document.createElement("th");
+            th.textContent = label;
+            headRow.appendChild(th);
+        }
+        thead.appendChild(headRow);
+        table.appendChild(thead);
+        const tbody = document.createElement("tbody");
+        for (const share of shares) {
+            const row = document.createElement("tr");
+            const vmCell = document.createElement("td");
+            vmCell.className = "vm-name";
+            vmCell.textContent = share.vm;
+            row.appendChild(vmCell);
+            const withCell = document.createElement("td");
+            withCell.textContent = `${share.grant.type} ${share.grant.name}`;
+            row.appendChild(withCell);
+            const rightCell = document.createElement("td");
+            rightCell.textContent = share.grant.right === "manage" ? "connect and power" : share.grant.right;
+            row.appendChild(rightCell);
+            const sinceCell = document.createElement("td");
+            sinceCell.textContent = formatTimestamp(share.grant.grantedAt);
+            row.appendChild(sinceCell);
+            const actionCell = document.createElement("td");
+            const unshareButton = document.createElement("button");
+            unshareButton.type = "button";
+            unshareButton.className = "vm-remove";
+            unshareButton.textContent = "Remove";
+            unshareButton.disabled = state.busy;
+            unshareButton.addEventListener("click", () => {
+                void unshareVM(share.vm, share.grant);
+            });
+            actionCell.appendChild(unshareButton);
+            row.appendChild(actionCell);
+            tbody.appendChild(row);
+        }
+        table.appendChild(tbody);
+        wrap.appendChild(table);
+        shareListEl.appendChild(wrap);
+    }
+    function renderTokenList() {
+        tokenListEl.innerHTML = "";
+        if (state.tokenError) {
+            const error = document.createElement("p");
+            error.className = "vm-error";
+            error.textContent = state.tokenError;
+            tokenListEl.appendChild(error);
+            return;
+        }
+        if (state.tokens.length === 0) {
+            const empty = document.createElement("p");
+            empty.className = "vm-empty";
+            empty.textContent = "No API tokens yet.";
+            tokenListEl.appendChild(empty);
+            return;
+        }
+        const wrap = document.createElement("div");
+        wrap.className = "vm-table-wrap";
+        const table = document.createElement("table");
+        table.className = "vm-table";
+        const thead = document.createElement("thead");
+        const headRow = document.createElement("tr");
+        for (const label of ["Name", "Scopes", "Expires", "Last Used", "Actions"]) {
+            const th = document.createElement("th");
+            th.textContent = label;
+            headRow.appendChild(th);
+        }
+        thead.appendChild(headRow);
+        table.appendChild(thead);
+        const tbody = document.createElement("tbody");
+        for (const token of state.tokens) {
+            const row = document.createElement("tr");
+            const nameCell = document.createElement("td");
+            nameCell.className = "vm-name";
+            nameCell.textContent = token.name;
+            row.appendChild(nameCell);
+            const scopesCell = document.createElement("td");
+            scopesCell.textContent = token.scopes.join(", ");
+            row.appendChild(scopesCell);
+            const expiresCell = document.createElement("td");
+            expiresCell.textContent = token.expired ? "expired" : formatTimestamp(token.expiresAt);
+            row.appendChild(expiresCell);
+            const usedCell = document.createElement("td");
+            usedCell.textContent = formatTimestamp(token.lastUsedAt);
+            row.appendChild(usedCell);
+            const actionCell = document.createElement("td");
+            const revokeButton = document.createElement("button");
+            revokeButton.type = "button";
+            revokeButton.className = "vm-remove";
+            revokeButton.textContent = "Revoke";
+            revokeButton.disabled = state.busy;
+            revokeButton.addEventListener("click", () => {
+                void revokeToken(token.id);
+            });
+            actionCell.appendChild(revokeButton);
+            row.appendChild(actionCell);
+            tbody.appendChild(row);
+        }
+        table.appendChild(tbody);
+        wrap.appendChild(table);
+        tokenListEl.appendChild(wrap);
+    }
+    function renderSSHKeyList() {
+        sshKeyListEl.innerHTML = "";
+        if (state.sshKeyError) {
+            const error = document.createElement("p");
+            error.className = "vm-error";
+            error.textContent = state.sshKeyError;
+            sshKeyListEl.appendChild(error);
+            return;
+        }
+        if (state.sshKeys.length === 0) {
+            const empty = document.createElement("p");
+            empty.className = "vm-empty";
+            empty.textContent = "No SSH keys yet.";
+            sshKeyListEl.appendChild(empty);
+            return;
+        }
+        const wrap = document.createElement("div");
+        wrap.className = "vm-table-wrap";
+        const table = document.createElement("table");
+        table.className = "vm-table";
+        const thead = document.createElement("thead");
+        const headRow = document.createElement("tr");
+        for (const label of ["Comment", "Type", "Fingerprint", "Added", "Actions"]) {
+            const th = document.createElement("th");
+            th.textContent = label;
+            headRow.appendChild(th);
+        }
+        thead.appendChild(headRow);
+        table.appendChild(thead);
+        const tbody = document.createElement("tbody");
+        for (const key of state.sshKeys) {
+            const row = document.createElement("tr");
+            const commentCell = document.createElement("td");
+            commentCell.className = "vm-name";
+            commentCell.textContent = key.comment || "n/a";
+            row.appendChild(commentCell);
+            const typeCell = document.createElement("td");
+            typeCell.textContent = key.type;
+            row.appendChild(typeCell);
+            const fingerprintCell = document.createElement("td");
+            const fingerprint = document.createElement("code");
+            fingerprint.className = "ssh-fingerprint";
+            fingerprint.textContent = key.fingerprint;
+            fingerprintCell.appendChild(fingerprint);
+            row.appendChild(fingerprintCell);
+            const addedCell = document.createElement("td");
+            addedCell.textContent = key.source === "directory" ? "directory" : formatTimestamp(key.addedAt);
+            row.appendChild(addedCell);
+            const actionCell = document.createElement("td");
+            if (key.source === "directory") {
+                // Directory keys are changed in LDAP.
+                const fixed = document.createElement("span");
+                fixed.className = "vm-disabled";
+                fixed.textContent = "From directory";
+                actionCell.appendChild(fixed);
+            } else {
+                const removeButton = document.createElement("button");
+                removeButton.type = "button";
+                removeButton.className = "vm-remove";
+                removeButton.textContent = "Remove";
+                removeButton.disabled = state.busy;
+                removeButton.addEventListener("click", () => {
+                    void removeSSHKey(key.fingerprint);
+                });
+                actionCell.appendChild(removeButton);
+            }
+            row.appendChild(actionCell);
+            tbody.appendChild(row);
+        }
+        table.appendChild(tbody);
+        wrap.appendChild(table);
+        sshKeyListEl.appendChild(wrap);
+    }    function buildTable(columns, rows) {
+        const wrap = document.createElement("div");
+        wrap.className = "vm-table-wrap";
+        const table = document.createElement("table");
+        table.className = "vm-table";
+        const thead = document.createElement("thead");
+        const headRow = document.createElement("tr");
+        for (const label of columns) {
+            const th = document.createElement("th");
+            th.textContent = label;
+            headRow.appendChild(th);
+        }
+        thead.appendChild(headRow);
+        table.appendChild(thead);
+        const tbody = document.createElement("tbody");
+        for (const cells of rows) {
+            const row = document.createElement("tr");
+            for (const cell of cells) {
+                const td = document.createElement("td");
+                if (typeof cell === "string") {
+                    td.textContent = cell;
+                }
+                else {
+                    td.appendChild(cell);
+                }
+                row.appendChild(td);
+            }
+            tbody.appendChild(row);
+        }
+        table.appendChild(tbody);
+        wrap.appendChild(table);
+        return wrap;
+    }
+    function isActiveJob(job) {
+        return job.state === "queued" || job.state === "running";
+    }
+    function renderJobList() {
+        jobListEl.innerHTML = "";
+        // Active jobs and the most recent finished ones.
+        const jobs = state.jobs.filter((job, index) => index < RECENT_JOBS || isActiveJob(job));
+        if (jobs.length === 0) {
+            return;
+        }
+        const rows = jobs.map((job) => {
+            const steps = document.createElement("ol");
+            steps.className = "job-steps";
+            for (const step of job.steps) {
+                const item = document.createElement("li");
+                item.className = `job-step job-${step.state}`;
+                item.textContent = step.name;
+                if (step.error) {
+                    item.title = step.error;
+                }
+                steps.appendChild(item);
+            }
+            const status = document.createElement("span");
+            status.className = `job-state job-${job.state}`;
+            status.textContent = job.state === "failed" && job.error ? `failed: ${job.error}` : job.state;
+            const actions = document.createElement("span");
+            if (isActiveJob(job)) {
+                const cancelButton = document.createElement("button");
+                cancelButton.type = "button";
+                cancelButton.className = "vm-remove";
+                cancelButton.textContent = "Cancel";
+                cancelButton.disabled = state.busy;
+                cancelButton.addEventListener("click", () => {
+                    void cancelJob(job.id);
+                });
+                actions.appendChild(cancelButton);
+            }
+            return [job.vm, job.template, job.size, steps, status, actions];
+        });
+        jobListEl.appendChild(buildTable(["VM", "Template", "Size", "Progress", "State", "Actions"], rows));
+    }
+    function renderAdmin() {
+        adminPanelEl.hidden = !state.isAdmin;
+        adminVMsEl.innerHTML = "";
+        adminSessionsEl.innerHTML = "";
+        adminTunnelsEl.innerHTML = "";
+        if (!state.isAdmin) {
+            return;
+        }
+        if (state.adminError || !state.admin) {
+            const message = document.createElement("p");
+            message.className = state.adminError ? "vm-error" : "vm-loading";
+            message.textContent = state.adminError || "Loading overview...";
+            adminVMsEl.appendChild(message);
+            return;
+        }
+        const vmRows = [];
+        for (const group of state.admin.owners || []) {
+            for (const vm of group.vms) {
+                const isActive = isActiveState(vm.state || "");
+                const actions = document.createElement("div");
+                actions.className = "vm-actions";
+                const buttons = [
+                    ["start", "Start", !isActive],
+                    ["restart", "Restart", isActive],
+                    ["shutdown", "Shutdown", isActive],
+                    ["remove", "Remove", true],
+                ];
+                for (const [action, label, enabled] of buttons) {
+                    const button = document.createElement("button");
+                    button.type = "button";
+                    button.className = action === "remove" ? "vm-remove" : `vm-power vm-${action}`;
+                    button.textContent = label;
+                    button.disabled = state.busy || !enabled;
+                    button.addEventListener("click", () => {
+                        void adminVMAction(vm.name, action);
+                    });
+                    actions.appendChild(button);
+                }
+                const shares = (vm.grants || []).map((grant) => `${grant.type} ${grant.name}`).join(", ");
+                vmRows.push([group.owner || "unowned", vm.name, vm.state || "n/a", shares || "-", actions]);
+            }
+        }
+        if (vmRows.length === 0) {
+            const empty = document.createElement("p");
+            empty.className = "vm-empty";
+            empty.textContent = "No virtual machines found.";
+            adminVMsEl.appendChild(empty);
+        }
+        else {
+            adminVMsEl.appendChild(buildTable(["Owner", "VM", "State", "Shared With", "Actions"], vmRows));
+        }
+        const sessionRows = [];
+        for (const sess of state.admin.sessions || []) {
+            const revokeButton = document.createElement("button");
+            revokeButton.type = "button";
+            revokeButton.className = "vm-remove";
+            revokeButton.textContent = "Sign out";
+            revokeButton.disabled = state.busy;
+            revokeButton.addEventListener("click", () => {
+                void revokeSessions(sess.user);
+            });
+            sessionRows.push([
+                sess.user,
+                (sess.groups || []).join(", ") || "-",
+                formatTimestamp(sess.createdAt),
+                formatTimestamp(sess.expiry),
+                sess.mfaVerified ? "yes" : "no",
+                revokeButton,
+            ]);
+        }
+        if (sessionRows.length === 0) {
+            const empty = document.createElement("p");
+            empty.className = "vm-empty";
+            empty.textContent = "Nobody is logged in.";
+            adminSessionsEl.appendChild(empty);
+        }
+        else {
+            adminSessionsEl.appendChild(buildTable(["User", "Groups", "Signed In", "Expires", "Two-factor", "Actions"], sessionRows));
+        }
+        const tunnelRows = (state.admin.tunnels || []).map((tunnel) => [
+            tunnel.user,
+            `${tunnel.clientName || "n/a"} (${tunnel.clientIp || "n/a"})`,
+            tunnel.target,
+            tunnel.redirect,
+            formatTimestamp(tunnel.connectedAt),
+            formatTimestamp(tunnel.lastActivity),
+        ]);
+        if (tunnelRows.length === 0) {
+            const empty = document.createElement("p");
+            empty.className = "vm-empty";
+            empty.textContent = "No open gateway tunnels.";
+            adminTunnelsEl.appendChild(empty);
+        }
+        else {
+            adminTunnelsEl.appendChild(buildTable(["User", "Client", "Target", "Redirection", "Connected", "Last Activity"], tunnelRows));
+        }
+    }
     function setBusy(isBusy) {
         state.busy = isBusy;
         inputEl.disabled = isBusy;
         createButtonEl.disabled = isBusy;
+        appPasswordButtonEl.disabled = isBusy;
+        tokenButtonEl.disabled = isBusy;
+        sshKeyButtonEl.disabled = isBusy;
         renderVMList();
+        renderShareList();
+        renderTokenList();
+        renderSSHKeyList();
+        renderJobList();
+        renderAdmin();
     }
     function setActionError(message) {
         state.actionError = message;
@@ -265,6 +980,9 @@ function bootstrap() {
     async function requestJSON(url, init = {}) {
         const headers = new Headers(init.headers);
         headers.set("Accept", "application/json");
+        if (init.method && init.method !== "GET" && csrfToken) {
+            headers.set("X-CSRF-Token", csrfToken);
+        }
         const response = await fetch(url, {
             ...init,
             headers,
@@ -314,6 +1032,18 @@ function bootstrap() {
                 return;
             }
             state.vms = result.data.vms || [];
+            state.isAdmin = result.data.isAdmin === true;
+            state.idleShutdown = result.data.idleShutdown === true;
+            renderQuota(result.data.quota);
+            renderTemplates(result.data.templates);
+            renderSizes(result.data.sizes);
+            if (state.isAdmin) {
+                void loadAdmin();
+            }
+            mfaSetupLinkEl.hidden = result.data.mfaVerified !== false;
+            if (result.data.csrfToken) {
+                csrfToken = result.data.csrfToken;
+            }
             if (result.data.filename) {
                 state.filename = result.data.filename;
             }
@@ -327,6 +1057,7 @@ function bootstrap() {
         finally {
             state.loading = false;
             renderVMList();
+            renderShareList();
             loadInFlight = false;
         }
     }
@@ -337,7 +1068,12 @@ function bootstrap() {
         clearAction();
         setBusy(true);
         try {
-            const body = new URLSearchParams({ vm_name: name });
+            const body = new URLSearchParams({ vm_name: name, template: templateSelectEl.value, size: sizeSelectEl.value });
+            if (sizeSelectEl.value === "custom") {
+                for (const [field] of customInputs) {
+                    body.set(field.name, field.value);
+                }
+            }
             const result = await requestJSON("/api/dashboard", {
                 method: "POST",
                 headers: {
@@ -356,22 +1092,23 @@ function bootstrap() {
                 setActionError(result.data.error || "Failed to create VM.");
                 return;
             }
-            setActionMessage(result.data.message || "VM creation started.");
+            setActionMessage(result.data.message || "VM creation queued.");
             inputEl.value = "";
+            await loadJobs();
             await loadVMs();
         }
         finally {
             setBusy(false);
         }
     }
-    async function actionVM(name, url, successMessage, failureMessage) {
+    async function actionVM(name, url, successMessage, failureMessage, extra = {}) {
         if (state.busy) {
             return;
         }
         clearAction();
         setBusy(true);
         try {
-            const body = new URLSearchParams({ vm_name: name });
+            const body = new URLSearchParams({ vm_name: name, ...extra });
             const result = await requestJSON(url, {
                 method: "POST",
                 headers: {
@@ -409,6 +1146,320 @@ function bootstrap() {
     async function shutdownVM(name) {
         await actionVM(name, "/api/dashboard/shutdown", "VM shutdown requested.", "Failed to shutdown VM.");
     }
+    async function setKeepRunning(name, keep) {
+        await actionVM(name, "/api/dashboard/keep-running", "VM idle shutdown updated.", "Failed to update idle shutdown.", {
+            keep: String(keep),
+        });
+    }
+    async function shareVMWith() {
+        const data = new FormData(shareFormEl);
+        await actionVM(String(data.get("vm_name") || ""), "/api/dashboard/share", "VM shared.", "Failed to share VM.", {
+            type: String(data.get("type") || ""),
+            name: String(data.get("name") || "").trim(),
+            right: String(data.get("right") || ""),
+        });
+    }
+    async function unshareVM(name, grant) {
+        await actionVM(name, "/api/dashboard/unshare", "VM sharing removed.", "Failed to update VM sharing.", {
+            type: grant.type,
+            name: grant.name,
+        });
+    }
+    async function loadAdmin() {
+        const result = await requestJSON("/api/admin/overview");
+        if (!result) {
+            return;
+        }
+        if (!result.ok || !result.data) {
+            state.adminError = result.error || "Unable to load the overview right now.";
+        }
+        else {
+            state.admin = result.data;
+            state.adminError = result.data.error || "";
+        }
+        renderAdmin();
+    }
+    async function adminVMAction(name, action) {
+        await actionVM(name, "/api/admin/vm", `VM ${action} requested.`, `Failed to ${action} VM.`, { action });
+    }
+    async function revokeSessions(username) {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const body = new URLSearchParams({ username });
+            const result = await requestJSON("/api/admin/sessions/revoke", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                },
+                body: body.toString(),
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data || !result.data.ok) {
+                setActionError((result.data && result.data.error) || result.error || "Failed to revoke sessions.");
+                return;
+            }
+            setActionMessage(result.data.message || "Sessions revoked.");
+            await loadAdmin();
+        }
+        finally {
+            setBusy(false);
+        }
+    }
+    function showAppPassword(username, password) {
+        actionAreaEl.innerHTML = "";
+        const message = document.createElement("p");
+        message.className = "vm-success";
+        message.append("Gateway login ");
+        const user = document.createElement("code");
+        user.className = "app-password";
+        user.textContent = username;
+        message.appendChild(user);
+        message.append(" password ");
+        const secret = document.createElement("code");
+        secret.className = "app-password";
+        secret.textContent = password;
+        message.appendChild(secret);
+        message.append(". It will not be shown again.");
+        actionAreaEl.appendChild(message);
+    }
+    async function createAppPassword() {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const result = await requestJSON("/api/dashboard/app-password", {
+                method: "POST",
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data) {
+                setActionError(result.error || "Failed to create gateway password.");
+                return;
+            }
+            if (!result.data.ok || !result.data.username || !result.data.password) {
+                setActionError(result.data.error || "Failed to create gateway password.");
+                return;
+            }
+            showAppPassword(result.data.username, result.data.password);
+        }
+        finally {
+            setBusy(false);
+        }
+    }
+    async function loadTokens() {
+        const result = await requestJSON("/api/tokens");
+        if (!result) {
+            return;
+        }
+        if (!result.ok || !result.data) {
+            state.tokenError = result.error || "Unable to load API tokens.";
+        }
+        else {
+            state.tokens = result.data.tokens || [];
+            state.tokenError = result.data.error || "";
+        }
+        renderTokenList();
+    }
+    function showAPIToken(token) {
+        actionAreaEl.innerHTML = "";
+        const message = document.createElement("p");
+        message.className = "vm-success";
+        message.append("API token ");
+        const secret = document.createElement("code");
+        secret.className = "app-password";
+        secret.textContent = token;
+        message.appendChild(secret);
+        message.append(". It will not be shown again.");
+        actionAreaEl.appendChild(message);
+    }
+    async function createToken() {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const body = new URLSearchParams();
+            new FormData(tokenFormEl).forEach((value, key) => {
+                body.append(key, String(value));
+            });
+            const result = await requestJSON("/api/tokens", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                },
+                body: body.toString(),
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data) {
+                setActionError(result.error || "Failed to create API token.");
+                return;
+            }
+            if (!result.data.ok || !result.data.token) {
+                setActionError(result.data.error || "Failed to create API token.");
+                return;
+            }
+            showAPIToken(result.data.token);
+            tokenFormEl.reset();
+            await loadTokens();
+        }
+        finally {
+            setBusy(false);
+        }
+    }
+    async function revokeToken(id) {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const body = new URLSearchParams({ id });
+            const result = await requestJSON("/api/tokens/revoke", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                },
+                body: body.toString(),
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data || !result.data.ok) {
+                setActionError((result.data && result.data.error) || result.error || "Failed to revoke API token.");
+                return;
+            }
+            setActionMessage(result.data.message || "API token revoked.");
+            await loadTokens();
+        }
+        finally {
+            setBusy(false);
+        }
+    }
+    async function loadSSHKeys() {
+        const result = await requestJSON("/api/dashboard/ssh-keys");
+        if (!result) {
+            return;
+        }
+        if (!result.ok || !result.data) {
+            state.sshKeyError = result.error || "Unable to load SSH keys.";
+        } else {
+            state.sshKeys = result.data.keys || [];
+            state.sshKeyError = result.data.error || "";
+        }
+        renderSSHKeyList();
+    }
+    async function addSSHKey() {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const body = new URLSearchParams();
+            new FormData(sshKeyFormEl).forEach((value, key) => {
+                body.append(key, String(value));
+            });
+            const result = await requestJSON("/api/dashboard/ssh-keys", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                },
+                body: body.toString(),
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data || !result.data.ok) {
+                setActionError((result.data && result.data.error) || result.error || "Failed to add SSH key.");
+                return;
+            }
+            setActionMessage(result.data.message || "SSH key added.");
+            sshKeyFormEl.reset();
+            await loadSSHKeys();
+        } finally {
+            setBusy(false);
+        }
+    }
+    async function removeSSHKey(fingerprint) {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const body = new URLSearchParams({ fingerprint });
+            const result = await requestJSON("/api/dashboard/ssh-keys/remove", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                },
+                body: body.toString(),
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data || !result.data.ok) {
+                setActionError((result.data && result.data.error) || result.error || "Failed to remove SSH key.");
+                return;
+            }
+            setActionMessage(result.data.message || "SSH key removed.");
+            await loadSSHKeys();
+        } finally {
+            setBusy(false);
+        }
+    }    async function loadJobs() {
+        const result = await requestJSON("/api/dashboard/jobs");
+        if (!result || !result.ok || !result.data) {
+            return;
+        }
+        const activeBefore = state.jobs.filter(isActiveJob).length;
+        state.jobs = result.data.jobs || [];
+        renderJobList();
+        // A finished job changed the VM list.
+        if (state.jobs.filter(isActiveJob).length < activeBefore) {
+            void loadVMs({ showLoading: false });
+        }
+    }
+    async function cancelJob(id) {
+        if (state.busy) {
+            return;
+        }
+        clearAction();
+        setBusy(true);
+        try {
+            const body = new URLSearchParams({ job_id: id });
+            const result = await requestJSON("/api/dashboard/jobs/cancel", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                },
+                body: body.toString(),
+            });
+            if (!result) {
+                return;
+            }
+            if (!result.ok || !result.data || !result.data.ok) {
+                setActionError((result.data && result.data.error) || result.error || "Failed to cancel VM creation.");
+                return;
+            }
+            setActionMessage(result.data.message || "VM creation canceled.");
+            await loadJobs();
+        } finally {
+            setBusy(false);
+        }
+    }
     formEl.addEventListener("submit", (event) => {
         event.preventDefault();
         if (!formEl.reportValidity()) {
@@ -416,16 +1467,57 @@ function bootstrap() {
         }
         void createVM(inputEl.value.trim());
     });
+    templateSelectEl.addEventListener("change", () => {
+        sizeSelectEl.value = templateSize();
+        toggleCustomSize();
+    });
+    sizeSelectEl.addEventListener("change", toggleCustomSize);
+    appPasswordButtonEl.addEventListener("click", () => {
+        void createAppPassword();
+    });
+    shareFormEl.addEventListener("submit", (event) => {
+        event.preventDefault();
+        if (!shareFormEl.reportValidity()) {
+            return;
+        }
+        void shareVMWith();
+    });
+    tokenFormEl.addEventListener("submit", (event) => {
+        event.preventDefault();
+        if (!tokenFormEl.reportValidity()) {
+            return;
+        }
+        void createToken();
+    });
+    sshKeyFormEl.addEventListener("submit", (event) => {
+        event.preventDefault();
+        if (!sshKeyFormEl.reportValidity()) {
+            return;
+        }
+        void addSSHKey();
+    });
     applyInitialMessage();
     renderAction();
     renderVMList();
+    renderShareList();
+    renderTokenList();
+    renderSSHKeyList();
     void loadVMs();
+    void loadTokens();
+    void loadSSHKeys();
+    void loadJobs();
     const refreshHandle = window.setInterval(() => {
         if (document.hidden || state.busy) {
             return;
         }
         void loadVMs({ showLoading: false });
     }, AUTO_REFRESH_INTERVAL_MS);
+    const jobRefreshHandle = window.setInterval(() => {
+        if (document.hidden || !state.jobs.some(isActiveJob)) {
+            return;
+        }
+        void loadJobs();
+    }, JOB_REFRESH_INTERVAL_MS);
     document.addEventListener("visibilitychange", () => {
         if (!document.hidden) {
             void loadVMs({ showLoading: false });
@@ -433,6 +1525,7 @@ function bootstrap() {
     });
     window.addEventListener("beforeunload", () => {
         window.clearInterval(refreshHandle);
+        window.clearInterval(jobRefreshHandle);
     });
 }
 bootstrap();
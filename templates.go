@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/virt"
+	"remotegateway/internal/vmsize"
+)
+
+// loadVMTemplates reads the template catalog from VDI_IMAGE_DIR and
+// CLOUD_INIT_DIR. It returns nil, refusing every VM creation, when the
+// catalog is invalid or a template names an unknown size profile.
+func loadVMTemplates(settings *config.SettingsType, sizes *vmsize.Catalog) *virt.Catalog {
+	c, err := virt.LoadCatalog(settings.Get(config.VDI_IMAGE_DIR), settings.Get(config.CLOUD_INIT_DIR))
+	if err == nil {
+		err = checkTemplateSizes(c, sizes)
+	}
+	if err != nil {
+		log.Printf("template catalog: %v; refusing to create VMs", err)
+		return nil
+	}
+	return c
+}
+
+func checkTemplateSizes(c *virt.Catalog, sizes *vmsize.Catalog) error {
+	for _, t := range c.Templates {
+		if t.DefaultSize == "" {
+			continue
+		}
+		if _, err := sizes.Choose(t.DefaultSize); err != nil {
+			return fmt.Errorf("template %s: default size: %w", t.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/virt"
+)
+
+func writeTemplateManifest(t *testing.T, raw string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, virt.TemplateManifest), []byte(raw), 0o600); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	t.Setenv(config.VDI_IMAGE_DIR, dir)
+}
+
+func TestDashboardOffersTemplates(t *testing.T) {
+	writeTemplateManifest(t, `
+templates:
+  - name: ubuntu-desktop
+    image: noble.img
+    os_family: ubuntu
+  - name: workstation
+    description: Large build box
+    image: build.img
+    os_family: ubuntu
+    default_size: large
+`)
+	t.Setenv(config.QUOTA_DEFAULT, "memory=4096")
+	stubListVMs(t, nil)
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	resp, err := env.client.Get(env.server.URL + "/api/dashboard/data")
+	if err != nil {
+		t.Fatalf("dashboard data: %v", err)
+	}
+	var data dashboardDataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatalf("decode dashboard data: %v", err)
+	}
+	resp.Body.Close()
+	if data.Templates == nil || data.Templates.Default != "ubuntu-desktop" || len(data.Templates.Templates) != 2 {
+		t.Fatalf("unexpected templates %+v", data.Templates)
+	}
+	if tmpl := data.Templates.Templates[1]; tmpl.Description != "Large build box" || tmpl.DefaultSize != "large" || tmpl.Image != "" {
+		t.Fatalf("unexpected template %+v", tmpl)
+	}
+
+	resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"dev"}, "template": {"windows"}})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "Unknown VM template.") {
+		t.Fatalf("expected unknown template refusal, got %d %q", resp.StatusCode, body)
+	}
+	// The template's default size applies when no size is chosen.
+	resp, body = env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"dev"}, "template": {"workstation"}})
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "8192 MiB requested") {
+		t.Fatalf("expected the large size to exceed the quota, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestTemplateWithUnknownSizeDisablesCreation(t *testing.T) {
+	writeTemplateManifest(t, "templates:\n  - {name: a, image: a.img, os_family: x, default_size: huge}\n")
+	settings := config.NewSettingType(false)
+	if templates := loadVMTemplates(settings, loadVMSizes(settings)); templates != nil {
+		t.Fatalf("expected an unknown default size to reject the catalog, got %+v", templates)
+	}
+
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+	resp, body := env.postForm(t, "/api/dashboard", url.Values{"vm_name": {"dev"}})
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "No VM templates are available") {
+		t.Fatalf("expected creation to be refused, got %d %q", resp.StatusCode, body)
+	}
+}
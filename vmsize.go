@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/vmsize"
+)
+
+// loadVMSizes reads the size settings. Invalid settings offer only the
+// built-in default size.
+func loadVMSizes(settings *config.SettingsType) *vmsize.Catalog {
+	c, err := vmsize.Parse(
+		settings.Get(config.VM_SIZES),
+		settings.Get(config.VM_SIZE_DEFAULT),
+		settings.Get(config.VM_SIZE_CUSTOM_MAX),
+	)
+	if err != nil {
+		log.Printf("vm size settings: %v; offering only %s (%s)", err, vmsize.Default.Name, vmsize.Default)
+		return &vmsize.Catalog{Profiles: []vmsize.Size{vmsize.Default}, Default: vmsize.Default.Name}
+	}
+	return c
+}
+
+// vmSizeFromForm returns the size requested by the size form field, or the
+// vcpu, memory (MiB) and disk (GB) fields when size is "custom". fallback
+// names the profile used when the field is empty.
+func vmSizeFromForm(sizes *vmsize.Catalog, req *http.Request, fallback string) (vmsize.Size, error) {
+	name := req.FormValue("size")
+	if strings.TrimSpace(name) == "" {
+		name = fallback
+	}
+	if !strings.EqualFold(strings.TrimSpace(name), vmsize.Custom) {
+		return sizes.Choose(name)
+	}
+	var values [3]int
+	for i, field := range []string{"vcpu", "memory", "disk"} {
+		n, err := strconv.Atoi(strings.TrimSpace(req.FormValue(field)))
+		if err != nil {
+			return vmsize.Size{}, fmt.Errorf("%w: %s must be a number", vmsize.ErrNotAllowed, field)
+		}
+		values[i] = n
+	}
+	return sizes.CustomSize(values[0], values[1], values[2])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"remotegateway/internal/config"
+	"remotegateway/internal/virt"
+)
+
+func TestDashboardOffersAndValidatesSizes(t *testing.T) {
+	t.Setenv(config.VM_SIZES, "small:vcpu=2,memory=2048,disk=30;large:vcpu=8,memory=8192,disk=80")
+	t.Setenv(config.VM_SIZE_DEFAULT, "small")
+	t.Setenv(config.VM_SIZE_CUSTOM_MAX, "vcpu=8,memory=16384,disk=100")
+	t.Setenv(config.QUOTA_DEFAULT, "memory=8192")
+	stubListVMs(t, []virt.VMInfo{
+		{Name: "alice-dev", Owner: "alice", State: "running", VCPU: 2, MemoryMiB: 2048, VolumeGB: 30},
+	})
+	env := newOIDCTestEnv(t, "alice")
+	env.login(t)
+
+	resp, err := env.client.Get(env.server.URL + "/api/dashboard/data")
+	if err != nil {
+		t.Fatalf("dashboard data: %v", err)
+	}
+	var data dashboardDataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatalf("decode dashboard data: %v", err)
+	}
+	resp.Body.Close()
+	if data.Sizes == nil || len(data.Sizes.Profiles) != 2 || data.Sizes.Default != "small" || data.Sizes.Max == nil {
+		t.Fatalf("unexpected sizes %+v", data.Sizes)
+	}
+
+	cases := []struct {
+		name   string
+		form   url.Values
+		status int
+		want   string
+	}{
+		{"unknown profile", url.Values{"size": {"huge"}}, http.StatusBadRequest, `unknown size \"huge\"`},
+		{"custom over max", url.Values{"size": {"custom"}, "vcpu": {"16"}, "memory": {"2048"}, "disk": {"30"}}, http.StatusBadRequest, "at most 8 vCPU allowed"},
+		{"custom not a number", url.Values{"size": {"custom"}, "vcpu": {"two"}}, http.StatusBadRequest, "vcpu must be a number"},
+		{"profile charged to quota", url.Values{"size": {"large"}}, http.StatusForbidden, "memory quota is 8192 MiB, 2048 MiB in use and 8192 MiB requested"},
+		{"custom charged to quota", url.Values{"size": {"custom"}, "vcpu": {"4"}, "memory": {"7000"}, "disk": {"50"}}, http.StatusForbidden, "7000 MiB requested"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.form.Set("vm_name", "second")
+			resp, body := env.postForm(t, "/api/dashboard", tc.form)
+			if resp.StatusCode != tc.status || !strings.Contains(body, tc.want) {
+				t.Fatalf("got %d %q, want %d containing %q", resp.StatusCode, body, tc.status, tc.want)
+			}
+		})
+	}
+}
+
+func TestInvalidSizeSettingsOfferTheDefault(t *testing.T) {
+	t.Setenv(config.VM_SIZES, "tiny:vcpu=1")
+	sizes := loadVMSizes(config.NewSettingType(false))
+	if len(sizes.Profiles) != 1 || sizes.Default != "medium" || sizes.Max != nil {
+		t.Fatalf("unexpected fallback sizes %+v", sizes)
+	}
+}